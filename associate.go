@@ -0,0 +1,182 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// ListenPacket associates a UDP relay of the proxy and returns a packet
+// connection whose datagrams are relayed to and from their targets, see
+// RFC 1928. The local UDP socket listens on address of network, e.g.
+// "udp" and ":0". With Socks5DialerOptions.UDPOverTCP, the datagrams are
+// carried over the connection to the proxy instead and address is
+// ignored. The association ends when the connection is closed or the
+// proxy closes the connection of the request.
+func (d *Socks5Dialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.udpOverTCP {
+		_, conn, err := d.associate(ctx, conn, UDPOverTCPCommand, "0.0.0.0:0")
+		if err != nil {
+			return nil, err
+		}
+
+		return &socks5PacketConn{
+			PacketConn: newStreamPacketConn(conn),
+			relay:      conn.RemoteAddr(),
+		}, nil
+	}
+
+	var lc net.ListenConfig
+
+	pc, err := lc.ListenPacket(ctx, network, address)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	_, port, err := net.SplitHostPort(pc.LocalAddr().String())
+	if err != nil {
+		_ = pc.Close()
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	// The unspecified address stands for the address of the connection
+	// to the proxy.
+	resp, conn, err := d.associate(ctx, conn, AssociateCommand, net.JoinHostPort("0.0.0.0", port))
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", boundAddr(resp.Addr, conn).String())
+	if err != nil {
+		_ = pc.Close()
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	c := &socks5PacketConn{
+		PacketConn: pc,
+		control:    conn,
+		relay:      relay,
+	}
+
+	// The relay drops the association with the connection of the
+	// request.
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		_ = c.Close()
+	}()
+
+	return c, nil
+}
+
+// associate performs the handshake of an association on conn and
+// returns the reply and the connection, which keeps the data following
+// the reply. It closes conn on failure.
+func (d *Socks5Dialer) associate(ctx context.Context, conn net.Conn, cmd Command, addr string) (*Socks5Response, net.Conn, error) {
+	req := &Socks5Request{
+		CMD:  cmd,
+		Addr: addr,
+	}
+
+	if err := d.hookRequest(ctx, req); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	socksConn := NewConn(conn)
+
+	resp, err := ClientHandshake(ctx, socksConn, req, func(o *ClientHandshakeOptions) {
+		o.AuthMethods = d.authMethods
+		o.Authenticate = d.authenticate
+		o.ReplyValidation = d.validation
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	return resp, socksConn.NetConn(), nil
+}
+
+// socks5PacketConn adds and removes the UDP request headers of the
+// datagrams exchanged with a relay.
+type socks5PacketConn struct {
+	net.PacketConn
+	control net.Conn // connection of the request, if not PacketConn
+	relay   net.Addr
+}
+
+// ReadFrom reads the data of the next datagram of the relay and returns
+// the address of its origin.
+func (c *socks5PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxUDPPacketSize)
+
+	for {
+		n, src, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if src.String() != c.relay.String() {
+			continue
+		}
+
+		datagram := &UDPDatagram{}
+		if err := datagram.UnmarshalBinary(buf[:n]); err != nil || datagram.Frag != 0 {
+			continue
+		}
+
+		return copy(p, datagram.Data), datagramAddr(datagram.Addr), nil
+	}
+}
+
+// WriteTo sends p to addr through the relay.
+func (c *socks5PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	b, err := (&UDPDatagram{Addr: addr.String(), Data: p}).MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := c.PacketConn.WriteTo(b, c.relay); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *socks5PacketConn) Close() error {
+	err := c.PacketConn.Close()
+
+	if c.control != nil {
+		if controlErr := c.control.Close(); err == nil {
+			err = controlErr
+		}
+	}
+
+	return err
+}
+
+// datagramAddr returns the address of the origin of a datagram.
+func datagramAddr(addr string) net.Addr {
+	host, port, err := splitHostAnyPort(addr)
+	if err != nil {
+		return &fqdnAddr{network: "udp", addr: addr}
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &fqdnAddr{network: "udp", addr: addr}
+	}
+
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
@@ -0,0 +1,76 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// ErrAuthTimeout is returned by a guarded AuthenticateFunc which did not
+// return before its deadline, see GuardAuthenticator.
+var ErrAuthTimeout = errors.New("socks: authentication timed out")
+
+// AuthPanicError is returned by a guarded AuthenticateFunc which
+// panicked, see GuardAuthenticator.
+type AuthPanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *AuthPanicError) Error() string {
+	return fmt.Sprintf("socks: authentication panicked: %v", e.Value)
+}
+
+// GuardAuthenticator returns an AuthenticateFunc which calls authenticate
+// with a context whose deadline is timeout and turns its panics into an
+// *AuthPanicError. If authenticate does not return in time, e.g. since
+// its backend ignores the context, the deadline of the connection is set
+// to now, which fails its pending reads and writes, and ErrAuthTimeout
+// is returned without waiting for it. If timeout is zero, there is no
+// deadline. A server guards its AuthenticateFunc, see
+// Options.AuthTimeout.
+func GuardAuthenticator(authenticate AuthenticateFunc, timeout time.Duration) AuthenticateFunc {
+	return func(ctx context.Context, conn *Conn, method AuthMethod) error {
+		if timeout <= 0 {
+			return callAuthenticate(ctx, authenticate, conn, method)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		done := make(chan error, 1)
+
+		go func() {
+			done <- callAuthenticate(ctx, authenticate, conn, method)
+		}()
+
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			_ = conn.conn.SetDeadline(time.Now())
+
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ErrAuthTimeout
+			}
+
+			return ctx.Err()
+		}
+	}
+}
+
+// callAuthenticate calls authenticate and recovers from its panics.
+func callAuthenticate(ctx context.Context, authenticate AuthenticateFunc, conn *Conn, method AuthMethod) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &AuthPanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+
+	return authenticate(ctx, conn, method)
+}
@@ -0,0 +1,104 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGuardAuthenticator(t *testing.T) {
+	t.Run("panic", func(t *testing.T) {
+		authenticate := GuardAuthenticator(func(ctx context.Context, conn *Conn, method AuthMethod) error {
+			panic("boom")
+		}, 0)
+
+		err := authenticate(context.Background(), nil, AuthMethodUsernamePassword)
+
+		var panicErr *AuthPanicError
+		assert.True(t, errors.As(err, &panicErr))
+		assert.Equal(t, "boom", panicErr.Value)
+		assert.NotEmpty(t, panicErr.Stack)
+		assert.EqualError(t, err, "socks: authentication panicked: boom")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		readErr := make(chan error, 1)
+
+		// The backend ignores the context and waits for the client.
+		authenticate := GuardAuthenticator(func(ctx context.Context, conn *Conn, method AuthMethod) error {
+			err := conn.Read(&UsernamePasswordAuthRequest{})
+			readErr <- err
+
+			return err
+		}, 50*time.Millisecond)
+
+		err := authenticate(context.Background(), NewConn(server), AuthMethodUsernamePassword)
+		assert.ErrorIs(t, err, ErrAuthTimeout)
+
+		// The deadline of the connection releases the backend.
+		select {
+		case err := <-readErr:
+			assert.Error(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("read not released")
+		}
+	})
+
+	t.Run("server", func(t *testing.T) {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		defer listen.Close()
+
+		var calls int32
+
+		server := New(func(o *Options) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.AuthTimeout = 50 * time.Millisecond
+			o.Authenticate = func(ctx context.Context, conn *Conn, method AuthMethod) error {
+				switch atomic.AddInt32(&calls, 1) {
+				case 1:
+					panic("boom")
+				case 2:
+					time.Sleep(time.Second)
+				}
+
+				return userPassServerAuthenticateFuncGen("user", "pass")(ctx, conn, method)
+			}
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		dial := func() error {
+			conn, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+				o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+				o.Authenticate = UsernamePasswordAuthenticator("user", "pass")
+			}).Dial("tcp", testServer.Listener.Addr().String())
+			if err != nil {
+				return err
+			}
+
+			return conn.Close()
+		}
+
+		assert.Error(t, dial())
+		assert.Error(t, dial())
+		assert.NoError(t, dial())
+
+		m := server.Metrics()
+		assert.Equal(t, uint64(1), m.AuthPanics)
+		assert.Equal(t, uint64(1), m.AuthTimeouts)
+		assert.Equal(t, uint64(2), m.AuthFailures)
+		assert.Equal(t, uint64(1), m.AuthSuccesses)
+	})
+}
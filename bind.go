@@ -0,0 +1,226 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Bind sends a SOCKS4 BIND request for a connection from peerHint, the
+// address of the expected peer, and returns the address of the socket
+// the proxy listens on. accept waits for the second reply of the proxy
+// and returns the connection of the peer; it must be called once to
+// release the connection to the proxy and gives up when ctx is done.
+// An unspecified address of the socket is replaced by the address of
+// the proxy.
+func (d *Socks4Dialer) Bind(ctx context.Context, peerHint string) (net.Addr, func(ctx context.Context) (net.Conn, error), error) {
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	socksConn := NewConn(conn)
+
+	resp, err := d.bindRequest(ctx, socksConn, peerHint)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	accept := bindAccept(socksConn, func() (string, error) {
+		resp := &Socks4Response{}
+		if err := socksConn.Read(resp); err != nil {
+			return "", err
+		}
+
+		if resp.Status != Socks4StatusGranted {
+			return "", socks4StatusError(resp.Status)
+		}
+
+		return resp.Addr, nil
+	})
+
+	return boundAddr(resp.Addr, conn), accept, nil
+}
+
+func (d *Socks4Dialer) bindRequest(ctx context.Context, conn *Conn, peerHint string) (*Socks4Response, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.conn.SetDeadline(deadline)
+
+		defer func() {
+			_ = conn.conn.SetDeadline(time.Time{})
+		}()
+	}
+
+	if err := conn.Write(&Socks4Request{
+		CMD:    BindCommand,
+		Addr:   peerHint,
+		UserID: d.userID,
+	}); err != nil {
+		return nil, err
+	}
+
+	resp := &Socks4Response{}
+	if err := conn.Read(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Status != Socks4StatusGranted {
+		return nil, socks4StatusError(resp.Status)
+	}
+
+	return resp, nil
+}
+
+// Bind sends a SOCKS5 BIND request for a connection from peerHint, the
+// address of the expected peer, and returns the address of the socket
+// the proxy listens on. accept waits for the second reply of the proxy
+// and returns the connection of the peer, whose RemoteAddr is the
+// address of the peer reported by the proxy; it must be called once to
+// release the connection to the proxy and gives up when ctx is done.
+// An unspecified address of the socket is replaced by the address of
+// the proxy.
+func (d *Socks5Dialer) Bind(ctx context.Context, peerHint string) (net.Addr, func(ctx context.Context) (net.Conn, error), error) {
+	req := &Socks5Request{
+		CMD:           BindCommand,
+		Addr:          peerHint,
+		LiteralAsFQDN: d.ipLiteral == IPLiteralAsFQDN,
+	}
+
+	if err := d.hookRequest(ctx, req); err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	socksConn := NewConn(conn)
+
+	resp, err := ClientHandshake(ctx, socksConn, req, func(o *ClientHandshakeOptions) {
+		o.AuthMethods = d.authMethods
+		o.Authenticate = d.authenticate
+		o.ReplyValidation = d.validation
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	accept := bindAccept(socksConn, func() (string, error) {
+		resp, err := clientReply(socksConn, &d.validation)
+		if err != nil {
+			return "", err
+		}
+
+		return resp.Addr, nil
+	})
+
+	return boundAddr(resp.Addr, conn), accept, nil
+}
+
+// bindAccept returns the accept function of a BIND socket. readReply
+// reads the second reply and returns the address of the peer.
+func bindAccept(conn *Conn, readReply func() (string, error)) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		// Closing the connection releases the socket of the proxy.
+		done := make(chan struct{})
+		canceled := make(chan bool, 1)
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = conn.conn.Close()
+				canceled <- true
+			case <-done:
+				canceled <- false
+			}
+		}()
+
+		peer, err := readReply()
+
+		close(done)
+
+		if <-canceled {
+			return nil, ctx.Err()
+		}
+
+		if err != nil {
+			_ = conn.conn.Close()
+			return nil, err
+		}
+
+		c := conn.NetConn()
+
+		if addr := peerAddr(peer); addr != nil {
+			return &boundConn{Conn: c, remoteAddr: addr}, nil
+		}
+
+		return c, nil
+	}
+}
+
+// boundAddr returns the address of a BIND socket announced as addr. The
+// unspecified address stands for the address of the proxy.
+func boundAddr(addr string, proxy net.Conn) net.Addr {
+	host, port, err := splitHostAnyPort(addr)
+	if err != nil {
+		return &fqdnAddr{network: "tcp", addr: addr}
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &fqdnAddr{network: "tcp", addr: addr}
+	}
+
+	if ip.IsUnspecified() {
+		if tcpAddr, ok := proxy.RemoteAddr().(*net.TCPAddr); ok {
+			ip = tcpAddr.IP
+		}
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}
+}
+
+// peerAddr returns the address of the peer of a second BIND reply, or
+// nil if the proxy did not report it.
+func peerAddr(addr string) net.Addr {
+	host, port, err := splitHostAnyPort(addr)
+	if err != nil || port == 0 {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &fqdnAddr{network: "tcp", addr: addr}
+	}
+
+	if ip.IsUnspecified() {
+		return nil
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}
+}
+
+// fqdnAddr is an address with a host name, e.g. a BND.ADDR of type
+// AddrTypeFQDN.
+type fqdnAddr struct {
+	network string
+	addr    string
+}
+
+func (a *fqdnAddr) Network() string { return a.network }
+
+func (a *fqdnAddr) String() string { return a.addr }
+
+// boundConn is the connection of a BIND peer reporting the address of
+// the peer as remote address.
+type boundConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *boundConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
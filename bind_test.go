@@ -0,0 +1,196 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialerBind(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	go func() {
+		_ = New().Serve(listen)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	testCases := []struct {
+		name   string
+		binder Binder
+	}{
+		{"socks4", NewSocks4Dialer("tcp", listen.Addr().String())},
+		{"socks5", NewSocks5Dialer("tcp", listen.Addr().String())},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, accept, err := tc.binder.Bind(ctx, "127.0.0.1:0")
+			assert.NoError(t, err)
+
+			// The unspecified address of the listener of the proxy is
+			// replaced by the address of the proxy.
+			tcpAddr, ok := addr.(*net.TCPAddr)
+			assert.True(t, ok)
+			assert.True(t, tcpAddr.IP.IsLoopback())
+
+			peer, err := net.Dial("tcp", addr.String())
+			assert.NoError(t, err)
+
+			defer peer.Close()
+
+			_, err = peer.Write([]byte("hello"))
+			assert.NoError(t, err)
+
+			conn, err := accept(ctx)
+			assert.NoError(t, err)
+
+			defer conn.Close()
+
+			if tc.name == "socks5" {
+				assert.Equal(t, peer.LocalAddr().String(), conn.RemoteAddr().String())
+			}
+
+			b := make([]byte, 5)
+			_, err = io.ReadFull(conn, b)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(b))
+		})
+
+		t.Run(tc.name+" canceled", func(t *testing.T) {
+			_, accept, err := tc.binder.Bind(ctx, "127.0.0.1:0")
+			assert.NoError(t, err)
+
+			cctx, ccancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer ccancel()
+
+			_, err = accept(cctx)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		})
+	}
+
+	t.Run("zone", func(t *testing.T) {
+		_, _, err := NewSocks5Dialer("tcp", listen.Addr().String()).Bind(ctx, "[fe80::1%eth0]:0")
+		assert.Error(t, err)
+	})
+}
+
+func TestMaxBinds(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.HandlerOptions = func(h *DefaultHandlerOptions) {
+			h.MaxBinds = 1
+			h.BindTimeout = 200 * time.Millisecond
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d := NewSocks5Dialer("tcp", listen.Addr().String())
+
+	addr, accept, err := d.Bind(ctx, "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(1), server.Metrics().BindsPending)
+
+	// The only slot is taken.
+	_, _, err = d.Bind(ctx, "127.0.0.1:0")
+	assert.Error(t, err)
+
+	peer, err := net.Dial("tcp", addr.String())
+	assert.NoError(t, err)
+
+	defer peer.Close()
+
+	conn, err := accept(ctx)
+	assert.NoError(t, err)
+
+	_ = conn.Close()
+
+	// A request without a peer releases its slot after the timeout.
+	_, accept, err = d.Bind(ctx, "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	_, err = accept(ctx)
+	assert.Error(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, _, err := d.Bind(ctx, "127.0.0.1:0")
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	m := server.Metrics()
+	assert.Equal(t, uint64(1), m.BindSuccesses)
+	assert.GreaterOrEqual(t, m.BindFailures, uint64(1))
+	assert.Equal(t, uint64(1), m.BindRejected)
+	assert.Greater(t, m.BindWaitTime, time.Duration(0))
+}
+
+func TestSocks4BindIPv6(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	testCases := []struct {
+		name   string
+		policy Socks4IPv6Policy
+	}{
+		{"reject", Socks4IPv6Reject},
+		{"proxy addr", Socks4IPv6ProxyAddr},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			listen, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NoError(t, err)
+
+			defer listen.Close()
+
+			go func() {
+				_ = New(func(o *Options) {
+					o.HandlerOptions = func(h *DefaultHandlerOptions) {
+						h.PublicIP = net.ParseIP("2001:db8::1")
+						h.Socks4IPv6 = tc.policy
+					}
+				}).Serve(listen)
+			}()
+
+			addr, _, err := NewSocks4Dialer("tcp", listen.Addr().String()).Bind(ctx, "127.0.0.1:0")
+
+			if tc.policy == Socks4IPv6Reject {
+				assert.ErrorIs(t, err, ErrSocks4Rejected)
+				return
+			}
+
+			assert.NoError(t, err)
+
+			tcpAddr, ok := addr.(*net.TCPAddr)
+			assert.True(t, ok)
+			assert.True(t, tcpAddr.IP.IsLoopback())
+		})
+	}
+
+	t.Run("unspecified", func(t *testing.T) {
+		h := NewDefaultHandler()
+
+		addr, err := h.socks4BindAddr(&net.TCPAddr{IP: net.IPv6unspecified, Port: 5566})
+		assert.NoError(t, err)
+		assert.Equal(t, "[::]:5566", addr)
+	})
+}
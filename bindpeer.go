@@ -0,0 +1,93 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// BindPeerValidator validates the peer which connects to the listener of
+// a BIND request. It must return an error when the peer is refused.
+type BindPeerValidator func(ctx context.Context, req *Request, peer net.Addr) error
+
+// MatchBindPeerIP returns the default BindPeerValidator. It accepts a
+// peer whose IP address equals the IP address of the request, or any
+// peer if the request carries the unspecified address. A FQDN request
+// never matches.
+func MatchBindPeerIP() BindPeerValidator {
+	return func(ctx context.Context, req *Request, peer net.Addr) error {
+		host, peerIP, err := bindPeerIPs(req, peer)
+		if err != nil {
+			return err
+		}
+
+		if ip := net.ParseIP(host); ip != nil && (ip.IsUnspecified() || ip.Equal(peerIP)) {
+			return nil
+		}
+
+		return fmt.Errorf("ip mismatch. Expected %s. Got %s", host, peerIP)
+	}
+}
+
+// ResolveBindPeer returns a BindPeerValidator which behaves like
+// MatchBindPeerIP, but resolves a FQDN request with the resolver and
+// accepts a peer matching any of its IP addresses. If resolver is nil,
+// net.DefaultResolver is used.
+func ResolveBindPeer(resolver *net.Resolver) BindPeerValidator {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	matchIP := MatchBindPeerIP()
+
+	return func(ctx context.Context, req *Request, peer net.Addr) error {
+		host, peerIP, err := bindPeerIPs(req, peer)
+		if err != nil {
+			return err
+		}
+
+		if net.ParseIP(host) != nil {
+			return matchIP(ctx, req, peer)
+		}
+
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+
+		for _, addr := range addrs {
+			if addr.IP.Equal(peerIP) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("ip mismatch. Expected %s. Got %s", host, peerIP)
+	}
+}
+
+// AnyBindPeer returns a BindPeerValidator which accepts any peer, e.g.
+// when peers connect through a NAT.
+func AnyBindPeer() BindPeerValidator {
+	return func(ctx context.Context, req *Request, peer net.Addr) error {
+		return nil
+	}
+}
+
+// bindPeerIPs returns the host of the request and the IP address of the
+// peer.
+func bindPeerIPs(req *Request, peer net.Addr) (string, net.IP, error) {
+	host, _, err := net.SplitHostPort(req.Addr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	peerHost, _, err := net.SplitHostPort(peer.String())
+	if err != nil {
+		return "", nil, err
+	}
+
+	host, _ = stripZone(host)
+	peerHost, _ = stripZone(peerHost)
+
+	return host, net.ParseIP(peerHost), nil
+}
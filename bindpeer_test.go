@@ -0,0 +1,36 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBindPeerValidator(t *testing.T) {
+	ctx := context.Background()
+	peer := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4711}
+
+	t.Run("match ip", func(t *testing.T) {
+		validate := MatchBindPeerIP()
+
+		assert.NoError(t, validate(ctx, &Request{Addr: "127.0.0.1:0"}, peer))
+		assert.NoError(t, validate(ctx, &Request{Addr: "0.0.0.0:0"}, peer))
+		assert.NoError(t, validate(ctx, &Request{Addr: "[::ffff:127.0.0.1]:21"}, peer))
+		assert.Error(t, validate(ctx, &Request{Addr: "192.0.2.1:0"}, peer))
+		assert.Error(t, validate(ctx, &Request{Addr: "localhost:0"}, peer))
+	})
+
+	t.Run("resolve", func(t *testing.T) {
+		validate := ResolveBindPeer(nil)
+
+		assert.NoError(t, validate(ctx, &Request{Addr: "localhost:0"}, peer))
+		assert.NoError(t, validate(ctx, &Request{Addr: "127.0.0.1:0"}, peer))
+		assert.Error(t, validate(ctx, &Request{Addr: "192.0.2.1:0"}, peer))
+	})
+
+	t.Run("any", func(t *testing.T) {
+		assert.NoError(t, AnyBindPeer()(ctx, &Request{Addr: "192.0.2.1:0"}, peer))
+	})
+}
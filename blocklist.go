@@ -0,0 +1,319 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hupe1980/golog"
+)
+
+// BlocklistFormat is the format of a blocklist source.
+type BlocklistFormat int
+
+const (
+	// BlocklistDomains is a list of DomainSet patterns, one per line.
+	BlocklistDomains BlocklistFormat = iota
+
+	// BlocklistHosts is a hosts file, see ParseHostsFile.
+	BlocklistHosts
+
+	// BlocklistAdblock is an adblock-style filter list, see
+	// ParseAdblockList.
+	BlocklistAdblock
+
+	// BlocklistCIDRs is a list of CIDRs or IP addresses, one per line.
+	BlocklistCIDRs
+)
+
+// BlocklistSource is a file path or an HTTP(S) URL of a blocklist.
+type BlocklistSource struct {
+	Location string
+	Format   BlocklistFormat
+}
+
+// BlocklistEvent describes the outcome of loading a blocklist source.
+type BlocklistEvent struct {
+	Source BlocklistSource
+
+	// Changed reports whether the source was modified since the
+	// last load.
+	Changed bool
+
+	Err error
+}
+
+type BlocklistOptions struct {
+	// Logger specifies an optional logger.
+	// If nil, logging is done via the log package's standard logger.
+	Logger golog.Logger
+
+	// Sources specifies the blocklist sources.
+	Sources []BlocklistSource
+
+	// RefreshInterval specifies the interval in which the sources are
+	// reloaded. If zero, the sources are only loaded once.
+	RefreshInterval time.Duration
+
+	// Client specifies the optional HTTP client for URL sources.
+	// If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Hooks specifies optional callbacks. OnBlocklistLoad is called
+	// after each load of a source.
+	Hooks Hooks
+}
+
+// Blocklist is a HostMatcher loaded from files and URLs which are
+// periodically reloaded. A reload atomically replaces the matchers, a
+// source failing to reload keeps its previous entries. Use it with
+// DenyHosts to block the listed destinations.
+type Blocklist struct {
+	*logger
+	client   *http.Client
+	hooks    *Hooks
+	sources  []*blocklistSource
+	matchers atomic.Value // hostMatchers
+
+	mu        sync.Mutex // serializes reloads
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type blocklistSource struct {
+	BlocklistSource
+	etag         string
+	lastModified string
+	modTime      time.Time
+	matcher      HostMatcher
+}
+
+type hostMatchers []HostMatcher
+
+// NewBlocklist returns a new Blocklist. It returns an error if a source
+// cannot be loaded initially.
+func NewBlocklist(optFns ...func(*BlocklistOptions)) (*Blocklist, error) {
+	options := BlocklistOptions{
+		Logger: golog.NewGoLogger(golog.INFO, log.Default()),
+		Client: http.DefaultClient,
+	}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	b := &Blocklist{
+		logger: &logger{options.Logger},
+		client: options.Client,
+		hooks:  &options.Hooks,
+		done:   make(chan struct{}),
+	}
+
+	for _, s := range options.Sources {
+		b.sources = append(b.sources, &blocklistSource{BlocklistSource: s})
+	}
+
+	b.matchers.Store(hostMatchers{})
+
+	if err := b.Reload(context.Background()); err != nil {
+		return nil, err
+	}
+
+	if options.RefreshInterval > 0 {
+		go b.refresh(options.RefreshInterval)
+	}
+
+	return b, nil
+}
+
+// MatchHost reports whether host is matched by an entry of a source.
+func (b *Blocklist) MatchHost(host string) bool {
+	for _, m := range b.matchers.Load().(hostMatchers) {
+		if m.MatchHost(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reload loads the modified sources and replaces the matchers. It
+// returns the first error; the other sources are loaded regardless.
+func (b *Blocklist) Reload(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var firstErr error
+
+	matchers := make(hostMatchers, 0, len(b.sources))
+
+	for _, s := range b.sources {
+		changed, err := b.load(ctx, s)
+		if err != nil {
+			b.logErrorf("Failed to load blocklist %s: %v", s.Location, err)
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		b.hooks.blocklistLoad(ctx, &BlocklistEvent{
+			Source:  s.BlocklistSource,
+			Changed: changed,
+			Err:     err,
+		})
+
+		if s.matcher != nil {
+			matchers = append(matchers, s.matcher)
+		}
+	}
+
+	b.matchers.Store(matchers)
+
+	return firstErr
+}
+
+// Close stops the periodic reloads.
+func (b *Blocklist) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+
+	return nil
+}
+
+func (b *Blocklist) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			_ = b.Reload(context.Background())
+		}
+	}
+}
+
+func (b *Blocklist) load(ctx context.Context, s *blocklistSource) (bool, error) {
+	if strings.HasPrefix(s.Location, "http://") || strings.HasPrefix(s.Location, "https://") {
+		return b.loadURL(ctx, s)
+	}
+
+	return b.loadFile(s)
+}
+
+func (b *Blocklist) loadFile(s *blocklistSource) (bool, error) {
+	f, err := os.Open(s.Location)
+	if err != nil {
+		return false, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	if s.matcher != nil && fi.ModTime().Equal(s.modTime) {
+		return false, nil
+	}
+
+	m, err := parseBlocklist(f, s.Format)
+	if err != nil {
+		return false, err
+	}
+
+	s.matcher = m
+	s.modTime = fi.ModTime()
+
+	return true, nil
+}
+
+func (b *Blocklist) loadURL(ctx context.Context, s *blocklistSource) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Location, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if s.matcher != nil {
+		if s.etag != "" {
+			req.Header.Set("If-None-Match", s.etag)
+		}
+
+		if s.lastModified != "" {
+			req.Header.Set("If-Modified-Since", s.lastModified)
+		}
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	m, err := parseBlocklist(resp.Body, s.Format)
+	if err != nil {
+		return false, err
+	}
+
+	s.matcher = m
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+
+	return true, nil
+}
+
+func parseBlocklist(r io.Reader, format BlocklistFormat) (HostMatcher, error) {
+	switch format {
+	case BlocklistDomains:
+		return parseDomainList(r, func(line string) ([]string, error) {
+			return []string{line}, nil
+		})
+	case BlocklistHosts:
+		return ParseHostsFile(r)
+	case BlocklistAdblock:
+		return ParseAdblockList(r)
+	case BlocklistCIDRs:
+		s := &CIDRSet{}
+
+		scanner := bufio.NewScanner(r)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || line[0] == '#' {
+				continue
+			}
+
+			if err := s.Add(line); err != nil {
+				return nil, fmt.Errorf("socks: line %d: invalid CIDR %q", n, line)
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+
+		return s, nil
+	default:
+		return nil, fmt.Errorf("socks: unknown blocklist format %d", format)
+	}
+}
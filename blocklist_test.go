@@ -0,0 +1,121 @@
+package socks
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlocklist(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "blocklist.txt")
+		assert.NoError(t, os.WriteFile(filename, []byte("# domains\n.ads.example\n"), 0o600))
+
+		blocklist, err := NewBlocklist(func(o *BlocklistOptions) {
+			o.Sources = []BlocklistSource{{Location: filename}}
+			o.RefreshInterval = 10 * time.Millisecond
+		})
+		assert.NoError(t, err)
+
+		defer blocklist.Close()
+
+		assert.True(t, blocklist.MatchHost("x.ads.example"))
+		assert.False(t, blocklist.MatchHost("tracker.example"))
+
+		assert.NoError(t, os.WriteFile(filename, []byte("tracker.example\n"), 0o600))
+		assert.NoError(t, os.Chtimes(filename, time.Now(), time.Now().Add(time.Minute)))
+
+		assert.Eventually(t, func() bool {
+			return blocklist.MatchHost("tracker.example") && !blocklist.MatchHost("x.ads.example")
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("url", func(t *testing.T) {
+		var (
+			mu      sync.Mutex
+			body    = "10.0.0.0/8\n"
+			etag    = `"v1"`
+			fetches int
+		)
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			fetches++
+
+			if r.Header.Get("If-None-Match") == etag {
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			rw.Header().Set("ETag", etag)
+			_, _ = rw.Write([]byte(body))
+		}))
+		defer server.Close()
+
+		var (
+			eventsMu sync.Mutex
+			changed  []bool
+		)
+
+		blocklist, err := NewBlocklist(func(o *BlocklistOptions) {
+			o.Sources = []BlocklistSource{{Location: server.URL, Format: BlocklistCIDRs}}
+			o.Hooks.OnBlocklistLoad = func(ctx context.Context, e *BlocklistEvent) {
+				eventsMu.Lock()
+				defer eventsMu.Unlock()
+
+				changed = append(changed, e.Changed)
+			}
+		})
+		assert.NoError(t, err)
+
+		assert.True(t, blocklist.MatchHost("10.1.1.1"))
+
+		assert.NoError(t, blocklist.Reload(context.Background()))
+
+		mu.Lock()
+		body, etag = "192.0.2.0/24\n", `"v2"`
+		mu.Unlock()
+
+		assert.NoError(t, blocklist.Reload(context.Background()))
+
+		assert.False(t, blocklist.MatchHost("10.1.1.1"))
+		assert.True(t, blocklist.MatchHost("192.0.2.1"))
+		assert.Equal(t, []bool{true, false, true}, changed)
+		assert.Equal(t, 3, fetches)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "hosts")
+		assert.NoError(t, os.WriteFile(filename, []byte("0.0.0.0 ads.example\n"), 0o600))
+
+		var lastErr error
+
+		blocklist, err := NewBlocklist(func(o *BlocklistOptions) {
+			o.Sources = []BlocklistSource{{Location: filename, Format: BlocklistHosts}}
+			o.Hooks.OnBlocklistLoad = func(ctx context.Context, e *BlocklistEvent) {
+				lastErr = e.Err
+			}
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, os.Remove(filename))
+
+		assert.Error(t, blocklist.Reload(context.Background()))
+		assert.Error(t, lastErr)
+		assert.True(t, blocklist.MatchHost("ads.example"))
+
+		_, err = NewBlocklist(func(o *BlocklistOptions) {
+			o.Sources = []BlocklistSource{{Location: filename}}
+		})
+		assert.Error(t, err)
+	})
+}
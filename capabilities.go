@@ -0,0 +1,137 @@
+package socks
+
+import (
+	"sort"
+	"strings"
+)
+
+// Capability names a feature a configuration may require of the build of
+// the package, see Capabilities.
+type Capability string
+
+const (
+	CapabilitySocks4         Capability = "socks4"          // SOCKS4 and SOCKS4a
+	CapabilitySocks5         Capability = "socks5"          // SOCKS5 CONNECT and BIND
+	CapabilitySocks6         Capability = "socks6"          // SOCKS6, not implemented
+	CapabilityUDPAssociate   Capability = "udp-associate"   // SOCKS5 UDP ASSOCIATE relay
+	CapabilityUDPOverTCP     Capability = "udp-over-tcp"    // UDP datagrams framed in the TCP connection
+	CapabilityGSSAPI         Capability = "gssapi"          // RFC 1961 GSSAPI framing
+	CapabilityTLS            Capability = "tls"             // TLS to upstream proxies
+	CapabilityWebSocket      Capability = "websocket"       // SOCKS inside WebSocket messages
+	CapabilityMultiplex      Capability = "multiplex"       // streams of a MultiplexDialer
+	CapabilityProxyProtocol  Capability = "proxy-protocol"  // PROXY protocol headers
+	CapabilitySocketMark     Capability = "socket-mark"     // DefaultHandlerOptions.EgressMark, Linux only
+	CapabilityDropPrivileges Capability = "drop-privileges" // Options.RunAs, Unix only
+)
+
+// Capabilities reports for each known capability whether the build
+// supports it, so that e.g. an orchestrator can verify a build before
+// starting it with a configuration, see RequireCapabilities.
+func Capabilities() map[Capability]bool {
+	return map[Capability]bool{
+		CapabilitySocks4:         true,
+		CapabilitySocks5:         true,
+		CapabilitySocks6:         false,
+		CapabilityUDPAssociate:   true,
+		CapabilityUDPOverTCP:     true,
+		CapabilityGSSAPI:         true,
+		CapabilityTLS:            true,
+		CapabilityWebSocket:      true,
+		CapabilityMultiplex:      true,
+		CapabilityProxyProtocol:  true,
+		CapabilitySocketMark:     socketMarkSupported,
+		CapabilityDropPrivileges: dropPrivilegesSupported,
+	}
+}
+
+// RequireCapabilities returns a *CapabilityError naming the capabilities
+// the build does not support, including unknown ones, or nil.
+func RequireCapabilities(caps ...Capability) error {
+	supported := Capabilities()
+
+	var missing []Capability
+
+	for _, c := range caps {
+		if !supported[c] {
+			missing = append(missing, c)
+		}
+	}
+
+	if len(missing) > 0 {
+		return &CapabilityError{Missing: missing}
+	}
+
+	return nil
+}
+
+// CapabilityError is returned if the build lacks required capabilities.
+type CapabilityError struct {
+	Missing []Capability
+}
+
+func (e *CapabilityError) Error() string {
+	names := make([]string, len(e.Missing))
+	for i, c := range e.Missing {
+		names[i] = string(c)
+	}
+
+	return "socks: unsupported capabilities: " + strings.Join(names, ", ")
+}
+
+// RequiredCapabilities returns the capabilities the options use.
+func (o *Options) RequiredCapabilities() []Capability {
+	caps := []Capability{CapabilitySocks4, CapabilitySocks5}
+
+	handlerOptions := o.defaultHandlerOptions()
+
+	if udp := handlerOptions.UDP; !udp.Disabled || udp.Authorize != nil {
+		caps = append(caps, CapabilityUDPAssociate)
+	}
+
+	if handlerOptions.UDP.OverTCP {
+		caps = append(caps, CapabilityUDPOverTCP)
+	}
+
+	for _, method := range o.AuthMethods {
+		if method == AuthMethodGSSAPI {
+			caps = append(caps, CapabilityGSSAPI)
+			break
+		}
+	}
+
+	if o.WebSocketPath != "" {
+		caps = append(caps, CapabilityWebSocket)
+	}
+
+	if o.Multiplex {
+		caps = append(caps, CapabilityMultiplex)
+	}
+
+	if o.ProxyProtocol.Networks != nil {
+		caps = append(caps, CapabilityProxyProtocol)
+	}
+
+	if handlerOptions.EgressMark != nil {
+		caps = append(caps, CapabilitySocketMark)
+	}
+
+	if o.RunAs != "" {
+		caps = append(caps, CapabilityDropPrivileges)
+	}
+
+	return caps
+}
+
+// sortedCapabilities returns the known capabilities sorted by name.
+func sortedCapabilities() []Capability {
+	supported := Capabilities()
+
+	caps := make([]Capability, 0, len(supported))
+	for c := range supported {
+		caps = append(caps, c)
+	}
+
+	sort.Slice(caps, func(i, j int) bool { return caps[i] < caps[j] })
+
+	return caps
+}
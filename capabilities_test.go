@@ -0,0 +1,55 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapabilities(t *testing.T) {
+	caps := Capabilities()
+
+	assert.True(t, caps[CapabilitySocks5])
+	assert.True(t, caps[CapabilityUDPAssociate])
+	assert.False(t, caps[CapabilitySocks6])
+	assert.Equal(t, runtime.GOOS == "linux", caps[CapabilitySocketMark])
+
+	t.Run("require", func(t *testing.T) {
+		assert.NoError(t, RequireCapabilities(CapabilitySocks4, CapabilityTLS))
+
+		err := RequireCapabilities(CapabilityGSSAPI, CapabilitySocks6, "quic")
+
+		var capErr *CapabilityError
+		assert.True(t, errors.As(err, &capErr))
+		assert.Equal(t, []Capability{CapabilitySocks6, "quic"}, capErr.Missing)
+		assert.EqualError(t, err, "socks: unsupported capabilities: socks6, quic")
+	})
+
+	t.Run("options", func(t *testing.T) {
+		options := newOptions([]func(*Options){func(o *Options) {
+			o.HandlerOptions = func(h *DefaultHandlerOptions) {
+				h.UDP.Disabled = true
+			}
+			o.WebSocketPath = "/socks"
+			o.RunAs = "nobody"
+		}})
+
+		assert.Equal(t, []Capability{
+			CapabilitySocks4,
+			CapabilitySocks5,
+			CapabilityWebSocket,
+			CapabilityDropPrivileges,
+		}, options.RequiredCapabilities())
+		assert.Equal(t, caps[CapabilityDropPrivileges], options.Validate() == nil)
+	})
+
+	t.Run("prometheus", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(t, New().WritePrometheus(&buf))
+		assert.Contains(t, buf.String(), "socks_capability{name=\"socks5\"} 1\n")
+		assert.Contains(t, buf.String(), "socks_capability{name=\"socks6\"} 0\n")
+	})
+}
@@ -0,0 +1,387 @@
+package socks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pcapng block types and the link type of raw IP packets.
+const (
+	pcapngSectionHeader        = 0x0a0d0d0a
+	pcapngInterfaceDescription = 0x00000001
+	pcapngEnhancedPacket       = 0x00000006
+	pcapngByteOrderMagic       = 0x1a2b3c4d
+	pcapngOptComment           = 1
+	linkTypeRaw                = 101
+)
+
+// maxCapturePayload is the maximum TCP payload of a captured packet.
+const maxCapturePayload = 65000
+
+type CaptureOptions struct {
+	// MaxBytes specifies the number of bytes captured per direction
+	// of each session. If zero, 64 KiB are captured.
+	MaxBytes int
+
+	// Disabled specifies whether the capture starts disabled, see
+	// Capture.SetEnabled.
+	Disabled bool
+}
+
+// Capture writes the first bytes of each direction of the tunnels of a
+// server as synthesized TCP packets in the pcapng format. The first
+// packet of each direction carries the SOCKS metadata of the session as
+// a comment. It can be enabled and disabled at runtime, e.g. from an
+// admin endpoint.
+type Capture struct {
+	maxBytes int
+	enabled  int32 // accessed atomically
+
+	mu  sync.Mutex // serializes writes
+	w   io.Writer
+	err error
+}
+
+// NewCapture returns a new Capture which writes to w. The section and
+// interface headers are written immediately.
+func NewCapture(w io.Writer, optFns ...func(*CaptureOptions)) (*Capture, error) {
+	options := CaptureOptions{
+		MaxBytes: 64 * 1024,
+	}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	c := &Capture{
+		maxBytes: options.MaxBytes,
+		w:        w,
+	}
+
+	c.SetEnabled(!options.Disabled)
+
+	// Section Header Block without options and with unknown length.
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+
+	// Interface Description Block of raw IP packets.
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+
+	if err := c.writeBlock(pcapngSectionHeader, shb); err != nil {
+		return nil, err
+	}
+
+	if err := c.writeBlock(pcapngInterfaceDescription, idb); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// SetEnabled enables or disables the capture. A disabled capture drops
+// the packets of all sessions.
+func (c *Capture) SetEnabled(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+
+	atomic.StoreInt32(&c.enabled, v)
+}
+
+// Enabled reports whether the capture is enabled.
+func (c *Capture) Enabled() bool {
+	return atomic.LoadInt32(&c.enabled) == 1
+}
+
+// Err returns the first error writing the capture. The capture is
+// disabled after an error.
+func (c *Capture) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+func (c *Capture) writeBlock(blockType uint32, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+
+	n := 12 + len(body)
+
+	b := make([]byte, 0, n)
+	b = appendUint32LE(b, blockType)
+	b = appendUint32LE(b, uint32(n))
+	b = append(b, body...)
+	b = appendUint32LE(b, uint32(n))
+
+	if _, err := c.w.Write(b); err != nil {
+		c.err = err
+		c.SetEnabled(false)
+
+		return err
+	}
+
+	return nil
+}
+
+func (c *Capture) writePacket(ts time.Time, packet []byte, comment string) error {
+	micros := uint64(ts.UnixNano() / int64(time.Microsecond))
+
+	body := make([]byte, 0, 20+len(packet)+len(comment)+16)
+	body = appendUint32LE(body, 0) // interface ID
+	body = appendUint32LE(body, uint32(micros>>32))
+	body = appendUint32LE(body, uint32(micros))
+	body = appendUint32LE(body, uint32(len(packet)))
+	body = appendUint32LE(body, uint32(len(packet)))
+	body = appendPadded(body, packet)
+
+	if comment != "" {
+		body = append(body, pcapngOptComment, 0)
+		body = append(body, byte(len(comment)), byte(len(comment)>>8))
+		body = appendPadded(body, []byte(comment))
+		body = append(body, 0, 0, 0, 0) // opt_endofopt
+	}
+
+	return c.writeBlock(pcapngEnhancedPacket, body)
+}
+
+func (c *Capture) newSession(session *Session) *captureSession {
+	cs := &captureSession{
+		capture: c,
+		session: session,
+	}
+
+	cs.budget[0], cs.budget[1] = c.maxBytes, c.maxBytes
+	cs.seq[0], cs.seq[1] = 1, 1
+
+	return cs
+}
+
+// captureSession captures the tunnel of a session. Direction 0 is from
+// the client to the target, direction 1 from the target to the client.
+type captureSession struct {
+	capture *Capture
+	session *Session
+
+	mu        sync.Mutex
+	budget    [2]int
+	seq       [2]uint32
+	commented [2]bool
+}
+
+// wrap returns target capturing the data from and to the client.
+func (cs *captureSession) wrap(client net.Addr, target net.Conn) net.Conn {
+	return &captureConn{
+		Conn:   target,
+		cs:     cs,
+		client: captureEndpoint(client),
+		target: captureEndpoint(target.RemoteAddr()),
+	}
+}
+
+func (cs *captureSession) record(dir int, src, dst *net.TCPAddr, b []byte) {
+	if !cs.capture.Enabled() {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if len(b) > cs.budget[dir] {
+		b = b[:cs.budget[dir]]
+	}
+
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxCapturePayload {
+			n = maxCapturePayload
+		}
+
+		var comment string
+		if !cs.commented[dir] {
+			comment = cs.comment(dir)
+			cs.commented[dir] = true
+		}
+
+		packet := tcpPacket(src, dst, cs.seq[dir], cs.seq[1-dir], b[:n])
+		if err := cs.capture.writePacket(time.Now(), packet, comment); err != nil {
+			return
+		}
+
+		cs.seq[dir] += uint32(n)
+		cs.budget[dir] -= n
+		b = b[n:]
+	}
+}
+
+func (cs *captureSession) comment(dir int) string {
+	direction := "client->target"
+	if dir == 1 {
+		direction = "target->client"
+	}
+
+	if cs.session == nil {
+		return "socks " + direction
+	}
+
+	return fmt.Sprintf("socks session=%s user=%q dest=%s target=%s %s", cs.session.ID, cs.session.User(), cs.session.DestAddr(), cs.session.TargetAddr(), direction)
+}
+
+type captureConn struct {
+	net.Conn
+	cs     *captureSession
+	client *net.TCPAddr
+	target *net.TCPAddr
+}
+
+func (c *captureConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.cs.record(1, c.target, c.client, p[:n])
+	}
+
+	return n, err
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.cs.record(0, c.client, c.target, p[:n])
+	}
+
+	return n, err
+}
+
+func (c *captureConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+// captureEndpoint returns the IP address and port of addr, or the
+// unspecified address for addresses without them.
+func captureEndpoint(addr net.Addr) *net.TCPAddr {
+	if addr != nil {
+		if host, port, err := splitHostAnyPort(addr.String()); err == nil {
+			host, _ = stripZone(host)
+
+			if ip := net.ParseIP(host); ip != nil {
+				return &net.TCPAddr{IP: ip, Port: int(port)}
+			}
+		}
+	}
+
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// tcpPacket returns an IPv4 or IPv6 packet with a TCP segment carrying
+// the payload. IPv4 addresses are mapped to IPv6 if the families of the
+// addresses differ.
+func tcpPacket(src, dst *net.TCPAddr, seq, ack uint32, payload []byte) []byte {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // data offset
+	tcp[13] = 0x18   // PSH, ACK
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	tcp = append(tcp, payload...)
+
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+
+	if src4 != nil && dst4 != nil {
+		pseudo := make([]byte, 0, 12)
+		pseudo = append(pseudo, src4...)
+		pseudo = append(pseudo, dst4...)
+		pseudo = append(pseudo, 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[6] = 0x40 // don't fragment
+		ip[8] = 64   // TTL
+		ip[9] = 6    // TCP
+		copy(ip[12:16], src4)
+		copy(ip[16:20], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+
+		return append(ip, tcp...)
+	}
+
+	src16, dst16 := src.IP.To16(), dst.IP.To16()
+
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, src16...)
+	pseudo = append(pseudo, dst16...)
+	pseudo = append(pseudo, byte(len(tcp)>>24), byte(len(tcp)>>16), byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, 6)
+	binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+	ip[6] = 6  // TCP
+	ip[7] = 64 // hop limit
+	copy(ip[8:24], src16)
+	copy(ip[24:40], dst16)
+
+	return append(ip, tcp...)
+}
+
+// checksum returns the Internet checksum of the concatenated data.
+func checksum(data ...[]byte) uint16 {
+	var (
+		sum uint32
+		odd bool
+	)
+
+	for _, b := range data {
+		for _, c := range b {
+			if odd {
+				sum += uint32(c)
+			} else {
+				sum += uint32(c) << 8
+			}
+
+			odd = !odd
+		}
+	}
+
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
+
+func appendUint32LE(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// appendPadded appends data padded to 32 bits.
+func appendPadded(b, data []byte) []byte {
+	b = append(b, data...)
+
+	if pad := len(data) % 4; pad != 0 {
+		b = append(b, make([]byte, 4-pad)...)
+	}
+
+	return b
+}
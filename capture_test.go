@@ -0,0 +1,107 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func readPcapng(t *testing.T, b []byte) []pcapngBlock {
+	var blocks []pcapngBlock
+
+	for len(b) > 0 {
+		n := binary.LittleEndian.Uint32(b[4:8])
+		assert.Equal(t, n, binary.LittleEndian.Uint32(b[n-4:n]))
+
+		blocks = append(blocks, pcapngBlock{
+			blockType: binary.LittleEndian.Uint32(b[0:4]),
+			body:      b[8 : n-4],
+		})
+
+		b = b[n:]
+	}
+
+	return blocks
+}
+
+func TestCapture(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	capture, err := NewCapture(buf, func(o *CaptureOptions) {
+		o.MaxBytes = 4
+	})
+	assert.NoError(t, err)
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	accessed := make(chan struct{}, 1)
+
+	server := New(func(o *Options) {
+		o.Capture = capture
+		o.Hooks.OnAccess = func(ctx context.Context, e *AccessEvent) {
+			accessed <- struct{}{}
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	get := func() {
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		assert.NoError(t, err)
+
+		_, err = io.ReadAll(conn)
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		<-accessed
+	}
+
+	get()
+
+	blocks := readPcapng(t, buf.Bytes())
+	assert.Len(t, blocks, 4)
+
+	assert.Equal(t, uint32(pcapngSectionHeader), blocks[0].blockType)
+	assert.Equal(t, uint32(pcapngInterfaceDescription), blocks[1].blockType)
+	assert.Equal(t, uint16(linkTypeRaw), binary.LittleEndian.Uint16(blocks[1].body))
+
+	request := blocks[2].body
+	assert.Equal(t, uint32(pcapngEnhancedPacket), blocks[2].blockType)
+	assert.Equal(t, uint32(44), binary.LittleEndian.Uint32(request[12:16]))
+
+	packet := request[20:64]
+	assert.Equal(t, byte(0x45), packet[0])
+	assert.Equal(t, uint16(0), checksum(packet[:20]))
+	assert.Equal(t, "GET ", string(packet[40:]))
+	assert.Contains(t, string(request[64:]), "socks session=")
+	assert.Contains(t, string(request[64:]), "client->target")
+
+	response := blocks[3].body
+	assert.Equal(t, "HTTP", string(response[20+40:20+44]))
+	assert.Contains(t, string(response[64:]), "target->client")
+
+	capture.SetEnabled(false)
+
+	get()
+
+	assert.Len(t, readPcapng(t, buf.Bytes()), 4)
+}
@@ -0,0 +1,205 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// CheckResult is the result of Check.
+type CheckResult struct {
+	// Proxy is the address of the proxy.
+	Proxy string
+
+	// Version is the SOCKS version of the proxy URL.
+	Version Version
+
+	// Target is the canary target, if any.
+	Target string
+
+	// Timing holds the timestamps of the completed phases.
+	Timing NegotiationTiming
+
+	// ConnectLatency, MethodSelectLatency, AuthLatency and ReplyLatency
+	// are the durations of the completed phases, see PhaseLatencies.
+	ConnectLatency      time.Duration
+	MethodSelectLatency time.Duration
+	AuthLatency         time.Duration
+	ReplyLatency        time.Duration
+
+	// Status is the status of the reply to the CONNECT request. It is
+	// empty without a reply.
+	Status string
+
+	// Granted reports whether the CONNECT request was granted.
+	Granted bool
+
+	// Err is the error of the check, if any.
+	Err error
+}
+
+// Healthy reports whether the check succeeded.
+func (r *CheckResult) Healthy() bool {
+	return r.Err == nil
+}
+
+// PhaseLatencies returns the durations of the connection to the proxy,
+// the method selection, the authentication and the reply. Phases which
+// did not complete or were skipped are zero.
+func (t NegotiationTiming) PhaseLatencies() (connect, methodSelect, auth, reply time.Duration) {
+	prev := t.Start
+
+	phase := func(at time.Time) time.Duration {
+		if at.IsZero() || prev.IsZero() {
+			return 0
+		}
+
+		d := at.Sub(prev)
+		prev = at
+
+		return d
+	}
+
+	connect = phase(t.ProxyConnected)
+	methodSelect = phase(t.MethodSelected)
+	auth = phase(t.Authenticated)
+	reply = phase(t.Replied)
+
+	return connect, methodSelect, auth, reply
+}
+
+// Check checks the proxy of a proxy URL, see ParseProxyURL. It connects
+// to the proxy and performs the handshake. If target is not empty, it
+// also connects to the canary target through the proxy and closes the
+// connection. The result holds the latencies of the completed phases
+// and the error of the check, which is also returned. Without a target,
+// a SOCKS4 check only connects to the proxy, since SOCKS4 has no
+// handshake before the request.
+func Check(ctx context.Context, proxyURL, target string) (*CheckResult, error) {
+	config, err := ParseProxyURL(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := config.NewDialer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CheckResult{
+		Proxy:   config.Address,
+		Version: config.Version,
+		Target:  target,
+	}
+
+	result.Err = checkDialer(ctx, dialer, target, result)
+
+	return result, result.Err
+}
+
+// HandshakeHealthChecker returns a HealthChecker which performs the
+// handshake of Check with the dialer, e.g. for the health checks of a
+// Pool. Dialers other than a Socks4Dialer or Socks5Dialer connect to
+// the target; without a target, they are healthy.
+func HandshakeHealthChecker(target string) HealthChecker {
+	return HealthCheckerFunc(func(ctx context.Context, d Dialer) error {
+		return checkDialer(ctx, d, target, &CheckResult{})
+	})
+}
+
+// checkDialer checks the dialer and records the progress in result.
+func checkDialer(ctx context.Context, dialer Dialer, target string, result *CheckResult) error {
+	n := &negotiation{}
+
+	defer func() {
+		result.Timing = n.timing
+		result.ConnectLatency, result.MethodSelectLatency, result.AuthLatency, result.ReplyLatency = n.timing.PhaseLatencies()
+
+		switch {
+		case n.socks4Reply != nil:
+			result.Status = n.socks4Reply.Status.String()
+			result.Granted = n.socks4Reply.Status == Socks4StatusGranted
+		case n.socks5Reply != nil:
+			result.Status = n.socks5Reply.Status.String()
+			result.Granted = n.socks5Reply.Status == Socks5StatusGranted
+		}
+	}()
+
+	if target == "" {
+		switch d := dialer.(type) {
+		case *Socks5Dialer:
+			return d.handshake(ctx, n)
+		case *Socks4Dialer:
+			n.timing.Start = time.Now()
+
+			conn, err := d.dialProxy(ctx)
+			if err != nil {
+				return err
+			}
+
+			n.timing.ProxyConnected = time.Now()
+
+			return conn.Close()
+		default:
+			return nil
+		}
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	switch d := dialer.(type) {
+	case *Socks5Dialer:
+		conn, err = d.dial(ctx, "tcp", target, n)
+	case *Socks4Dialer:
+		conn, err = d.dial(ctx, "tcp", target, n)
+	default:
+		conn, err = dialer.DialContext(ctx, "tcp", target)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// handshake connects to the proxy, negotiates the method selection and
+// the authentication and closes the connection.
+func (d *Socks5Dialer) handshake(ctx context.Context, n *negotiation) error {
+	n.timing.Start = time.Now()
+
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	n.timing.ProxyConnected = time.Now()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	socksConn := NewConn(conn)
+
+	method, err := clientSelectMethod(socksConn, d.authMethods)
+	if err != nil {
+		return err
+	}
+
+	n.timing.MethodSelected = time.Now()
+
+	if d.authenticate != nil {
+		if err := d.authenticate(ctx, socksConn, method); err != nil {
+			return err
+		}
+
+		n.timing.Authenticated = time.Now()
+	}
+
+	return nil
+}
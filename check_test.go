@@ -0,0 +1,94 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		o.Authenticate = userPassServerAuthenticateFuncGen("user", "pass")
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	proxyURL := "socks5://user:pass@" + listen.Addr().String()
+	target := testServer.Listener.Addr().String()
+
+	t.Run("connect", func(t *testing.T) {
+		result, err := Check(context.Background(), proxyURL, target)
+		assert.NoError(t, err)
+		assert.True(t, result.Healthy())
+		assert.True(t, result.Granted)
+		assert.Equal(t, Socks5StatusGranted.String(), result.Status)
+		assert.Equal(t, listen.Addr().String(), result.Proxy)
+		assert.False(t, result.Timing.Authenticated.IsZero())
+		assert.False(t, result.Timing.Replied.IsZero())
+		assert.Equal(t, result.Timing.Overhead(), result.ConnectLatency+result.MethodSelectLatency+result.AuthLatency+result.ReplyLatency)
+	})
+
+	t.Run("handshake only", func(t *testing.T) {
+		result, err := Check(context.Background(), proxyURL, "")
+		assert.NoError(t, err)
+		assert.False(t, result.Timing.Authenticated.IsZero())
+		assert.True(t, result.Timing.Replied.IsZero())
+		assert.Empty(t, result.Status)
+		assert.False(t, result.Granted)
+	})
+
+	t.Run("authentication failure", func(t *testing.T) {
+		result, err := Check(context.Background(), "socks5://user:wrong@"+listen.Addr().String(), "")
+		assert.Error(t, err)
+		assert.False(t, result.Healthy())
+		assert.False(t, result.Timing.MethodSelected.IsZero())
+		assert.True(t, result.Timing.Authenticated.IsZero())
+	})
+
+	t.Run("unreachable target", func(t *testing.T) {
+		closed, err := net.Listen("tcp", "localhost:0")
+		assert.NoError(t, err)
+
+		_ = closed.Close()
+
+		result, err := Check(context.Background(), proxyURL, closed.Addr().String())
+		assert.Error(t, err)
+		assert.False(t, result.Granted)
+		assert.NotEmpty(t, result.Status)
+		assert.False(t, result.Timing.Replied.IsZero())
+	})
+
+	t.Run("socks4", func(t *testing.T) {
+		result, err := Check(context.Background(), "socks4://"+listen.Addr().String(), target)
+		assert.NoError(t, err)
+		assert.True(t, result.Granted)
+		assert.Equal(t, Socks4StatusGranted.String(), result.Status)
+		assert.True(t, result.Timing.MethodSelected.IsZero())
+	})
+
+	t.Run("invalid url", func(t *testing.T) {
+		result, err := Check(context.Background(), "http://"+listen.Addr().String(), target)
+		assert.Error(t, err)
+		assert.Nil(t, result)
+	})
+
+	t.Run("health checker", func(t *testing.T) {
+		checker := HandshakeHealthChecker(target)
+
+		assert.NoError(t, checker.CheckHealth(context.Background(), NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = UsernamePasswordAuthenticator("user", "pass")
+		})))
+		assert.Error(t, checker.CheckHealth(context.Background(), NewSocks5Dialer("tcp", listen.Addr().String())))
+	})
+}
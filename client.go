@@ -0,0 +1,301 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ClientHandshakeOptions specifies the client side of a SOCKS5
+// handshake.
+type ClientHandshakeOptions struct {
+	// AuthMethods specifies the list of request authentication
+	// methods.
+	// If empty, only AuthMethodNotRequired is requested.
+	AuthMethods []AuthMethod
+
+	// Authenticate specifies the optional authentication
+	// function. It must be non-nil when AuthMethods is not empty.
+	// It must return an error when the authentication is failed.
+	Authenticate AuthenticateFunc
+
+	// ReplyValidation specifies the validation of the reply.
+	ReplyValidation ReplyValidation
+
+	// Timing specifies the optional record of the timestamps of the
+	// method selection, the authentication and the reply.
+	Timing *NegotiationTiming
+
+	// RequireAuth specifies whether the handshake fails with
+	// ErrAuthRequired if the proxy selects AuthMethodNotRequired, e.g.
+	// a misconfigured or downgraded proxy. AuthMethodNotRequired is not
+	// offered.
+	RequireAuth bool
+}
+
+// ClientHandshake performs the method selection, the authentication and
+// the request of a SOCKS5 handshake on an established connection to a
+// proxy. It returns the reply of the proxy and an error if the request
+// was not granted. The deadline of ctx applies to the handshake. After a
+// granted CONNECT, conn.NetConn() returns the tunnel.
+func ClientHandshake(ctx context.Context, conn *Conn, req *Socks5Request, optFns ...func(*ClientHandshakeOptions)) (*Socks5Response, error) {
+	options := ClientHandshakeOptions{
+		AuthMethods: []AuthMethod{AuthMethodNotRequired},
+	}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	if options.RequireAuth {
+		options.AuthMethods, options.Authenticate = requireAuth(options.AuthMethods, options.Authenticate)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.conn.SetDeadline(deadline)
+
+		defer func() {
+			_ = conn.conn.SetDeadline(time.Time{})
+		}()
+	}
+
+	timing := options.Timing
+	if timing == nil {
+		timing = &NegotiationTiming{}
+	}
+
+	method, err := clientSelectMethod(conn, options.AuthMethods)
+	if err != nil {
+		return nil, err
+	}
+
+	timing.MethodSelected = time.Now()
+
+	if options.Authenticate != nil {
+		if err := options.Authenticate(ctx, conn, method); err != nil {
+			return nil, err
+		}
+
+		timing.Authenticated = time.Now()
+	}
+
+	resp, err := clientRequest(conn, req, &options.ReplyValidation)
+	if resp != nil {
+		timing.Replied = time.Now()
+	}
+
+	if err != nil {
+		return resp, err
+	}
+
+	conn.endHandshake()
+
+	return resp, nil
+}
+
+// clientRequest sends the request and reads the reply. If v is not nil,
+// the reply is validated.
+func clientRequest(conn *Conn, req *Socks5Request, v *ReplyValidation) (*Socks5Response, error) {
+	if err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	return clientReply(conn, v)
+}
+
+// clientReply reads a reply, e.g. the second reply to a BIND request. If
+// v is not nil, the reply is validated.
+func clientReply(conn *Conn, v *ReplyValidation) (*Socks5Response, error) {
+	var hdr []byte
+
+	if v != nil && v.enabled() {
+		// VER, REP, RSV and ATYP; a short header is checked by the
+		// validation after decoding.
+		b, _ := conn.Peek(4)
+		hdr = append(hdr, b...)
+	}
+
+	resp := &Socks5Response{}
+	if err := conn.Read(resp); err != nil {
+		return nil, err
+	}
+
+	if v != nil && v.enabled() {
+		if err := v.validate(hdr, resp); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.Status != Socks5StatusGranted {
+		return resp, newProtocolError("SOCKS5 reply", Socks5StatusGranted.String(), resp.Status.String(), []byte{byte(resp.Status)})
+	}
+
+	return resp, nil
+}
+
+// ReplyValidation specifies the validation of the reply to a request.
+// Violations fail the handshake with a *ProtocolError instead of leaving
+// garbage in the stream.
+type ReplyValidation struct {
+	// Strict rejects replies with an unknown status or a non-zero RSV
+	// field and granted replies without BND.ADDR or with an empty FQDN.
+	Strict bool
+
+	// AddrTypes specifies the accepted address types of BND.ADDR of
+	// granted replies. If empty, all address types are accepted.
+	AddrTypes []AddrType
+}
+
+// enabled reports whether any validation is specified.
+func (v *ReplyValidation) enabled() bool {
+	return v.Strict || len(v.AddrTypes) > 0
+}
+
+// validate validates the reply resp whose first bytes are hdr.
+func (v *ReplyValidation) validate(hdr []byte, resp *Socks5Response) error {
+	const phase = "SOCKS5 reply"
+
+	if v.Strict {
+		if resp.Status > Socks5StatusAddrTypeNotSupported {
+			return newProtocolError(phase, "status 0 to 8", fmt.Sprintf("status %d", resp.Status), hdr)
+		}
+
+		if len(hdr) > 2 && hdr[2] != 0 {
+			return newProtocolError(phase, "RSV 0", fmt.Sprintf("RSV %d", hdr[2]), hdr)
+		}
+	}
+
+	if resp.Status != Socks5StatusGranted {
+		return nil
+	}
+
+	if len(hdr) < 4 {
+		return newProtocolError(phase, "BND.ADDR", "end of reply", hdr)
+	}
+
+	atype := AddrType(hdr[3])
+
+	if v.Strict && atype == AddrTypeFQDN {
+		if host, _, err := net.SplitHostPort(resp.Addr); err != nil || host == "" {
+			return newProtocolError(phase, "BND.ADDR", "empty FQDN", hdr)
+		}
+	}
+
+	if len(v.AddrTypes) == 0 {
+		return nil
+	}
+
+	for _, t := range v.AddrTypes {
+		if t == atype {
+			return nil
+		}
+	}
+
+	return newProtocolError(phase, fmt.Sprintf("address type in %v", v.AddrTypes), fmt.Sprintf("address type %d", atype), hdr)
+}
+
+// clientSelectMethod offers the authentication methods to the proxy and
+// returns the selected method.
+func clientSelectMethod(conn *Conn, methods []AuthMethod) (AuthMethod, error) {
+	if err := conn.Write(&MethodSelectRequest{
+		Methods: methods,
+	}); err != nil {
+		return 0, err
+	}
+
+	resp := &MethodSelectResponse{}
+	if err := conn.Read(resp); err != nil {
+		return 0, err
+	}
+
+	// If the selected METHOD is X'FF', none of the methods listed by the
+	// client are acceptable, and the client MUST close the connection.
+	if resp.Method == AuthMethodNoAcceptableMethods {
+		return 0, newProtocolError("method selection", fmt.Sprintf("one of %v", methods), fmt.Sprintf("%v", resp.Method), nil)
+	}
+
+	// The server sends the notice of AuthMethodNotice unsolicited.
+	if resp.Method == AuthMethodNotice {
+		return resp.Method, nil
+	}
+
+	if err := checkUnsolicited(conn, "method selection"); err != nil {
+		return 0, err
+	}
+
+	return resp.Method, nil
+}
+
+// requireAuth removes AuthMethodNotRequired from the offered methods,
+// unless it is the only one, and wraps authenticate to fail if the proxy
+// selects it anyway.
+func requireAuth(methods []AuthMethod, authenticate AuthenticateFunc) ([]AuthMethod, AuthenticateFunc) {
+	offered := make([]AuthMethod, 0, len(methods))
+
+	for _, method := range methods {
+		if method != AuthMethodNotRequired {
+			offered = append(offered, method)
+		}
+	}
+
+	if len(offered) == 0 {
+		offered = methods
+	}
+
+	return offered, func(ctx context.Context, conn *Conn, method AuthMethod) error {
+		if method == AuthMethodNotRequired {
+			return ErrAuthRequired
+		}
+
+		if authenticate == nil {
+			return nil
+		}
+
+		return authenticate(ctx, conn, method)
+	}
+}
+
+// checkUnsolicited fails with a *ProtocolError if the proxy sent more
+// data after the last message of phase, although the client is to send
+// next. The data would otherwise corrupt the following messages or the
+// application stream.
+func checkUnsolicited(conn *Conn, phase string) error {
+	n := conn.reader.Buffered()
+	if n == 0 {
+		return nil
+	}
+
+	b, _ := conn.Peek(n)
+
+	return newProtocolError(phase, "end of message", fmt.Sprintf("%d unsolicited bytes", n), b)
+}
+
+// UsernamePasswordAuthenticator returns the client side AuthenticateFunc
+// of the username/password authentication defined in RFC 1929.
+func UsernamePasswordAuthenticator(username, password string) AuthenticateFunc {
+	return func(ctx context.Context, conn *Conn, method AuthMethod) error {
+		if method != AuthMethodUsernamePassword {
+			return nil
+		}
+
+		if err := conn.Write(&UsernamePasswordAuthRequest{
+			Username: username,
+			Password: password,
+		}); err != nil {
+			return err
+		}
+
+		resp := &UsernamePasswordAuthResponse{}
+		if err := conn.Read(resp); err != nil {
+			return err
+		}
+
+		if resp.Status != AuthStatusSuccess {
+			return errors.New("socks: username/password authentication failed")
+		}
+
+		return checkUnsolicited(conn, "username/password authentication")
+	}
+}
@@ -0,0 +1,279 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientHandshake(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		o.Authenticate = userPassServerAuthenticateFuncGen("user", "pass")
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("granted", func(t *testing.T) {
+		c, err := net.Dial("tcp", listen.Addr().String())
+		assert.NoError(t, err)
+
+		defer c.Close()
+
+		resp, err := ClientHandshake(ctx, NewConn(c), &Socks5Request{
+			CMD:  ConnectCommand,
+			Addr: testServer.Listener.Addr().String(),
+		}, func(o *ClientHandshakeOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = userPassDialerAuthenticateFuncGen("user", "pass")
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, Socks5StatusGranted, resp.Status)
+
+		_, err = c.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		assert.NoError(t, err)
+
+		buf := make([]byte, 12)
+		_, err = c.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "HTTP/1.0 200", string(buf))
+	})
+
+	t.Run("no acceptable method", func(t *testing.T) {
+		c, err := net.Dial("tcp", listen.Addr().String())
+		assert.NoError(t, err)
+
+		defer c.Close()
+
+		_, err = ClientHandshake(ctx, NewConn(c), &Socks5Request{
+			CMD:  ConnectCommand,
+			Addr: testServer.Listener.Addr().String(),
+		})
+
+		var protocolErr *ProtocolError
+		assert.ErrorAs(t, err, &protocolErr)
+	})
+}
+
+func TestReplyValidation(t *testing.T) {
+	// handshake runs a handshake against a fake proxy sending reply.
+	handshake := func(reply []byte, v ReplyValidation) (*Socks5Response, error) {
+		client, proxy := net.Pipe()
+		defer client.Close()
+
+		go func() {
+			defer proxy.Close()
+
+			buf := make([]byte, 512)
+
+			_, _ = proxy.Read(buf) // method selection
+			_, _ = proxy.Write([]byte{0x05, 0x00})
+			_, _ = proxy.Read(buf) // request
+			_, _ = proxy.Write(reply)
+		}()
+
+		return ClientHandshake(context.Background(), NewConn(client), &Socks5Request{
+			CMD:  ConnectCommand,
+			Addr: "example.com:80",
+		}, func(o *ClientHandshakeOptions) {
+			o.ReplyValidation = v
+		})
+	}
+
+	ipv4 := []byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x1f, 0x90}
+	ipv6 := []byte{0x05, 0x00, 0x00, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90}
+
+	t.Run("valid", func(t *testing.T) {
+		resp, err := handshake(ipv4, ReplyValidation{Strict: true, AddrTypes: []AddrType{AddrTypeIPv4}})
+		assert.NoError(t, err)
+		assert.Equal(t, "127.0.0.1:8080", resp.Addr)
+	})
+
+	t.Run("pinned family", func(t *testing.T) {
+		_, err := handshake(ipv6, ReplyValidation{AddrTypes: []AddrType{AddrTypeIPv4}})
+
+		var protocolErr *ProtocolError
+		assert.ErrorAs(t, err, &protocolErr)
+		assert.Equal(t, "address type 4", protocolErr.Got)
+	})
+
+	t.Run("unknown status", func(t *testing.T) {
+		_, err := handshake([]byte{0x05, 0x42, 0x00, 0x01, 0, 0, 0, 0, 0, 0}, ReplyValidation{Strict: true})
+
+		var protocolErr *ProtocolError
+		assert.ErrorAs(t, err, &protocolErr)
+		assert.Equal(t, "status 66", protocolErr.Got)
+	})
+
+	t.Run("reserved", func(t *testing.T) {
+		_, err := handshake([]byte{0x05, 0x00, 0x07, 0x01, 0, 0, 0, 0, 0, 0}, ReplyValidation{Strict: true})
+
+		var protocolErr *ProtocolError
+		assert.ErrorAs(t, err, &protocolErr)
+		assert.Equal(t, "RSV 7", protocolErr.Got)
+	})
+
+	t.Run("missing address", func(t *testing.T) {
+		_, err := handshake([]byte{0x05, 0x00, 0x00}, ReplyValidation{Strict: true})
+
+		var protocolErr *ProtocolError
+		assert.ErrorAs(t, err, &protocolErr)
+		assert.Equal(t, "end of reply", protocolErr.Got)
+
+		_, err = handshake([]byte{0x05, 0x00, 0x00}, ReplyValidation{})
+		assert.NoError(t, err)
+	})
+
+	t.Run("empty fqdn", func(t *testing.T) {
+		_, err := handshake([]byte{0x05, 0x00, 0x00, 0x03, 0x00, 0x00, 0x50}, ReplyValidation{Strict: true})
+
+		var protocolErr *ProtocolError
+		assert.ErrorAs(t, err, &protocolErr)
+		assert.Equal(t, "empty FQDN", protocolErr.Got)
+	})
+}
+
+func TestUnsolicitedData(t *testing.T) {
+	// handshake runs a handshake against a fake proxy sending the
+	// messages in one write each.
+	handshake := func(selection, auth []byte) error {
+		client, proxy := net.Pipe()
+		defer client.Close()
+
+		go func() {
+			defer proxy.Close()
+
+			buf := make([]byte, 512)
+
+			_, _ = proxy.Read(buf) // method selection
+			_, _ = proxy.Write(selection)
+
+			if auth != nil {
+				_, _ = proxy.Read(buf) // username/password
+				_, _ = proxy.Write(auth)
+			}
+
+			_, _ = proxy.Read(buf) // request
+			_, _ = proxy.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x1f, 0x90, 'h', 'i'})
+		}()
+
+		_, err := ClientHandshake(context.Background(), NewConn(client), &Socks5Request{
+			CMD:  ConnectCommand,
+			Addr: "example.com:80",
+		}, func(o *ClientHandshakeOptions) {
+			if auth != nil {
+				o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+				o.Authenticate = UsernamePasswordAuthenticator("user", "pass")
+			}
+		})
+
+		return err
+	}
+
+	t.Run("after reply", func(t *testing.T) {
+		// Data after the reply belongs to the application stream.
+		assert.NoError(t, handshake([]byte{0x05, 0x00}, nil))
+		assert.NoError(t, handshake([]byte{0x05, 0x02}, []byte{0x01, 0x00}))
+	})
+
+	t.Run("after method selection", func(t *testing.T) {
+		err := handshake([]byte{0x05, 0x00, 0xde, 0xad}, nil)
+
+		var protocolErr *ProtocolError
+		assert.ErrorAs(t, err, &protocolErr)
+		assert.Equal(t, "method selection", protocolErr.Phase)
+		assert.Equal(t, "2 unsolicited bytes", protocolErr.Got)
+		assert.Equal(t, []byte{0xde, 0xad}, protocolErr.Raw)
+	})
+
+	t.Run("after authentication", func(t *testing.T) {
+		err := handshake([]byte{0x05, 0x02}, []byte{0x01, 0x00, 0xff})
+
+		var protocolErr *ProtocolError
+		assert.ErrorAs(t, err, &protocolErr)
+		assert.Equal(t, "username/password authentication", protocolErr.Phase)
+	})
+}
+
+func TestRequireAuth(t *testing.T) {
+	// The proxy selects no authentication whatever the client offers.
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	offered := make(chan []AuthMethod, 1)
+
+	go func() {
+		for {
+			c, err := listen.Accept()
+			if err != nil {
+				return
+			}
+
+			conn := NewConn(c)
+
+			req := &MethodSelectRequest{}
+			if err := conn.Read(req); err == nil {
+				offered <- req.Methods
+				_ = conn.Write(&MethodSelectResponse{Method: AuthMethodNotRequired})
+			}
+
+			_ = c.Close()
+		}
+	}()
+
+	t.Run("dialer", func(t *testing.T) {
+		d := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodNotRequired, AuthMethodUsernamePassword}
+			o.Authenticate = UsernamePasswordAuthenticator("user", "pass")
+			o.RequireAuth = true
+		})
+
+		_, err := d.Dial("tcp", testServer.Listener.Addr().String())
+		assert.ErrorIs(t, err, ErrAuthRequired)
+		assert.Equal(t, []AuthMethod{AuthMethodUsernamePassword}, <-offered)
+	})
+
+	t.Run("resumption fallback", func(t *testing.T) {
+		d := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = UsernamePasswordAuthenticator("user", "pass")
+			o.Resumption = &ResumptionCache{}
+			o.RequireAuth = true
+		})
+
+		_, err := d.Dial("tcp", testServer.Listener.Addr().String())
+		assert.ErrorIs(t, err, ErrAuthRequired)
+		assert.Equal(t, []AuthMethod{AuthMethodResumption, AuthMethodUsernamePassword}, <-offered)
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+		c, err := net.Dial("tcp", listen.Addr().String())
+		assert.NoError(t, err)
+
+		defer c.Close()
+
+		_, err = ClientHandshake(context.Background(), NewConn(c), &Socks5Request{
+			CMD:  ConnectCommand,
+			Addr: testServer.Listener.Addr().String(),
+		}, func(o *ClientHandshakeOptions) {
+			o.RequireAuth = true
+		})
+		assert.ErrorIs(t, err, ErrAuthRequired)
+		assert.Equal(t, []AuthMethod{AuthMethodNotRequired}, <-offered)
+	})
+}
@@ -0,0 +1,193 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// CloseReason classifies the termination of a session, e.g. to tell
+// benign closes from failures in logs and metrics.
+type CloseReason int
+
+const (
+	// CloseReasonUnknown is the reason of a session which has not been
+	// closed yet.
+	CloseReasonUnknown CloseReason = iota
+
+	// CloseReasonClientEOF is a close by the client, e.g. at the end of
+	// a tunnel or a UDP association.
+	CloseReasonClientEOF
+
+	// CloseReasonTargetEOF is a close by the target of a tunnel.
+	CloseReasonTargetEOF
+
+	// CloseReasonIdleTimeout is a tunnel closed after
+	// Options.IdleTimeout without data in either direction.
+	CloseReasonIdleTimeout
+
+	// CloseReasonQuota is a session closed because it exceeded a quota,
+	// see Server.CloseSession.
+	CloseReasonQuota
+
+	// CloseReasonAdminKill is a session closed by an operator, see
+	// Server.CloseSession.
+	CloseReasonAdminKill
+
+	// CloseReasonPolicyRevoked is a session closed because the policy
+	// which allowed it no longer does, see Server.Revalidate.
+	CloseReasonPolicyRevoked
+
+	// CloseReasonShutdown is a session closed by Server.Close.
+	CloseReasonShutdown
+
+	// CloseReasonRejected is a session whose request was denied with a
+	// *DenialError.
+	CloseReasonRejected
+
+	// CloseReasonError is a session which failed, e.g. in the handshake,
+	// the dial of the target or the tunnel.
+	CloseReasonError
+
+	closeReasonCount
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseReasonClientEOF:
+		return "client_eof"
+	case CloseReasonTargetEOF:
+		return "target_eof"
+	case CloseReasonIdleTimeout:
+		return "idle_timeout"
+	case CloseReasonQuota:
+		return "quota"
+	case CloseReasonAdminKill:
+		return "admin_kill"
+	case CloseReasonPolicyRevoked:
+		return "policy_revoked"
+	case CloseReasonShutdown:
+		return "shutdown"
+	case CloseReasonRejected:
+		return "rejected"
+	case CloseReasonError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Benign reports whether the reason is not a failure.
+func (r CloseReason) Benign() bool {
+	switch r {
+	case CloseReasonClientEOF, CloseReasonTargetEOF, CloseReasonIdleTimeout, CloseReasonShutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// classifyClose returns the reason of a session which ended with err,
+// unless a reason has been recorded already.
+func classifyClose(session *Session, err error) CloseReason {
+	if session != nil {
+		if reason := session.CloseReason(); reason != CloseReasonUnknown {
+			return reason
+		}
+	}
+
+	var denial *DenialError
+
+	switch {
+	case errors.As(err, &denial):
+		return CloseReasonRejected
+	case err != nil:
+		return CloseReasonError
+	default:
+		return CloseReasonClientEOF
+	}
+}
+
+// tunnelEnd is the end of a direction of a tunnel.
+type tunnelEnd struct {
+	toTarget bool
+	err      error
+}
+
+// reason returns the reason of a tunnel whose first direction ended
+// with e.
+func (e tunnelEnd) reason() CloseReason {
+	switch {
+	case e.err != nil:
+		return CloseReasonError
+	case e.toTarget:
+		return CloseReasonClientEOF
+	default:
+		return CloseReasonTargetEOF
+	}
+}
+
+// idleWatch closes a tunnel without reads in either direction for the
+// timeout.
+type idleWatch struct {
+	timeout      time.Duration
+	lastActivity int64 // unix nanoseconds, accessed atomically
+	done         chan struct{}
+}
+
+func newIdleWatch(timeout time.Duration) *idleWatch {
+	return &idleWatch{
+		timeout:      timeout,
+		lastActivity: time.Now().UnixNano(),
+		done:         make(chan struct{}),
+	}
+}
+
+// reader returns r recording its reads as activity.
+func (w *idleWatch) reader(r io.Reader) io.Reader {
+	return &activityReader{r: r, last: &w.lastActivity}
+}
+
+// watch calls expire once the tunnel is idle, unless stop is called
+// before.
+func (w *idleWatch) watch(expire func()) {
+	timer := time.NewTimer(w.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-timer.C:
+		}
+
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&w.lastActivity)))
+		if idle < w.timeout {
+			timer.Reset(w.timeout - idle)
+			continue
+		}
+
+		expire()
+
+		return
+	}
+}
+
+func (w *idleWatch) stop() {
+	close(w.done)
+}
+
+type activityReader struct {
+	r    io.Reader
+	last *int64
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(r.last, time.Now().UnixNano())
+	}
+
+	return n, err
+}
@@ -0,0 +1,182 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyClose(t *testing.T) {
+	t.Run("recorded", func(t *testing.T) {
+		session := newSession(nil)
+		session.setCloseReason(CloseReasonAdminKill)
+		session.setCloseReason(CloseReasonError)
+
+		assert.Equal(t, CloseReasonAdminKill, classifyClose(session, errors.New("closed")))
+	})
+
+	t.Run("denial", func(t *testing.T) {
+		assert.Equal(t, CloseReasonRejected, classifyClose(nil, &DenialError{}))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		assert.Equal(t, CloseReasonError, classifyClose(newSession(nil), io.ErrUnexpectedEOF))
+	})
+
+	t.Run("no error", func(t *testing.T) {
+		assert.Equal(t, CloseReasonClientEOF, classifyClose(nil, nil))
+	})
+
+	assert.Equal(t, "idle_timeout", CloseReasonIdleTimeout.String())
+	assert.True(t, CloseReasonTargetEOF.Benign())
+	assert.False(t, CloseReasonQuota.Benign())
+}
+
+func TestCloseReason(t *testing.T) {
+	// The target closes its connections after echoing a line, or holds
+	// them open if the client sends "hold".
+	target, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer target.Close()
+
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				b := make([]byte, 4)
+				if _, err := io.ReadFull(conn, b); err != nil || string(b) == "hold" {
+					_, _ = io.Copy(io.Discard, conn)
+					return
+				}
+
+				_, _ = conn.Write(b)
+			}()
+		}
+	}()
+
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.IdleTimeout = 200 * time.Millisecond
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	sub := server.Subscribe(64)
+	defer sub.Unsubscribe()
+
+	d := NewSocks5Dialer("tcp", listen.Addr().String())
+
+	closed := func(t *testing.T) Event {
+		t.Helper()
+
+		for {
+			select {
+			case e := <-sub.C:
+				if e.Type == EventSessionClosed {
+					return e
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no close event")
+				return Event{}
+			}
+		}
+	}
+
+	t.Run("client eof", func(t *testing.T) {
+		conn, err := d.Dial("tcp", target.Addr().String())
+		assert.NoError(t, err)
+
+		_, err = conn.Write([]byte("hold"))
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		assert.Equal(t, CloseReasonClientEOF, closed(t).CloseReason)
+	})
+
+	t.Run("target eof", func(t *testing.T) {
+		conn, err := d.Dial("tcp", target.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+
+		b, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(b))
+
+		_ = conn.Close()
+
+		assert.Equal(t, CloseReasonTargetEOF, closed(t).CloseReason)
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		conn, err := d.Dial("tcp", target.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("hold"))
+		assert.NoError(t, err)
+
+		assert.Equal(t, CloseReasonIdleTimeout, closed(t).CloseReason)
+	})
+
+	t.Run("admin kill", func(t *testing.T) {
+		conn, err := d.Dial("tcp", target.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		var id string
+
+		assert.Eventually(t, func() bool {
+			server.mu.Lock()
+			defer server.mu.Unlock()
+
+			for session := range server.sessions {
+				if session.TargetAddr() != "" {
+					id = session.ID
+				}
+			}
+
+			return id != ""
+		}, 5*time.Second, 10*time.Millisecond)
+
+		assert.True(t, server.CloseSession(id, CloseReasonAdminKill))
+		assert.False(t, server.CloseSession("unknown", CloseReasonAdminKill))
+
+		assert.Equal(t, CloseReasonAdminKill, closed(t).CloseReason)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		_, err := d.Dial("tcp", "bad_host!:80")
+		assert.Error(t, err)
+
+		assert.Equal(t, CloseReasonRejected, closed(t).CloseReason)
+	})
+
+	m := server.Metrics()
+	assert.Equal(t, uint64(1), m.CloseReasons[CloseReasonTargetEOF])
+	assert.Equal(t, uint64(1), m.CloseReasons[CloseReasonIdleTimeout])
+	assert.Equal(t, uint64(1), m.CloseReasons[CloseReasonAdminKill])
+}
@@ -0,0 +1,108 @@
+// Command socksd is a SOCKS4 and SOCKS5 proxy server. It shuts down
+// gracefully on SIGINT or SIGTERM and reloads its rule file on SIGHUP.
+// On Windows it runs as a service, see the -service flag.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hupe1980/golog"
+	"github.com/hupe1980/socks"
+)
+
+var (
+	addr            = flag.String("addr", ":1080", "address to listen on")
+	rulesFile       = flag.String("rules", "", "optional rule file, reloaded on SIGHUP")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long a shutdown waits for the sessions")
+	logLevel        = flag.String("log-level", "INFO", "log level: ERROR, WARNING, INFO or DEBUG")
+)
+
+func main() {
+	flag.Parse()
+
+	level, err := golog.LogLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if done, err := runService(level); done {
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	sigCh := make(chan os.Signal, 1)
+
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	if err := run(context.Background(), golog.NewGoLogger(level, log.Default()), sigCh); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves SOCKS on addr until a SIGINT or SIGTERM of sigCh shut the
+// server down. A SIGHUP reloads the rule file.
+func run(ctx context.Context, logger golog.Logger, sigCh <-chan os.Signal) error {
+	var rules *ruleFile
+
+	if *rulesFile != "" {
+		rules = &ruleFile{path: *rulesFile}
+
+		if err := rules.Reload(ctx); err != nil {
+			return err
+		}
+	}
+
+	server, err := socks.NewServer(func(o *socks.Options) {
+		o.Logger = logger
+
+		if rules != nil {
+			o.Rules = rules
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	listen, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	signalErr := make(chan error, 1)
+
+	go func() {
+		signalErr <- server.ServeSignals(ctx, sigCh, func(o *socks.SignalOptions) {
+			o.ShutdownTimeout = *shutdownTimeout
+
+			if rules != nil {
+				o.Reload = rules.Reload
+				o.Revalidate = true
+			}
+		})
+	}()
+
+	logger.Printf(golog.INFO, "Serving SOCKS on %v", listen.Addr())
+
+	if err := server.Serve(listen); !errors.Is(err, socks.ErrServerClosed) {
+		return err
+	}
+
+	// Serve returns once the shutdown closed the listener, the sessions
+	// are drained until ServeSignals returns.
+	return <-signalErr
+}
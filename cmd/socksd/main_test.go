@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hupe1980/golog"
+	"github.com/hupe1980/socks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	assert.NoError(t, os.WriteFile(path, []byte("default deny\n"), 0o600))
+
+	rules := &ruleFile{path: path}
+	assert.NoError(t, rules.Reload(context.Background()))
+
+	req := &socks.Request{CMD: socks.ConnectCommand, Addr: "127.0.0.1:80"}
+	assert.False(t, rules.Allow(context.Background(), req))
+
+	assert.NoError(t, os.WriteFile(path, []byte("default allow\n"), 0o600))
+	assert.NoError(t, rules.Reload(context.Background()))
+	assert.True(t, rules.Allow(context.Background(), req))
+
+	// Invalid rules keep the previous ones.
+	assert.NoError(t, os.WriteFile(path, []byte("maybe\n"), 0o600))
+	assert.Error(t, rules.Reload(context.Background()))
+	assert.True(t, rules.Allow(context.Background(), req))
+}
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	assert.NoError(t, os.WriteFile(path, []byte("default allow\n"), 0o600))
+
+	*addr = "127.0.0.1:0"
+	*rulesFile = path
+	*shutdownTimeout = time.Second
+
+	sigCh := make(chan os.Signal, 2)
+	sigCh <- syscall.SIGHUP
+	sigCh <- syscall.SIGTERM
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- run(context.Background(), golog.NewGoLogger(golog.DEBUG, log.Default()), sigCh)
+	}()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after SIGTERM")
+	}
+}
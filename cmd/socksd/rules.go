@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hupe1980/socks"
+)
+
+// ruleFile is the rule set of a rule file, which is replaced by Reload.
+type ruleFile struct {
+	path string
+
+	mu    sync.RWMutex
+	rules *socks.RuleList
+}
+
+// Reload parses the rule file and replaces the rules. The rules are kept
+// if the file is invalid.
+func (f *ruleFile) Reload(ctx context.Context) error {
+	rules, err := socks.LoadRules(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.rules = rules
+	f.mu.Unlock()
+
+	return nil
+}
+
+func (f *ruleFile) current() *socks.RuleList {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.rules
+}
+
+func (f *ruleFile) Allow(ctx context.Context, req *socks.Request) bool {
+	return f.current().Allow(ctx, req)
+}
+
+func (f *ruleFile) AllowDatagram(ctx context.Context, req *socks.Request, addr string) bool {
+	return f.current().AllowDatagram(ctx, req, addr)
+}
+
+func (f *ruleFile) Denial(ctx context.Context, req *socks.Request) *socks.DenialError {
+	return f.current().Denial(ctx, req)
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "github.com/hupe1980/golog"
+
+// runService reports that socksd does not run as a service.
+func runService(level golog.Level) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,197 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/hupe1980/golog"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "socksd"
+
+var serviceCmd = flag.String("service", "", `"install" or "remove" the Windows service, passing it the other flags`)
+
+// runService installs or removes the service, or runs socksd as the
+// service if the service control manager started it. It reports whether
+// main is done.
+func runService(level golog.Level) (bool, error) {
+	switch *serviceCmd {
+	case "install":
+		return true, installService()
+	case "remove":
+		return true, removeService()
+	case "":
+	default:
+		return true, fmt.Errorf("socksd: unknown service command %q", *serviceCmd)
+	}
+
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return isService, err
+	}
+
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return true, err
+	}
+
+	defer elog.Close()
+
+	return true, svc.Run(serviceName, &service{
+		logger: &eventLogger{log: elog, level: level},
+	})
+}
+
+// service is the control handler of the service. It translates stop and
+// shutdown requests to SIGTERM and parameter changes to SIGHUP, so that
+// the server handles them like the signals on Unix.
+type service struct {
+	logger golog.Logger
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+
+	status <- svc.Status{State: svc.StartPending}
+
+	sigCh := make(chan os.Signal, 8)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- run(context.Background(), s.logger, sigCh)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				s.logger.Printf(golog.ERROR, "Stopped: %v", err)
+				return true, 1
+			}
+
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				sigCh <- syscall.SIGTERM
+			case svc.ParamChange:
+				sigCh <- syscall.SIGHUP
+			}
+		}
+	}
+}
+
+// eventLogger is a golog.Logger writing to the Windows event log.
+type eventLogger struct {
+	log   *eventlog.Log
+	level golog.Level
+}
+
+// eventID is the ID of the events of socksd.
+const eventID = 1
+
+func (l *eventLogger) Print(level golog.Level, v ...interface{}) {
+	l.write(level, fmt.Sprint(v...))
+}
+
+func (l *eventLogger) Println(level golog.Level, v ...interface{}) {
+	l.write(level, fmt.Sprintln(v...))
+}
+
+func (l *eventLogger) Printf(level golog.Level, format string, v ...interface{}) {
+	l.write(level, fmt.Sprintf(format, v...))
+}
+
+func (l *eventLogger) write(level golog.Level, msg string) {
+	if level > l.level {
+		return
+	}
+
+	switch level {
+	case golog.ERROR:
+		_ = l.log.Error(eventID, msg)
+	case golog.WARNING:
+		_ = l.log.Warning(eventID, msg)
+	default:
+		_ = l.log.Info(eventID, msg)
+	}
+}
+
+// installService registers the executable as an automatically started
+// service with the flags given besides -service, and the event source of
+// its log.
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var args []string
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "service" {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+
+	defer m.Disconnect()
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "SOCKS proxy",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		_ = s.Delete()
+		return err
+	}
+
+	return nil
+}
+
+// removeService deletes the service and the event source of its log.
+func removeService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return err
+	}
+
+	return eventlog.Remove(serviceName)
+}
@@ -4,8 +4,12 @@ import (
 	"bufio"
 	"context"
 	"encoding"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Dialer interface {
@@ -16,23 +20,190 @@ type Listener interface {
 	Listen(ctx context.Context, network string, address string) (net.Listener, error)
 }
 
+// Binder opens a socket on a proxy which accepts a single connection,
+// i.e. a BIND request. peerHint is the expected address of the peer.
+// accept waits for the connection of the peer; it gives up and releases
+// the socket when ctx is done.
+type Binder interface {
+	Bind(ctx context.Context, peerHint string) (net.Addr, func(ctx context.Context) (net.Conn, error), error)
+}
+
 type Conn struct {
-	reader *bufio.Reader
-	writer io.Writer
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  io.Writer
+	capture *captureSession
+	session *Session // counts the tunneled bytes, if set
+	stats   *connStats
+	budget  *connReader
+
+	// idleTimeout closes tunnels without data for the duration, if set.
+	idleTimeout time.Duration
+
+	// limiter limits the rate of the tunnel of the session, if set.
+	limiter *RateLimiter
+
+	// credentials limits the username/password requests read, if set.
+	credentials *CredentialLimits
+
+	// handshakeDone is called by endHandshake, if set.
+	handshakeDone func()
+
+	closeOnce sync.Once
+	closed    chan struct{} // closed once the peer closed the connection
 }
 
 func NewConn(conn net.Conn) *Conn {
+	return newBudgetConn(conn, 0)
+}
+
+// newBudgetConn returns a new Conn which fails reads with
+// ErrHandshakeTooLarge once more than budget bytes have been read, until
+// endHandshake is called. If budget is not positive, reads are
+// unlimited.
+func newBudgetConn(conn net.Conn, budget int) *Conn {
+	stats := &connStats{
+		start: time.Now(),
+	}
+
+	r := &connReader{
+		r:         conn,
+		stats:     stats,
+		remaining: -1,
+	}
+
+	if budget > 0 {
+		r.remaining = budget
+	}
+
 	return &Conn{
-		reader: bufio.NewReader(conn),
-		writer: conn,
+		conn:   conn,
+		reader: bufio.NewReader(r),
+		writer: &connWriter{w: conn, stats: stats},
+		stats:  stats,
+		budget: r,
 	}
 }
 
+// endHandshake lifts the read budget of the handshake and records the
+// duration of the negotiation.
+func (c *Conn) endHandshake() {
+	c.budget.remaining = -1
+
+	if c.handshakeDone != nil {
+		c.handshakeDone()
+	}
+
+	atomic.CompareAndSwapInt64(&c.stats.negotiation, 0, int64(time.Since(c.stats.start)))
+}
+
+// ConnStats holds the counters of a Conn.
+type ConnStats struct {
+	// BytesRead and BytesWritten count the bytes read from and written
+	// to the connection, including the handshake and tunneled data.
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// MessagesRead and MessagesWritten count the SOCKS messages.
+	MessagesRead    uint64
+	MessagesWritten uint64
+
+	// Negotiation is the duration of the handshake. It is zero until
+	// the handshake has completed.
+	Negotiation time.Duration
+}
+
+// Stats returns a snapshot of the counters of the connection. It is
+// safe to call while the connection is in use, e.g. during a tunnel.
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{
+		BytesRead:       atomic.LoadUint64(&c.stats.bytesRead),
+		BytesWritten:    atomic.LoadUint64(&c.stats.bytesWritten),
+		MessagesRead:    atomic.LoadUint64(&c.stats.messagesRead),
+		MessagesWritten: atomic.LoadUint64(&c.stats.messagesWritten),
+		Negotiation:     time.Duration(atomic.LoadInt64(&c.stats.negotiation)),
+	}
+}
+
+// LocalAddr returns the local network address of the underlying connection.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address of the underlying connection.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection. Data already buffered by
+// the Conn is returned first by reads from the connection.
+func (c *Conn) NetConn() net.Conn {
+	if c.reader.Buffered() == 0 {
+		return c.conn
+	}
+
+	return &bufferedConn{
+		Conn:   c.conn,
+		reader: c.reader,
+	}
+}
+
+// ForwardEarlyData writes the data the client pipelined after the
+// request, as far as it is already buffered, to the target without
+// waiting for the tunnel, e.g. as soon as the target is connected and
+// before the reply is written.
+func (c *Conn) ForwardEarlyData(target net.Conn) error {
+	n := c.reader.Buffered()
+	if n == 0 {
+		return nil
+	}
+
+	if c.capture != nil {
+		target = c.capture.wrap(c.conn.RemoteAddr(), target)
+	}
+
+	b, _ := c.reader.Peek(n)
+	if _, err := target.Write(b); err != nil {
+		return err
+	}
+
+	_, _ = c.reader.Discard(n)
+
+	if c.session != nil {
+		atomic.AddUint64(&c.session.bytesIn, uint64(n))
+	}
+
+	return nil
+}
+
+// countingConn returns the underlying connection like NetConn whose
+// writes are counted by the Conn.
+func (c *Conn) countingConn() net.Conn {
+	return &writerConn{Conn: c.NetConn(), writer: c.writer}
+}
+
 func (c *Conn) Peek(n int) ([]byte, error) {
 	return c.reader.Peek(n)
 }
 
+// Read reads the next message into req. The messages of this package
+// are decoded from the stream, so bytes following the message stay
+// unread.
 func (c *Conn) Read(req encoding.BinaryUnmarshaler) error {
+	if d, ok := req.(messageDecoder); ok {
+		if err := d.decode(c.reader); err != nil {
+			return err
+		}
+
+		atomic.AddUint64(&c.stats.messagesRead, 1)
+
+		if authReq, ok := req.(*UsernamePasswordAuthRequest); ok && c.credentials != nil {
+			return c.credentials.check(authReq)
+		}
+
+		return nil
+	}
+
 	buff := make([]byte, 1024)
 
 	n, err := c.reader.Read(buff)
@@ -44,9 +215,45 @@ func (c *Conn) Read(req encoding.BinaryUnmarshaler) error {
 		return err
 	}
 
+	atomic.AddUint64(&c.stats.messagesRead, 1)
+
 	return nil
 }
 
+// PeekMessage decodes the next message into m without consuming it, so
+// the connection can be inspected and handed over with all bytes
+// intact. m must be a message of this package.
+func (c *Conn) PeekMessage(m encoding.BinaryUnmarshaler) error {
+	d, ok := m.(messageDecoder)
+	if !ok {
+		return fmt.Errorf("socks: cannot peek message of type %T", m)
+	}
+
+	n := c.reader.Buffered()
+	if n == 0 {
+		n = 1
+	}
+
+	for {
+		b, err := c.reader.Peek(n)
+		if len(b) > 0 {
+			if derr := d.decode(&peekBuffer{b: b}); derr != errShortMessage {
+				return derr
+			}
+		}
+
+		if err != nil {
+			if err == io.EOF && len(b) > 0 {
+				return io.ErrUnexpectedEOF
+			}
+
+			return err
+		}
+
+		n = c.reader.Buffered() + 1
+	}
+}
+
 func (c *Conn) Write(resp encoding.BinaryMarshaler) error {
 	b, err := resp.MarshalBinary()
 	if err != nil {
@@ -57,41 +264,197 @@ func (c *Conn) Write(resp encoding.BinaryMarshaler) error {
 		return err
 	}
 
+	atomic.AddUint64(&c.stats.messagesWritten, 1)
+
 	return nil
 }
 
 func (c *Conn) Tunnel(target net.Conn) error {
-	errCh := make(chan error, 2)
+	if c.capture != nil {
+		target = c.capture.wrap(c.conn.RemoteAddr(), target)
+	}
+
+	var in, out *uint64
+	if c.session != nil {
+		in, out = &c.session.bytesIn, &c.session.bytesOut
+	}
 
-	go proxy(target, c.reader, errCh)
-	go proxy(c.writer, target, errCh)
+	var fromClient, fromTarget io.Reader = c.reader, target
 
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			return e
-		}
+	if c.limiter != nil && c.session != nil {
+		bucket, release := c.limiter.acquire(c.session)
+		defer release()
+
+		fromClient = &rateLimitedReader{r: fromClient, bucket: bucket}
+		fromTarget = &rateLimitedReader{r: fromTarget, bucket: bucket}
 	}
 
-	return nil
+	if c.idleTimeout > 0 {
+		idle := newIdleWatch(c.idleTimeout)
+		defer idle.stop()
+
+		fromClient, fromTarget = idle.reader(fromClient), idle.reader(fromTarget)
+
+		go idle.watch(func() {
+			if c.session != nil {
+				c.session.setCloseReason(CloseReasonIdleTimeout)
+			}
+
+			_ = c.conn.Close()
+			_ = target.Close()
+		})
+	}
+
+	endCh := make(chan tunnelEnd, 2)
+
+	go proxy(target, fromClient, in, true, endCh)
+	go proxy(c.writer, fromTarget, out, false, endCh)
+
+	first := <-endCh
+	if c.session != nil {
+		c.session.setCloseReason(first.reason())
+	}
+
+	// A failed direction ends the tunnel, e.g. of a session closed by
+	// Server.Close, even if the other peer ignores the half-close.
+	if first.err != nil {
+		_ = c.conn.Close()
+		_ = target.Close()
+	}
+
+	second := <-endCh
+
+	if first.err != nil {
+		return first.err
+	}
+
+	return second.err
 }
 
-func (c Conn) WaitForClose() {
-	buf := make([]byte, 1)
+// CloseNotify returns a channel which is closed once the peer closes the
+// connection or reading from it fails, e.g. to end a UDP association
+// with its control connection. The first call starts a goroutine which
+// reads and discards all further data of the connection; the Conn must
+// not be read otherwise afterwards.
+func (c *Conn) CloseNotify() <-chan struct{} {
+	c.closeOnce.Do(func() {
+		c.closed = make(chan struct{})
 
-	for {
-		if _, err := c.reader.Read(buf[:]); err == io.EOF {
-			break
-		}
+		go func() {
+			defer close(c.closed)
+
+			_, _ = io.Copy(io.Discard, c.reader)
+		}()
+	})
+
+	return c.closed
+}
+
+// WaitForClose blocks until the peer closes the connection, see
+// CloseNotify.
+func (c *Conn) WaitForClose() {
+	<-c.CloseNotify()
+}
+
+func proxy(dst io.Writer, src io.Reader, counter *uint64, toTarget bool, endCh chan tunnelEnd) {
+	n, err := io.Copy(dst, src)
+
+	if counter != nil {
+		atomic.AddUint64(counter, uint64(n))
 	}
+
+	if cw, ok := dst.(closeWriter); ok {
+		_ = cw.CloseWrite()
+	}
+
+	endCh <- tunnelEnd{toTarget: toTarget, err: err}
+}
+
+// messageDecoder is implemented by the messages of this package.
+type messageDecoder interface {
+	decode(r messageReader) error
+}
+
+// closeWriter is implemented by connections which can shut down the
+// writing side, e.g. *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// connStats holds the counters of a Conn, accessed atomically.
+type connStats struct {
+	bytesRead       uint64
+	bytesWritten    uint64
+	messagesRead    uint64
+	messagesWritten uint64
+	negotiation     int64
+	start           time.Time
+}
+
+// connReader counts the bytes read from r and limits them to remaining.
+// A negative remaining means no limit.
+type connReader struct {
+	r         io.Reader
+	stats     *connStats
+	remaining int
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	if cr.remaining == 0 {
+		return 0, ErrHandshakeTooLarge
+	}
+
+	if cr.remaining > 0 && len(p) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+
+	n, err := cr.r.Read(p)
+
+	if cr.remaining > 0 {
+		cr.remaining -= n
+	}
+
+	atomic.AddUint64(&cr.stats.bytesRead, uint64(n))
+
+	return n, err
+}
+
+// connWriter counts the bytes written to w.
+type connWriter struct {
+	w     io.Writer
+	stats *connStats
 }
 
-func proxy(dst io.Writer, src io.Reader, errCh chan error) {
-	_, err := io.Copy(dst, src)
+func (cw *connWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddUint64(&cw.stats.bytesWritten, uint64(n))
 
-	if tcpConn, ok := dst.(*net.TCPConn); ok {
-		_ = tcpConn.CloseWrite()
+	return n, err
+}
+
+func (cw *connWriter) CloseWrite() error {
+	if c, ok := cw.w.(closeWriter); ok {
+		return c.CloseWrite()
 	}
 
-	errCh <- err
+	return nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// writerConn is a net.Conn whose writes go to writer.
+type writerConn struct {
+	net.Conn
+	writer io.Writer
+}
+
+func (c *writerConn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
 }
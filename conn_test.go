@@ -0,0 +1,106 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnStats(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	stats := make(chan ConnStats, 1)
+
+	server := New(func(o *Options) {
+		o.Handler = RequestHandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+			stats <- conn.Stats()
+
+			return conn.Write(&Socks5Response{
+				Status: Socks5StatusNotAllowed,
+			})
+		})
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	_, err = NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", "127.0.0.1:80")
+	assert.Error(t, err)
+
+	s := <-stats
+	assert.Equal(t, uint64(3+10), s.BytesRead) // method selection and request
+	assert.Equal(t, uint64(2), s.BytesWritten)
+	assert.Equal(t, uint64(2), s.MessagesRead)
+	assert.Equal(t, uint64(1), s.MessagesWritten)
+	assert.Greater(t, s.Negotiation, time.Duration(0))
+}
+
+func TestForwardEarlyData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		b := marshalAll(t, &Socks5Request{CMD: ConnectCommand, Addr: "example.com:80"})
+		_, _ = client.Write(append(b, "GET / HTTP/1.0\r\n\r\n"...))
+	}()
+
+	conn := NewConn(server)
+	conn.session = newSession(client.LocalAddr())
+
+	assert.NoError(t, conn.Read(&Socks5Request{}))
+
+	target, peer := net.Pipe()
+	defer target.Close()
+
+	received := make(chan string, 1)
+
+	go func() {
+		b := make([]byte, 64)
+		n, _ := peer.Read(b)
+		received <- string(b[:n])
+	}()
+
+	assert.NoError(t, conn.ForwardEarlyData(target))
+	assert.Equal(t, "GET / HTTP/1.0\r\n\r\n", <-received)
+	assert.Equal(t, 0, conn.reader.Buffered())
+	assert.Equal(t, uint64(18), conn.session.BytesIn())
+
+	// Nothing left to forward.
+	assert.NoError(t, conn.ForwardEarlyData(target))
+}
+
+func TestCloseNotify(t *testing.T) {
+	client, server := net.Pipe()
+
+	conn := NewConn(server)
+
+	closed := conn.CloseNotify()
+	assert.Equal(t, closed, conn.CloseNotify())
+
+	// Data is discarded.
+	_, err := client.Write([]byte("ignored"))
+	assert.NoError(t, err)
+
+	select {
+	case <-closed:
+		t.Fatal("closed before the peer closed the connection")
+	default:
+	}
+
+	_ = client.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("not closed after the peer closed the connection")
+	}
+
+	conn.WaitForClose()
+}
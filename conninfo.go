@@ -0,0 +1,51 @@
+package socks
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// ConnInfo describes the accepted connection of a session. It is stored
+// in the context of the session, e.g. for an AuthenticateFunc or an
+// IdentFunc to pin credentials to client addresses or to implement a
+// realm per listener.
+type ConnInfo struct {
+	// ClientAddr is the remote address of the connection.
+	ClientAddr net.Addr
+
+	// LocalAddr is the local address of the connection.
+	LocalAddr net.Addr
+
+	// ListenerAddr is the address of the listener which accepted the
+	// connection. Connections of ServeConns have the address "chan".
+	ListenerAddr net.Addr
+
+	conn net.Conn
+}
+
+// TLS returns the state of the connection if it was accepted by a TLS
+// listener, e.g. of tls.NewListener. The handshake is complete once the
+// server has read from the connection, i.e. before the authentication.
+func (ci *ConnInfo) TLS() (*tls.ConnectionState, bool) {
+	tlsConn, ok := ci.conn.(*tls.Conn)
+	if !ok {
+		return nil, false
+	}
+
+	state := tlsConn.ConnectionState()
+
+	return &state, true
+}
+
+type connInfoKey struct{}
+
+func withConnInfo(ctx context.Context, ci *ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, ci)
+}
+
+// ConnInfoFromContext returns the ConnInfo of the session of ctx, if any.
+func ConnInfoFromContext(ctx context.Context) (*ConnInfo, bool) {
+	ci, ok := ctx.Value(connInfoKey{}).(*ConnInfo)
+	return ci, ok
+}
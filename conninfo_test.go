@@ -0,0 +1,81 @@
+package socks
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnInfo(t *testing.T) {
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certServer.Close()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	tlsListen := tls.NewListener(listen, &tls.Config{
+		Certificates: certServer.TLS.Certificates,
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	defer tlsListen.Close()
+
+	infos := make(chan *ConnInfo, 1)
+	states := make(chan *tls.ConnectionState, 1)
+
+	server := New(func(o *Options) {
+		o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		o.Authenticate = func(ctx context.Context, conn *Conn, am AuthMethod) error {
+			ci, ok := ConnInfoFromContext(ctx)
+			assert.True(t, ok)
+
+			infos <- ci
+
+			state, ok := ci.TLS()
+			assert.True(t, ok)
+
+			states <- state
+
+			return userPassServerAuthenticateFuncGen("user", "pass")(ctx, conn, am)
+		}
+	})
+
+	go func() {
+		_ = server.Serve(tlsListen)
+	}()
+
+	config := certServer.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.ServerName = "127.0.0.1"
+
+	dialer := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+		o.ProxyDialer = &tlsDialer{forward: &net.Dialer{}, config: config}
+		o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		o.Authenticate = userPassDialerAuthenticateFuncGen("user", "pass")
+	})
+
+	conn, err := dialer.Dial("tcp", testServer.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	_ = conn.Close()
+
+	ci := <-infos
+	assert.Equal(t, listen.Addr().String(), ci.ListenerAddr.String())
+	assert.Equal(t, listen.Addr().String(), ci.LocalAddr.String())
+	assert.Equal(t, "127.0.0.1", addrIP(ci.ClientAddr).String())
+
+	state := <-states
+	assert.True(t, state.HandshakeComplete)
+	assert.NotZero(t, state.Version)
+
+	t.Run("plain", func(t *testing.T) {
+		c, _ := net.Pipe()
+
+		_, ok := (&ConnInfo{conn: c}).TLS()
+		assert.False(t, ok)
+	})
+}
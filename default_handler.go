@@ -0,0 +1,777 @@
+package socks
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hupe1980/golog"
+)
+
+// Socks4IPv6Policy defines how the default handler replies to SOCKS4
+// BIND requests whose BND.ADDR is an IPv6 address, e.g. of a listener on
+// an IPv6 address or an IPv6 PublicIP. SOCKS4 replies only carry IPv4
+// addresses; the unspecified address "::" is replied as 0.0.0.0 by both
+// policies.
+type Socks4IPv6Policy int
+
+const (
+	// Socks4IPv6Reject rejects the request with Socks4StatusRejected and
+	// fails it with ErrSocks4IPv6.
+	Socks4IPv6Reject Socks4IPv6Policy = iota
+
+	// Socks4IPv6ProxyAddr replies 0.0.0.0 with the port of the listener,
+	// by which the client connects to the address of the proxy instead,
+	// e.g. for listeners on both address families.
+	Socks4IPv6ProxyAddr
+)
+
+type DefaultHandlerOptions struct {
+	// Logger specifies an optional logger.
+	// If nil, logging is done via the log package's standard logger.
+	Logger golog.Logger
+
+	// Dialer specifies the dialer for CONNECT requests.
+	Dialer Dialer
+
+	// Listener specifies the listener for BIND requests.
+	Listener Listener
+
+	// UDP specifies the options of the UDP relay for ASSOCIATE
+	// requests.
+	UDP UDPOptions
+
+	// PublicIP specifies the optional IP address advertised in BIND
+	// and ASSOCIATE replies instead of the local address, e.g. when
+	// the server runs behind a NAT.
+	PublicIP net.IP
+
+	// ReplyTargetAddr specifies whether the SOCKS5 CONNECT reply
+	// carries the address of the target, e.g. the IP address a FQDN
+	// destination resolved to, in BND.ADDR and BND.PORT instead of the
+	// local address of the connection to the target. This deviates
+	// from RFC 1928 and is meant for tracing with clients aware of it.
+	ReplyTargetAddr bool
+
+	// OptimisticReply specifies whether CONNECT requests are granted
+	// before the target is dialed, saving a round trip on high latency
+	// links. The data the client sends early is tunneled once the dial
+	// completes. This deviates from RFC 1928: BND.ADDR is unspecified
+	// and a failed dial closes the connection without an error reply.
+	OptimisticReply bool
+
+	// UnixSockets specifies the paths of the Unix domain sockets which
+	// CONNECT requests may reach with a FQDN destination of the form
+	// "unix:<path>", see UnixSocketAddr. If empty, such destinations
+	// are dialed as TCP hosts.
+	UnixSockets []string
+
+	// BindPeerValidator specifies the optional validation of the peer
+	// connecting to the listener of a BIND request.
+	// If nil, MatchBindPeerIP is used.
+	BindPeerValidator BindPeerValidator
+
+	// Socks4EchoRejectedAddr specifies whether SOCKS4 rejection replies
+	// carry DSTPORT and DSTIP of the request instead of zeros, see
+	// NewSocks4Rejection.
+	Socks4EchoRejectedAddr bool
+
+	// Socks4IPv6 specifies the reply to SOCKS4 BIND requests whose
+	// BND.ADDR is an IPv6 address.
+	Socks4IPv6 Socks4IPv6Policy
+
+	// EgressMark specifies the optional socket mark of the connections
+	// to the targets of CONNECT requests, see EgressMarkFunc. Dialer
+	// must be a *net.Dialer.
+	EgressMark EgressMarkFunc
+
+	// MaxBinds specifies the number of BIND requests which may wait for
+	// their peer at the same time. Further BIND requests are rejected,
+	// so that clients cannot exhaust the ephemeral ports. If zero, the
+	// number is not limited.
+	MaxBinds int
+
+	// BindTimeout specifies how long a BIND request waits for its peer,
+	// so that abandoned requests release their listener. If zero, there
+	// is no timeout.
+	BindTimeout time.Duration
+
+	// Ports specifies the optional allocator of the ports of the
+	// listeners of BIND requests and of the sockets the UDP relay
+	// receives the datagrams of the client on. If nil, the system
+	// assigns ephemeral ports.
+	Ports PortAllocator
+}
+
+// DefaultHandler is the RequestHandler used by the Server unless
+// Options.Handler is set. It dials CONNECT targets and accepts BIND
+// peers. It can be wrapped or embedded by custom handlers.
+type DefaultHandler struct {
+	*logger
+	dialer            Dialer
+	listener          Listener
+	udp               UDPOptions
+	publicIP          net.IP
+	replyTargetAddr   bool
+	optimisticReply   bool
+	unixSockets       map[string]struct{}
+	bindPeerValidator BindPeerValidator
+	socks4EchoAddr    bool
+	socks4IPv6        Socks4IPv6Policy
+	egressMark        EgressMarkFunc
+	binds             chan struct{} // semaphore of MaxBinds, if set
+	bindTimeout       time.Duration
+	ports             PortAllocator
+}
+
+// NewDefaultHandler returns a new DefaultHandler.
+func NewDefaultHandler(optFns ...func(*DefaultHandlerOptions)) *DefaultHandler {
+	options := DefaultHandlerOptions{
+		Logger:   golog.NewGoLogger(golog.INFO, log.Default()),
+		Dialer:   &net.Dialer{},
+		Listener: &net.ListenConfig{},
+	}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	bindPeerValidator := options.BindPeerValidator
+	if bindPeerValidator == nil {
+		bindPeerValidator = MatchBindPeerIP()
+	}
+
+	unixSockets := make(map[string]struct{}, len(options.UnixSockets))
+	for _, path := range options.UnixSockets {
+		unixSockets[path] = struct{}{}
+	}
+
+	var binds chan struct{}
+	if options.MaxBinds > 0 {
+		binds = make(chan struct{}, options.MaxBinds)
+	}
+
+	return &DefaultHandler{
+		logger:            &logger{options.Logger},
+		dialer:            options.Dialer,
+		listener:          options.Listener,
+		udp:               options.UDP,
+		publicIP:          options.PublicIP,
+		replyTargetAddr:   options.ReplyTargetAddr,
+		optimisticReply:   options.OptimisticReply,
+		unixSockets:       unixSockets,
+		bindPeerValidator: bindPeerValidator,
+		socks4EchoAddr:    options.Socks4EchoRejectedAddr,
+		socks4IPv6:        options.Socks4IPv6,
+		egressMark:        options.EgressMark,
+		binds:             binds,
+		bindTimeout:       options.BindTimeout,
+		ports:             options.Ports,
+	}
+}
+
+// ServeSOCKS dispatches the request by version and command.
+func (h *DefaultHandler) ServeSOCKS(ctx context.Context, conn *Conn, req *Request) error {
+	switch req.Version {
+	case Socks4Version:
+		return h.serveSocks4(ctx, conn, req)
+	case Socks5Version:
+		return h.serveSocks5(ctx, conn, req)
+	default:
+		return fmt.Errorf("unsupported socks version: %d", req.Version)
+	}
+}
+
+func (h *DefaultHandler) serveSocks4(ctx context.Context, conn *Conn, req *Request) error {
+	switch req.CMD {
+	case ConnectCommand:
+		return h.socks4Connect(ctx, conn, req)
+	case BindCommand:
+		return h.socks4Bind(ctx, conn, req)
+	case AssociateCommand:
+		fallthrough
+	default:
+		if err := conn.Write(NewSocks4Rejection(req, h.socks4EchoAddr)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *DefaultHandler) socks4Connect(ctx context.Context, conn *Conn, req *Request) error {
+	if h.optimisticReply {
+		return h.optimisticConnect(ctx, conn, req, &Socks4Response{
+			Status: Socks4StatusGranted,
+		})
+	}
+
+	target, err := h.dial(ctx, req.Addr)
+	if err != nil {
+		writeErr := conn.Write(NewSocks4Rejection(req, h.socks4EchoAddr))
+		if writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	defer func() {
+		_ = target.Close()
+	}()
+
+	h.connected(ctx, req, target)
+
+	if err := h.forwardEarlyData(ctx, conn, target); err != nil {
+		return err
+	}
+
+	if err := conn.Write(&Socks4Response{
+		Status: Socks4StatusGranted,
+		Addr:   "",
+	}); err != nil {
+		return err
+	}
+
+	return tunnel(ctx, conn, req, target)
+}
+
+// optimisticConnect writes the granted reply before it dials the target.
+// The early data of the client waits in the connection until the tunnel
+// starts.
+func (h *DefaultHandler) optimisticConnect(ctx context.Context, conn *Conn, req *Request, reply encoding.BinaryMarshaler) error {
+	if err := conn.Write(reply); err != nil {
+		return err
+	}
+
+	target, err := h.dial(ctx, req.Addr)
+	if err != nil {
+		h.fromContext(ctx).logErrorf("Connect to %v failed: %v", req.Addr, err)
+		return err
+	}
+
+	defer func() {
+		_ = target.Close()
+	}()
+
+	h.connected(ctx, req, target)
+
+	return tunnel(ctx, conn, req, target)
+}
+
+// forwardEarlyData forwards the pipelined data of the client unless
+// Hooks.OnEstablished may write to the target first.
+func (h *DefaultHandler) forwardEarlyData(ctx context.Context, conn *Conn, target net.Conn) error {
+	if hooks := hooksFromContext(ctx); hooks != nil && hooks.OnEstablished != nil {
+		return nil
+	}
+
+	return conn.ForwardEarlyData(target)
+}
+
+// dial connects to the destination of a CONNECT request.
+func (h *DefaultHandler) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if path, ok := unixSocketPath(addr); ok && len(h.unixSockets) > 0 {
+		if _, allowed := h.unixSockets[path]; !allowed {
+			return nil, fmt.Errorf("socks: unix socket %s not allowed", path)
+		}
+
+		return h.dialer.DialContext(ctx, "unix", path)
+	}
+
+	dialer, err := h.markedDialer(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if p := dnsPrefetchFromContext(ctx, addr); p != nil {
+		return p.dial(ctx, dialer)
+	}
+
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// markedDialer returns the dialer marking the sockets with the
+// EgressMark of the session, if any.
+func (h *DefaultHandler) markedDialer(ctx context.Context) (Dialer, error) {
+	if h.egressMark == nil {
+		return h.dialer, nil
+	}
+
+	session, ok := SessionFromContext(ctx)
+	if !ok {
+		return h.dialer, nil
+	}
+
+	mark := h.egressMark(session)
+	if mark == 0 {
+		return h.dialer, nil
+	}
+
+	dialer, err := markDialer(h.dialer, mark)
+	if err != nil {
+		return nil, err
+	}
+
+	session.Annotate(EgressMarkAnnotation, fmt.Sprintf("%#x", mark))
+
+	return dialer, nil
+}
+
+// connected records the address of the target in the session.
+func (h *DefaultHandler) connected(ctx context.Context, req *Request, target net.Conn) {
+	targetAddr := target.RemoteAddr().String()
+
+	if session, ok := SessionFromContext(ctx); ok {
+		session.SetTargetAddr(targetAddr)
+		eventsFromContext(ctx).emit(EventSessionConnected, session, nil)
+	}
+
+	h.fromContext(ctx).logDebugf("Connected to %s (%s)", req.Addr, targetAddr)
+}
+
+// tunnel passes the connections to Hooks.OnEstablished and relays them.
+func tunnel(ctx context.Context, conn *Conn, req *Request, target net.Conn) error {
+	hooks := hooksFromContext(ctx)
+	if hooks != nil && hooks.OnEstablished != nil {
+		session, _ := SessionFromContext(ctx)
+
+		if err := hooks.established(ctx, &EstablishedEvent{
+			Session: session,
+			Request: req,
+			Client:  conn.countingConn(),
+			Target:  target,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return conn.Tunnel(target)
+}
+
+func (h *DefaultHandler) socks4Bind(ctx context.Context, conn *Conn, req *Request) error {
+	listener, release, err := h.listenBind(ctx) // use a free port
+	if err != nil {
+		writeErr := conn.Write(NewSocks4Rejection(req, h.socks4EchoAddr))
+		if writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	defer release()
+
+	bndAddr, err := h.socks4BindAddr(listener.Addr())
+	if err != nil {
+		writeErr := conn.Write(NewSocks4Rejection(req, h.socks4EchoAddr))
+		if writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	if err = conn.Write(&Socks4Response{
+		Status: Socks4StatusGranted,
+		Addr:   bndAddr,
+	}); err != nil {
+		return err
+	}
+
+	// The SOCKS server checks the IP address of the originating host against
+	// the value of DSTIP specified in the client's BIND request.
+	peer, err := h.awaitBindPeer(ctx, req, listener, release)
+	if err != nil {
+		writeErr := conn.Write(NewSocks4Rejection(req, h.socks4EchoAddr))
+		if writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	// The SOCKS server sends a second reply packet to the client when the
+	// anticipated connection from the application server is established.
+	if err := conn.Write(&Socks4Response{
+		Status: Socks4StatusGranted,
+		Addr:   "",
+	}); err != nil {
+		return err
+	}
+
+	return tunnel(ctx, conn, req, peer)
+}
+
+// listenBind opens the listener of a BIND request within MaxBinds. The
+// returned function closes the listener and releases the slot; it may
+// be called more than once.
+func (h *DefaultHandler) listenBind(ctx context.Context) (net.Listener, func(), error) {
+	m := metricsFromContext(ctx)
+
+	if h.binds != nil {
+		select {
+		case h.binds <- struct{}{}:
+		default:
+			m.bindRejected()
+			return nil, nil, ErrTooManyBinds
+		}
+	}
+
+	listener, err := listenPort(ctx, h.ports, h.listener, "tcp", "")
+	if err != nil {
+		if h.binds != nil {
+			<-h.binds
+		}
+
+		m.bindDone(false, 0)
+
+		return nil, nil, err
+	}
+
+	m.bindPending(1)
+
+	var once sync.Once
+
+	return listener, func() {
+		once.Do(func() {
+			_ = listener.Close()
+
+			m.bindPending(-1)
+
+			if h.binds != nil {
+				<-h.binds
+			}
+		})
+	}, nil
+}
+
+// awaitBindPeer accepts and validates the peer of a BIND request, then
+// releases the listener. It records the wait in the metrics.
+func (h *DefaultHandler) awaitBindPeer(ctx context.Context, req *Request, listener net.Listener, release func()) (net.Conn, error) {
+	start := time.Now()
+
+	if h.bindTimeout > 0 {
+		timer := time.AfterFunc(h.bindTimeout, release)
+		defer timer.Stop()
+	}
+
+	peer, err := listener.Accept()
+
+	release()
+
+	if err == nil {
+		if err = h.bindPeerValidator(ctx, req, peer.RemoteAddr()); err != nil {
+			_ = peer.Close()
+		}
+	}
+
+	metricsFromContext(ctx).bindDone(err == nil, time.Since(start))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return peer, nil
+}
+
+func (h *DefaultHandler) serveSocks5(ctx context.Context, conn *Conn, req *Request) error {
+	if req.CMD == AssociateCommand || (req.CMD == UDPOverTCPCommand && h.udp.OverTCP) {
+		if err := h.authorizeUDP(ctx, req); err != nil {
+			return err
+		}
+	}
+
+	if req.CMD == UDPOverTCPCommand && h.udp.OverTCP {
+		return h.socks5UDPOverTCP(ctx, conn, req)
+	}
+
+	switch req.CMD {
+	case ConnectCommand:
+		return h.socks5Connect(ctx, conn, req)
+	case BindCommand:
+		return h.socks5Bind(ctx, conn, req)
+	case AssociateCommand:
+		return h.socks5Associate(ctx, conn, req)
+	default:
+		if err := conn.Write(&Socks5Response{
+			Status: Socks5StatusCMDNotSupported,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// authorizeUDP returns a *DenialError, which the server replies, if
+// UDPOptions.Disabled rejects the UDP association of req.
+func (h *DefaultHandler) authorizeUDP(ctx context.Context, req *Request) error {
+	if !h.udp.Disabled {
+		return nil
+	}
+
+	var err error = &DenialError{Socks5Status: Socks5StatusCMDNotSupported, Err: ErrUDPDisabled}
+
+	if h.udp.Authorize != nil {
+		if err = h.udp.Authorize(ctx, req); err == nil {
+			return nil
+		}
+
+		var denial *DenialError
+		if !errors.As(err, &denial) {
+			err = &DenialError{Socks5Status: Socks5StatusCMDNotSupported, Err: err}
+		}
+	}
+
+	session, _ := SessionFromContext(ctx)
+
+	metricsFromContext(ctx).udpRejected()
+	hooksFromContext(ctx).udpRejected(ctx, &UDPRejectedEvent{
+		Session: session,
+		Request: req,
+		Err:     err,
+	})
+
+	return err
+}
+
+func (h *DefaultHandler) socks5Connect(ctx context.Context, conn *Conn, req *Request) error {
+	if h.optimisticReply {
+		return h.optimisticConnect(ctx, conn, req, &Socks5Response{
+			Status: Socks5StatusGranted,
+			Addr:   "0.0.0.0:0",
+		})
+	}
+
+	target, err := h.dial(ctx, req.Addr)
+	if err != nil {
+		msg := err.Error()
+		status := Socks5StatusHostUnreachable
+
+		if strings.Contains(msg, "refused") {
+			status = Socks5StatusConnectionRefused
+		} else if strings.Contains(msg, "network is unreachable") {
+			status = Socks5StatusNetworkUnreaachable
+		}
+
+		writeErr := conn.Write(&Socks5Response{
+			Status: status,
+		})
+		if writeErr != nil {
+			return writeErr
+		}
+
+		h.fromContext(ctx).logErrorf("Connect to %v failed: %v", req.Addr, err)
+
+		return err
+	}
+
+	defer func() {
+		_ = target.Close()
+	}()
+
+	h.connected(ctx, req, target)
+
+	if err := h.forwardEarlyData(ctx, conn, target); err != nil {
+		return err
+	}
+
+	// In the reply to a CONNECT, BND.PORT contains the port number that the
+	// server assigned to connect to the target host, while BND.ADDR
+	// contains the associated IP address.
+	bndAddr := target.LocalAddr().String()
+	if h.replyTargetAddr {
+		bndAddr = target.RemoteAddr().String()
+	}
+
+	if target.LocalAddr().Network() == "unix" {
+		bndAddr = "0.0.0.0:0"
+	}
+
+	if err := conn.Write(&Socks5Response{
+		Status: Socks5StatusGranted,
+		Addr:   bndAddr,
+	}); err != nil {
+		return err
+	}
+
+	return tunnel(ctx, conn, req, target)
+}
+
+func (h *DefaultHandler) socks5Bind(ctx context.Context, conn *Conn, req *Request) error {
+	listener, release, err := h.listenBind(ctx)
+	if err != nil {
+		writeErr := conn.Write(&Socks5Response{
+			Status: Socks5StatusFailure,
+		})
+		if writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	defer release()
+
+	if err = conn.Write(&Socks5Response{
+		Status: Socks5StatusGranted,
+		Addr:   h.advertisedAddr(listener.Addr(), nil),
+	}); err != nil {
+		return err
+	}
+
+	peer, err := h.awaitBindPeer(ctx, req, listener, release)
+	if err != nil {
+		writeErr := conn.Write(&Socks5Response{
+			Status: Socks5StatusFailure,
+		})
+		if writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	if err := conn.Write(&Socks5Response{
+		Status: Socks5StatusGranted,
+		Addr:   peer.RemoteAddr().String(),
+	}); err != nil {
+		return err
+	}
+
+	return tunnel(ctx, conn, req, peer)
+}
+
+func (h *DefaultHandler) socks5Associate(ctx context.Context, conn *Conn, req *Request) error {
+	relay, err := newUDPRelay(ctx, conn, req, h.udp, h.ports, h.logger)
+	if err != nil {
+		writeErr := conn.Write(&Socks5Response{
+			Status: Socks5StatusFailure,
+		})
+		if writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	defer func() {
+		_ = relay.Close()
+	}()
+
+	if err = conn.Write(&Socks5Response{
+		Status: Socks5StatusGranted,
+		Addr:   h.advertisedAddr(relay.LocalAddr(), h.udp.MapPort),
+	}); err != nil {
+		return err
+	}
+
+	if err := setKeepAlivePeriod(conn.conn, h.udp.ControlKeepAlive); err != nil {
+		h.fromContext(ctx).logDebugf("Failed to set keep-alive of UDP control connection: %v", err)
+	}
+
+	// A UDP association terminates when the TCP connection that the UDP
+	// ASSOCIATE request arrived on terminates.
+	go func() {
+		<-conn.CloseNotify()
+
+		_ = relay.Close()
+	}()
+
+	return relay.Serve()
+}
+
+// socks5UDPOverTCP serves a UDPOverTCPCommand request. The association
+// ends when the client closes the connection.
+func (h *DefaultHandler) socks5UDPOverTCP(ctx context.Context, conn *Conn, req *Request) error {
+	relay, err := newStreamUDPRelay(ctx, conn, req, h.udp, h.logger)
+	if err != nil {
+		writeErr := conn.Write(&Socks5Response{
+			Status: Socks5StatusFailure,
+		})
+		if writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	defer func() {
+		_ = relay.Close()
+	}()
+
+	if err = conn.Write(&Socks5Response{
+		Status: Socks5StatusGranted,
+		Addr:   "0.0.0.0:0",
+	}); err != nil {
+		return err
+	}
+
+	return relay.Serve()
+}
+
+// advertisedAddr returns the address announced to the client for a
+// local address, applying the public IP and the port mapping.
+func (h *DefaultHandler) advertisedAddr(addr net.Addr, mapPort func(port int) int) string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	if h.publicIP != nil {
+		host = h.publicIP.String()
+	}
+
+	if mapPort != nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			port = strconv.Itoa(mapPort(p))
+		}
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// socks4BindAddr returns the advertised address of the listener of a
+// SOCKS4 BIND request according to the Socks4IPv6Policy.
+func (h *DefaultHandler) socks4BindAddr(addr net.Addr) (string, error) {
+	bndAddr := h.advertisedAddr(addr, nil)
+
+	host, port, err := net.SplitHostPort(bndAddr)
+	if err != nil || !isIPv6(host) {
+		return bndAddr, nil
+	}
+
+	if h.socks4IPv6 == Socks4IPv6ProxyAddr {
+		return net.JoinHostPort(net.IPv4zero.String(), port), nil
+	}
+
+	return "", ErrSocks4IPv6
+}
+
+const unixSocketPrefix = "unix:"
+
+// UnixSocketAddr returns the destination address of the Unix domain
+// socket at path for a CONNECT request to a server configured with
+// DefaultHandlerOptions.UnixSockets.
+func UnixSocketAddr(path string) string {
+	return net.JoinHostPort(unixSocketPrefix+path, "0")
+}
+
+// unixSocketPath returns the path of a destination returned by
+// UnixSocketAddr.
+func unixSocketPath(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || !strings.HasPrefix(host, unixSocketPrefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(host, unixSocketPrefix), true
+}
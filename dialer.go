@@ -2,14 +2,42 @@ package socks
 
 import (
 	"context"
-	"errors"
-	"fmt"
 	"log"
 	"net"
+	"time"
 
 	"github.com/hupe1980/golog"
 )
 
+// IPv6ZonePolicy defines how a dialer handles target addresses with an
+// IPv6 zone identifier, e.g. "[fe80::1%eth0]:80".
+type IPv6ZonePolicy int
+
+const (
+	// IPv6ZoneReject fails the dial with a *ZoneError.
+	IPv6ZoneReject IPv6ZonePolicy = iota
+
+	// IPv6ZoneStrip removes the zone and sends the bare address.
+	IPv6ZoneStrip
+
+	// IPv6ZoneDirect dials the target with the ProxyDialer instead of
+	// through the proxy, as a zone is only meaningful on the local host.
+	IPv6ZoneDirect
+)
+
+// IPLiteralPolicy defines how a SOCKS5 dialer sends target addresses
+// whose host is an IP literal, e.g. "192.0.2.1:80".
+type IPLiteralPolicy int
+
+const (
+	// IPLiteralAsIP sends IP literals with AddrTypeIPv4 or AddrTypeIPv6.
+	IPLiteralAsIP IPLiteralPolicy = iota
+
+	// IPLiteralAsFQDN sends IP literals with AddrTypeFQDN, e.g. for
+	// setups where the proxy should only see names.
+	IPLiteralAsFQDN
+)
+
 type Socks4DialerOptions struct {
 	UserID string
 
@@ -20,6 +48,27 @@ type Socks4DialerOptions struct {
 	// ProxyDialer specifies the optional dialer for
 	// establishing the transport connection.
 	ProxyDialer Dialer
+
+	// ZonePolicy specifies how target addresses with an IPv6 zone
+	// identifier are handled.
+	ZonePolicy IPv6ZonePolicy
+
+	// KeepAlive specifies the optional keep-alive settings of the
+	// tunnels.
+	KeepAlive KeepAliveOptions
+
+	// ResolveLocally specifies whether FQDN target addresses are
+	// resolved to an IPv4 address by the client instead of being sent
+	// to the proxy as SOCKS4a requests.
+	ResolveLocally bool
+
+	// ProxyResolver specifies the optional resolver of the host name of
+	// the proxy address. If nil, ProxyDialer resolves it.
+	ProxyResolver ProxyResolver
+
+	// Hostnames specifies the canonicalization and validation of FQDN
+	// target addresses before they are resolved or sent to the proxy.
+	Hostnames HostnameOptions
 }
 
 type Socks4Dialer struct {
@@ -28,6 +77,11 @@ type Socks4Dialer struct {
 	proxyNetwork string // network between a proxy server and a client
 	proxyAddress string // proxy server address
 	proxyDialer  Dialer
+	resolver     ProxyResolver
+	zonePolicy   IPv6ZonePolicy
+	keepAlive    KeepAliveOptions
+	resolve      bool
+	hostnames    HostnameOptions
 	userID       string
 }
 
@@ -49,20 +103,64 @@ func NewSocks4Dialer(network, address string, optFns ...func(*Socks4DialerOption
 		proxyNetwork: network,
 		proxyAddress: address,
 		proxyDialer:  options.ProxyDialer,
+		resolver:     options.ProxyResolver,
+		zonePolicy:   options.ZonePolicy,
+		keepAlive:    options.KeepAlive,
+		resolve:      options.ResolveLocally,
+		hostnames:    options.Hostnames,
 		userID:       options.UserID,
 	}
 }
 
+// dialProxy connects to the proxy.
+func (d *Socks4Dialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	return dialProxy(ctx, d.proxyDialer, d.resolver, d.proxyNetwork, d.proxyAddress)
+}
+
 func (d *Socks4Dialer) Dial(network, addr string) (net.Conn, error) {
 	return d.DialContext(context.Background(), network, addr)
 }
 
 func (d *Socks4Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	conn, err := d.proxyDialer.DialContext(ctx, d.proxyNetwork, d.proxyAddress)
+	return d.dial(ctx, network, addr, &negotiation{})
+}
+
+// dial connects to addr through the proxy and records the progress in n,
+// also of a failed dial.
+func (d *Socks4Dialer) dial(ctx context.Context, network, addr string, n *negotiation) (net.Conn, error) {
+	addr, direct, err := applyZonePolicy(d.zonePolicy, addr)
 	if err != nil {
 		return nil, err
 	}
 
+	if direct {
+		return d.proxyDialer.DialContext(ctx, network, addr)
+	}
+
+	if addr, err = d.hostnames.apply(addr); err != nil {
+		return nil, err
+	}
+
+	if d.resolve {
+		if addr, err = resolveAddr(ctx, "ip4", addr); err != nil {
+			return nil, err
+		}
+	}
+
+	n.timing.Start = time.Now()
+
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	n.timing.ProxyConnected = time.Now()
+
+	if err := setKeepAlivePeriod(conn, d.keepAlive.Period); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
 	socksConn := NewConn(conn)
 
 	if err := socksConn.Write(&Socks4Request{
@@ -70,19 +168,29 @@ func (d *Socks4Dialer) DialContext(ctx context.Context, network, addr string) (n
 		Addr:   addr,
 		UserID: d.userID,
 	}); err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 
 	resp := &Socks4Response{}
 	if err := socksConn.Read(resp); err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 
+	n.timing.Replied = time.Now()
+	n.socks4Reply = resp
+
 	if resp.Status != Socks4StatusGranted {
-		return nil, fmt.Errorf("socks error: %v", resp.Status)
+		_ = conn.Close()
+		return nil, socks4StatusError(resp.Status)
 	}
 
-	return conn, nil
+	return &Socks4Conn{
+		Conn:   newKeepAliveConn(socksConn.NetConn(), d.logger, d.keepAlive),
+		Timing: n.timing,
+		Reply:  resp,
+	}, nil
 }
 
 type Socks5DialerOptions struct {
@@ -94,6 +202,18 @@ type Socks5DialerOptions struct {
 	// establishing the transport connection.
 	ProxyDialer Dialer
 
+	// ZonePolicy specifies how target addresses with an IPv6 zone
+	// identifier are handled.
+	ZonePolicy IPv6ZonePolicy
+
+	// KeepAlive specifies the optional keep-alive settings of the
+	// tunnels.
+	KeepAlive KeepAliveOptions
+
+	// ResolveLocally specifies whether FQDN target addresses are
+	// resolved by the client instead of by the proxy.
+	ResolveLocally bool
+
 	// AuthMethods specifies the list of request authentication
 	// methods.
 	// If empty, SOCKS client requests only AuthMethodNotRequired.
@@ -103,16 +223,72 @@ type Socks5DialerOptions struct {
 	// function. It must be non-nil when AuthMethods is not empty.
 	// It must return an error when the authentication is failed.
 	Authenticate AuthenticateFunc
+
+	// ReplyValidation specifies the validation of the replies of the
+	// proxy, e.g. to pin the address family of BND.ADDR.
+	ReplyValidation ReplyValidation
+
+	// Resumption specifies the optional cache of the token which
+	// resumes the authentication on later connections, see
+	// AuthMethodResumption. The cache belongs to the proxy.
+	Resumption *ResumptionCache
+
+	// IPLiteralPolicy specifies how target addresses with an IP literal
+	// are sent to the proxy. It also applies to the addresses resolved
+	// with ResolveLocally.
+	IPLiteralPolicy IPLiteralPolicy
+
+	// ProxyResolver specifies the optional resolver of the host name of
+	// the proxy address. If nil, ProxyDialer resolves it.
+	ProxyResolver ProxyResolver
+
+	// Hostnames specifies the canonicalization and validation of FQDN
+	// target addresses before they are resolved or sent to the proxy.
+	Hostnames HostnameOptions
+
+	// UDPOverTCP specifies whether ListenPacket carries the datagrams
+	// over the connection to the proxy, see UDPOverTCPCommand. The proxy
+	// must support the extension, e.g. with UDPOptions.OverTCP.
+	UDPOverTCP bool
+
+	// RequireAuth specifies whether the dialer fails with ErrAuthRequired
+	// if the proxy selects AuthMethodNotRequired, also as the fallback of
+	// AuthMethodResumption, see ClientHandshakeOptions.RequireAuth.
+	RequireAuth bool
+
+	// OnNotice specifies an optional function which receives the notices
+	// of the proxy, see AuthMethodNotice. A notice with Disconnect set
+	// fails the dial with a *NoticeError.
+	OnNotice func(n *Notice)
+
+	// RequestHook specifies an optional function which may modify the
+	// requests before they are sent to the proxy, e.g. to append a domain
+	// suffix to host names or to map ports. A returned error fails the
+	// dial.
+	RequestHook RequestHookFunc
 }
 
+// RequestHookFunc modifies a request of a Socks5Dialer, see
+// Socks5DialerOptions.RequestHook.
+type RequestHookFunc func(ctx context.Context, req *Socks5Request) error
+
 type Socks5Dialer struct {
 	*logger
 	cmd          Command
 	proxyNetwork string // network between a proxy server and a client
 	proxyAddress string // proxy server address
 	proxyDialer  Dialer
+	resolver     ProxyResolver
+	zonePolicy   IPv6ZonePolicy
+	keepAlive    KeepAliveOptions
+	resolve      bool
+	hostnames    HostnameOptions
 	authMethods  []AuthMethod
 	authenticate AuthenticateFunc
+	validation   ReplyValidation
+	ipLiteral    IPLiteralPolicy
+	udpOverTCP   bool
+	requestHook  RequestHookFunc
 }
 
 // NewSocks5Dialer returns a new Socks5Dialer that dials through the provided
@@ -128,68 +304,268 @@ func NewSocks5Dialer(network, address string, optFns ...func(*Socks5DialerOption
 		fn(&options)
 	}
 
+	if options.RequireAuth {
+		options.AuthMethods, options.Authenticate = requireAuth(options.AuthMethods, options.Authenticate)
+	}
+
+	if options.Resumption != nil {
+		options.AuthMethods = append([]AuthMethod{AuthMethodResumption}, options.AuthMethods...)
+		options.Authenticate = ResumptionAuthenticator(options.Resumption, options.Authenticate)
+	}
+
+	if options.OnNotice != nil {
+		options.AuthMethods = append([]AuthMethod{AuthMethodNotice}, options.AuthMethods...)
+		options.Authenticate = NoticeAuthenticator(options.OnNotice, options.Authenticate)
+	}
+
 	return &Socks5Dialer{
 		logger:       &logger{options.Logger},
 		cmd:          ConnectCommand,
 		proxyNetwork: network,
 		proxyAddress: address,
 		proxyDialer:  options.ProxyDialer,
+		resolver:     options.ProxyResolver,
+		zonePolicy:   options.ZonePolicy,
+		keepAlive:    options.KeepAlive,
+		resolve:      options.ResolveLocally,
+		hostnames:    options.Hostnames,
 		authMethods:  options.AuthMethods,
 		authenticate: options.Authenticate,
+		validation:   options.ReplyValidation,
+		ipLiteral:    options.IPLiteralPolicy,
+		udpOverTCP:   options.UDPOverTCP,
+		requestHook:  options.RequestHook,
 	}
 }
 
+// dialProxy connects to the proxy.
+func (d *Socks5Dialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	return dialProxy(ctx, d.proxyDialer, d.resolver, d.proxyNetwork, d.proxyAddress)
+}
+
+// hookRequest passes req to the request hook, if any.
+func (d *Socks5Dialer) hookRequest(ctx context.Context, req *Socks5Request) error {
+	if d.requestHook == nil {
+		return nil
+	}
+
+	return d.requestHook(ctx, req)
+}
+
 func (d *Socks5Dialer) Dial(network, addr string) (net.Conn, error) {
 	return d.DialContext(context.Background(), network, addr)
 }
 
 func (d *Socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	conn, err := d.proxyDialer.DialContext(ctx, d.proxyNetwork, d.proxyAddress)
+	return d.dial(ctx, network, addr, &negotiation{})
+}
+
+// dial connects to addr through the proxy and records the progress in n,
+// also of a failed dial.
+func (d *Socks5Dialer) dial(ctx context.Context, network, addr string, n *negotiation) (net.Conn, error) {
+	addr, direct, err := applyZonePolicy(d.zonePolicy, addr)
 	if err != nil {
 		return nil, err
 	}
 
-	socksConn := NewConn(conn)
+	if direct {
+		return d.proxyDialer.DialContext(ctx, network, addr)
+	}
 
-	if err := socksConn.Write(&MethodSelectRequest{
-		Methods: d.authMethods,
-	}); err != nil {
+	if addr, err = d.hostnames.apply(addr); err != nil {
 		return nil, err
 	}
 
-	methodSelectResp := &MethodSelectResponse{}
-	if err := socksConn.Read(methodSelectResp); err != nil {
-		return nil, err
+	if d.resolve {
+		if addr, err = resolveAddr(ctx, "ip", addr); err != nil {
+			return nil, err
+		}
 	}
 
-	// If the selected METHOD is X'FF', none of the methods listed by the
-	// client are acceptable, and the client MUST close the connection.
-	if methodSelectResp.Method == AuthMethodNoAcceptableMethods {
-		_ = conn.Close()
-		return nil, errors.New("no authentication method accepted")
+	req := &Socks5Request{
+		CMD:           ConnectCommand,
+		Addr:          addr,
+		LiteralAsFQDN: d.ipLiteral == IPLiteralAsFQDN,
 	}
 
-	if d.authenticate != nil {
-		if err := d.authenticate(ctx, socksConn, methodSelectResp.Method); err != nil {
-			return nil, err
-		}
+	if err := d.hookRequest(ctx, req); err != nil {
+		return nil, err
 	}
 
-	if err := socksConn.Write(&Socks5Request{
-		CMD:  ConnectCommand,
-		Addr: addr,
-	}); err != nil {
+	n.timing.Start = time.Now()
+
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	resp := &Socks5Response{}
-	if err := socksConn.Read(resp); err != nil {
+	n.timing.ProxyConnected = time.Now()
+
+	if err := setKeepAlivePeriod(conn, d.keepAlive.Period); err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 
-	if resp.Status != Socks5StatusGranted {
-		return nil, fmt.Errorf("socks error: %v", resp.Status)
+	socksConn := NewConn(conn)
+
+	resp, err := ClientHandshake(ctx, socksConn, req, func(o *ClientHandshakeOptions) {
+		o.AuthMethods = d.authMethods
+		o.Authenticate = d.authenticate
+		o.ReplyValidation = d.validation
+		o.Timing = &n.timing
+	})
+
+	n.socks5Reply = resp
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
 	}
 
-	return conn, nil
+	return &Socks5Conn{
+		Conn:   newKeepAliveConn(socksConn.NetConn(), d.logger, d.keepAlive),
+		Timing: n.timing,
+		Reply:  resp,
+	}, nil
+}
+
+// NegotiationTiming holds the timestamps of the negotiation of a
+// connection through a proxy, e.g. to log the overhead of the proxy.
+// The timestamps of skipped steps are zero.
+type NegotiationTiming struct {
+	// Start is the start of the dial.
+	Start time.Time
+
+	// ProxyConnected is the time the connection to the proxy was
+	// established.
+	ProxyConnected time.Time
+
+	// MethodSelected is the time the SOCKS5 method selection completed.
+	MethodSelected time.Time
+
+	// Authenticated is the time the authentication completed.
+	Authenticated time.Time
+
+	// Replied is the time the reply to the request was read.
+	Replied time.Time
+}
+
+// Overhead returns the duration from the start of the dial until the
+// reply.
+func (t NegotiationTiming) Overhead() time.Duration {
+	if t.Replied.IsZero() {
+		return 0
+	}
+
+	return t.Replied.Sub(t.Start)
+}
+
+// negotiation records the progress of a dial through a proxy.
+type negotiation struct {
+	timing      NegotiationTiming
+	socks4Reply *Socks4Response
+	socks5Reply *Socks5Response
+}
+
+// Socks4Conn is the connection returned by a Socks4Dialer.
+type Socks4Conn struct {
+	net.Conn
+
+	// Timing holds the timestamps of the negotiation.
+	Timing NegotiationTiming
+
+	// Reply is the reply of the proxy.
+	Reply *Socks4Response
+}
+
+// CloseWrite shuts down the writing side of the connection, if supported.
+func (c *Socks4Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+// Socks5Conn is the connection returned by a Socks5Dialer.
+type Socks5Conn struct {
+	net.Conn
+
+	// Timing holds the timestamps of the negotiation.
+	Timing NegotiationTiming
+
+	// Reply is the reply of the proxy, e.g. with the address the proxy
+	// connects from.
+	Reply *Socks5Response
+}
+
+// CloseWrite shuts down the writing side of the connection, if supported.
+func (c *Socks5Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+// checkHealth connects to the proxy, negotiates the method selection
+// and closes the connection.
+func (d *Socks5Dialer) checkHealth(ctx context.Context) error {
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	_, err = clientSelectMethod(NewConn(conn), d.authMethods)
+
+	return err
+}
+
+// resolveAddr resolves the host of addr to an IP address of the network
+// unless it is an IP address.
+func resolveAddr(ctx context.Context, network, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// applyZonePolicy returns the address to send to the proxy and whether
+// the address must be dialed directly instead.
+func applyZonePolicy(policy IPv6ZonePolicy, addr string) (string, bool, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, false, nil
+	}
+
+	stripped, ok := stripZone(host)
+	if !ok {
+		return addr, false, nil
+	}
+
+	switch policy {
+	case IPv6ZoneStrip:
+		return net.JoinHostPort(stripped, port), false, nil
+	case IPv6ZoneDirect:
+		return addr, true, nil
+	default:
+		return "", false, &ZoneError{Addr: addr}
+	}
 }
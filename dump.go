@@ -0,0 +1,136 @@
+package socks
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+type handshakeDumper struct {
+	b      strings.Builder
+	client *bytes.Buffer
+	server *bytes.Buffer
+}
+
+// DumpHandshake renders a transcript of a SOCKS negotiation from the
+// bytes sent by the client and the bytes sent by the server, e.g. as
+// captured by a packet sniffer. Credentials are redacted and bytes
+// following the negotiation are summarized. If the bytes cannot be
+// parsed, the transcript up to the failure is returned along with the
+// error.
+func DumpHandshake(client, server []byte) (string, error) {
+	d := &handshakeDumper{
+		client: bytes.NewBuffer(client),
+		server: bytes.NewBuffer(server),
+	}
+
+	err := d.dump()
+
+	if d.client.Len() > 0 {
+		fmt.Fprintf(&d.b, "C: %d bytes of data\n", d.client.Len())
+	}
+
+	if d.server.Len() > 0 {
+		fmt.Fprintf(&d.b, "S: %d bytes of data\n", d.server.Len())
+	}
+
+	return d.b.String(), err
+}
+
+func (d *handshakeDumper) dump() error {
+	if len(d.client.Bytes()) == 0 {
+		return nil
+	}
+
+	switch Version(d.client.Bytes()[0]) {
+	case Socks4Version:
+		return d.dumpSocks4()
+	case Socks5Version:
+		return d.dumpSocks5()
+	default:
+		return newProtocolError("version identification", "version 4 or 5", fmt.Sprintf("version %d", d.client.Bytes()[0]), d.client.Bytes())
+	}
+}
+
+func (d *handshakeDumper) dumpSocks4() error {
+	req := &Socks4Request{}
+	if err := d.read(d.client, "C", req); err != nil {
+		return err
+	}
+
+	resp := &Socks4Response{}
+	if err := d.read(d.server, "S", resp); err != nil {
+		return err
+	}
+
+	// A successful BIND is followed by a second reply.
+	if req.CMD == BindCommand && resp.Status == Socks4StatusGranted && d.server.Len() > 0 {
+		return d.read(d.server, "S", &Socks4Response{})
+	}
+
+	return nil
+}
+
+func (d *handshakeDumper) dumpSocks5() error {
+	if err := d.read(d.client, "C", &MethodSelectRequest{}); err != nil {
+		return err
+	}
+
+	methodResp := &MethodSelectResponse{}
+	if err := d.read(d.server, "S", methodResp); err != nil {
+		return err
+	}
+
+	switch methodResp.Method {
+	case AuthMethodNotRequired:
+	case AuthMethodUsernamePassword:
+		if err := d.read(d.client, "C", &UsernamePasswordAuthRequest{}); err != nil {
+			return err
+		}
+
+		authResp := &UsernamePasswordAuthResponse{}
+		if err := d.read(d.server, "S", authResp); err != nil {
+			return err
+		}
+
+		if authResp.Status != AuthStatusSuccess {
+			return nil
+		}
+	default:
+		d.b.WriteString("-- subnegotiation not decoded\n")
+		return nil
+	}
+
+	req := &Socks5Request{}
+	if err := d.read(d.client, "C", req); err != nil {
+		return err
+	}
+
+	resp := &Socks5Response{}
+	if err := d.read(d.server, "S", resp); err != nil {
+		return err
+	}
+
+	// A successful BIND is followed by a second reply.
+	if req.CMD == BindCommand && resp.Status == Socks5StatusGranted && d.server.Len() > 0 {
+		return d.read(d.server, "S", &Socks5Response{})
+	}
+
+	return nil
+}
+
+type decoder interface {
+	fmt.Stringer
+	decode(r messageReader) error
+}
+
+func (d *handshakeDumper) read(r *bytes.Buffer, prefix string, msg decoder) error {
+	if err := msg.decode(r); err != nil {
+		fmt.Fprintf(&d.b, "%s: malformed message: %v\n", prefix, err)
+		return err
+	}
+
+	fmt.Fprintf(&d.b, "%s: %s\n", prefix, msg)
+
+	return nil
+}
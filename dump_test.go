@@ -0,0 +1,69 @@
+package socks
+
+import (
+	"encoding"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func marshalAll(t *testing.T, msgs ...encoding.BinaryMarshaler) []byte {
+	t.Helper()
+
+	var b []byte
+
+	for _, m := range msgs {
+		p, err := m.MarshalBinary()
+		assert.NoError(t, err)
+
+		b = append(b, p...)
+	}
+
+	return b
+}
+
+func TestDumpHandshake(t *testing.T) {
+	t.Run("socks5", func(t *testing.T) {
+		client := marshalAll(t,
+			&MethodSelectRequest{Methods: []AuthMethod{AuthMethodNotRequired, AuthMethodUsernamePassword}},
+			&UsernamePasswordAuthRequest{Username: "user", Password: "secret"},
+			&Socks5Request{CMD: ConnectCommand, Addr: "example.com:80"},
+		)
+		client = append(client, "GET / HTTP/1.1\r\n"...)
+
+		server := marshalAll(t,
+			&MethodSelectResponse{Method: AuthMethodUsernamePassword},
+			&UsernamePasswordAuthResponse{Status: AuthStatusSuccess},
+			&Socks5Response{Status: Socks5StatusGranted, Addr: "10.0.0.1:4321"},
+		)
+
+		dump, err := DumpHandshake(client, server)
+		assert.NoError(t, err)
+		assert.Equal(t, `C: SOCKS5 method selection methods=[no authentication required, username/password]
+S: SOCKS5 method selection reply method="username/password"
+C: username/password auth request username="user" password=<redacted>
+S: username/password auth reply status=success
+C: SOCKS5 request cmd="socks connect" addr=example.com:80
+S: SOCKS5 reply status="succeeded" addr=10.0.0.1:4321
+C: 16 bytes of data
+`, dump)
+		assert.NotContains(t, dump, "secret")
+	})
+
+	t.Run("socks4", func(t *testing.T) {
+		client := marshalAll(t, &Socks4Request{CMD: ConnectCommand, Addr: "127.0.0.1:80", UserID: "xyz"})
+		server := marshalAll(t, &Socks4Response{Status: Socks4StatusRejected})
+
+		dump, err := DumpHandshake(client, server)
+		assert.NoError(t, err)
+		assert.Equal(t, `C: SOCKS4 request cmd="socks connect" addr=127.0.0.1:80 userid="xyz"
+S: SOCKS4 reply status="request rejected or failed" addr=
+`, dump)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		dump, err := DumpHandshake([]byte{0x05, 0x02, 0x00}, nil)
+		assert.Error(t, err)
+		assert.Contains(t, dump, "C: malformed message")
+	})
+}
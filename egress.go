@@ -0,0 +1,55 @@
+package socks
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"syscall"
+)
+
+// EgressMarkAnnotation is the session annotation holding the socket mark
+// of the connections to the targets of the session, see EgressMarkFunc.
+const EgressMarkAnnotation = "egress_mark"
+
+// EgressMarkFunc returns the socket mark (SO_MARK) of the connections
+// the default handler dials for the CONNECT requests of a session. The
+// firewall can log marked connections, e.g. with an NFLOG rule matching
+// the mark, or save the mark to the conntrack entry with CONNMARK to
+// correlate the flows with the proxy logs. A mark of zero leaves the
+// connection unmarked. Socket marks are only supported on Linux and
+// require CAP_NET_ADMIN and a *net.Dialer.
+type EgressMarkFunc func(session *Session) uint32
+
+// SessionMark is an EgressMarkFunc returning the 32-bit FNV-1a hash of
+// the session ID. The mark is recorded in the EgressMarkAnnotation of
+// the session.
+func SessionMark(session *Session) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(session.ID))
+
+	return h.Sum32()
+}
+
+// markDialer returns a copy of dialer which sets the mark on its sockets
+// before they connect, so that the mark also applies to the SYN.
+func markDialer(dialer Dialer, mark uint32) (Dialer, error) {
+	d, ok := dialer.(*net.Dialer)
+	if !ok {
+		return nil, fmt.Errorf("socks: socket marks require a *net.Dialer, got %T", dialer)
+	}
+
+	marked := *d
+	control := d.Control
+
+	marked.Control = func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+
+		return setSocketMark(c, mark)
+	}
+
+	return &marked, nil
+}
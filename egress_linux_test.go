@@ -0,0 +1,41 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSocketMark(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	d, err := markDialer(&net.Dialer{}, 42)
+	assert.NoError(t, err)
+
+	conn, err := d.DialContext(context.Background(), "tcp", listen.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting socket marks requires CAP_NET_ADMIN")
+	}
+
+	assert.NoError(t, err)
+
+	defer conn.Close()
+
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	assert.NoError(t, err)
+
+	var mark int
+
+	assert.NoError(t, rawConn.Control(func(fd uintptr) {
+		mark, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, 42, mark)
+}
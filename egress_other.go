@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package socks
+
+import (
+	"errors"
+	"syscall"
+)
+
+const socketMarkSupported = false
+
+func setSocketMark(c syscall.RawConn, mark uint32) error {
+	return errors.New("socks: socket marks are not supported on this platform")
+}
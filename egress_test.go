@@ -0,0 +1,32 @@
+package socks
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionMark(t *testing.T) {
+	a := &Session{ID: "0123456789abcdef"}
+	b := &Session{ID: "fedcba9876543210"}
+
+	assert.Equal(t, SessionMark(a), SessionMark(&Session{ID: a.ID}))
+	assert.NotEqual(t, SessionMark(a), SessionMark(b))
+}
+
+func TestMarkDialer(t *testing.T) {
+	t.Run("net dialer", func(t *testing.T) {
+		d := &net.Dialer{}
+
+		marked, err := markDialer(d, 42)
+		assert.NoError(t, err)
+		assert.NotSame(t, d, marked)
+		assert.Nil(t, d.Control)
+	})
+
+	t.Run("other dialer", func(t *testing.T) {
+		_, err := markDialer(NewSocks5Dialer("tcp", "localhost:1080"), 42)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,234 @@
+package socks
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+)
+
+// ErrHandshakeTooLarge is returned when a client sends more bytes during
+// the handshake than allowed by Options.MaxHandshakeBytes.
+var ErrHandshakeTooLarge = errors.New("socks: handshake exceeds byte budget")
+
+// ErrTooManyHandshakes is returned when a connection is closed because
+// Options.MaxHandshakes handshakes are already in progress.
+var ErrTooManyHandshakes = errors.New("socks: too many concurrent handshakes")
+
+// ErrTooManyBinds is returned when a BIND request is rejected because
+// DefaultHandlerOptions.MaxBinds BIND requests are waiting for their
+// peer.
+var ErrTooManyBinds = errors.New("socks: too many concurrent binds")
+
+// ErrUDPDisabled is returned when a UDP association is rejected because
+// UDPOptions.Disabled is set.
+var ErrUDPDisabled = errors.New("socks: UDP is disabled")
+
+// ErrAuthRequired is returned by a client requiring authentication when
+// the proxy selects AuthMethodNotRequired.
+var ErrAuthRequired = errors.New("socks: proxy selected no authentication")
+
+// ErrSocks4IPv6 is returned when a SOCKS4 request is rejected because
+// its reply would have to carry an IPv6 address, see Socks4IPv6Policy.
+var ErrSocks4IPv6 = errors.New("socks: SOCKS4 reply cannot carry an IPv6 address")
+
+// The errors of a Socks4Dialer for the statuses of SOCKS4 rejections.
+var (
+	ErrSocks4Rejected      = errors.New("socks error: " + Socks4StatusRejected.String())
+	ErrSocks4NoIdentd      = errors.New("socks error: " + Socks4StatusNoIdentd.String())
+	ErrSocks4InvalidUserID = errors.New("socks error: " + Socks4StatusInvalidUserID.String())
+)
+
+// socks4StatusError returns the error for the status of a SOCKS4
+// rejection.
+func socks4StatusError(status Socks4Status) error {
+	switch status {
+	case Socks4StatusRejected:
+		return ErrSocks4Rejected
+	case Socks4StatusNoIdentd:
+		return ErrSocks4NoIdentd
+	case Socks4StatusInvalidUserID:
+		return ErrSocks4InvalidUserID
+	default:
+		return newProtocolError("SOCKS4 reply", "status 90 to 93", fmt.Sprintf("status %d", status), []byte{byte(status)})
+	}
+}
+
+// maxProtocolErrorRawLen limits the bytes kept in ProtocolError.Raw.
+const maxProtocolErrorRawLen = 32
+
+// ProtocolError is returned when a peer sends a malformed or unexpected
+// message.
+type ProtocolError struct {
+	// Phase names the message or negotiation step, e.g. "SOCKS5 request".
+	Phase string
+
+	// Expected describes what the parser expected.
+	Expected string
+
+	// Got describes what the parser received instead.
+	Got string
+
+	// Raw holds a snippet of the offending bytes, if any.
+	Raw []byte
+}
+
+func (e *ProtocolError) Error() string {
+	s := fmt.Sprintf("socks: protocol error in %s: expected %s, got %s", e.Phase, e.Expected, e.Got)
+	if len(e.Raw) > 0 {
+		s += fmt.Sprintf(" (raw % x)", e.Raw)
+	}
+
+	return s
+}
+
+// NegotiationTimeoutError is returned when a read of the handshake times
+// out, e.g. because a client sends its request byte by byte until
+// Options.HandshakeTimeout has passed. It names the field being read.
+type NegotiationTimeoutError struct {
+	// Phase names the message, e.g. "SOCKS5 request".
+	Phase string
+
+	// Field names the field of the message as in its RFC, e.g. "ATYP".
+	Field string
+
+	// Err is the timeout error of the read.
+	Err error
+}
+
+func (e *NegotiationTimeoutError) Error() string {
+	return fmt.Sprintf("socks: negotiation timeout at field %s of %s", e.Field, e.Phase)
+}
+
+func (e *NegotiationTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// ZoneError is returned when an address with an IPv6 zone identifier,
+// e.g. "[fe80::1%eth0]:80", is sent to a proxy. Zones are only
+// meaningful on the local host and cannot be encoded in SOCKS messages.
+type ZoneError struct {
+	Addr string
+}
+
+func (e *ZoneError) Error() string {
+	return "socks: IPv6 zone identifier not supported in address " + e.Addr
+}
+
+// CredentialLengthError is returned if the username or the password of
+// a username/password request, named by Field as in RFC 1929, has a
+// length outside of the accepted range.
+type CredentialLengthError struct {
+	Field  string
+	Length int
+	Min    int
+	Max    int
+}
+
+func (e *CredentialLengthError) Error() string {
+	return fmt.Sprintf("socks: length %d of field %s not in range %d to %d", e.Length, e.Field, e.Min, e.Max)
+}
+
+// Socks4AddrError is returned when a SOCKS4 message is marshaled with an
+// address SOCKS4 cannot represent, i.e. an IPv6 address.
+type Socks4AddrError struct {
+	Addr string
+}
+
+func (e *Socks4AddrError) Error() string {
+	return "socks: address " + e.Addr + " cannot be represented in SOCKS4"
+}
+
+// IdentError is returned by an IdentFunc to reject a SOCKS4 request with
+// a specific status, e.g. Socks4StatusNoIdentd if the ident server of
+// the client is unreachable or Socks4StatusInvalidUserID if it reports a
+// different user. Other errors are replied with Socks4StatusRejected.
+type IdentError struct {
+	Status Socks4Status
+	Err    error
+}
+
+func (e *IdentError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("socks: ident failed: %v", e.Status)
+	}
+
+	return fmt.Sprintf("socks: ident failed: %v: %v", e.Status, e.Err)
+}
+
+func (e *IdentError) Unwrap() error {
+	return e.Err
+}
+
+// DenialError denies a request with a specific status. A RequestHandler
+// or Middleware, e.g. an authorization check, may return it without
+// replying; the server then writes the reply. Operators can choose
+// between a transparent Socks5StatusNotAllowed and an opaque status
+// like Socks5StatusHostUnreachable or Socks5StatusConnectionRefused,
+// which does not reveal to probing clients that a destination is
+// filtered.
+type DenialError struct {
+	// Socks5Status is the status of the SOCKS5 reply. If zero,
+	// Socks5StatusNotAllowed is replied.
+	Socks5Status Socks5Status
+
+	// Socks4Status is the status of the SOCKS4 reply. If zero,
+	// Socks4StatusRejected is replied.
+	Socks4Status Socks4Status
+
+	Err error
+}
+
+func (e *DenialError) Error() string {
+	if e.Err == nil {
+		return "socks: request denied"
+	}
+
+	return "socks: request denied: " + e.Err.Error()
+}
+
+func (e *DenialError) Unwrap() error {
+	return e.Err
+}
+
+// reply returns the reply to the denied request.
+func (e *DenialError) reply(req *Request, socks4EchoAddr bool) encoding.BinaryMarshaler {
+	if req.Version == Socks4Version {
+		resp := NewSocks4Rejection(req, socks4EchoAddr)
+		if e.Socks4Status != 0 {
+			resp.Status = e.Socks4Status
+		}
+
+		return resp
+	}
+
+	status := Socks5StatusNotAllowed
+	if e.Socks5Status != Socks5StatusGranted {
+		status = e.Socks5Status
+	}
+
+	return NewDenyReply(req, status)
+}
+
+func newProtocolError(phase, expected, got string, raw []byte) *ProtocolError {
+	if len(raw) > maxProtocolErrorRawLen {
+		raw = raw[:maxProtocolErrorRawLen]
+	}
+
+	return &ProtocolError{
+		Phase:    phase,
+		Expected: expected,
+		Got:      got,
+		Raw:      append([]byte(nil), raw...),
+	}
+}
+
+// isProtocolError reports whether err is a *ProtocolError, i.e. the peer
+// is still connected and expects a reply.
+func isProtocolError(err error) bool {
+	var protocolErr *ProtocolError
+	return errors.As(err, &protocolErr)
+}
+
+func versionError(phase string, expected, got byte) *ProtocolError {
+	return newProtocolError(phase, fmt.Sprintf("version %d", expected), fmt.Sprintf("version %d", got), []byte{got})
+}
@@ -0,0 +1,75 @@
+package socks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProtocolError(t *testing.T) {
+	t.Run("version", func(t *testing.T) {
+		req := &Socks5Request{}
+		err := req.UnmarshalBinary([]byte{4, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+
+		var pe *ProtocolError
+		assert.True(t, errors.As(err, &pe))
+		assert.Equal(t, "SOCKS5 request", pe.Phase)
+		assert.Equal(t, "version 5", pe.Expected)
+		assert.Equal(t, "version 4", pe.Got)
+		assert.Equal(t, []byte{4}, pe.Raw)
+		assert.Equal(t, "socks: protocol error in SOCKS5 request: expected version 5, got version 4 (raw 04)", err.Error())
+	})
+
+	t.Run("address type", func(t *testing.T) {
+		d := &UDPDatagram{}
+		err := d.UnmarshalBinary([]byte{0, 0, 0, 9, 1, 2, 3})
+
+		var pe *ProtocolError
+		assert.True(t, errors.As(err, &pe))
+		assert.Equal(t, "SOCKS5 UDP datagram", pe.Phase)
+		assert.Equal(t, "address type 9", pe.Got)
+		assert.Equal(t, []byte{9}, pe.Raw)
+	})
+
+	t.Run("raw snippet", func(t *testing.T) {
+		pe := newProtocolError("test", "a", "b", make([]byte, 100))
+		assert.Len(t, pe.Raw, maxProtocolErrorRawLen)
+	})
+
+	t.Run("encoding", func(t *testing.T) {
+		_, err := (&Socks5Request{CMD: ConnectCommand, Addr: strings.Repeat("a", 256) + ":80"}).MarshalBinary()
+
+		var pe *ProtocolError
+		assert.True(t, errors.As(err, &pe))
+		assert.Equal(t, "SOCKS5 request", pe.Phase)
+		assert.Equal(t, "256 bytes", pe.Got)
+
+		_, err = (&Socks5Response{Addr: strings.Repeat("a", 256) + ":80"}).MarshalBinary()
+		assert.True(t, errors.As(err, &pe))
+		assert.Equal(t, "SOCKS5 reply", pe.Phase)
+	})
+
+	t.Run("rejection", func(t *testing.T) {
+		err := socks4StatusError(Socks4Status(0x42))
+
+		var pe *ProtocolError
+		assert.True(t, errors.As(err, &pe))
+		assert.Equal(t, "SOCKS4 reply", pe.Phase)
+		assert.Equal(t, "status 66", pe.Got)
+	})
+}
+
+// assertSocks5Rejection asserts that err is the *ProtocolError of a
+// SOCKS5 reply with status.
+func assertSocks5Rejection(t *testing.T, err error, status Socks5Status) {
+	t.Helper()
+
+	var pe *ProtocolError
+	if assert.True(t, errors.As(err, &pe), "%v", err) {
+		assert.Equal(t, "SOCKS5 reply", pe.Phase)
+		assert.Equal(t, status.String(), pe.Got)
+		assert.Equal(t, []byte{byte(status)}, pe.Raw)
+	}
+}
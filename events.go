@@ -0,0 +1,178 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the type of a session event.
+type EventType int
+
+const (
+	// EventSessionStarted is emitted when a connection is accepted.
+	EventSessionStarted EventType = iota
+
+	// EventSessionAuthenticated is emitted after a successful SOCKS5
+	// authentication.
+	EventSessionAuthenticated
+
+	// EventSessionConnected is emitted by the DefaultHandler once the
+	// connection to the target is established.
+	EventSessionConnected
+
+	// EventSessionClosed is emitted when the connection is closed.
+	EventSessionClosed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSessionStarted:
+		return "started"
+	case EventSessionAuthenticated:
+		return "authenticated"
+	case EventSessionConnected:
+		return "connected"
+	case EventSessionClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a step in the life of a session. The fields are a
+// snapshot of the session when the event was emitted.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	SessionID  string
+	ClientAddr net.Addr
+	User       string
+	DestAddr   string
+	TargetAddr string
+
+	// CorrelationID is the correlation ID of the session, see
+	// Session.SetCorrelationID.
+	CorrelationID string
+
+	// Annotations are the annotations of the session, see
+	// Session.Annotate.
+	Annotations map[string]string
+
+	// Err is the error the session was closed with, if any.
+	Err error
+
+	// CloseReason is the reason the session was closed for. It is
+	// CloseReasonUnknown for the events of an active session.
+	CloseReason CloseReason
+}
+
+// Subscription receives the events of a server, see Server.Subscribe.
+// Events are dropped instead of blocking the server when the buffer of
+// the subscription is full.
+type Subscription struct {
+	// C delivers the events. It is closed by Unsubscribe.
+	C <-chan Event
+
+	c       chan Event
+	dropped uint64 // accessed atomically
+	stream  *eventStream
+	once    sync.Once
+}
+
+// Dropped returns the number of events dropped because the buffer of
+// the subscription was full.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Unsubscribe stops the delivery of events and closes C.
+func (sub *Subscription) Unsubscribe() {
+	sub.once.Do(func() {
+		sub.stream.remove(sub)
+		close(sub.c)
+	})
+}
+
+// eventStream fans out events to the subscriptions.
+type eventStream struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+func (es *eventStream) subscribe(buffer int) *Subscription {
+	c := make(chan Event, buffer)
+
+	sub := &Subscription{
+		C:      c,
+		c:      c,
+		stream: es,
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.subs == nil {
+		es.subs = make(map[*Subscription]struct{})
+	}
+
+	es.subs[sub] = struct{}{}
+
+	return sub
+}
+
+func (es *eventStream) remove(sub *Subscription) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	delete(es.subs, sub)
+}
+
+// emit sends an event of the session to all subscriptions.
+func (es *eventStream) emit(t EventType, session *Session, err error) {
+	if es == nil || session == nil {
+		return
+	}
+
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if len(es.subs) == 0 {
+		return
+	}
+
+	e := Event{
+		Type:          t,
+		Time:          time.Now(),
+		SessionID:     session.ID,
+		ClientAddr:    session.ClientAddr,
+		User:          session.User(),
+		DestAddr:      session.DestAddr(),
+		TargetAddr:    session.TargetAddr(),
+		Annotations:   session.Annotations(),
+		CorrelationID: session.CorrelationID(),
+		Err:           err,
+		CloseReason:   session.CloseReason(),
+	}
+
+	for sub := range es.subs {
+		select {
+		case sub.c <- e:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+type eventsKey struct{}
+
+func withEvents(ctx context.Context, es *eventStream) context.Context {
+	return context.WithValue(ctx, eventsKey{}, es)
+}
+
+func eventsFromContext(ctx context.Context) *eventStream {
+	es, _ := ctx.Value(eventsKey{}).(*eventStream)
+	return es
+}
@@ -0,0 +1,102 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerSubscribe(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		o.Authenticate = userPassServerAuthenticateFuncGen("user", "pass")
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	next := func(t *testing.T, sub *Subscription) Event {
+		select {
+		case e := <-sub.C:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+			return Event{}
+		}
+	}
+
+	t.Run("lifecycle", func(t *testing.T) {
+		sub := server.Subscribe(8)
+		defer sub.Unsubscribe()
+
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = UsernamePasswordAuthenticator("user", "pass")
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		assert.NoError(t, err)
+
+		_, err = io.ReadAll(conn)
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		var types []EventType
+
+		for _, want := range []EventType{EventSessionStarted, EventSessionAuthenticated, EventSessionConnected, EventSessionClosed} {
+			e := next(t, sub)
+			types = append(types, e.Type)
+
+			if want == EventSessionConnected {
+				assert.Equal(t, "user", e.User)
+				assert.Equal(t, testServer.Listener.Addr().String(), e.DestAddr)
+			}
+		}
+
+		assert.Equal(t, []EventType{EventSessionStarted, EventSessionAuthenticated, EventSessionConnected, EventSessionClosed}, types)
+		assert.Equal(t, uint64(0), sub.Dropped())
+	})
+
+	t.Run("dropped", func(t *testing.T) {
+		sub := server.Subscribe(1)
+
+		conn, err := net.Dial("tcp", listen.Addr().String())
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		assert.Equal(t, EventSessionStarted, next(t, sub).Type)
+
+		assert.Eventually(t, func() bool {
+			return sub.Dropped() == 0 && len(sub.C) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		conn, err = net.Dial("tcp", listen.Addr().String())
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		assert.Eventually(t, func() bool {
+			return sub.Dropped() == 2
+		}, 5*time.Second, 10*time.Millisecond)
+
+		sub.Unsubscribe()
+
+		_, ok := <-sub.C
+		assert.True(t, ok) // the buffered closed event
+
+		_, ok = <-sub.C
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,363 @@
+// Package ftp implements the FTP control and data connection handling
+// through a SOCKS proxy. Passive transfers connect to the server with
+// CONNECT, active transfers let the server connect to a BIND socket on
+// the proxy.
+package ftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/hupe1980/socks"
+)
+
+type Options struct {
+	// Active specifies whether data connections are opened by the
+	// server (PORT/EPRT) instead of by the client (EPSV/PASV). Binder
+	// must be set for active transfers.
+	Active bool
+
+	// Binder specifies the BIND support of the proxy for active
+	// transfers, e.g. the socks.Socks5Dialer of the proxy.
+	Binder socks.Binder
+}
+
+// Client is an FTP client whose control and data connections are
+// established through a SOCKS proxy.
+type Client struct {
+	text   *textproto.Conn
+	dialer socks.Dialer
+	host   string // host of the server as dialed
+	addr   string
+	active bool
+	binder socks.Binder
+}
+
+// Dial connects to the FTP server addr through the dialer of a proxy
+// and reads the greeting of the server.
+func Dial(ctx context.Context, dialer socks.Dialer, addr string, optFns ...func(*Options)) (*Client, error) {
+	options := Options{}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	if options.Active && options.Binder == nil {
+		return nil, errors.New("ftp: active transfers require a Binder")
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		text:   textproto.NewConn(conn),
+		dialer: dialer,
+		host:   host,
+		addr:   addr,
+		active: options.Active,
+		binder: options.Binder,
+	}
+
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		_ = c.text.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Cmd sends a command and reads the reply, which must match the code
+// expected as in textproto.Reader.ReadResponse.
+func (c *Client) Cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	if _, err := c.text.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+
+	return c.text.ReadResponse(expectCode)
+}
+
+// Login authenticates with USER and PASS.
+func (c *Client) Login(user, password string) error {
+	code, _, err := c.Cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+
+	switch code {
+	case 230:
+		return nil
+	case 331:
+		_, _, err = c.Cmd(230, "PASS %s", password)
+		return err
+	default:
+		return &textproto.Error{Code: code, Msg: "unexpected reply to USER"}
+	}
+}
+
+// Retr returns the content of the file. The transfer is completed by
+// closing the reader.
+func (c *Client) Retr(ctx context.Context, path string) (io.ReadCloser, error) {
+	return c.Transfer(ctx, "RETR "+path)
+}
+
+// Stor stores the content of r in the file.
+func (c *Client) Stor(ctx context.Context, path string, r io.Reader) error {
+	conn, err := c.Transfer(ctx, "STOR "+path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(conn, r); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	return conn.Close()
+}
+
+// NameList returns the names of the files in the directory.
+func (c *Client) NameList(ctx context.Context, path string) ([]string, error) {
+	cmd := "NLST"
+	if path != "" {
+		cmd += " " + path
+	}
+
+	conn, err := c.Transfer(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if err := conn.Close(); err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+
+	return names, nil
+}
+
+// Transfer opens a data connection and sends the transfer command, e.g.
+// "RETR file". Closing the returned connection reads the final reply of
+// the transfer.
+func (c *Client) Transfer(ctx context.Context, cmd string) (io.ReadWriteCloser, error) {
+	if _, _, err := c.Cmd(200, "TYPE I"); err != nil {
+		return nil, err
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	if c.active {
+		conn, err = c.activeTransfer(ctx, cmd)
+	} else {
+		conn, err = c.passiveTransfer(ctx, cmd)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &dataConn{Conn: conn, text: c.text}, nil
+}
+
+// Quit sends QUIT and closes the control connection.
+func (c *Client) Quit() error {
+	_, _, err := c.Cmd(221, "QUIT")
+
+	if cerr := c.text.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Close closes the control connection.
+func (c *Client) Close() error {
+	return c.text.Close()
+}
+
+// passiveTransfer connects through the proxy to the port announced with
+// EPSV, or PASV if EPSV is not supported. The address of PASV is
+// ignored, it is often private to the network of the server.
+func (c *Client) passiveTransfer(ctx context.Context, cmd string) (net.Conn, error) {
+	extended := true
+
+	code, msg, err := c.Cmd(229, "EPSV")
+	if err != nil {
+		if code < 500 {
+			return nil, err
+		}
+
+		extended = false
+
+		if _, msg, err = c.Cmd(227, "PASV"); err != nil {
+			return nil, err
+		}
+	}
+
+	port, err := parsePassivePort(extended, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.dialer.DialContext(ctx, "tcp", net.JoinHostPort(c.host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := c.Cmd(1, cmd); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// activeTransfer announces a BIND socket of the proxy with EPRT, or
+// PORT for IPv4 addresses, and accepts the connection of the server.
+func (c *Client) activeTransfer(ctx context.Context, cmd string) (net.Conn, error) {
+	addr, accept, err := c.binder.Bind(ctx, c.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Releases the BIND socket of the proxy on failure.
+	abort := func() {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, _ = accept(cctx)
+	}
+
+	host, port, err := splitAddr(addr)
+	if err != nil {
+		abort()
+		return nil, err
+	}
+
+	// The unspecified address stands for the address of the proxy,
+	// which is unknown to the client.
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		abort()
+		return nil, fmt.Errorf("ftp: unusable BIND address %s", addr)
+	}
+
+	if ip4 := net.ParseIP(host).To4(); ip4 != nil {
+		_, _, err = c.Cmd(200, "PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff)
+	} else {
+		_, _, err = c.Cmd(200, "EPRT |2|%s|%d|", host, port)
+	}
+
+	if err != nil {
+		abort()
+		return nil, err
+	}
+
+	if _, _, err := c.Cmd(1, cmd); err != nil {
+		abort()
+		return nil, err
+	}
+
+	return accept(ctx)
+}
+
+// parsePassivePort returns the port of an EPSV reply like "Entering
+// Extended Passive Mode (|||6446|)" or a PASV reply like "Entering
+// Passive Mode (h1,h2,h3,h4,p1,p2)".
+func parsePassivePort(extended bool, msg string) (int, error) {
+	start, end := strings.IndexByte(msg, '('), strings.LastIndexByte(msg, ')')
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("ftp: invalid passive reply %q", msg)
+	}
+
+	params := msg[start+1 : end]
+
+	if extended {
+		if params == "" {
+			return 0, fmt.Errorf("ftp: invalid passive reply %q", msg)
+		}
+
+		fields := strings.Split(params, params[:1])
+		if len(fields) != 5 {
+			return 0, fmt.Errorf("ftp: invalid passive reply %q", msg)
+		}
+
+		port, err := strconv.Atoi(fields[3])
+		if err != nil || port <= 0 || port > 65535 {
+			return 0, fmt.Errorf("ftp: invalid passive reply %q", msg)
+		}
+
+		return port, nil
+	}
+
+	fields := strings.Split(params, ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("ftp: invalid passive reply %q", msg)
+	}
+
+	p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+
+	if err1 != nil || err2 != nil || p1 < 0 || p1 > 255 || p2 < 0 || p2 > 255 {
+		return 0, fmt.Errorf("ftp: invalid passive reply %q", msg)
+	}
+
+	return p1<<8 | p2, nil
+}
+
+func splitAddr(addr net.Addr) (string, int, error) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", 0, err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, p, nil
+}
+
+// dataConn reads the final reply of the transfer when it is closed.
+type dataConn struct {
+	net.Conn
+	text *textproto.Conn
+}
+
+func (c *dataConn) Close() error {
+	if err := c.Conn.Close(); err != nil {
+		return err
+	}
+
+	_, _, err := c.text.ReadResponse(2)
+
+	return err
+}
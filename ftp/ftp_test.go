@@ -0,0 +1,282 @@
+package ftp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hupe1980/socks"
+	"github.com/stretchr/testify/assert"
+)
+
+// ftpServer is a minimal FTP server keeping the files in memory.
+type ftpServer struct {
+	listener net.Listener
+	noEPSV   bool
+
+	mu    sync.Mutex
+	files map[string]string
+}
+
+func newFTPServer(t *testing.T, noEPSV bool) *ftpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	s := &ftpServer{
+		listener: listener,
+		noEPSV:   noEPSV,
+		files:    map[string]string{"hello.txt": "hello world"},
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *ftpServer) file(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.files[name]
+}
+
+func (s *ftpServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	reply := func(format string, args ...interface{}) {
+		_, _ = fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	var (
+		passive net.Listener
+		active  string
+	)
+
+	// data opens the data connection of a transfer.
+	data := func() (net.Conn, error) {
+		if passive != nil {
+			defer passive.Close()
+			return passive.Accept()
+		}
+
+		return net.Dial("tcp", active)
+	}
+
+	reply("220 ready")
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd, arg := strings.TrimSpace(line), ""
+		if i := strings.IndexByte(cmd, ' '); i >= 0 {
+			cmd, arg = cmd[:i], cmd[i+1:]
+		}
+
+		switch cmd {
+		case "USER":
+			reply("331 password required")
+		case "PASS":
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 type set")
+		case "EPSV", "PASV":
+			if cmd == "EPSV" && s.noEPSV {
+				reply("500 unknown command")
+				continue
+			}
+
+			passive, _ = net.Listen("tcp", "127.0.0.1:0")
+			port := passive.Addr().(*net.TCPAddr).Port
+
+			if cmd == "EPSV" {
+				reply("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				reply("227 Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "PORT":
+			f := strings.Split(arg, ",")
+			p1, _ := strconv.Atoi(f[4])
+			p2, _ := strconv.Atoi(f[5])
+			active = net.JoinHostPort(strings.Join(f[:4], "."), strconv.Itoa(p1<<8|p2))
+			reply("200 port set")
+		case "RETR", "STOR", "NLST":
+			if cmd == "RETR" && s.file(arg) == "" {
+				reply("550 not found")
+				continue
+			}
+
+			d, err := data()
+			if err != nil {
+				reply("425 no data connection")
+				continue
+			}
+
+			reply("150 opening data connection")
+
+			switch cmd {
+			case "RETR":
+				_, _ = io.WriteString(d, s.file(arg))
+			case "STOR":
+				b, _ := io.ReadAll(d)
+
+				s.mu.Lock()
+				s.files[arg] = string(b)
+				s.mu.Unlock()
+			case "NLST":
+				s.mu.Lock()
+				for name := range s.files {
+					_, _ = io.WriteString(d, name+"\r\n")
+				}
+				s.mu.Unlock()
+			}
+
+			_ = d.Close()
+			reply("226 transfer complete")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// localBinder binds on the local host instead of on a proxy.
+type localBinder struct{}
+
+func (localBinder) Bind(ctx context.Context, peerHint string) (net.Addr, func(ctx context.Context) (net.Conn, error), error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accept := func(ctx context.Context) (net.Conn, error) {
+		defer l.Close()
+
+		stop := make(chan struct{})
+		defer close(stop)
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = l.Close()
+			case <-stop:
+			}
+		}()
+
+		return l.Accept()
+	}
+
+	return l.Addr(), accept, nil
+}
+
+func TestClient(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	go func() {
+		_ = socks.New().Serve(listen)
+	}()
+
+	dialer := socks.NewSocks5Dialer("tcp", listen.Addr().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	session := func(t *testing.T, server *ftpServer, optFns ...func(*Options)) {
+		c, err := Dial(ctx, dialer, server.listener.Addr().String(), optFns...)
+		assert.NoError(t, err)
+
+		assert.NoError(t, c.Login("anonymous", "anonymous"))
+
+		r, err := c.Retr(ctx, "hello.txt")
+		assert.NoError(t, err)
+
+		b, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world", string(b))
+		assert.NoError(t, r.Close())
+
+		assert.NoError(t, c.Stor(ctx, "upload.txt", strings.NewReader("uploaded")))
+		assert.Equal(t, "uploaded", server.file("upload.txt"))
+
+		names, err := c.NameList(ctx, "")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"hello.txt", "upload.txt"}, names)
+
+		_, err = c.Retr(ctx, "missing.txt")
+		assert.Error(t, err)
+
+		assert.NoError(t, c.Quit())
+	}
+
+	t.Run("extended passive", func(t *testing.T) {
+		session(t, newFTPServer(t, false))
+	})
+
+	t.Run("passive", func(t *testing.T) {
+		session(t, newFTPServer(t, true))
+	})
+
+	t.Run("active", func(t *testing.T) {
+		session(t, newFTPServer(t, false), func(o *Options) {
+			o.Active = true
+			o.Binder = localBinder{}
+		})
+	})
+
+	t.Run("active through proxy", func(t *testing.T) {
+		session(t, newFTPServer(t, false), func(o *Options) {
+			o.Active = true
+			o.Binder = dialer
+		})
+	})
+
+	t.Run("active without binder", func(t *testing.T) {
+		_, err := Dial(ctx, dialer, "127.0.0.1:21", func(o *Options) {
+			o.Active = true
+		})
+		assert.EqualError(t, err, "ftp: active transfers require a Binder")
+	})
+}
+
+func TestParsePassivePort(t *testing.T) {
+	port, err := parsePassivePort(true, "Entering Extended Passive Mode (|||6446|)")
+	assert.NoError(t, err)
+	assert.Equal(t, 6446, port)
+
+	port, err = parsePassivePort(false, "Entering Passive Mode (192,168,1,2,25,46)")
+	assert.NoError(t, err)
+	assert.Equal(t, 6446, port)
+
+	_, err = parsePassivePort(true, "Entering Extended Passive Mode ()")
+	assert.Error(t, err)
+
+	_, err = parsePassivePort(false, "Entering Passive Mode (1,2,3)")
+	assert.Error(t, err)
+}
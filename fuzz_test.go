@@ -0,0 +1,110 @@
+//go:build go1.18
+// +build go1.18
+
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// assertDecodeError checks that err of a decoder is nil, a
+// *ProtocolError or the end of a truncated input.
+func assertDecodeError(t *testing.T, err error) {
+	var protocolErr *ProtocolError
+
+	if err == nil || errors.As(err, &protocolErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return
+	}
+
+	t.Fatalf("unexpected error type %T: %v", err, err)
+}
+
+func FuzzUsernamePasswordAuthRequest(f *testing.F) {
+	for _, length := range []int{0, 1, 255} {
+		b, err := (&UsernamePasswordAuthRequest{
+			Username: strings.Repeat("u", length),
+			Password: strings.Repeat("p", length),
+		}).MarshalBinary()
+		assert.NoError(f, err)
+
+		f.Add(b)
+
+		// Truncated within every field.
+		for _, n := range []int{0, 1, 2, len(b) - 1} {
+			if n >= 0 && n < len(b) {
+				f.Add(b[:n])
+			}
+		}
+	}
+
+	f.Add([]byte{0x05, 0x01, 'u', 0x01, 'p'})
+	f.Add([]byte{0x01, 0xff, 'u'})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req := &UsernamePasswordAuthRequest{}
+		err := req.UnmarshalBinary(b)
+		assertDecodeError(t, err)
+
+		// The server decodes from a buffered reader.
+		streamed := &UsernamePasswordAuthRequest{}
+		streamErr := streamed.decode(bufio.NewReader(bytes.NewReader(b)))
+		assert.Equal(t, err, streamErr)
+
+		if err != nil {
+			return
+		}
+
+		assert.Equal(t, req, streamed)
+
+		encoded, err := req.MarshalBinary()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		// The encoding is the consumed prefix of the input.
+		assert.Equal(t, b[:len(encoded)], encoded)
+	})
+}
+
+func FuzzUsernamePasswordAuthResponse(f *testing.F) {
+	for _, status := range []AuthStatus{AuthStatusSuccess, AuthStatusFailure} {
+		b, err := (&UsernamePasswordAuthResponse{Status: status}).MarshalBinary()
+		assert.NoError(f, err)
+
+		f.Add(b)
+		f.Add(b[:1])
+	}
+
+	f.Add([]byte{})
+	f.Add([]byte{0x05, 0x00})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		resp := &UsernamePasswordAuthResponse{}
+		err := resp.UnmarshalBinary(b)
+		assertDecodeError(t, err)
+
+		streamed := &UsernamePasswordAuthResponse{}
+		streamErr := streamed.decode(bufio.NewReader(bytes.NewReader(b)))
+		assert.Equal(t, err, streamErr)
+
+		if err != nil {
+			return
+		}
+
+		assert.Equal(t, resp, streamed)
+
+		encoded, err := resp.MarshalBinary()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, b[:len(encoded)], encoded)
+	})
+}
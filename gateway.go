@@ -0,0 +1,161 @@
+package socks
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/hupe1980/golog"
+)
+
+// Backend opens the streams of the CONNECT requests of a gateway, see
+// NewGatewayHandler, e.g. over a serial line, a Kubernetes port-forward
+// or the API of a cloud provider.
+type Backend interface {
+	// Open returns the stream to the destination of the request. A
+	// *DenialError is replied with its status.
+	Open(ctx context.Context, req *Request) (io.ReadWriteCloser, error)
+}
+
+// The BackendFunc type is an adapter to allow the use of ordinary
+// functions as backends.
+type BackendFunc func(ctx context.Context, req *Request) (io.ReadWriteCloser, error)
+
+// Open calls f(ctx, req).
+func (f BackendFunc) Open(ctx context.Context, req *Request) (io.ReadWriteCloser, error) {
+	return f(ctx, req)
+}
+
+type GatewayHandlerOptions struct {
+	// Logger specifies an optional logger.
+	// If nil, logging is done via the log package's standard logger.
+	Logger golog.Logger
+}
+
+// GatewayHandler is a RequestHandler which passes the CONNECT requests
+// to a Backend instead of dialing the targets and tunnels the returned
+// streams, turning the server into a SOCKS front-end of the backend. It
+// does not support BIND and ASSOCIATE requests.
+type GatewayHandler struct {
+	*logger
+	backend Backend
+}
+
+// NewGatewayHandler returns a new GatewayHandler of the backend, e.g. for
+// Options.Handler.
+func NewGatewayHandler(backend Backend, optFns ...func(*GatewayHandlerOptions)) *GatewayHandler {
+	options := GatewayHandlerOptions{
+		Logger: golog.NewGoLogger(golog.INFO, log.Default()),
+	}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	return &GatewayHandler{
+		logger:  &logger{options.Logger},
+		backend: backend,
+	}
+}
+
+// ServeSOCKS opens the stream of a CONNECT request and tunnels it.
+func (h *GatewayHandler) ServeSOCKS(ctx context.Context, conn *Conn, req *Request) error {
+	if req.CMD != ConnectCommand {
+		return conn.Write(h.rejection(req, Socks5StatusCMDNotSupported))
+	}
+
+	stream, err := h.backend.Open(ctx, req)
+	if err != nil {
+		h.fromContext(ctx).logErrorf("Backend failed to open %v: %v", req.Addr, err)
+
+		var denial *DenialError
+		if errors.As(err, &denial) {
+			// The denial is replied by the server.
+			return err
+		}
+
+		if writeErr := conn.Write(h.rejection(req, Socks5StatusHostUnreachable)); writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	target := newBackendConn(stream)
+
+	defer func() {
+		_ = target.Close()
+	}()
+
+	if session, ok := SessionFromContext(ctx); ok {
+		if _, isConn := stream.(net.Conn); isConn {
+			session.SetTargetAddr(target.RemoteAddr().String())
+		}
+
+		eventsFromContext(ctx).emit(EventSessionConnected, session, nil)
+	}
+
+	var reply encoding.BinaryMarshaler = &Socks4Response{Status: Socks4StatusGranted}
+
+	if req.Version == Socks5Version {
+		reply = &Socks5Response{Status: Socks5StatusGranted, Addr: "0.0.0.0:0"}
+	}
+
+	if err := conn.Write(reply); err != nil {
+		return err
+	}
+
+	return tunnel(ctx, conn, req, target)
+}
+
+// rejection returns the reply rejecting the request with status.
+func (h *GatewayHandler) rejection(req *Request, status Socks5Status) encoding.BinaryMarshaler {
+	if req.Version == Socks4Version {
+		return NewSocks4Rejection(req, false)
+	}
+
+	return &Socks5Response{Status: status}
+}
+
+// backendConn is the net.Conn of a stream of a Backend. Streams which
+// are no net.Conn have no addresses and deadlines.
+type backendConn struct {
+	io.ReadWriteCloser
+}
+
+func newBackendConn(stream io.ReadWriteCloser) net.Conn {
+	if conn, ok := stream.(net.Conn); ok {
+		return conn
+	}
+
+	return &backendConn{ReadWriteCloser: stream}
+}
+
+func (c *backendConn) LocalAddr() net.Addr { return backendAddr{} }
+
+func (c *backendConn) RemoteAddr() net.Addr { return backendAddr{} }
+
+func (c *backendConn) SetDeadline(t time.Time) error { return nil }
+
+func (c *backendConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c *backendConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// CloseWrite shuts down the writing side of the stream, if supported.
+func (c *backendConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+type backendAddr struct{}
+
+func (backendAddr) Network() string { return "backend" }
+
+func (backendAddr) String() string { return "backend" }
@@ -0,0 +1,97 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGatewayHandler(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	var opened []string
+
+	backend := BackendFunc(func(ctx context.Context, req *Request) (io.ReadWriteCloser, error) {
+		opened = append(opened, req.Addr)
+
+		switch req.Addr {
+		case "denied.example:80":
+			return nil, &DenialError{Socks5Status: Socks5StatusNotAllowed}
+		case "broken.example:80":
+			return nil, errors.New("backend down")
+		}
+
+		// The backend answers like an echo service.
+		client, backend := net.Pipe()
+
+		go func() {
+			defer backend.Close()
+
+			_, _ = io.Copy(backend, backend)
+		}()
+
+		return struct{ io.ReadWriteCloser }{client}, nil
+	})
+
+	server := New(func(o *Options) {
+		o.Handler = NewGatewayHandler(backend)
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	t.Run("socks5", func(t *testing.T) {
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", "echo.example:7")
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("hello"))
+		assert.NoError(t, err)
+
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+	})
+
+	t.Run("socks4", func(t *testing.T) {
+		conn, err := NewSocks4Dialer("tcp", listen.Addr().String()).Dial("tcp", "127.0.0.1:7")
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("hello"))
+		assert.NoError(t, err)
+
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		_, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", "denied.example:80")
+		assertSocks5Rejection(t, err, Socks5StatusNotAllowed)
+	})
+
+	t.Run("backend error", func(t *testing.T) {
+		_, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", "broken.example:80")
+		assertSocks5Rejection(t, err, Socks5StatusHostUnreachable)
+	})
+
+	t.Run("bind", func(t *testing.T) {
+		_, _, err := NewSocks5Dialer("tcp", listen.Addr().String()).Bind(context.Background(), "127.0.0.1:0")
+		assert.Error(t, err)
+	})
+
+	assert.Equal(t, []string{"echo.example:7", "127.0.0.1:7", "denied.example:80", "broken.example:80"}, opened)
+}
@@ -5,6 +5,7 @@ go 1.17
 require (
 	github.com/hupe1980/golog v0.0.2
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/sys v0.13.0
 )
 
 require (
@@ -0,0 +1,179 @@
+package socks
+
+import (
+	"bufio"
+	"encoding"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// wireMessage is a message which can be encoded and decoded.
+type wireMessage interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// readGolden reads the fixtures of a file of testdata/golden. The
+// fixtures are separated by blank lines, their first line is the name,
+// the following lines are the hex bytes. Lines starting with # are
+// comments.
+func readGolden(t *testing.T, file string) map[string][]byte {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join("testdata", "golden", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	fixtures := make(map[string][]byte)
+
+	var name string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case strings.HasPrefix(line, "#"):
+		case line == "":
+			name = ""
+		case name == "":
+			name = line
+			fixtures[name] = []byte{}
+		default:
+			b, err := hex.DecodeString(strings.ReplaceAll(line, " ", ""))
+			if err != nil {
+				t.Fatalf("%s: %s: %v", file, name, err)
+			}
+
+			fixtures[name] = append(fixtures[name], b...)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return fixtures
+}
+
+func TestGoldenMessages(t *testing.T) {
+	testCases := []struct {
+		file string
+		name string
+		msg  wireMessage
+		// variant specifies whether the fixture is only decoded, since
+		// the package encodes the message differently.
+		variant bool
+	}{
+		{"curl.hex", "method-select-no-auth", &MethodSelectRequest{Methods: []AuthMethod{AuthMethodNotRequired}}, false},
+		{"curl.hex", "method-select-user-pass", &MethodSelectRequest{Methods: []AuthMethod{AuthMethodNotRequired, AuthMethodUsernamePassword}}, false},
+		{"curl.hex", "user-pass-auth", &UsernamePasswordAuthRequest{Username: "user", Password: "pass"}, false},
+		{"curl.hex", "socks5-connect-fqdn", &Socks5Request{CMD: ConnectCommand, Addr: "example.com:443"}, false},
+		{"curl.hex", "socks5-connect-ipv4", &Socks5Request{CMD: ConnectCommand, Addr: "93.184.216.34:80"}, false},
+		{"curl.hex", "socks5-connect-ipv6", &Socks5Request{CMD: ConnectCommand, Addr: "[2606:2800:220:1:248:1893:25c8:1946]:443"}, false},
+		{"curl.hex", "socks4-connect", &Socks4Request{CMD: ConnectCommand, Addr: "93.184.216.34:80"}, false},
+		{"curl.hex", "socks4a-connect", &Socks4Request{CMD: ConnectCommand, Addr: "example.com:80"}, false},
+
+		{"openssh.hex", "method-select-reply", &MethodSelectResponse{Method: AuthMethodNotRequired}, false},
+		{"openssh.hex", "socks5-connect-reply", &Socks5Response{Status: Socks5StatusGranted}, false},
+		{"openssh.hex", "socks4-connect-reply", &Socks4Response{Status: Socks4StatusGranted}, false},
+
+		{"dante.hex", "user-pass-auth-success", &UsernamePasswordAuthResponse{Status: AuthStatusSuccess}, false},
+		{"dante.hex", "user-pass-auth-failure", &UsernamePasswordAuthResponse{Status: AuthStatus(0x01)}, false},
+		{"dante.hex", "socks5-connect-reply", &Socks5Response{Status: Socks5StatusGranted, Addr: "192.168.1.10:54321"}, false},
+		{"dante.hex", "socks5-connect-reply-ipv6", &Socks5Response{Status: Socks5StatusGranted, Addr: "[2001:db8::a]:54321"}, false},
+		{"dante.hex", "socks5-rejected-reply", &Socks5Response{Status: Socks5StatusNotAllowed}, false},
+		{"dante.hex", "socks5-associate-reply", &Socks5Response{Status: Socks5StatusGranted, Addr: "192.168.1.10:1080"}, false},
+		{"dante.hex", "udp-datagram", &UDPDatagram{Addr: "8.8.8.8:53", Data: []byte{0x12, 0x34, 0x01, 0x00}}, false},
+
+		{"putty.hex", "method-select-user-pass", &MethodSelectRequest{Methods: []AuthMethod{AuthMethodNotRequired, AuthMethodUsernamePassword}}, false},
+		{"putty.hex", "socks5-connect-fqdn", &Socks5Request{CMD: ConnectCommand, Addr: "github.com:22"}, false},
+		{"putty.hex", "socks4-connect-user-id", &Socks4Request{CMD: ConnectCommand, Addr: "192.168.1.1:22", UserID: "simon"}, false},
+		{"putty.hex", "socks5-connect-reply", &Socks5Response{Status: Socks5StatusGranted}, false},
+		{"putty.hex", "socks4-connect-reply", &Socks4Response{Status: Socks4StatusGranted}, false},
+
+		{"variants.hex", "socks4-reply-echo", &Socks4Response{Status: Socks4StatusGranted, Addr: "93.184.216.34:80"}, false},
+		{"variants.hex", "socks4a-connect-0-0-0-255", &Socks4Request{CMD: ConnectCommand, Addr: "example.com:80"}, true},
+		{"variants.hex", "socks5-reply-fqdn", &Socks5Response{Status: Socks5StatusGranted, Addr: "localhost:1080"}, false},
+		{"variants.hex", "method-select-duplicate", &MethodSelectRequest{Methods: []AuthMethod{AuthMethodNotRequired, AuthMethodUsernamePassword, AuthMethodNotRequired}}, false},
+		{"variants.hex", "user-pass-auth-empty", &UsernamePasswordAuthRequest{}, false},
+		{"variants.hex", "user-pass-auth-255", &UsernamePasswordAuthRequest{Username: strings.Repeat("u", 255), Password: "p"}, false},
+	}
+
+	fixtures := make(map[string]map[string][]byte)
+
+	for _, tc := range testCases {
+		tc := tc
+
+		if fixtures[tc.file] == nil {
+			fixtures[tc.file] = readGolden(t, tc.file)
+		}
+
+		golden, ok := fixtures[tc.file][tc.name]
+		if !ok {
+			t.Fatalf("%s: no fixture %s", tc.file, tc.name)
+		}
+
+		t.Run(strings.TrimSuffix(tc.file, ".hex")+"/"+tc.name, func(t *testing.T) {
+			if !tc.variant {
+				b, err := tc.msg.MarshalBinary()
+				assert.NoError(t, err)
+				assert.Equal(t, hex.EncodeToString(golden), hex.EncodeToString(b))
+			}
+
+			// A new message of the same type decodes the fixture.
+			got := newWireMessage(tc.msg)
+			assert.NoError(t, got.UnmarshalBinary(golden))
+			assert.Equal(t, tc.msg, got)
+		})
+	}
+
+	// Every fixture is covered by a test case.
+	for file, named := range fixtures {
+		for name := range named {
+			covered := false
+
+			for _, tc := range testCases {
+				if tc.file == file && tc.name == name {
+					covered = true
+					break
+				}
+			}
+
+			assert.True(t, covered, "%s: fixture %s without test case", file, name)
+		}
+	}
+}
+
+func newWireMessage(msg wireMessage) wireMessage {
+	switch msg.(type) {
+	case *MethodSelectRequest:
+		return &MethodSelectRequest{}
+	case *MethodSelectResponse:
+		return &MethodSelectResponse{}
+	case *UsernamePasswordAuthRequest:
+		return &UsernamePasswordAuthRequest{}
+	case *UsernamePasswordAuthResponse:
+		return &UsernamePasswordAuthResponse{}
+	case *Socks4Request:
+		return &Socks4Request{}
+	case *Socks4Response:
+		return &Socks4Response{}
+	case *Socks5Request:
+		return &Socks5Request{}
+	case *Socks5Response:
+		return &Socks5Response{}
+	case *UDPDatagram:
+		return &UDPDatagram{}
+	default:
+		panic("unknown message type")
+	}
+}
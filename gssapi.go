@@ -0,0 +1,192 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// GSSAPIVersion1 is the version of the GSS-API subnegotiation (RFC 1961).
+const GSSAPIVersion1 = 0x01
+
+type GSSAPIMessageType uint8
+
+const (
+	GSSAPIMessageAuthentication GSSAPIMessageType = 0x01
+	GSSAPIMessageProtection     GSSAPIMessageType = 0x02
+	GSSAPIMessageEncapsulation  GSSAPIMessageType = 0x03
+	GSSAPIMessageAbort          GSSAPIMessageType = 0xff
+)
+
+// maxGSSAPITokenLen is the maximum token length of a GSS-API message.
+const maxGSSAPITokenLen = 0xffff
+
+// gssapiChunkSize is the maximum size of user data wrapped into a
+// single encapsulation message, leaving room for the token overhead.
+const gssapiChunkSize = 32 * 1024
+
+// GSSAPIContext is an established GSS-API security context which
+// provides per-message protection.
+type GSSAPIContext interface {
+	// Wrap protects p and returns the resulting token.
+	Wrap(p []byte) ([]byte, error)
+
+	// Unwrap verifies the token and returns the contained data.
+	Unwrap(token []byte) ([]byte, error)
+}
+
+type GSSAPIMessage struct {
+	Type  GSSAPIMessageType
+	Token []byte
+}
+
+func (m *GSSAPIMessage) String() string {
+	return fmt.Sprintf("GSS-API message type=%d len=%d", m.Type, len(m.Token))
+}
+
+func (m *GSSAPIMessage) MarshalBinary() ([]byte, error) {
+	if m.Type == GSSAPIMessageAbort {
+		return []byte{GSSAPIVersion1, byte(m.Type)}, nil
+	}
+
+	if len(m.Token) > maxGSSAPITokenLen {
+		return nil, errors.New("GSS-API token too long")
+	}
+
+	b := []byte{GSSAPIVersion1, byte(m.Type), byte(len(m.Token) >> 8), byte(len(m.Token))}
+
+	return append(b, m.Token...), nil
+}
+
+func (m *GSSAPIMessage) UnmarshalBinary(p []byte) error {
+	return m.readFrom(bytes.NewReader(p))
+}
+
+func (m *GSSAPIMessage) readFrom(r io.Reader) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+
+	if header[0] != GSSAPIVersion1 {
+		return newProtocolError("GSS-API message", fmt.Sprintf("version %d", GSSAPIVersion1), fmt.Sprintf("version %d", header[0]), header)
+	}
+
+	m.Type = GSSAPIMessageType(header[1])
+
+	if m.Type == GSSAPIMessageAbort {
+		m.Token = nil
+		return nil
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return err
+	}
+
+	m.Token = make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(r, m.Token); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// gssapiConn encapsulates all data in GSS-API protected messages
+// as required by RFC 1961 once integrity or confidentiality has been
+// negotiated.
+type gssapiConn struct {
+	net.Conn
+	reader  io.Reader
+	ctx     GSSAPIContext
+	pending []byte
+}
+
+// NewGSSAPIConn returns a connection which encapsulates all data
+// written to and read from conn in GSS-API protected messages.
+func NewGSSAPIConn(conn net.Conn, ctx GSSAPIContext) net.Conn {
+	return &gssapiConn{
+		Conn:   conn,
+		reader: conn,
+		ctx:    ctx,
+	}
+}
+
+func (c *gssapiConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		m := &GSSAPIMessage{}
+		if err := m.readFrom(c.reader); err != nil {
+			return 0, err
+		}
+
+		switch m.Type {
+		case GSSAPIMessageEncapsulation:
+		case GSSAPIMessageAbort:
+			return 0, errors.New("GSS-API abort message received")
+		default:
+			return 0, newProtocolError("GSS-API message", fmt.Sprintf("message type %d", GSSAPIMessageEncapsulation), fmt.Sprintf("message type %d", m.Type), []byte{byte(m.Type)})
+		}
+
+		data, err := c.ctx.Unwrap(m.Token)
+		if err != nil {
+			return 0, err
+		}
+
+		c.pending = data
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+func (c *gssapiConn) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > gssapiChunkSize {
+			chunk = chunk[:gssapiChunkSize]
+		}
+
+		token, err := c.ctx.Wrap(chunk)
+		if err != nil {
+			return written, err
+		}
+
+		b, err := (&GSSAPIMessage{Type: GSSAPIMessageEncapsulation, Token: token}).MarshalBinary()
+		if err != nil {
+			return written, err
+		}
+
+		if _, err := c.Conn.Write(b); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// SetGSSAPIContext enables the GSS-API message protection for all
+// subsequent requests, replies and tunneled data. It must be called by
+// the AuthenticateFunc of both ends once the GSS-API subnegotiation has
+// established integrity or confidentiality protection.
+func (c *Conn) SetGSSAPIContext(ctx GSSAPIContext) {
+	gc := &gssapiConn{
+		Conn:   c.conn,
+		reader: c.reader, // keep data already buffered
+		ctx:    ctx,
+	}
+
+	c.conn = gc
+	c.reader = bufio.NewReader(gc)
+	c.writer = &connWriter{w: gc, stats: c.stats}
+}
@@ -0,0 +1,105 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type xorGSSAPIContext struct {
+	key byte
+}
+
+func (c *xorGSSAPIContext) Wrap(p []byte) ([]byte, error) {
+	token := make([]byte, len(p))
+	for i, b := range p {
+		token[i] = b ^ c.key
+	}
+
+	return token, nil
+}
+
+func (c *xorGSSAPIContext) Unwrap(token []byte) ([]byte, error) {
+	return c.Wrap(token)
+}
+
+func TestGSSAPIMessage(t *testing.T) {
+	m := &GSSAPIMessage{
+		Type:  GSSAPIMessageEncapsulation,
+		Token: []byte{0x01, 0x02},
+	}
+
+	b, err := m.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x01, 0x03, 0x00, 0x02, 0x01, 0x02}, b)
+
+	m2 := &GSSAPIMessage{}
+	assert.NoError(t, m2.UnmarshalBinary(b))
+	assert.Equal(t, m, m2)
+}
+
+func TestGSSAPIConn(t *testing.T) {
+	client, server := net.Pipe()
+
+	defer client.Close()
+	defer server.Close()
+
+	gssConn := NewGSSAPIConn(client, &xorGSSAPIContext{key: 0xff})
+
+	go func() {
+		_, _ = gssConn.Write([]byte("hi"))
+	}()
+
+	raw := make([]byte, 6)
+	_, err := io.ReadFull(server, raw)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x01, 0x03, 0x00, 0x02, 'h' ^ 0xff, 'i' ^ 0xff}, raw)
+}
+
+func TestSocks5GSSAPIProtection(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	authenticate := func(ctx context.Context, conn *Conn, am AuthMethod) error {
+		// The context establishment is skipped, only the message
+		// protection is exercised.
+		conn.SetGSSAPIContext(&xorGSSAPIContext{key: 0x5a})
+		return nil
+	}
+
+	server := New(func(o *Options) {
+		o.AuthMethods = []AuthMethod{AuthMethodGSSAPI}
+		o.Authenticate = authenticate
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+				o.AuthMethods = []AuthMethod{AuthMethodGSSAPI}
+				o.Authenticate = authenticate
+			})
+
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	resp, err := cli.Get(testServer.URL)
+	assert.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "hello", string(body))
+}
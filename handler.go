@@ -6,354 +6,588 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 type socks4Handler struct {
 	*logger
-	conn     *Conn
-	dialer   Dialer
-	listener Listener
-	ident    IdentFunc
+	conn      *Conn
+	ident     IdentFunc
+	trusted   *TrustedNetwork
+	tarpit    *TarpitOptions
+	hostnames *HostnameOptions
+	echoAddr  bool
+	hooks     *Hooks
+	handler   RequestHandler
 }
 
-func (h *socks4Handler) handle() error {
+func (h *socks4Handler) handle(ctx context.Context) error {
 	req := &Socks4Request{}
 	if err := h.conn.Read(req); err != nil {
+		if isProtocolError(err) {
+			_ = h.conn.Write(&Socks4Response{Status: Socks4StatusRejected})
+		}
+
 		return err
 	}
 
-	if h.ident != nil {
-		if err := h.ident(context.Background(), h.conn, req); err != nil {
-			return err
-		}
-	}
+	if h.ident != nil && h.trusted == nil {
+		if err := h.ident(ctx, h.conn, req); err != nil {
+			resp := NewSocks4Rejection(&Request{Addr: req.Addr}, h.echoAddr)
+
+			var identErr *IdentError
+			if errors.As(err, &identErr) {
+				resp.Status = identErr.Status
+			}
+
+			h.tarpit.wait()
+
+			if writeErr := h.conn.Write(resp); writeErr != nil {
+				return writeErr
+			}
 
-	switch req.CMD {
-	case ConnectCommand:
-		return h.handleConnect(req)
-	case BindCommand:
-		return h.handleBind(req)
-	case AssociateCommand:
-		fallthrough
-	default:
-		if err := h.conn.Write(&Socks4Response{
-			Status: Socks4StatusRejected,
-		}); err != nil {
 			return err
 		}
 	}
 
-	return nil
-}
+	addr, addrErr := canonicalRequestAddr(h.hostnames, req.Addr)
 
-func (h *socks4Handler) handleConnect(req *Socks4Request) error {
-	target, err := h.dialer.DialContext(context.Background(), "tcp", req.Addr)
-	if err != nil {
-		writeErr := h.conn.Write(&Socks4Response{
-			Status: Socks4StatusRejected,
-		})
-		if writeErr != nil {
-			return writeErr
+	session, _ := SessionFromContext(ctx)
+	if session != nil {
+		if h.trusted != nil && h.trusted.User != "" {
+			session.SetUser(h.trusted.User)
+		} else if req.UserID != "" {
+			session.SetUser(req.UserID)
 		}
 
-		return err
+		session.SetDestAddr(addr)
 	}
 
-	defer func() {
-		_ = target.Close()
-	}()
+	h.conn.endHandshake()
 
-	if err := h.conn.Write(&Socks4Response{
-		Status: Socks4StatusGranted,
-		Addr:   "",
-	}); err != nil {
-		return err
+	r := &Request{
+		Version: Socks4Version,
+		CMD:     req.CMD,
+		Addr:    addr,
+		UserID:  req.UserID,
 	}
 
-	return h.conn.Tunnel(target)
-}
+	if session != nil {
+		session.setRequest(r)
+	}
 
-func (h *socks4Handler) handleBind(req *Socks4Request) error {
-	listener, err := h.listener.Listen(context.Background(), "tcp", ":0") // use a free port
-	if err != nil {
-		writeErr := h.conn.Write(&Socks4Response{
-			Status: Socks4StatusRejected,
-		})
-		if writeErr != nil {
-			return writeErr
-		}
+	start := time.Now()
+	writes := h.conn.Stats().MessagesWritten
 
-		return err
+	err := addrErr
+	if err == nil {
+		err = h.handler.ServeSOCKS(ctx, h.conn, r)
 	}
 
-	if err = h.conn.Write(&Socks4Response{
-		Status: Socks4StatusGranted,
-		Addr:   listener.Addr().String(),
-	}); err != nil {
-		return err
+	if err != nil && h.conn.Stats().MessagesWritten == writes {
+		err = writeDenial(h.conn, r, err, h.echoAddr, h.tarpit)
 	}
 
-	conn, err := listener.Accept()
-	if err != nil {
-		writeErr := h.conn.Write(&Socks4Response{
-			Status: Socks4StatusRejected,
-			Addr:   conn.RemoteAddr().String(),
-		})
-		if writeErr != nil {
-			return writeErr
-		}
+	h.hooks.access(ctx, newAccessEvent(session, r, start, err))
 
-		return err
-	}
+	return err
+}
 
-	_ = listener.Close()
+// canonicalRequestAddr returns the destination of a request checked by
+// checkFQDN and handled by hostnames. An invalid destination is returned
+// unchanged with a *DenialError.
+func canonicalRequestAddr(hostnames *HostnameOptions, addr string) (string, error) {
+	if hostnames == nil || !hostnames.AllowInvalid {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil && net.ParseIP(host) == nil && !strings.HasPrefix(host, unixSocketPrefix) {
+			if err := checkFQDN(host); err != nil {
+				return addr, &DenialError{Socks5Status: Socks5StatusAddrTypeNotSupported, Err: err}
+			}
+		}
+	}
 
-	// The SOCKS server checks the IP address of the originating host against
-	// the value of DSTIP specified in the client's BIND request.
-	if err := checkIPAddr(req.Addr, conn.RemoteAddr().String()); err != nil {
-		_ = conn.Close()
+	canonical, err := hostnames.apply(addr)
+	if err != nil {
+		return addr, &DenialError{Socks5Status: Socks5StatusHostUnreachable, Err: err}
+	}
 
-		writeErr := h.conn.Write(&Socks4Response{
-			Status: Socks4StatusRejected,
-		})
-		if writeErr != nil {
-			return writeErr
-		}
+	return canonical, nil
+}
 
+// writeDenial writes the reply of a *DenialError returned by a handler
+// which did not reply after the delay of tarpit. It returns err, or the
+// error of the write.
+func writeDenial(conn *Conn, req *Request, err error, socks4EchoAddr bool, tarpit *TarpitOptions) error {
+	var denial *DenialError
+	if !errors.As(err, &denial) {
 		return err
 	}
 
-	// The SOCKS server sends a second reply packet to the client when the
-	// anticipated connection from the application server is established.
-	if err := h.conn.Write(&Socks4Response{
-		Status: Socks4StatusGranted,
-		Addr:   "",
-	}); err != nil {
-		return err
+	tarpit.wait()
+
+	if writeErr := conn.Write(denial.reply(req, socks4EchoAddr)); writeErr != nil {
+		return writeErr
 	}
 
-	return h.conn.Tunnel(conn)
+	return err
 }
 
 type socks5Handler struct {
 	*logger
-	conn         *Conn
-	dialer       Dialer
-	listener     Listener
-	authMethods  []AuthMethod
-	authenticate AuthenticateFunc
+	conn                    *Conn
+	authMethods             []AuthMethod
+	preferServerAuthMethods bool
+	disallowAuthDowngrade   bool
+	authenticate            AuthenticateFunc
+	trusted                 *TrustedNetwork
+	grace                   bool
+	logAuthMethods          bool
+	resumption              *resumption
+	notice                  NoticeFunc
+	tarpit                  *TarpitOptions
+	hostnames               *HostnameOptions
+	multiplex               bool
+	hooks                   *Hooks
+	metrics                 *metrics
+	handler                 RequestHandler
 }
 
-func (h *socks5Handler) handle() error {
+func (h *socks5Handler) handle(ctx context.Context) error {
 	methodSelectReq := &MethodSelectRequest{}
 	if err := h.conn.Read(methodSelectReq); err != nil {
+		if isProtocolError(err) {
+			_ = h.conn.Write(&MethodSelectResponse{Method: AuthMethodNoAcceptableMethods})
+		}
+
 		return err
 	}
 
+	if h.logAuthMethods {
+		h.logInfof("Client %s offers authentication methods %v", h.conn.RemoteAddr(), methodSelectReq.Methods)
+	}
+
+	session, _ := SessionFromContext(ctx)
+
 	method := h.selectAuthMethod(methodSelectReq.Methods)
 
-	if err := h.conn.Write(&MethodSelectResponse{
+	// Trusted clients skip the authentication if they can.
+	trusted := h.trusted != nil && offersAuthMethod(methodSelectReq.Methods, AuthMethodNotRequired)
+	if trusted {
+		method = AuthMethodNotRequired
+	} else if h.resumption != nil && offersAuthMethod(methodSelectReq.Methods, AuthMethodResumption) {
+		method = AuthMethodResumption
+	}
+
+	grace := false
+
+	if method == AuthMethodNoAcceptableMethods {
+		grace = h.grace && offersAuthMethod(methodSelectReq.Methods, AuthMethodNotRequired)
+
+		e := &MethodSelectEvent{
+			Session: session,
+			Offered: methodSelectReq.Methods,
+			Grace:   grace,
+		}
+
+		if session != nil {
+			e.ClientAddr = session.ClientAddr
+		}
+
+		h.metrics.noAcceptableMethods(grace)
+		h.hooks.noAcceptableMethods(ctx, e)
+
+		if grace {
+			method = AuthMethodNotRequired
+		} else {
+			h.tarpit.wait()
+		}
+	}
+
+	var notice *Notice
+	if h.notice != nil && offersAuthMethod(methodSelectReq.Methods, AuthMethodNotice) {
+		notice = h.notice(ctx, session)
+	}
+
+	if notice != nil {
+		if err := h.sendNotice(notice, method); err != nil {
+			return err
+		}
+	} else if err := h.conn.Write(&MethodSelectResponse{
 		Method: method,
 	}); err != nil {
 		return err
 	}
 
 	if method == AuthMethodNoAcceptableMethods {
-		return errors.New("no supported authentication method")
+		return newProtocolError("method selection", fmt.Sprintf("one of %v", h.authMethods), fmt.Sprintf("%v", methodSelectReq.Methods), nil)
 	}
 
-	if h.authenticate != nil {
-		if err := h.authenticate(context.Background(), h.conn, method); err != nil {
+	if trusted {
+		if session != nil && h.trusted.User != "" {
+			session.SetUser(h.trusted.User)
+		}
+
+		h.reportAuth(ctx, session, method, 0, nil)
+	} else if grace {
+		h.reportAuth(ctx, session, method, 0, nil)
+	} else if method == AuthMethodResumption {
+		if err := h.resume(ctx, session, methodSelectReq.Methods); err != nil {
 			return err
 		}
+	} else if err := h.runAuthenticate(ctx, session, method); err != nil {
+		return err
 	}
 
 	req := &Socks5Request{}
 	if err := h.conn.Read(req); err != nil {
-		return err
-	}
+		var protocolErr *ProtocolError
+		if errors.As(err, &protocolErr) {
+			status := Socks5StatusFailure
+			if protocolErr.Expected == addrTypeExpected {
+				status = Socks5StatusAddrTypeNotSupported
+			}
 
-	switch req.CMD {
-	case ConnectCommand:
-		return h.handleConnect(req)
-	case BindCommand:
-		return h.handleBind(req)
-	case AssociateCommand:
-		fallthrough
-	default:
-		if err := h.conn.Write(&Socks5Response{
-			Status: Socks5StatusCMDNotSupported,
-		}); err != nil {
-			return err
+			_ = h.conn.Write(&Socks5Response{Status: status})
 		}
+
+		return err
 	}
 
-	return nil
-}
+	h.conn.endHandshake()
 
-func (h *socks5Handler) selectAuthMethod(authMethods []AuthMethod) AuthMethod {
-	for _, dm := range authMethods {
-		for _, sm := range h.authMethods {
-			if dm == sm {
-				return dm
-			}
-		}
+	if req.CMD == MultiplexCommand && h.multiplex {
+		return h.serveMultiplex(ctx, session)
 	}
 
-	return AuthMethodNoAcceptableMethods
+	return h.serveRequest(ctx, session, h.conn, req)
 }
 
-func (h *socks5Handler) handleConnect(req *Socks5Request) error {
-	target, err := h.dialer.DialContext(context.Background(), "tcp", req.Addr)
-	if err != nil {
-		msg := err.Error()
-		status := Socks5StatusHostUnreachable
+func (h *socks5Handler) serveRequest(ctx context.Context, session *Session, conn *Conn, req *Socks5Request) error {
+	addr, addrErr := canonicalRequestAddr(h.hostnames, req.Addr)
 
-		if strings.Contains(msg, "refused") {
-			status = Socks5StatusConnectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			status = Socks5StatusNetworkUnreaachable
-		}
+	r := &Request{
+		Version: Socks5Version,
+		CMD:     req.CMD,
+		Addr:    addr,
+	}
 
-		writeErr := h.conn.Write(&Socks5Response{
-			Status: status,
-		})
-		if writeErr != nil {
-			return writeErr
-		}
+	if session != nil {
+		session.SetDestAddr(addr)
+		session.setRequest(r)
+	}
 
-		h.logErrorf("Connect to %v failed: %v", req.Addr, err)
+	start := time.Now()
+	writes := conn.Stats().MessagesWritten
 
-		return err
+	err := addrErr
+	if err == nil {
+		err = h.handler.ServeSOCKS(ctx, conn, r)
 	}
 
-	defer func() {
-		_ = target.Close()
-	}()
+	if err != nil && conn.Stats().MessagesWritten == writes {
+		err = writeDenial(conn, r, err, false, h.tarpit)
+	}
 
+	h.hooks.access(ctx, newAccessEvent(session, r, start, err))
+
+	return err
+}
+
+// serveMultiplex grants a MULTIPLEX request and serves the CONNECT
+// requests of the streams of the connection. Each stream gets its own
+// session, derived from the session of the connection.
+func (h *socks5Handler) serveMultiplex(ctx context.Context, session *Session) error {
 	if err := h.conn.Write(&Socks5Response{
 		Status: Socks5StatusGranted,
-		// In the reply to a CONNECT, BND.PORT contains the port number that the
-		// server assigned to connect to the target host, while BND.ADDR
-		// contains the associated IP address.
-		Addr: target.LocalAddr().String(),
+		Addr:   "0.0.0.0:0",
 	}); err != nil {
 		return err
 	}
 
-	return h.conn.Tunnel(target)
+	mux := newMuxSession(h.conn.conn, h.conn.reader, false)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	defer mux.Close()
+
+	for {
+		st, err := mux.acceptStream()
+		if err != nil {
+			if err == errMuxSessionClosed {
+				return nil
+			}
+
+			return err
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			defer func() {
+				_ = st.Close()
+			}()
+
+			if err := h.serveStream(ctx, session, st); err != nil {
+				h.logDebugf("Multiplexed stream %d failed: %v", st.id, err)
+			}
+		}()
+	}
 }
 
-func (h *socks5Handler) handleBind(req *Socks5Request) error {
-	listener, err := h.listener.Listen(context.Background(), "tcp", ":0")
-	if err != nil {
-		writeErr := h.conn.Write(&Socks5Response{
-			Status: Socks5StatusFailure,
+func (h *socks5Handler) serveStream(ctx context.Context, session *Session, st *muxStream) error {
+	conn := NewConn(st)
+
+	req := &Socks5Request{}
+	if err := conn.Read(req); err != nil {
+		return err
+	}
+
+	// BIND and ASSOCIATE need connections of their own.
+	if req.CMD != ConnectCommand {
+		return conn.Write(&Socks5Response{
+			Status: Socks5StatusCMDNotSupported,
 		})
-		if writeErr != nil {
-			return writeErr
+	}
+
+	if session != nil {
+		session = session.stream(st.id)
+		ctx = WithSession(ctx, session)
+		conn.session = session
+		conn.limiter = h.conn.limiter
+
+		if l, ok := LoggerFromContext(ctx); ok {
+			if sl, ok := l.(*sessionLogger); ok {
+				ctx = WithLogger(ctx, SessionLogger(sl.Logger, session))
+			}
 		}
+	}
 
-		return err
+	return h.serveRequest(ctx, session, conn, req)
+}
+
+// runAuthenticate performs the subnegotiation of method with the
+// AuthenticateFunc, if any.
+func (h *socks5Handler) runAuthenticate(ctx context.Context, session *Session, method AuthMethod) error {
+	if h.authenticate == nil {
+		return nil
 	}
 
-	if err = h.conn.Write(&Socks5Response{
-		Status: Socks5StatusGranted,
-		Addr:   listener.Addr().String(),
-	}); err != nil {
+	start := time.Now()
+	writes := h.conn.Stats().MessagesWritten
+	err := h.authenticate(ctx, h.conn, method)
+	h.reportAuth(ctx, session, method, time.Since(start), err)
+
+	var panicErr *AuthPanicError
+
+	switch {
+	case errors.As(err, &panicErr):
+		h.logErrorf("Panic in AuthenticateFunc: %v\n%s", panicErr.Value, panicErr.Stack)
+		h.metrics.authPanic()
+	case errors.Is(err, ErrAuthTimeout):
+		// The AuthenticateFunc may still use the connection.
+		h.metrics.authTimeout()
 		return err
 	}
 
-	conn, err := listener.Accept()
 	if err != nil {
-		writeErr := h.conn.Write(&Socks5Response{
-			Status: Socks5StatusFailure,
-		})
-		if writeErr != nil {
-			return writeErr
+		h.tarpit.wait()
+
+		// The client waits for the status of the subnegotiation if the
+		// function failed before replying.
+		if method == AuthMethodUsernamePassword && h.conn.Stats().MessagesWritten == writes {
+			_ = h.conn.Write(&UsernamePasswordAuthResponse{Status: AuthStatusFailure})
 		}
 
 		return err
 	}
 
-	_ = listener.Close()
+	return nil
+}
 
-	if err := checkIPAddr(req.Addr, conn.RemoteAddr().String()); err != nil {
-		_ = conn.Close()
+// sendNotice selects AuthMethodNotice and sends the notice carrying the
+// selected method.
+func (h *socks5Handler) sendNotice(notice *Notice, method AuthMethod) error {
+	n := *notice
+	n.Method = method
 
-		writeErr := h.conn.Write(&Socks5Response{
-			Status: Socks5StatusFailure,
-		})
-		if writeErr != nil {
-			return writeErr
-		}
+	if n.Disconnect {
+		n.Method = AuthMethodNoAcceptableMethods
+	}
 
+	if err := h.conn.Write(&MethodSelectResponse{Method: AuthMethodNotice}); err != nil {
 		return err
 	}
 
-	if err := h.conn.Write(&Socks5Response{
-		Status: Socks5StatusGranted,
-		Addr:   conn.RemoteAddr().String(),
-	}); err != nil {
+	if err := h.conn.Write(&n); err != nil {
 		return err
 	}
 
-	return h.conn.Tunnel(conn)
+	if n.Disconnect {
+		return &NoticeError{Notice: &n}
+	}
+
+	return nil
 }
 
-func (h *socks5Handler) handleAssociate(req *Socks5Request) error {
-	var lc net.ListenConfig
+// resume performs the subnegotiation of AuthMethodResumption. Without a
+// valid token, the client authenticates with one of its other methods
+// and gets a token afterwards.
+func (h *socks5Handler) resume(ctx context.Context, session *Session, offered []AuthMethod) error {
+	start := time.Now()
 
-	udpConn, err := lc.ListenPacket(context.Background(), "udp", ":0")
-	if err != nil {
-		writeErr := h.conn.Write(&Socks5Response{
-			Status: Socks5StatusFailure,
-		})
-		if writeErr != nil {
-			return writeErr
+	req := &ResumptionRequest{}
+	if err := h.conn.Read(req); err != nil {
+		return err
+	}
+
+	if user, ok := h.resumption.verify(req.Token, h.conn.RemoteAddr()); ok {
+		if session != nil {
+			session.SetUser(user)
 		}
 
-		return err
+		if err := h.conn.Write(&ResumptionResponse{Status: ResumptionStatusResumed}); err != nil {
+			return err
+		}
+
+		h.reportAuth(ctx, session, AuthMethodResumption, time.Since(start), nil)
+
+		return nil
 	}
 
-	defer func() {
-		_ = udpConn.Close()
-	}()
+	method := h.selectAuthMethod(offered)
+	if method == AuthMethodNoAcceptableMethods {
+		h.tarpit.wait()
+	}
 
-	if err = h.conn.Write(&Socks5Response{
-		Status: Socks5StatusGranted,
-		Addr:   udpConn.LocalAddr().String(),
+	if err := h.conn.Write(&ResumptionResponse{
+		Status: ResumptionStatusAuthenticate,
+		Method: method,
 	}); err != nil {
 		return err
 	}
 
-	// A UDP association terminates when the TCP connection that the UDP
-	// ASSOCIATE request arrived on terminates.
-	go func() {
-		h.conn.WaitForClose()
+	if method == AuthMethodNoAcceptableMethods {
+		return newProtocolError("resumption", fmt.Sprintf("one of %v", h.authMethods), fmt.Sprintf("%v", offered), nil)
+	}
 
-		_ = udpConn.Close()
-	}()
+	if err := h.runAuthenticate(ctx, session, method); err != nil {
+		return err
+	}
 
-	// TODO
+	if err := h.conn.Read(&ResumptionTicketRequest{}); err != nil {
+		return err
+	}
 
-	return nil
+	ticket := &ResumptionTicket{TTL: h.resumption.ttl}
+
+	// A resumed session would lack the message protection of GSS-API.
+	if _, protected := h.conn.conn.(*gssapiConn); !protected && method != AuthMethodNotRequired {
+		var user string
+		if session != nil {
+			user = session.User()
+		}
+
+		ticket.Token = h.resumption.issue(method, user, h.conn.RemoteAddr())
+	}
+
+	return h.conn.Write(ticket)
 }
 
-func checkIPAddr(expected, actual string) error {
-	expectedIP, _, err := net.SplitHostPort(expected)
-	if err != nil {
-		return err
+func (h *socks5Handler) reportAuth(ctx context.Context, session *Session, method AuthMethod, latency time.Duration, err error) {
+	e := &AuthEvent{
+		Session: session,
+		Method:  method,
+		Latency: latency,
+		Err:     err,
 	}
 
-	actualIP, _, err := net.SplitHostPort(actual)
-	if err != nil {
-		return err
+	if session != nil {
+		e.User = session.User()
+		e.ClientAddr = session.ClientAddr
 	}
 
-	if expectedIP != actualIP {
-		return fmt.Errorf("ip mismatch. Expected %s. Got %s", expectedIP, actualIP)
+	h.metrics.auth(err == nil, latency)
+
+	if err == nil {
+		eventsFromContext(ctx).emit(EventSessionAuthenticated, session, nil)
 	}
 
-	return nil
+	h.hooks.auth(ctx, e)
+}
+
+func (h *socks5Handler) selectAuthMethod(authMethods []AuthMethod) AuthMethod {
+	preferred, supported := authMethods, h.authMethods
+	if h.preferServerAuthMethods {
+		preferred, supported = h.authMethods, authMethods
+	}
+
+	downgrade := h.disallowAuthDowngrade && h.offersStrongerAuthMethod(authMethods)
+
+	for _, pm := range preferred {
+		if pm == AuthMethodNotRequired && downgrade {
+			continue
+		}
+
+		for _, sm := range supported {
+			if pm == sm {
+				return pm
+			}
+		}
+	}
+
+	return AuthMethodNoAcceptableMethods
+}
+
+func offersAuthMethod(authMethods []AuthMethod, method AuthMethod) bool {
+	for _, m := range authMethods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// offersStrongerAuthMethod reports whether the client offers an
+// authentication method of the server other than AuthMethodNotRequired.
+// The private methods of this package, e.g. AuthMethodNotice, signal
+// extensions and do not authenticate.
+func (h *socks5Handler) offersStrongerAuthMethod(authMethods []AuthMethod) bool {
+	for _, m := range authMethods {
+		switch m {
+		case AuthMethodNotRequired, AuthMethodNoAcceptableMethods, AuthMethodNotice, AuthMethodResumption:
+			continue
+		}
+
+		if offersAuthMethod(h.authMethods, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newAccessEvent(session *Session, req *Request, start time.Time, err error) *AccessEvent {
+	e := &AccessEvent{
+		Session:     session,
+		Version:     req.Version,
+		CMD:         req.CMD,
+		Addr:        req.Addr,
+		Duration:    time.Since(start),
+		Err:         err,
+		CloseReason: classifyClose(session, err),
+	}
+
+	if session != nil {
+		session.setCloseReason(e.CloseReason)
+		e.User = session.User()
+		e.ClientAddr = session.ClientAddr
+		e.TargetAddr = session.TargetAddr()
+	}
+
+	return e
 }
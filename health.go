@@ -0,0 +1,172 @@
+package socks
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// HealthChecker checks whether an upstream dialer is usable.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context, d Dialer) error
+}
+
+// The HealthCheckerFunc type is an adapter to allow the use of ordinary
+// functions as health checkers.
+type HealthCheckerFunc func(ctx context.Context, d Dialer) error
+
+// CheckHealth calls f(ctx, d).
+func (f HealthCheckerFunc) CheckHealth(ctx context.Context, d Dialer) error {
+	return f(ctx, d)
+}
+
+// MethodSelectHealthChecker returns the default HealthChecker. For a
+// Socks5Dialer it connects to the proxy, negotiates the method
+// selection without authenticating and closes the connection. For a
+// Socks4Dialer it connects to the proxy. Other dialers are healthy.
+func MethodSelectHealthChecker() HealthChecker {
+	return HealthCheckerFunc(func(ctx context.Context, d Dialer) error {
+		switch d := d.(type) {
+		case *Socks5Dialer:
+			return d.checkHealth(ctx)
+		case *Socks4Dialer:
+			conn, err := d.dialProxy(ctx)
+			if err != nil {
+				return err
+			}
+
+			return conn.Close()
+		default:
+			return nil
+		}
+	})
+}
+
+// DialHealthChecker returns a HealthChecker which connects to addr
+// through the dialer and closes the connection.
+func DialHealthChecker(addr string) HealthChecker {
+	return HealthCheckerFunc(func(ctx context.Context, d Dialer) error {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	})
+}
+
+// HealthCheckOptions specifies the health checks of the dialers of a
+// pool.
+type HealthCheckOptions struct {
+	// Checker specifies the optional health checker.
+	// If nil, MethodSelectHealthChecker is used.
+	Checker HealthChecker
+
+	// Interval specifies the interval of the health checks.
+	// If zero, the dialers are never checked and always healthy.
+	Interval time.Duration
+
+	// Jitter specifies the maximum random delay added to each
+	// interval, spreading the checks of many dialers.
+	Jitter time.Duration
+
+	// Timeout specifies the timeout of a single check.
+	// If zero, Interval is used.
+	Timeout time.Duration
+
+	// FailureThreshold specifies the number of consecutive failed
+	// checks after which a dialer is unhealthy. If zero, one failed
+	// check is sufficient.
+	FailureThreshold int
+
+	// SuccessThreshold specifies the number of consecutive successful
+	// checks after which an unhealthy dialer is healthy again. If
+	// zero, one successful check is sufficient.
+	SuccessThreshold int
+}
+
+// UpstreamStatus describes the health of an upstream dialer of a pool.
+type UpstreamStatus struct {
+	Pool                string
+	Index               int
+	Healthy             bool
+	ConsecutiveFailures int
+	LastCheck           time.Time
+	LastErr             error
+}
+
+type healthState struct {
+	mu        sync.Mutex
+	healthy   bool
+	failures  int
+	successes int
+	lastCheck time.Time
+	lastErr   error
+}
+
+func newHealthState() *healthState {
+	return &healthState{healthy: true}
+}
+
+func (s *healthState) isHealthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.healthy
+}
+
+// record records the result of a check and reports whether the health
+// changed. The thresholds of opts must be positive.
+func (s *healthState) record(opts *HealthCheckOptions, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastCheck = time.Now()
+	s.lastErr = err
+
+	if err != nil {
+		s.failures++
+		s.successes = 0
+
+		if s.healthy && s.failures >= opts.FailureThreshold {
+			s.healthy = false
+			return true
+		}
+
+		return false
+	}
+
+	s.successes++
+	s.failures = 0
+
+	if !s.healthy && s.successes >= opts.SuccessThreshold {
+		s.healthy = true
+		return true
+	}
+
+	return false
+}
+
+func (s *healthState) status(pool string, index int) UpstreamStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return UpstreamStatus{
+		Pool:                pool,
+		Index:               index,
+		Healthy:             s.healthy,
+		ConsecutiveFailures: s.failures,
+		LastCheck:           s.lastCheck,
+		LastErr:             s.lastErr,
+	}
+}
+
+// nextHealthCheck returns the delay until the next check.
+func nextHealthCheck(opts *HealthCheckOptions) time.Duration {
+	if opts.Jitter <= 0 {
+		return opts.Interval
+	}
+
+	return opts.Interval + time.Duration(rand.Int63n(int64(opts.Jitter))) //nolint:gosec // jitter only
+}
@@ -0,0 +1,211 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// AuthEvent describes the outcome of a SOCKS5 authentication.
+type AuthEvent struct {
+	Session    *Session
+	Method     AuthMethod
+	User       string
+	ClientAddr net.Addr
+	Latency    time.Duration
+	Err        error
+}
+
+// Success reports whether the authentication succeeded.
+func (e *AuthEvent) Success() bool {
+	return e.Err == nil
+}
+
+// MethodSelectEvent describes a SOCKS5 method selection without an
+// acceptable authentication method.
+type MethodSelectEvent struct {
+	Session    *Session
+	ClientAddr net.Addr
+
+	// Offered are the methods offered by the client.
+	Offered []AuthMethod
+
+	// Grace reports whether AuthMethodNotRequired was selected anyway
+	// for a client of Options.NoAuthGraceNetworks.
+	Grace bool
+}
+
+// AccessEvent describes a handled request. It is emitted once the
+// request has been processed, e.g. when the tunnel is closed.
+type AccessEvent struct {
+	Session    *Session
+	User       string
+	ClientAddr net.Addr
+	Version    Version
+	CMD        Command
+	Addr       string
+
+	// TargetAddr is the remote address of the connection to the
+	// target, e.g. the IP address a FQDN destination resolved to.
+	TargetAddr string
+
+	Duration time.Duration
+	Err      error
+
+	// CloseReason classifies the end of the request, e.g. whether the
+	// client or the target closed the tunnel.
+	CloseReason CloseReason
+}
+
+// DatagramEvent describes a datagram of a UDP association.
+type DatagramEvent struct {
+	Session *Session
+
+	// ToClient reports whether the datagram is returned from a target
+	// to the client.
+	ToClient bool
+
+	// Addr is the address of the target.
+	Addr string
+
+	// Data is the payload. It is only valid during the call.
+	Data []byte
+
+	// Dropped reports whether the datagram was dropped because of the
+	// size or flow limits or the rule set.
+	Dropped bool
+}
+
+// UDPRejectedEvent describes a UDP association rejected because
+// UDPOptions.Disabled is set.
+type UDPRejectedEvent struct {
+	Session *Session
+	Request *Request
+
+	// Err is the error the request is rejected with, a *DenialError.
+	Err error
+}
+
+// EstablishedEvent describes a tunnel of the default handler before the
+// relaying begins.
+type EstablishedEvent struct {
+	Session *Session
+	Request *Request
+
+	// Client is the connection to the client. Writes are counted like
+	// the tunneled data.
+	Client net.Conn
+
+	// Target is the connection to the target or to the peer of a BIND
+	// request.
+	Target net.Conn
+}
+
+// Hooks specifies optional callbacks for server events. Hooks are
+// called synchronously and must not block.
+type Hooks struct {
+	// OnAuth is called after each SOCKS5 authentication attempt.
+	OnAuth func(ctx context.Context, e *AuthEvent)
+
+	// OnNoAcceptableMethods is called when none of the authentication
+	// methods offered by a SOCKS5 client is acceptable.
+	OnNoAcceptableMethods func(ctx context.Context, e *MethodSelectEvent)
+
+	// OnAccess is called for every handled request and carries the
+	// identity of the authenticated user.
+	OnAccess func(ctx context.Context, e *AccessEvent)
+
+	// OnDrain is called periodically during Shutdown with the
+	// progress of the connection draining.
+	OnDrain func(ctx context.Context, s *DrainStatus)
+
+	// OnBlocklistLoad is called by a Blocklist after each load of a
+	// source, including failed loads.
+	OnBlocklistLoad func(ctx context.Context, e *BlocklistEvent)
+
+	// OnUpstreamHealth is called by a Router when an upstream dialer
+	// becomes unhealthy or healthy again.
+	OnUpstreamHealth func(ctx context.Context, s *UpstreamStatus)
+
+	// OnDatagram is called for the datagrams of UDP associations of
+	// the default handler, sampled by UDPOptions.DatagramSampling,
+	// e.g. to debug protocols like QUIC over the relay.
+	OnDatagram func(ctx context.Context, e *DatagramEvent)
+
+	// OnUDPRejected is called by the default handler for the UDP
+	// associations rejected because UDPOptions.Disabled is set.
+	OnUDPRejected func(ctx context.Context, e *UDPRejectedEvent)
+
+	// OnEstablished is called by the default handler after the success
+	// reply and before the tunnel starts. It may write initial bytes to
+	// either connection, e.g. a PROXY protocol header or a banner. An
+	// error closes the connections.
+	OnEstablished func(ctx context.Context, e *EstablishedEvent) error
+}
+
+func (h *Hooks) auth(ctx context.Context, e *AuthEvent) {
+	if h != nil && h.OnAuth != nil {
+		h.OnAuth(ctx, e)
+	}
+}
+
+func (h *Hooks) noAcceptableMethods(ctx context.Context, e *MethodSelectEvent) {
+	if h != nil && h.OnNoAcceptableMethods != nil {
+		h.OnNoAcceptableMethods(ctx, e)
+	}
+}
+
+func (h *Hooks) access(ctx context.Context, e *AccessEvent) {
+	if h != nil && h.OnAccess != nil {
+		h.OnAccess(ctx, e)
+	}
+}
+
+func (h *Hooks) drain(ctx context.Context, s *DrainStatus) {
+	if h != nil && h.OnDrain != nil {
+		h.OnDrain(ctx, s)
+	}
+}
+
+func (h *Hooks) blocklistLoad(ctx context.Context, e *BlocklistEvent) {
+	if h != nil && h.OnBlocklistLoad != nil {
+		h.OnBlocklistLoad(ctx, e)
+	}
+}
+
+func (h *Hooks) upstreamHealth(ctx context.Context, s *UpstreamStatus) {
+	if h != nil && h.OnUpstreamHealth != nil {
+		h.OnUpstreamHealth(ctx, s)
+	}
+}
+
+func (h *Hooks) datagram(ctx context.Context, e *DatagramEvent) {
+	if h != nil && h.OnDatagram != nil {
+		h.OnDatagram(ctx, e)
+	}
+}
+
+func (h *Hooks) udpRejected(ctx context.Context, e *UDPRejectedEvent) {
+	if h != nil && h.OnUDPRejected != nil {
+		h.OnUDPRejected(ctx, e)
+	}
+}
+
+func (h *Hooks) established(ctx context.Context, e *EstablishedEvent) error {
+	if h != nil && h.OnEstablished != nil {
+		return h.OnEstablished(ctx, e)
+	}
+
+	return nil
+}
+
+type hooksKey struct{}
+
+func withHooks(ctx context.Context, h *Hooks) context.Context {
+	return context.WithValue(ctx, hooksKey{}, h)
+}
+
+func hooksFromContext(ctx context.Context) *Hooks {
+	h, _ := ctx.Value(hooksKey{}).(*Hooks)
+	return h
+}
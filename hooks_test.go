@@ -0,0 +1,96 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnEstablished(t *testing.T) {
+	// The target echoes the first line it receives.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer target.Close()
+
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err == nil {
+					_, _ = io.WriteString(conn, line)
+				}
+			}()
+		}
+	}()
+
+	serve := func(t *testing.T, fn func(ctx context.Context, e *EstablishedEvent) error) string {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		t.Cleanup(func() { _ = listen.Close() })
+
+		server := New(func(o *Options) {
+			o.Hooks.OnEstablished = fn
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		return listen.Addr().String()
+	}
+
+	t.Run("priming", func(t *testing.T) {
+		addr := serve(t, func(ctx context.Context, e *EstablishedEvent) error {
+			assert.NotNil(t, e.Session)
+			assert.Equal(t, target.Addr().String(), e.Request.Addr)
+
+			if _, err := io.WriteString(e.Client, "banner\n"); err != nil {
+				return err
+			}
+
+			_, err := io.WriteString(e.Target, "primed\n")
+
+			return err
+		})
+
+		conn, err := NewSocks5Dialer("tcp", addr).Dial("tcp", target.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		b, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "banner\nprimed\n", string(b))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		addr := serve(t, func(ctx context.Context, e *EstablishedEvent) error {
+			return errors.New("refused")
+		})
+
+		conn, err := NewSocks5Dialer("tcp", addr).Dial("tcp", target.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("hello\n"))
+		assert.NoError(t, err)
+
+		b, _ := io.ReadAll(conn)
+		assert.Empty(t, b)
+	})
+}
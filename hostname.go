@@ -0,0 +1,291 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxHostnameLen is the maximum length of a host name without the
+// trailing dot.
+const maxHostnameLen = 253
+
+// HostnameOptions specifies the handling of FQDN destination host names.
+type HostnameOptions struct {
+	// Canonicalize converts host names to their canonical form, see
+	// CanonicalHostname. Malformed host names are passed unchanged
+	// unless RejectMalformed is set.
+	Canonicalize bool
+
+	// RejectNonASCII rejects host names with non-ASCII characters
+	// instead of converting them to punycode.
+	RejectNonASCII bool
+
+	// RejectMalformed rejects host names which are not valid DNS names,
+	// e.g. with empty or too long labels.
+	RejectMalformed bool
+
+	// AllowInvalid disables the validation of the RFC 1035 constraints
+	// of FQDN destinations by the server, e.g. for handlers resolving
+	// names of other namespaces.
+	AllowInvalid bool
+}
+
+// apply returns addr with the host name handled by the options. IP
+// addresses and Unix socket destinations are returned unchanged.
+func (o *HostnameOptions) apply(addr string) (string, error) {
+	if o == nil || !o.Canonicalize && !o.RejectNonASCII && !o.RejectMalformed {
+		return addr, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil || strings.HasPrefix(host, unixSocketPrefix) {
+		return addr, nil
+	}
+
+	if o.RejectNonASCII && !isASCII(host) {
+		return "", fmt.Errorf("socks: non-ASCII host name %q", host)
+	}
+
+	canonical, err := CanonicalHostname(host)
+	if err != nil {
+		if o.RejectMalformed {
+			return "", err
+		}
+
+		return addr, nil
+	}
+
+	if o.Canonicalize {
+		host = canonical
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// checkFQDN checks the RFC 1035 constraints of a FQDN destination:
+// labels of 1 to 63 bytes, at most 253 bytes without a trailing dot and
+// no ASCII characters but letters, digits, hyphens and underscores.
+// Non-ASCII characters of internationalized names are accepted.
+func checkFQDN(host string) error {
+	name := strings.TrimSuffix(host, ".")
+	if name == "" {
+		return errors.New("socks: empty host name")
+	}
+
+	if len(name) > maxHostnameLen {
+		return fmt.Errorf("socks: host name %q too long", host)
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		switch {
+		case label == "":
+			return fmt.Errorf("socks: invalid host name %q: empty label", host)
+		case len(label) > 63:
+			return fmt.Errorf("socks: invalid host name %q: label too long", host)
+		}
+
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if c < utf8.RuneSelf && !isLabelChar(c) {
+				return fmt.Errorf("socks: invalid host name %q: invalid character %q", host, c)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CanonicalHostname returns the canonical form of a host name: lower
+// case, without a trailing dot and with internationalized labels
+// converted to punycode, e.g. "München.example." becomes
+// "xn--mnchen-3ya.example". It returns an error if the name is not a
+// valid DNS name.
+func CanonicalHostname(host string) (string, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if name == "" {
+		return "", errors.New("socks: empty host name")
+	}
+
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("socks: invalid host name %q", host)
+	}
+
+	labels := strings.Split(name, ".")
+
+	for i, label := range labels {
+		if !isASCII(label) {
+			encoded, err := punycodeEncode(label)
+			if err != nil {
+				return "", fmt.Errorf("socks: invalid host name %q: %w", host, err)
+			}
+
+			label = "xn--" + encoded
+			labels[i] = label
+		}
+
+		if msg := checkLabel(label); msg != "" {
+			return "", fmt.Errorf("socks: invalid host name %q: %s", host, msg)
+		}
+	}
+
+	name = strings.Join(labels, ".")
+	if len(name) > maxHostnameLen {
+		return "", fmt.Errorf("socks: host name %q too long", host)
+	}
+
+	return name, nil
+}
+
+// checkLabel returns a message describing why label is not a valid DNS
+// label, or an empty string. Underscores are allowed as they are common
+// in service names.
+func checkLabel(label string) string {
+	switch {
+	case label == "":
+		return "empty label"
+	case len(label) > 63:
+		return "label too long"
+	case label[0] == '-' || label[len(label)-1] == '-':
+		return "label starts or ends with a hyphen"
+	}
+
+	for i := 0; i < len(label); i++ {
+		if c := label[i]; !isLabelChar(c) || 'A' <= c && c <= 'Z' {
+			return fmt.Sprintf("invalid character %q", c)
+		}
+	}
+
+	return ""
+}
+
+func isLabelChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_'
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Parameters of punycode (RFC 3492).
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+	punyMaxDelta    = 1<<31 - 1
+)
+
+// punycodeEncode encodes a label with punycode (RFC 3492), without the
+// "xn--" prefix.
+func punycodeEncode(s string) (string, error) {
+	runes := []rune(s)
+
+	var out []byte
+
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+
+	b := len(out)
+	h := b
+
+	if b > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+
+	for h < len(runes) {
+		m := rune(utf8.MaxRune + 1)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+
+		if int(m-n) > (punyMaxDelta-delta)/(h+1) {
+			return "", errors.New("punycode overflow")
+		}
+
+		delta += int(m-n) * (h + 1)
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+
+			if r != n {
+				continue
+			}
+
+			q := delta
+
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+
+				if q < t {
+					break
+				}
+
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+
+		delta++
+		n++
+	}
+
+	return string(out), nil
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+
+	delta += delta / numPoints
+
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
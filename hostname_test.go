@@ -0,0 +1,158 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalHostname(t *testing.T) {
+	for _, tc := range []struct {
+		host string
+		want string
+		err  string
+	}{
+		{host: "Example.COM.", want: "example.com"},
+		{host: "_srv.example.com", want: "_srv.example.com"},
+		{host: "München.example", want: "xn--mnchen-3ya.example"},
+		{host: "bücher.de", want: "xn--bcher-kva.de"},
+		{host: "例え.テスト", want: "xn--r8jz45g.xn--zckzah"},
+		{host: "", err: "socks: empty host name"},
+		{host: "a..b", err: `socks: invalid host name "a..b": empty label`},
+		{host: "-a.b", err: `socks: invalid host name "-a.b": label starts or ends with a hyphen`},
+		{host: "a b", err: `socks: invalid host name "a b": invalid character ' '`},
+		{host: strings.Repeat("a", 64), err: `socks: invalid host name "` + strings.Repeat("a", 64) + `": label too long`},
+		{host: strings.Repeat("a.", 127) + "ab", err: `socks: host name "` + strings.Repeat("a.", 127) + `ab" too long`},
+	} {
+		t.Run(tc.host, func(t *testing.T) {
+			got, err := CanonicalHostname(tc.host)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestHostnameOptions(t *testing.T) {
+	t.Run("canonicalize", func(t *testing.T) {
+		o := &HostnameOptions{Canonicalize: true}
+
+		addr, err := o.apply("München.Example.:443")
+		assert.NoError(t, err)
+		assert.Equal(t, "xn--mnchen-3ya.example:443", addr)
+
+		addr, err = o.apply("a..b:80")
+		assert.NoError(t, err)
+		assert.Equal(t, "a..b:80", addr)
+
+		addr, err = o.apply("[::1]:80")
+		assert.NoError(t, err)
+		assert.Equal(t, "[::1]:80", addr)
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		o := &HostnameOptions{RejectNonASCII: true, RejectMalformed: true}
+
+		_, err := o.apply("münchen.example:443")
+		assert.EqualError(t, err, `socks: non-ASCII host name "münchen.example"`)
+
+		_, err = o.apply("a..b:80")
+		assert.Error(t, err)
+
+		addr, err := o.apply("Example.com.:80")
+		assert.NoError(t, err)
+		assert.Equal(t, "Example.com.:80", addr)
+	})
+
+	t.Run("server", func(t *testing.T) {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		defer listen.Close()
+
+		addrs := make(chan string, 1)
+
+		server := New(func(o *Options) {
+			o.Hostnames = HostnameOptions{Canonicalize: true, RejectMalformed: true}
+			o.Rules = RuleSetFunc(func(ctx context.Context, req *Request) bool {
+				addrs <- req.Addr
+				return false
+			})
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		_, err = NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", "WWW.Example.COM.:80")
+		assert.Error(t, err)
+		assert.Equal(t, "www.example.com:80", <-addrs)
+
+		_, err = NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", "-a.b:80")
+		assertSocks5Rejection(t, err, Socks5StatusHostUnreachable)
+	})
+
+	t.Run("dialer", func(t *testing.T) {
+		_, err := NewSocks5Dialer("tcp", "127.0.0.1:1", func(o *Socks5DialerOptions) {
+			o.Hostnames = HostnameOptions{RejectNonASCII: true}
+		}).Dial("tcp", "münchen.example:80")
+		assert.EqualError(t, err, `socks: non-ASCII host name "münchen.example"`)
+	})
+}
+
+func TestFQDNValidation(t *testing.T) {
+	t.Run("check", func(t *testing.T) {
+		assert.NoError(t, checkFQDN("Example.com."))
+		assert.NoError(t, checkFQDN("_srv._tcp.example.com"))
+		assert.NoError(t, checkFQDN("münchen.example"))
+		assert.EqualError(t, checkFQDN("."), "socks: empty host name")
+		assert.EqualError(t, checkFQDN("a b"), `socks: invalid host name "a b": invalid character ' '`)
+		assert.EqualError(t, checkFQDN("a\x00b"), `socks: invalid host name "a\x00b": invalid character '\x00'`)
+		assert.Error(t, checkFQDN(strings.Repeat("a", 64)+".com"))
+		assert.Error(t, checkFQDN(strings.Repeat("a.", 127)+"ab"))
+	})
+
+	serve := func(t *testing.T, hostnames HostnameOptions) string {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		t.Cleanup(func() { _ = listen.Close() })
+
+		server := New(func(o *Options) {
+			o.Hostnames = hostnames
+			o.Handler = RequestHandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+				return &DenialError{Socks5Status: Socks5StatusHostUnreachable}
+			})
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		return listen.Addr().String()
+	}
+
+	t.Run("rejected", func(t *testing.T) {
+		addr := serve(t, HostnameOptions{})
+
+		_, err := NewSocks5Dialer("tcp", addr).Dial("tcp", "bad host.example:80")
+		assertSocks5Rejection(t, err, Socks5StatusAddrTypeNotSupported)
+
+		_, err = NewSocks4Dialer("tcp", addr).Dial("tcp", "bad host.example:80")
+		assert.ErrorIs(t, err, ErrSocks4Rejected)
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		addr := serve(t, HostnameOptions{AllowInvalid: true})
+
+		_, err := NewSocks5Dialer("tcp", addr).Dial("tcp", "bad host.example:80")
+		assertSocks5Rejection(t, err, Socks5StatusHostUnreachable)
+	})
+}
@@ -0,0 +1,227 @@
+//go:build interop
+// +build interop
+
+// Interop tests exercise the package against external SOCKS
+// implementations. They are skipped unless the tools are installed or
+// the external proxies are configured:
+//
+//	SOCKS_INTEROP_SOCKS5 address of a SOCKS5 proxy, e.g. Dante or ssh -D
+//	SOCKS_INTEROP_SOCKS4 address of a SOCKS4 proxy, e.g. Dante
+//	SOCKS_INTEROP_UDP    set to 1 if the SOCKS5 proxy supports UDP ASSOCIATE
+//	SOCKS_INTEROP_BIND   set to 1 if the SOCKS5 proxy supports BIND
+//
+// Run with: go test -tags interop -run Interop ./...
+package socks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startInteropServer(t *testing.T, optFns ...func(*Options)) string {
+	t.Helper()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	t.Cleanup(func() { _ = listen.Close() })
+
+	server := New(optFns...)
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	return listen.Addr().String()
+}
+
+func lookPath(t *testing.T, file string) string {
+	t.Helper()
+
+	path, err := exec.LookPath(file)
+	if err != nil {
+		t.Skipf("%s not installed", file)
+	}
+
+	return path
+}
+
+func interopProxy(t *testing.T, env string) string {
+	t.Helper()
+
+	addr := os.Getenv(env)
+	if addr == "" {
+		t.Skipf("%s not set", env)
+	}
+
+	return addr
+}
+
+func TestInteropCurl(t *testing.T) {
+	curl := lookPath(t, "curl")
+
+	targetURL := strings.Replace(testServer.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name   string
+		args   []string
+		optFns []func(*Options)
+	}{
+		{name: "socks4", args: []string{"--socks4"}},
+		{name: "socks4a", args: []string{"--socks4a"}},
+		{name: "socks5", args: []string{"--socks5"}},
+		{name: "socks5h", args: []string{"--socks5-hostname"}},
+		{
+			name: "socks5 auth",
+			args: []string{"--socks5-hostname", "", "--proxy-user", "user:pass"},
+			optFns: []func(*Options){func(o *Options) {
+				o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+				o.Authenticate = userPassServerAuthenticateFuncGen("user", "pass")
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startInteropServer(t, tt.optFns...)
+
+			args := []string{"--silent", "--show-error", "--max-time", "5", tt.args[0], addr}
+			if len(tt.args) > 2 {
+				args = append(args, tt.args[2:]...)
+			}
+
+			out, err := exec.Command(curl, append(args, targetURL)...).CombinedOutput() //nolint:gosec // test input
+			assert.NoError(t, err, string(out))
+			assert.Equal(t, "hello", string(out))
+		})
+	}
+}
+
+func TestInteropProxychains(t *testing.T) {
+	proxychains := lookPath(t, "proxychains4")
+	curl := lookPath(t, "curl")
+
+	addr := startInteropServer(t)
+
+	host, port, err := net.SplitHostPort(addr)
+	assert.NoError(t, err)
+
+	conf := filepath.Join(t.TempDir(), "proxychains.conf")
+	assert.NoError(t, os.WriteFile(conf, []byte(fmt.Sprintf("strict_chain\nquiet_mode\n[ProxyList]\nsocks5 %s %s\n", host, port)), 0o600))
+
+	out, err := exec.Command(proxychains, "-f", conf, curl, "--silent", "--max-time", "5", testServer.URL).CombinedOutput() //nolint:gosec // test input
+	assert.NoError(t, err, string(out))
+	assert.Equal(t, "hello", string(out))
+}
+
+func TestInteropSocks5Dialer(t *testing.T) {
+	addr := interopProxy(t, "SOCKS_INTEROP_SOCKS5")
+
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return NewSocks5Dialer("tcp", addr).DialContext(ctx, network, address)
+		},
+	}
+
+	resp, err := cli.Get(testServer.URL)
+	assert.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestInteropSocks4Dialer(t *testing.T) {
+	addr := interopProxy(t, "SOCKS_INTEROP_SOCKS4")
+
+	conn, err := NewSocks4Dialer("tcp", addr).Dial("tcp", testServer.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	_ = conn.Close()
+}
+
+func TestInteropSocks5Associate(t *testing.T) {
+	addr := interopProxy(t, "SOCKS_INTEROP_SOCKS5")
+	if os.Getenv("SOCKS_INTEROP_UDP") == "" {
+		t.Skip("SOCKS_INTEROP_UDP not set")
+	}
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer client.Close()
+
+	control, relayAddr := socks5Associate(t, addr, client.LocalAddr().String())
+	defer control.Close()
+
+	sendUDPDatagram(t, client, relayAddr, echo.LocalAddr().String(), []byte("hello"))
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, maxUDPPacketSize)
+	n, _, err := client.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	datagram := &UDPDatagram{}
+	assert.NoError(t, datagram.UnmarshalBinary(buf[:n]))
+	assert.Equal(t, []byte("hello"), datagram.Data)
+}
+
+func TestInteropSocks5Bind(t *testing.T) {
+	addr := interopProxy(t, "SOCKS_INTEROP_SOCKS5")
+	if os.Getenv("SOCKS_INTEROP_BIND") == "" {
+		t.Skip("SOCKS_INTEROP_BIND not set")
+	}
+
+	control, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+
+	defer control.Close()
+
+	conn := NewConn(control)
+
+	assert.NoError(t, conn.Write(&MethodSelectRequest{Methods: []AuthMethod{AuthMethodNotRequired}}))
+	assert.NoError(t, conn.Read(&MethodSelectResponse{}))
+	assert.NoError(t, conn.Write(&Socks5Request{CMD: BindCommand, Addr: "127.0.0.1:0"}))
+
+	resp := &Socks5Response{}
+	assert.NoError(t, conn.Read(resp))
+	assert.Equal(t, Socks5StatusGranted, resp.Status)
+
+	// BND.ADDR must be a connectable address, some implementations
+	// reply with the unspecified address.
+	host, port, err := net.SplitHostPort(resp.Addr)
+	assert.NoError(t, err)
+
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host, _, _ = net.SplitHostPort(addr)
+	}
+
+	peer, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	assert.NoError(t, err)
+
+	defer peer.Close()
+
+	second := &Socks5Response{}
+	assert.NoError(t, conn.Read(second))
+	assert.Equal(t, Socks5StatusGranted, second.Status)
+}
@@ -0,0 +1,145 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeepAliveOptions specifies how a dialer keeps idle tunnels alive,
+// e.g. to preserve the state of NATs and firewalls on the path.
+type KeepAliveOptions struct {
+	// Period specifies the TCP keep-alive period of the connection to
+	// the proxy. If zero, the keep-alive settings of the ProxyDialer
+	// are kept.
+	Period time.Duration
+
+	// IdleInterval specifies the duration without reads and writes
+	// after which Ping is called.
+	IdleInterval time.Duration
+
+	// Ping specifies the optional function which writes a no-op
+	// message of the application protocol, e.g. an SSH ignore message,
+	// to the idle tunnel. It is never called concurrently with writes
+	// to the tunnel.
+	Ping func(w io.Writer) error
+}
+
+func setKeepAlivePeriod(conn net.Conn, period time.Duration) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || period == 0 {
+		return nil
+	}
+
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+
+	return tcpConn.SetKeepAlivePeriod(period)
+}
+
+// keepAliveConn calls the ping function on an idle connection.
+type keepAliveConn struct {
+	net.Conn
+	*logger
+	interval time.Duration
+	ping     func(w io.Writer) error
+
+	lastActivity int64      // unix nanoseconds, accessed atomically
+	mu           sync.Mutex // serializes writes and pings
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func newKeepAliveConn(conn net.Conn, l *logger, opts KeepAliveOptions) net.Conn {
+	if opts.Ping == nil || opts.IdleInterval <= 0 {
+		return conn
+	}
+
+	c := &keepAliveConn{
+		Conn:         conn,
+		logger:       l,
+		interval:     opts.IdleInterval,
+		ping:         opts.Ping,
+		lastActivity: time.Now().UnixNano(),
+		done:         make(chan struct{}),
+	}
+
+	go c.keepAlive()
+
+	return c
+}
+
+func (c *keepAliveConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+
+	return n, err
+}
+
+func (c *keepAliveConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.touch()
+
+	return c.Conn.Write(p)
+}
+
+func (c *keepAliveConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+func (c *keepAliveConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+
+	return c.Conn.Close()
+}
+
+func (c *keepAliveConn) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+func (c *keepAliveConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+}
+
+func (c *keepAliveConn) keepAlive() {
+	timer := time.NewTimer(c.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-timer.C:
+		}
+
+		if idle := c.idle(); idle < c.interval {
+			timer.Reset(c.interval - idle)
+			continue
+		}
+
+		c.mu.Lock()
+		err := c.ping(c.Conn)
+		c.touch()
+		c.mu.Unlock()
+
+		if err != nil {
+			c.logErrorf("Failed to send keep-alive ping: %v", err)
+			return
+		}
+
+		timer.Reset(c.interval)
+	}
+}
@@ -0,0 +1,67 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialerKeepAlive(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer target.Close()
+
+	received := make(chan string, 1)
+
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err == nil {
+			received <- string(buf)
+		}
+	}()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New()
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	d := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+		o.KeepAlive = KeepAliveOptions{
+			Period:       time.Second,
+			IdleInterval: 20 * time.Millisecond,
+			Ping: func(w io.Writer) error {
+				_, err := w.Write([]byte("ping"))
+				return err
+			},
+		}
+	})
+
+	conn, err := d.Dial("tcp", target.Addr().String())
+	assert.NoError(t, err)
+
+	defer conn.Close()
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "ping", msg)
+	case <-time.After(time.Second):
+		t.Fatal("no keep-alive ping received")
+	}
+}
@@ -0,0 +1,201 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ListenAndServeNetwork listens on the network and address and serves
+// connections with a default Server, see Server.ListenAndServeNetwork.
+func ListenAndServeNetwork(network, addr string) error {
+	server := New()
+	return server.ListenAndServeNetwork(network, addr)
+}
+
+// ListenAndServeNetwork listens on the network and address and serves
+// connections. The network must be "tcp", "tcp4", "tcp6" or "unix". For
+// "tcp" and a host name resolving to IPv4 and IPv6 addresses, a listener
+// is opened for each address. With port 0 the listeners get different
+// ports. It returns the first error of the listeners after closing the
+// others. If Options.RunAs is set, the privileges are dropped once the
+// listeners are open.
+func (s *Server) ListenAndServeNetwork(network, addr string) error {
+	listeners, err := listenNetwork(context.Background(), network, addr)
+	if err != nil {
+		return err
+	}
+
+	if s.runAs != "" {
+		if err := DropPrivileges(s.runAs); err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+
+			return err
+		}
+	}
+
+	return s.serveListeners(listeners)
+}
+
+// serveListeners serves the listeners until the first one fails.
+func (s *Server) serveListeners(listeners []net.Listener) error {
+	if len(listeners) == 1 {
+		return s.Serve(listeners[0])
+	}
+
+	errCh := make(chan error, len(listeners))
+
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errCh <- s.Serve(l)
+		}(l)
+	}
+
+	err := <-errCh
+
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+
+	for i := 1; i < len(listeners); i++ {
+		<-errCh
+	}
+
+	return err
+}
+
+// ServeConns serves the connections received from conns, for sources
+// which are no net.Listener, e.g. the streams of QUIC, yamux or gRPC
+// tunnels. The connections are served like those of Serve, including
+// the session tracking of Shutdown and Close. It returns nil when conns
+// is closed, and ErrServerClosed after Shutdown, LameDuck or Close;
+// connections not yet received are left in conns.
+func (s *Server) ServeConns(conns <-chan net.Conn) error {
+	err := s.Serve(newChanListener(conns))
+	if err == errChanListenerDone {
+		return nil
+	}
+
+	return err
+}
+
+var errChanListenerDone = errors.New("socks: connection channel closed")
+
+// chanListener is a net.Listener accepting the connections of a channel.
+type chanListener struct {
+	conns <-chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newChanListener(conns <-chan net.Conn) *chanListener {
+	return &chanListener{
+		conns: conns,
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn, ok := <-l.conns:
+		if !ok {
+			return nil, errChanListenerDone
+		}
+
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return chanAddr{}
+}
+
+type chanAddr struct{}
+
+func (chanAddr) Network() string { return "chan" }
+
+func (chanAddr) String() string { return "chan" }
+
+// listenNetwork opens the listeners of the network and address.
+func listenNetwork(ctx context.Context, network, addr string) ([]net.Listener, error) {
+	var lc net.ListenConfig
+
+	switch network {
+	case "tcp4", "tcp6", "unix":
+		l, err := lc.Listen(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return []net.Listener{l}, nil
+	case "tcp":
+	default:
+		return nil, fmt.Errorf("socks: unsupported listen network %q", network)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if host == "" || net.ParseIP(host) != nil {
+		l, err := lc.Listen(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return []net.Listener{l}, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var ip4, ip6 *net.IPAddr
+
+	for i := range ips {
+		if ips[i].IP.To4() != nil {
+			if ip4 == nil {
+				ip4 = &ips[i]
+			}
+		} else if ip6 == nil {
+			ip6 = &ips[i]
+		}
+	}
+
+	var listeners []net.Listener
+
+	for _, ip := range []*net.IPAddr{ip4, ip6} {
+		if ip == nil {
+			continue
+		}
+
+		l, err := lc.Listen(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+
+			return nil, err
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
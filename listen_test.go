@@ -0,0 +1,147 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenNetwork(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("tcp4", func(t *testing.T) {
+		listeners, err := listenNetwork(ctx, "tcp4", "localhost:0")
+		assert.NoError(t, err)
+		assert.Len(t, listeners, 1)
+
+		_ = listeners[0].Close()
+	})
+
+	t.Run("dual stack", func(t *testing.T) {
+		listeners, err := listenNetwork(ctx, "tcp", "localhost:0")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, listeners)
+
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := listenNetwork(ctx, "udp", "localhost:0")
+		assert.EqualError(t, err, `socks: unsupported listen network "udp"`)
+	})
+}
+
+func TestListenAndServeNetwork(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks.sock")
+
+	server := New()
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		serveErr <- server.ListenAndServeNetwork("unix", path)
+	}()
+
+	d := NewSocks5Dialer("unix", path)
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	assert.Eventually(t, func() bool {
+		conn, err = d.Dial("tcp", testServer.Listener.Addr().String())
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	assert.NoError(t, err)
+
+	resp, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Contains(t, string(resp), "hello")
+
+	_ = conn.Close()
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assert.ErrorIs(t, <-serveErr, ErrServerClosed)
+}
+
+func TestServeConns(t *testing.T) {
+	t.Run("closed channel", func(t *testing.T) {
+		server := New()
+		conns := make(chan net.Conn)
+
+		errCh := make(chan error, 1)
+
+		go func() {
+			errCh <- server.ServeConns(conns)
+		}()
+
+		client, proxy := net.Pipe()
+		conns <- proxy
+
+		conn := NewConn(client)
+
+		_, err := ClientHandshake(context.Background(), conn, &Socks5Request{
+			CMD:  ConnectCommand,
+			Addr: testServer.Listener.Addr().String(),
+		})
+		assert.NoError(t, err)
+
+		_, err = io.WriteString(conn.NetConn(), "GET / HTTP/1.0\r\n\r\n")
+		assert.NoError(t, err)
+
+		// A pipe cannot be half-closed, so the tunnel lasts until the
+		// client closes it.
+		b := make([]byte, 1024)
+		resp := ""
+
+		for !strings.Contains(resp, "hello") {
+			n, err := conn.NetConn().Read(b)
+			if !assert.NoError(t, err) {
+				break
+			}
+
+			resp += string(b[:n])
+		}
+
+		_ = client.Close()
+
+		close(conns)
+
+		assert.NoError(t, <-errCh)
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		server := New()
+		conns := make(chan net.Conn)
+
+		errCh := make(chan error, 1)
+
+		go func() {
+			errCh <- server.ServeConns(conns)
+		}()
+
+		assert.Eventually(t, func() bool {
+			server.mu.Lock()
+			defer server.mu.Unlock()
+
+			return len(server.listeners) == 1
+		}, time.Second, 10*time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		assert.NoError(t, server.Shutdown(ctx))
+		assert.ErrorIs(t, <-errCh, ErrServerClosed)
+	})
+}
@@ -1,11 +1,27 @@
 package socks
 
-import "github.com/hupe1980/golog"
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hupe1980/golog"
+)
 
 type logger struct {
 	logger golog.Logger
 }
 
+// fromContext returns the logger stored in ctx, if any, and l otherwise.
+func (l *logger) fromContext(ctx context.Context) *logger {
+	if cl, ok := LoggerFromContext(ctx); ok {
+		return &logger{cl}
+	}
+
+	return l
+}
+
 func (l *logger) logf(level golog.Level, format string, args ...interface{}) {
 	l.logger.Printf(level, format, args...)
 }
@@ -21,3 +37,84 @@ func (l *logger) logInfof(format string, args ...interface{}) {
 func (l *logger) logErrorf(format string, args ...interface{}) {
 	l.logf(golog.ERROR, format, args...)
 }
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying the logger. Handlers and
+// the UDP relay log through the logger of the context of a request.
+func WithLogger(ctx context.Context, l golog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFromContext returns the logger stored in ctx, if any.
+func LoggerFromContext(ctx context.Context) (golog.Logger, bool) {
+	l, ok := ctx.Value(loggerKey{}).(golog.Logger)
+	return l, ok
+}
+
+// SessionLogger returns a logger which prefixes every line with the
+// session ID, the correlation ID if set, the client address and, once known, the user, the
+// destination and the target address of the session.
+func SessionLogger(l golog.Logger, s *Session) golog.Logger {
+	return &sessionLogger{Logger: l, session: s}
+}
+
+type sessionLogger struct {
+	golog.Logger
+	session *Session
+}
+
+func (l *sessionLogger) Print(level golog.Level, v ...interface{}) {
+	l.Logger.Print(level, l.fields()+fmt.Sprint(v...))
+}
+
+func (l *sessionLogger) Println(level golog.Level, v ...interface{}) {
+	l.Logger.Println(level, l.fields()+strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (l *sessionLogger) Printf(level golog.Level, format string, v ...interface{}) {
+	l.Logger.Printf(level, "%s"+format, append([]interface{}{l.fields()}, v...)...)
+}
+
+func (l *sessionLogger) fields() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "[session=%s", l.session.ID)
+
+	if id := l.session.CorrelationID(); id != "" {
+		fmt.Fprintf(&b, " correlation=%q", id)
+	}
+
+	if l.session.ClientAddr != nil {
+		fmt.Fprintf(&b, " client=%s", l.session.ClientAddr)
+	}
+
+	if user := l.session.User(); user != "" {
+		fmt.Fprintf(&b, " user=%q", user)
+	}
+
+	if dest := l.session.DestAddr(); dest != "" {
+		fmt.Fprintf(&b, " dest=%s", dest)
+	}
+
+	if target := l.session.TargetAddr(); target != "" {
+		fmt.Fprintf(&b, " target=%s", target)
+	}
+
+	if annotations := l.session.Annotations(); len(annotations) > 0 {
+		keys := make([]string, 0, len(annotations))
+		for k := range annotations {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%q", k, annotations[k])
+		}
+	}
+
+	b.WriteString("] ")
+
+	return b.String()
+}
@@ -0,0 +1,90 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hupe1980/golog"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Print(level golog.Level, v ...interface{}) {
+	l.record(fmt.Sprint(v...))
+}
+
+func (l *recordingLogger) Println(level golog.Level, v ...interface{}) {
+	l.record(fmt.Sprint(v...))
+}
+
+func (l *recordingLogger) Printf(level golog.Level, format string, v ...interface{}) {
+	l.record(fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) record(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, line)
+}
+
+func (l *recordingLogger) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.lines...)
+}
+
+func TestSessionLogger(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	closedAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	l := &recordingLogger{}
+	accessed := make(chan bool, 1)
+
+	server := New(func(o *Options) {
+		o.Logger = l
+		o.SessionLogFields = true
+		o.Hooks.OnAccess = func(ctx context.Context, e *AccessEvent) {
+			_, ok := LoggerFromContext(ctx)
+			accessed <- ok
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	_, err = NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", closedAddr)
+	assert.Error(t, err)
+
+	assert.True(t, <-accessed)
+
+	assert.Eventually(t, func() bool {
+		for _, line := range l.Lines() {
+			if strings.HasPrefix(line, "[session=") && strings.Contains(line, " client=127.0.0.1:") &&
+				strings.Contains(line, " dest="+closedAddr+"] Connect to "+closedAddr+" failed") {
+				return true
+			}
+		}
+
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,377 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// HostMatcher matches destination hosts.
+type HostMatcher interface {
+	MatchHost(host string) bool
+}
+
+// AllowHosts returns a DatagramRuleSet which permits only destinations
+// matched by m.
+func AllowHosts(m HostMatcher) DatagramRuleSet {
+	return &hostRuleSet{matcher: m, allow: true}
+}
+
+// DenyHosts returns a DatagramRuleSet which permits all destinations
+// not matched by m.
+func DenyHosts(m HostMatcher) DatagramRuleSet {
+	return &hostRuleSet{matcher: m, allow: false}
+}
+
+type hostRuleSet struct {
+	matcher HostMatcher
+	allow   bool
+}
+
+func (rs *hostRuleSet) Allow(ctx context.Context, req *Request) bool {
+	return rs.match(req.Addr)
+}
+
+func (rs *hostRuleSet) AllowDatagram(ctx context.Context, req *Request, addr string) bool {
+	return rs.match(addr)
+}
+
+func (rs *hostRuleSet) match(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	return rs.matcher.MatchHost(host) == rs.allow
+}
+
+// DomainSet is a set of domain patterns stored in a suffix tree of
+// labels. A lookup costs one map access per label of the host
+// regardless of the size of the set.
+//
+// The patterns are
+//
+//	example.com     matches example.com
+//	*.example.com   matches the subdomains of example.com
+//	.example.com    matches example.com and its subdomains
+type DomainSet struct {
+	root domainNode
+	size int
+}
+
+type domainNode struct {
+	children   map[string]*domainNode
+	exact      bool
+	subdomains bool
+}
+
+// NewDomainSet returns a DomainSet holding the patterns.
+func NewDomainSet(patterns ...string) (*DomainSet, error) {
+	s := &DomainSet{}
+
+	for _, p := range patterns {
+		if err := s.Add(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Add adds a domain pattern to the set.
+func (s *DomainSet) Add(pattern string) error {
+	name := strings.ToLower(strings.TrimSuffix(pattern, "."))
+
+	exact, subdomains := true, false
+
+	switch {
+	case strings.HasPrefix(name, "*."):
+		name, exact, subdomains = name[2:], false, true
+	case strings.HasPrefix(name, "."):
+		name, subdomains = name[1:], true
+	}
+
+	if name == "" || strings.ContainsAny(name, " \t*/:") || strings.Contains(name, "..") {
+		return fmt.Errorf("socks: invalid domain pattern %q", pattern)
+	}
+
+	n := &s.root
+
+	labels := strings.Split(name, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*domainNode)
+			}
+
+			child = &domainNode{}
+			n.children[labels[i]] = child
+		}
+
+		n = child
+	}
+
+	if (exact && !n.exact) || (subdomains && !n.subdomains) {
+		s.size++
+	}
+
+	n.exact = n.exact || exact
+	n.subdomains = n.subdomains || subdomains
+
+	return nil
+}
+
+// Len returns the number of patterns in the set.
+func (s *DomainSet) Len() int {
+	return s.size
+}
+
+// MatchHost reports whether host is matched by a pattern of the set.
+func (s *DomainSet) MatchHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	n := &s.root
+
+	for host != "" {
+		var label string
+
+		if i := strings.LastIndexByte(host, '.'); i >= 0 {
+			label, host = host[i+1:], host[:i]
+		} else {
+			label, host = host, ""
+		}
+
+		child, ok := n.children[label]
+		if !ok {
+			return false
+		}
+
+		n = child
+
+		if n.subdomains && host != "" {
+			return true
+		}
+	}
+
+	return n.exact
+}
+
+// CIDRSet is a set of IP networks stored in a binary radix tree. A
+// lookup costs at most one step per address bit regardless of the size
+// of the set.
+type CIDRSet struct {
+	v4   cidrNode
+	v6   cidrNode
+	size int
+}
+
+type cidrNode struct {
+	children [2]*cidrNode
+	terminal bool
+}
+
+// NewCIDRSet returns a CIDRSet holding the networks, given in CIDR
+// notation or as single IP addresses.
+func NewCIDRSet(cidrs ...string) (*CIDRSet, error) {
+	s := &CIDRSet{}
+
+	for _, c := range cidrs {
+		if err := s.Add(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Add adds a network, given in CIDR notation or as a single IP
+// address, to the set.
+func (s *CIDRSet) Add(cidr string) error {
+	n, ok := parseCIDR(cidr)
+	if !ok {
+		return fmt.Errorf("socks: invalid CIDR %q", cidr)
+	}
+
+	s.AddIPNet(n)
+
+	return nil
+}
+
+// AddIPNet adds a network to the set.
+func (s *CIDRSet) AddIPNet(ipNet *net.IPNet) {
+	ones, _ := ipNet.Mask.Size()
+
+	node, ip := s.root(ipNet.IP)
+	if node == nil {
+		return
+	}
+
+	for i := 0; i < ones; i++ {
+		if node.terminal {
+			return // covered by a shorter prefix
+		}
+
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+
+		if node.children[bit] == nil {
+			node.children[bit] = &cidrNode{}
+		}
+
+		node = node.children[bit]
+	}
+
+	if !node.terminal {
+		node.terminal = true
+		node.children = [2]*cidrNode{}
+		s.size++
+	}
+}
+
+// Len returns the number of networks added to the set. Networks covered
+// by a shorter prefix added before are not counted.
+func (s *CIDRSet) Len() int {
+	return s.size
+}
+
+// Contains reports whether ip is in a network of the set.
+func (s *CIDRSet) Contains(ip net.IP) bool {
+	node, ip := s.root(ip)
+	if node == nil {
+		return false
+	}
+
+	for i := 0; i < 8*len(ip); i++ {
+		if node.terminal {
+			return true
+		}
+
+		node = node.children[ip[i/8]>>(7-uint(i%8))&1]
+		if node == nil {
+			return false
+		}
+	}
+
+	return node.terminal
+}
+
+// MatchHost reports whether host is an IP address in a network of the
+// set.
+func (s *CIDRSet) MatchHost(host string) bool {
+	host, _ = stripZone(host)
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && s.Contains(ip)
+}
+
+func (s *CIDRSet) root(ip net.IP) (*cidrNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &s.v4, ip4
+	}
+
+	if ip6 := ip.To16(); ip6 != nil {
+		return &s.v6, ip6
+	}
+
+	return nil, nil
+}
+
+// errSkipLine reports a list line without a domain.
+var errSkipLine = errors.New("skip line")
+
+// ParseHostsFile returns a DomainSet with the host names of a hosts
+// file, e.g. "0.0.0.0 ads.example.com". Entries for local names like
+// localhost are skipped.
+func ParseHostsFile(r io.Reader) (*DomainSet, error) {
+	return parseDomainList(r, func(line string) ([]string, error) {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, errSkipLine
+		}
+
+		if net.ParseIP(fields[0]) == nil {
+			return nil, fmt.Errorf("invalid address %q", fields[0])
+		}
+
+		var names []string
+
+		for _, name := range fields[1:] {
+			if !isLocalHostName(name) {
+				names = append(names, name)
+			}
+		}
+
+		return names, nil
+	})
+}
+
+// ParseAdblockList returns a DomainSet with the domains blocked by the
+// "||example.com^" rules of an adblock-style filter list. Each of these
+// rules matches the domain and its subdomains. Comments, exception
+// rules and rules which do not block a whole domain are skipped.
+func ParseAdblockList(r io.Reader) (*DomainSet, error) {
+	return parseDomainList(r, func(line string) ([]string, error) {
+		if !strings.HasPrefix(line, "||") || !strings.HasSuffix(line, "^") {
+			return nil, errSkipLine
+		}
+
+		name := line[2 : len(line)-1]
+		if name == "" || strings.ContainsAny(name, "*/^$|") {
+			return nil, errSkipLine
+		}
+
+		return []string{"." + name}, nil
+	})
+}
+
+func parseDomainList(r io.Reader, parseLine func(line string) ([]string, error)) (*DomainSet, error) {
+	s := &DomainSet{}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		patterns, err := parseLine(line)
+		if err == errSkipLine {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("socks: line %d: %v", n, err)
+		}
+
+		for _, p := range patterns {
+			if err := s.Add(p); err != nil {
+				return nil, fmt.Errorf("socks: line %d: invalid domain %q", n, p)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func isLocalHostName(name string) bool {
+	switch strings.ToLower(name) {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback",
+		"ip6-localnet", "ip6-mcastprefix", "ip6-allnodes", "ip6-allrouters", "ip6-allhosts", "0.0.0.0":
+		return true
+	}
+
+	return false
+}
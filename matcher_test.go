@@ -0,0 +1,126 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainSet(t *testing.T) {
+	s, err := NewDomainSet("example.com", "*.internal.example", ".ads.example", "Tracker.Example.")
+	assert.NoError(t, err)
+
+	for host, match := range map[string]bool{
+		"example.com":             true,
+		"www.example.com":         false,
+		"internal.example":        false,
+		"db.internal.example":     true,
+		"a.b.internal.example":    true,
+		"ads.example":             true,
+		"x.ads.example":           true,
+		"tracker.example":         true,
+		"TRACKER.EXAMPLE.":        true,
+		"example.org":             false,
+		"com":                     false,
+		"notads.example":          false,
+		"www.tracker.example.org": false,
+	} {
+		assert.Equal(t, match, s.MatchHost(host), host)
+	}
+
+	_, err = NewDomainSet("bad..example")
+	assert.Error(t, err)
+}
+
+func TestCIDRSet(t *testing.T) {
+	s, err := NewCIDRSet("10.0.0.0/8", "192.168.1.1", "2001:db8::/32", "10.1.0.0/16")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, s.Len())
+
+	for host, match := range map[string]bool{
+		"10.1.2.3":        true,
+		"11.0.0.1":        false,
+		"192.168.1.1":     true,
+		"192.168.1.2":     false,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"::ffff:10.0.0.1": true,
+		"example.com":     false,
+	} {
+		assert.Equal(t, match, s.MatchHost(host), host)
+	}
+
+	t.Run("large", func(t *testing.T) {
+		s := &CIDRSet{}
+		for i := 0; i < 100000; i++ {
+			s.AddIPNet(&net.IPNet{IP: net.IPv4(byte(i>>16), byte(i>>8), byte(i), 0), Mask: net.CIDRMask(24, 32)})
+		}
+
+		assert.Equal(t, 100000, s.Len())
+		assert.True(t, s.Contains(net.IPv4(1, 134, 159, 7)))
+		assert.False(t, s.Contains(net.IPv4(2, 0, 0, 1)))
+	})
+}
+
+func TestParseHostsFile(t *testing.T) {
+	s, err := ParseHostsFile(strings.NewReader(`# blocklist
+127.0.0.1 localhost
+::1 ip6-localhost ip6-loopback
+0.0.0.0 ads.example.com tracker.example.com # trailing comment
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, s.Len())
+	assert.True(t, s.MatchHost("ads.example.com"))
+	assert.False(t, s.MatchHost("localhost"))
+
+	_, err = ParseHostsFile(strings.NewReader("ads.example.com 0.0.0.0"))
+	assert.EqualError(t, err, `socks: line 1: invalid address "ads.example.com"`)
+}
+
+func TestParseAdblockList(t *testing.T) {
+	s, err := ParseAdblockList(strings.NewReader(`[Adblock Plus 2.0]
+! comment
+||ads.example.com^
+||tracker.example^
+@@||good.example^
+/banner/*
+||cdn.example/ads^
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, s.Len())
+	assert.True(t, s.MatchHost("x.ads.example.com"))
+	assert.True(t, s.MatchHost("tracker.example"))
+	assert.False(t, s.MatchHost("good.example"))
+	assert.False(t, s.MatchHost("cdn.example"))
+}
+
+func TestHostRuleSet(t *testing.T) {
+	s, err := NewDomainSet(".blocked.example")
+	assert.NoError(t, err)
+
+	deny := DenyHosts(s)
+	assert.False(t, deny.Allow(context.Background(), &Request{Addr: "www.blocked.example:443"}))
+	assert.True(t, deny.Allow(context.Background(), &Request{Addr: "example.com:443"}))
+	assert.False(t, deny.AllowDatagram(context.Background(), &Request{}, "blocked.example:53"))
+
+	allow := AllowHosts(s)
+	assert.True(t, allow.Allow(context.Background(), &Request{Addr: "www.blocked.example:443"}))
+	assert.False(t, allow.Allow(context.Background(), &Request{Addr: "example.com:443"}))
+}
+
+func BenchmarkDomainSet(b *testing.B) {
+	s := &DomainSet{}
+	for i := 0; i < 100000; i++ {
+		_ = s.Add(fmt.Sprintf(".host%d.example.com", i))
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s.MatchHost("www.host99999.example.com")
+	}
+}
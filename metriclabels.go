@@ -0,0 +1,326 @@
+package socks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sort"
+	"sync"
+)
+
+// DestinationLabel defines the destination label of the labeled session
+// metrics.
+type DestinationLabel int
+
+const (
+	// DestinationLabelNone omits the destination.
+	DestinationLabelNone DestinationLabel = iota
+
+	// DestinationLabelPort aggregates the destinations by port.
+	DestinationLabelPort
+
+	// DestinationLabelHost aggregates the destinations by host.
+	DestinationLabelHost
+
+	// DestinationLabelAddr labels with the destination address.
+	DestinationLabelAddr
+)
+
+// UserLabel defines the user label of the labeled session metrics.
+type UserLabel int
+
+const (
+	// UserLabelNone omits the user.
+	UserLabelNone UserLabel = iota
+
+	// UserLabelHash labels with a truncated hash of the user, which
+	// keeps the users apart without exposing their names.
+	UserLabelHash
+
+	// UserLabelPlain labels with the user.
+	UserLabelPlain
+)
+
+// DefaultMaxSeries is the default of MetricLabelOptions.MaxSeries.
+const DefaultMaxSeries = 1000
+
+// OtherLabelValue is the label value of the series aggregating the label
+// sets beyond MetricLabelOptions.MaxSeries.
+const OtherLabelValue = "other"
+
+// MetricLabelOptions specifies the labeled session metrics of a server
+// and bounds their cardinality, e.g. for the time series database of a
+// large deployment. The metrics are recorded when a session is closed.
+type MetricLabelOptions struct {
+	// Destination and User specify the labels of the series.
+	Destination DestinationLabel
+	User        UserLabel
+
+	// UserHashKey specifies the optional HMAC key of UserLabelHash, which
+	// prevents the recovery of user names from their hashes.
+	UserHashKey []byte
+
+	// MaxSeries specifies the maximum number of series. The sessions of
+	// further label sets are counted in the series whose labels are
+	// OtherLabelValue. If zero, DefaultMaxSeries is used.
+	MaxSeries int
+
+	// TopDestinations specifies the number of destination addresses of
+	// the top-K tracking of the destinations by sessions, an alternative
+	// to a destination label of unbounded cardinality. If zero, the
+	// destinations are not tracked.
+	TopDestinations int
+}
+
+func (o *MetricLabelOptions) enabled() bool {
+	return o.Destination != DestinationLabelNone || o.User != UserLabelNone || o.TopDestinations > 0
+}
+
+// LabeledSessionMetrics are the counters of the sessions of a label set.
+// Omitted labels are empty.
+type LabeledSessionMetrics struct {
+	Destination string
+	User        string
+
+	Sessions uint64
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+// DestinationCount is an entry of the top destinations. Sessions may
+// overestimate the count by up to Error, since the tracking only keeps
+// the top destinations.
+type DestinationCount struct {
+	Destination string
+	Sessions    uint64
+	Error       uint64
+}
+
+type seriesKey struct {
+	destination string
+	user        string
+}
+
+// labeledMetrics records the labeled session metrics.
+type labeledMetrics struct {
+	options   MetricLabelOptions
+	maxSeries int
+
+	mu     sync.Mutex
+	series map[seriesKey]*LabeledSessionMetrics
+	top    *topK
+}
+
+// newLabeledMetrics returns the labeled metrics of the options or nil if
+// they are disabled.
+func newLabeledMetrics(options MetricLabelOptions) *labeledMetrics {
+	if !options.enabled() {
+		return nil
+	}
+
+	maxSeries := options.MaxSeries
+	if maxSeries <= 0 {
+		maxSeries = DefaultMaxSeries
+	}
+
+	m := &labeledMetrics{
+		options:   options,
+		maxSeries: maxSeries,
+		series:    make(map[seriesKey]*LabeledSessionMetrics),
+	}
+
+	if options.TopDestinations > 0 {
+		m.top = newTopK(options.TopDestinations)
+	}
+
+	return m
+}
+
+// record records a closed session.
+func (m *labeledMetrics) record(session *Session) {
+	if m == nil {
+		return
+	}
+
+	key := seriesKey{
+		destination: m.destinationLabel(session.DestAddr()),
+		user:        m.userLabel(session.User()),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.series[key]
+	if !ok {
+		if len(m.series) >= m.maxSeries {
+			key = m.otherKey()
+		}
+
+		if s, ok = m.series[key]; !ok {
+			s = &LabeledSessionMetrics{Destination: key.destination, User: key.user}
+			m.series[key] = s
+		}
+	}
+
+	s.Sessions++
+	s.BytesIn += session.BytesIn()
+	s.BytesOut += session.BytesOut()
+
+	if m.top != nil && session.DestAddr() != "" {
+		m.top.add(session.DestAddr())
+	}
+}
+
+// otherKey returns the key of the series aggregating the label sets
+// beyond the maximum, with the omitted labels kept empty.
+func (m *labeledMetrics) otherKey() seriesKey {
+	var key seriesKey
+
+	if m.options.Destination != DestinationLabelNone {
+		key.destination = OtherLabelValue
+	}
+
+	if m.options.User != UserLabelNone {
+		key.user = OtherLabelValue
+	}
+
+	return key
+}
+
+func (m *labeledMetrics) destinationLabel(addr string) string {
+	if addr == "" {
+		return ""
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+
+	switch m.options.Destination {
+	case DestinationLabelPort:
+		return port
+	case DestinationLabelHost:
+		return host
+	case DestinationLabelAddr:
+		return addr
+	default:
+		return ""
+	}
+}
+
+func (m *labeledMetrics) userLabel(user string) string {
+	if user == "" {
+		return ""
+	}
+
+	switch m.options.User {
+	case UserLabelHash:
+		mac := hmac.New(sha256.New, m.options.UserHashKey)
+		_, _ = mac.Write([]byte(user))
+
+		return hex.EncodeToString(mac.Sum(nil)[:6])
+	case UserLabelPlain:
+		return user
+	default:
+		return ""
+	}
+}
+
+// snapshot returns the series sorted by their labels.
+func (m *labeledMetrics) snapshot() []LabeledSessionMetrics {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series := make([]LabeledSessionMetrics, 0, len(m.series))
+	for _, s := range m.series {
+		series = append(series, *s)
+	}
+
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].Destination != series[j].Destination {
+			return series[i].Destination < series[j].Destination
+		}
+
+		return series[i].User < series[j].User
+	})
+
+	return series
+}
+
+func (m *labeledMetrics) topDestinations() []DestinationCount {
+	if m == nil || m.top == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.top.snapshot()
+}
+
+// topK tracks the most frequent keys in bounded memory with the
+// space-saving algorithm: a new key replaces the least frequent one and
+// inherits its count as the error.
+type topK struct {
+	k       int
+	entries map[string]*DestinationCount
+}
+
+func newTopK(k int) *topK {
+	return &topK{
+		k:       k,
+		entries: make(map[string]*DestinationCount, k),
+	}
+}
+
+func (t *topK) add(key string) {
+	if e, ok := t.entries[key]; ok {
+		e.Sessions++
+		return
+	}
+
+	if len(t.entries) < t.k {
+		t.entries[key] = &DestinationCount{Destination: key, Sessions: 1}
+		return
+	}
+
+	var min *DestinationCount
+
+	for _, e := range t.entries {
+		if min == nil || e.Sessions < min.Sessions || e.Sessions == min.Sessions && e.Destination > min.Destination {
+			min = e
+		}
+	}
+
+	delete(t.entries, min.Destination)
+
+	t.entries[key] = &DestinationCount{
+		Destination: key,
+		Sessions:    min.Sessions + 1,
+		Error:       min.Sessions,
+	}
+}
+
+// snapshot returns the entries by descending count.
+func (t *topK) snapshot() []DestinationCount {
+	entries := make([]DestinationCount, 0, len(t.entries))
+	for _, e := range t.entries {
+		entries = append(entries, *e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Sessions != entries[j].Sessions {
+			return entries[i].Sessions > entries[j].Sessions
+		}
+
+		return entries[i].Destination < entries[j].Destination
+	})
+
+	return entries
+}
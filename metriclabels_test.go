@@ -0,0 +1,106 @@
+package socks
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLabelTestSession(user, destAddr string) *Session {
+	session := newSession(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234})
+	session.SetUser(user)
+	session.SetDestAddr(destAddr)
+
+	return session
+}
+
+func TestLabeledMetrics(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		m := newLabeledMetrics(MetricLabelOptions{})
+		assert.Nil(t, m)
+
+		m.record(newLabelTestSession("alice", "example.com:443"))
+		assert.Nil(t, m.snapshot())
+	})
+
+	t.Run("port and hashed user", func(t *testing.T) {
+		m := newLabeledMetrics(MetricLabelOptions{
+			Destination: DestinationLabelPort,
+			User:        UserLabelHash,
+		})
+
+		m.record(newLabelTestSession("alice", "example.com:443"))
+		m.record(newLabelTestSession("alice", "example.org:443"))
+		m.record(newLabelTestSession("bob", "example.com:80"))
+
+		series := m.snapshot()
+		assert.Len(t, series, 2)
+
+		for _, s := range series {
+			assert.Len(t, s.User, 12)
+			assert.NotEqual(t, "alice", s.User)
+
+			if s.Destination == "443" {
+				assert.Equal(t, uint64(2), s.Sessions)
+			}
+		}
+	})
+
+	t.Run("max series", func(t *testing.T) {
+		m := newLabeledMetrics(MetricLabelOptions{
+			Destination: DestinationLabelAddr,
+			MaxSeries:   2,
+		})
+
+		for i := 0; i < 5; i++ {
+			m.record(newLabelTestSession("", fmt.Sprintf("192.0.2.%d:80", i)))
+		}
+
+		m.record(newLabelTestSession("", "192.0.2.0:80"))
+
+		assert.Equal(t, []LabeledSessionMetrics{
+			{Destination: "192.0.2.0:80", Sessions: 2},
+			{Destination: "192.0.2.1:80", Sessions: 1},
+			{Destination: OtherLabelValue, Sessions: 3},
+		}, m.snapshot())
+	})
+}
+
+func TestTopK(t *testing.T) {
+	top := newTopK(2)
+
+	for _, key := range []string{"a", "a", "a", "b", "b", "c", "a"} {
+		top.add(key)
+	}
+
+	entries := top.snapshot()
+	assert.Len(t, entries, 2)
+	assert.Equal(t, DestinationCount{Destination: "a", Sessions: 4}, entries[0])
+	assert.Equal(t, "c", entries[1].Destination)
+	assert.Equal(t, uint64(3), entries[1].Sessions)
+	assert.Equal(t, uint64(2), entries[1].Error)
+}
+
+func TestWritePrometheus(t *testing.T) {
+	server := New(func(o *Options) {
+		o.MetricLabels = MetricLabelOptions{
+			Destination:     DestinationLabelHost,
+			User:            UserLabelPlain,
+			TopDestinations: 10,
+		}
+	})
+
+	server.labels.record(newLabelTestSession("al\"ice", "example.com:443"))
+
+	var buf bytes.Buffer
+	assert.NoError(t, server.WritePrometheus(&buf))
+
+	out := buf.String()
+	assert.Contains(t, out, "# TYPE socks_auth_successes_total counter\nsocks_auth_successes_total 0\n")
+	assert.Contains(t, out, `socks_sessions_total{destination="example.com",user="al\"ice"} 1`)
+	assert.Contains(t, out, `socks_session_bytes_total{destination="example.com",user="al\"ice",direction="in"} 0`)
+	assert.Contains(t, out, `socks_top_destination_sessions{destination="example.com:443"} 1`)
+}
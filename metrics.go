@@ -0,0 +1,300 @@
+package socks
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a snapshot of the server counters.
+type Metrics struct {
+	AuthSuccesses uint64
+	AuthFailures  uint64
+
+	// AuthLatency is the accumulated latency of all authentications.
+	AuthLatency time.Duration
+
+	// AuthTimeouts and AuthPanics count the calls of the AuthenticateFunc
+	// which exceeded Options.AuthTimeout or panicked. They are also
+	// counted as AuthFailures.
+	AuthTimeouts uint64
+	AuthPanics   uint64
+
+	// NoAcceptableMethods counts the SOCKS5 method selections without an
+	// acceptable method, including those accepted in grace mode, which
+	// AuthGraceAccepted counts.
+	NoAcceptableMethods uint64
+	AuthGraceAccepted   uint64
+
+	// HandshakesRejected counts the connections closed because
+	// Options.MaxHandshakes handshakes were in progress.
+	HandshakesRejected uint64
+
+	// HandshakeTimeouts counts the handshakes which exceeded
+	// Options.HandshakeTimeout by the field being read.
+	HandshakeTimeouts map[HandshakeField]uint64
+
+	// BindSuccesses and BindFailures count the BIND requests of the
+	// default handler by whether a valid peer connected, BindRejected
+	// those rejected because of DefaultHandlerOptions.MaxBinds.
+	BindSuccesses uint64
+	BindFailures  uint64
+	BindRejected  uint64
+
+	// BindsPending is the number of BIND requests waiting for their
+	// peer.
+	BindsPending int64
+
+	// BindWaitTime is the accumulated time the BIND requests waited for
+	// their peer.
+	BindWaitTime time.Duration
+
+	// UDPSpoofedDropped is the number of datagrams dropped by the UDP
+	// relay because they did not originate from the associated client.
+	UDPSpoofedDropped uint64
+
+	// UDPDropped is the number of datagrams dropped by the UDP relay
+	// because of its size or flow limits or the rule set.
+	UDPDropped uint64
+
+	// UDPForwarded and UDPBytes count the datagrams and payload bytes
+	// relayed in both directions.
+	UDPForwarded uint64
+	UDPBytes     uint64
+
+	// UDPRejected is the number of UDP associations rejected because
+	// UDPOptions.Disabled is set.
+	UDPRejected uint64
+
+	// DNSLookups and DNSFailures count the resolutions of PrefetchDNS.
+	DNSLookups  uint64
+	DNSFailures uint64
+
+	// DNSLatency is the accumulated latency of all resolutions.
+	DNSLatency time.Duration
+
+	// CloseReasons counts the closed sessions by reason.
+	CloseReasons map[CloseReason]uint64
+}
+
+// HandshakeField names a field of a handshake message, see
+// NegotiationTimeoutError.
+type HandshakeField struct {
+	Phase string
+	Field string
+}
+
+type metrics struct {
+	authSuccesses     uint64
+	authFailures      uint64
+	authLatency       int64
+	authTimeouts      uint64
+	authPanics        uint64
+	noAcceptable      uint64
+	authGrace         uint64
+	handshakes        uint64
+	bindSuccesses     uint64
+	bindFailures      uint64
+	bindRejects       uint64
+	bindsPending      int64
+	bindWait          int64
+	udpSpoofedDropped uint64
+	udpDropped        uint64
+	udpForwarded      uint64
+	udpBytes          uint64
+	udpRejects        uint64
+	dnsLookups        uint64
+	dnsFailures       uint64
+	dnsLatency        int64
+	closeReasons      [closeReasonCount]uint64
+
+	mu                sync.Mutex
+	handshakeTimeouts map[HandshakeField]uint64
+}
+
+type metricsKey struct{}
+
+func withMetrics(ctx context.Context, m *metrics) context.Context {
+	return context.WithValue(ctx, metricsKey{}, m)
+}
+
+func metricsFromContext(ctx context.Context) *metrics {
+	m, _ := ctx.Value(metricsKey{}).(*metrics)
+	return m
+}
+
+func (m *metrics) auth(success bool, latency time.Duration) {
+	if m == nil {
+		return
+	}
+
+	if success {
+		atomic.AddUint64(&m.authSuccesses, 1)
+	} else {
+		atomic.AddUint64(&m.authFailures, 1)
+	}
+
+	atomic.AddInt64(&m.authLatency, int64(latency))
+}
+
+func (m *metrics) authTimeout() {
+	if m != nil {
+		atomic.AddUint64(&m.authTimeouts, 1)
+	}
+}
+
+func (m *metrics) authPanic() {
+	if m != nil {
+		atomic.AddUint64(&m.authPanics, 1)
+	}
+}
+
+func (m *metrics) noAcceptableMethods(grace bool) {
+	if m == nil {
+		return
+	}
+
+	atomic.AddUint64(&m.noAcceptable, 1)
+
+	if grace {
+		atomic.AddUint64(&m.authGrace, 1)
+	}
+}
+
+func (m *metrics) handshakeRejected() {
+	if m != nil {
+		atomic.AddUint64(&m.handshakes, 1)
+	}
+}
+
+func (m *metrics) handshakeTimeout(phase, field string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.handshakeTimeouts == nil {
+		m.handshakeTimeouts = make(map[HandshakeField]uint64)
+	}
+
+	m.handshakeTimeouts[HandshakeField{Phase: phase, Field: field}]++
+}
+
+func (m *metrics) bindRejected() {
+	if m != nil {
+		atomic.AddUint64(&m.bindRejects, 1)
+	}
+}
+
+func (m *metrics) bindPending(delta int64) {
+	if m != nil {
+		atomic.AddInt64(&m.bindsPending, delta)
+	}
+}
+
+func (m *metrics) bindDone(success bool, wait time.Duration) {
+	if m == nil {
+		return
+	}
+
+	if success {
+		atomic.AddUint64(&m.bindSuccesses, 1)
+	} else {
+		atomic.AddUint64(&m.bindFailures, 1)
+	}
+
+	atomic.AddInt64(&m.bindWait, int64(wait))
+}
+
+func (m *metrics) udpSpoofed() {
+	if m != nil {
+		atomic.AddUint64(&m.udpSpoofedDropped, 1)
+	}
+}
+
+func (m *metrics) udpRejected() {
+	if m != nil {
+		atomic.AddUint64(&m.udpRejects, 1)
+	}
+}
+
+func (m *metrics) udpDrop() {
+	if m != nil {
+		atomic.AddUint64(&m.udpDropped, 1)
+	}
+}
+
+func (m *metrics) udpForward(n int) {
+	if m != nil {
+		atomic.AddUint64(&m.udpForwarded, 1)
+		atomic.AddUint64(&m.udpBytes, uint64(n))
+	}
+}
+
+func (m *metrics) dnsLookup(success bool, latency time.Duration) {
+	if m == nil {
+		return
+	}
+
+	atomic.AddUint64(&m.dnsLookups, 1)
+
+	if !success {
+		atomic.AddUint64(&m.dnsFailures, 1)
+	}
+
+	atomic.AddInt64(&m.dnsLatency, int64(latency))
+}
+
+func (m *metrics) sessionClosed(reason CloseReason) {
+	if m != nil && reason >= 0 && reason < closeReasonCount {
+		atomic.AddUint64(&m.closeReasons[reason], 1)
+	}
+}
+
+func (m *metrics) snapshot() Metrics {
+	closeReasons := make(map[CloseReason]uint64)
+
+	for reason := range m.closeReasons {
+		if n := atomic.LoadUint64(&m.closeReasons[reason]); n > 0 {
+			closeReasons[CloseReason(reason)] = n
+		}
+	}
+
+	m.mu.Lock()
+
+	handshakeTimeouts := make(map[HandshakeField]uint64, len(m.handshakeTimeouts))
+	for field, n := range m.handshakeTimeouts {
+		handshakeTimeouts[field] = n
+	}
+
+	m.mu.Unlock()
+
+	return Metrics{
+		AuthSuccesses:       atomic.LoadUint64(&m.authSuccesses),
+		AuthFailures:        atomic.LoadUint64(&m.authFailures),
+		AuthLatency:         time.Duration(atomic.LoadInt64(&m.authLatency)),
+		AuthTimeouts:        atomic.LoadUint64(&m.authTimeouts),
+		AuthPanics:          atomic.LoadUint64(&m.authPanics),
+		NoAcceptableMethods: atomic.LoadUint64(&m.noAcceptable),
+		AuthGraceAccepted:   atomic.LoadUint64(&m.authGrace),
+		HandshakesRejected:  atomic.LoadUint64(&m.handshakes),
+		HandshakeTimeouts:   handshakeTimeouts,
+		BindSuccesses:       atomic.LoadUint64(&m.bindSuccesses),
+		BindFailures:        atomic.LoadUint64(&m.bindFailures),
+		BindRejected:        atomic.LoadUint64(&m.bindRejects),
+		BindsPending:        atomic.LoadInt64(&m.bindsPending),
+		BindWaitTime:        time.Duration(atomic.LoadInt64(&m.bindWait)),
+		UDPSpoofedDropped:   atomic.LoadUint64(&m.udpSpoofedDropped),
+		UDPDropped:          atomic.LoadUint64(&m.udpDropped),
+		UDPForwarded:        atomic.LoadUint64(&m.udpForwarded),
+		UDPBytes:            atomic.LoadUint64(&m.udpBytes),
+		UDPRejected:         atomic.LoadUint64(&m.udpRejects),
+		DNSLookups:          atomic.LoadUint64(&m.dnsLookups),
+		DNSFailures:         atomic.LoadUint64(&m.dnsFailures),
+		DNSLatency:          time.Duration(atomic.LoadInt64(&m.dnsLatency)),
+		CloseReasons:        closeReasons,
+	}
+}
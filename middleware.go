@@ -0,0 +1,15 @@
+package socks
+
+// Middleware wraps a RequestHandler to add behavior before or after
+// the command dispatch, e.g. logging, rules or rewriting.
+type Middleware func(next RequestHandler) RequestHandler
+
+// Chain applies the middlewares to h. The first middleware is the
+// outermost one and sees the request first.
+func Chain(h RequestHandler, middlewares ...Middleware) RequestHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
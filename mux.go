@@ -0,0 +1,692 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hupe1980/golog"
+)
+
+// Frames of a multiplex session. Each frame starts with a header of the
+// frame type, the stream ID and the payload length.
+const (
+	muxFrameOpen   byte = 0x00
+	muxFrameData   byte = 0x01
+	muxFrameWindow byte = 0x02 // payload: 4 byte window increment
+	muxFrameFin    byte = 0x03
+	muxFrameReset  byte = 0x04
+)
+
+const (
+	muxHeaderLen  = 7
+	muxMaxPayload = 16 * 1024
+
+	// muxWindow is the number of bytes a stream may send before the
+	// receiver grants more.
+	muxWindow = 256 * 1024
+)
+
+var (
+	errMuxSessionClosed = errors.New("socks: multiplex session closed")
+	errMuxStreamReset   = errors.New("socks: multiplex stream reset")
+)
+
+// muxSession carries logical streams over a single connection. Only the
+// client opens streams.
+type muxSession struct {
+	conn   net.Conn
+	reader io.Reader
+	client bool
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error
+
+	accept    chan *muxStream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newMuxSession starts a session on conn. reader reads from conn,
+// including data already buffered.
+func newMuxSession(conn net.Conn, reader io.Reader, client bool) *muxSession {
+	s := &muxSession{
+		conn:    conn,
+		reader:  reader,
+		client:  client,
+		streams: make(map[uint32]*muxStream),
+		nextID:  1,
+		accept:  make(chan *muxStream),
+		done:    make(chan struct{}),
+	}
+
+	go s.readLoop()
+
+	return s
+}
+
+func (s *muxSession) open() (*muxStream, error) {
+	s.mu.Lock()
+
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+
+	st := newMuxStream(s, s.nextID)
+	s.streams[st.id] = st
+	s.nextID++
+
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxFrameOpen, st.id, nil); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+func (s *muxSession) acceptStream() (*muxStream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+func (s *muxSession) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *muxSession) Close() error {
+	s.close(errMuxSessionClosed)
+	return nil
+}
+
+func (s *muxSession) close(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		streams := s.streams
+		s.streams = make(map[uint32]*muxStream)
+		s.mu.Unlock()
+
+		close(s.done)
+
+		_ = s.conn.Close()
+
+		for _, st := range streams {
+			st.fail(err)
+		}
+	})
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.streams, id)
+}
+
+func (s *muxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	b := make([]byte, muxHeaderLen, muxHeaderLen+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:5], id)
+	binary.BigEndian.PutUint16(b[5:7], uint16(len(payload)))
+	b = append(b, payload...)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if _, err := s.conn.Write(b); err != nil {
+		s.close(err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *muxSession) readLoop() {
+	header := make([]byte, muxHeaderLen)
+
+	for {
+		if _, err := io.ReadFull(s.reader, header); err != nil {
+			if err == io.EOF {
+				err = errMuxSessionClosed
+			}
+
+			s.close(err)
+
+			return
+		}
+
+		n := int(binary.BigEndian.Uint16(header[5:7]))
+		if n > muxMaxPayload {
+			s.close(newProtocolError("multiplex frame", fmt.Sprintf("at most %d bytes", muxMaxPayload), fmt.Sprintf("%d bytes", n), header))
+			return
+		}
+
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(s.reader, payload); err != nil {
+			s.close(err)
+			return
+		}
+
+		if err := s.handleFrame(header[0], binary.BigEndian.Uint32(header[1:5]), payload); err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+func (s *muxSession) handleFrame(typ byte, id uint32, payload []byte) error {
+	if typ == muxFrameOpen {
+		return s.handleOpen(id)
+	}
+
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+
+	// Frames of closed streams are dropped.
+	if st == nil {
+		return nil
+	}
+
+	switch typ {
+	case muxFrameData:
+		return st.receive(payload)
+	case muxFrameWindow:
+		if len(payload) != 4 {
+			return newProtocolError("multiplex window frame", "4 bytes", fmt.Sprintf("%d bytes", len(payload)), payload)
+		}
+
+		st.grant(binary.BigEndian.Uint32(payload))
+	case muxFrameFin:
+		st.receiveFin()
+	case muxFrameReset:
+		s.remove(id)
+		st.fail(errMuxStreamReset)
+	default:
+		return newProtocolError("multiplex frame", "a known frame type", fmt.Sprintf("type %d", typ), []byte{typ})
+	}
+
+	return nil
+}
+
+func (s *muxSession) handleOpen(id uint32) error {
+	if s.client {
+		return newProtocolError("multiplex frame", "no open frame from the server", fmt.Sprintf("stream %d", id), nil)
+	}
+
+	st := newMuxStream(s, id)
+
+	s.mu.Lock()
+	_, exists := s.streams[id]
+	if !exists {
+		s.streams[id] = st
+	}
+	s.mu.Unlock()
+
+	if exists {
+		return newProtocolError("multiplex frame", "a new stream", fmt.Sprintf("open stream %d", id), nil)
+	}
+
+	select {
+	case s.accept <- st:
+	case <-s.done:
+	}
+
+	return nil
+}
+
+// muxStream is a logical connection of a multiplex session.
+type muxStream struct {
+	session *muxSession
+	id      uint32
+
+	readable chan struct{}
+	writable chan struct{}
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	consumed      uint32 // bytes read since the last window update
+	sendWindow    uint32
+	finReceived   bool
+	finSent       bool
+	closed        bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newMuxStream(s *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		session:    s,
+		id:         id,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		sendWindow: muxWindow,
+	}
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+
+			var increment uint32
+
+			st.consumed += uint32(n)
+			if st.consumed >= muxWindow/2 {
+				increment, st.consumed = st.consumed, 0
+			}
+
+			st.mu.Unlock()
+
+			if increment > 0 {
+				b := make([]byte, 4)
+				binary.BigEndian.PutUint32(b, increment)
+
+				_ = st.session.writeFrame(muxFrameWindow, st.id, b)
+			}
+
+			return n, nil
+		}
+
+		if err := st.err; err != nil {
+			st.mu.Unlock()
+			return 0, err
+		}
+
+		if st.finReceived {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		deadline := st.readDeadline
+
+		st.mu.Unlock()
+
+		if err := waitMux(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+
+	for written < len(p) {
+		st.mu.Lock()
+
+		if err := st.err; err != nil {
+			st.mu.Unlock()
+			return written, err
+		}
+
+		if st.finSent {
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+
+			st.mu.Unlock()
+
+			if err := waitMux(st.writable, deadline); err != nil {
+				return written, err
+			}
+
+			continue
+		}
+
+		n := len(p) - written
+		if n > int(st.sendWindow) {
+			n = int(st.sendWindow)
+		}
+
+		if n > muxMaxPayload {
+			n = muxMaxPayload
+		}
+
+		st.sendWindow -= uint32(n)
+
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(muxFrameData, st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+
+		written += n
+	}
+
+	return written, nil
+}
+
+// CloseWrite sends the end of the stream to the peer.
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+
+	if st.finSent || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+
+	st.finSent = true
+
+	st.mu.Unlock()
+
+	return st.session.writeFrame(muxFrameFin, st.id, nil)
+}
+
+// Close closes the stream. The stream is reset if the peer has not yet
+// finished sending.
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+
+	st.closed = true
+
+	var frame byte = 0xff
+
+	if st.err == nil {
+		if !st.finReceived {
+			frame = muxFrameReset
+		} else if !st.finSent {
+			frame = muxFrameFin
+		}
+
+		st.err = net.ErrClosed
+	}
+
+	st.mu.Unlock()
+
+	st.session.remove(st.id)
+	st.signal()
+
+	if frame != 0xff {
+		return st.session.writeFrame(frame, st.id, nil)
+	}
+
+	return nil
+}
+
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline, st.writeDeadline = t, t
+	st.mu.Unlock()
+
+	st.signal()
+
+	return nil
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+
+	st.signal()
+
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+
+	st.signal()
+
+	return nil
+}
+
+func (st *muxStream) receive(payload []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.buf.Len()+len(payload) > muxWindow {
+		return newProtocolError("multiplex data frame", fmt.Sprintf("at most %d buffered bytes", muxWindow), fmt.Sprintf("%d bytes", st.buf.Len()+len(payload)), nil)
+	}
+
+	st.buf.Write(payload)
+	notify(st.readable)
+
+	return nil
+}
+
+func (st *muxStream) receiveFin() {
+	st.mu.Lock()
+	st.finReceived = true
+	st.mu.Unlock()
+
+	notify(st.readable)
+}
+
+func (st *muxStream) grant(increment uint32) {
+	st.mu.Lock()
+	st.sendWindow += increment
+	st.mu.Unlock()
+
+	notify(st.writable)
+}
+
+func (st *muxStream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+
+	st.signal()
+}
+
+// signal wakes up blocked reads and writes to reevaluate the state.
+func (st *muxStream) signal() {
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// waitMux waits for a notification on ch until the deadline.
+func waitMux(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+type MultiplexDialerOptions struct {
+	// Logger specifies an optional logger.
+	// If nil, logging is done via the log package's standard logger.
+	Logger golog.Logger
+
+	// ProxyDialer specifies the optional dialer for
+	// establishing the transport connection.
+	ProxyDialer Dialer
+
+	// AuthMethods specifies the list of request authentication
+	// methods.
+	// If empty, SOCKS client requests only AuthMethodNotRequired.
+	AuthMethods []AuthMethod
+
+	// Authenticate specifies the optional authentication
+	// function. It must be non-nil when AuthMethods is not empty.
+	// It must return an error when the authentication is failed.
+	Authenticate AuthenticateFunc
+}
+
+// MultiplexDialer connects through a SOCKS5 server of this package with
+// Options.Multiplex enabled. The connections are streams of a single
+// connection to the proxy, which is established by the first dial and
+// reestablished once it fails, saving a dial and a handshake per
+// connection.
+type MultiplexDialer struct {
+	*logger
+	proxyNetwork string // network between a proxy server and a client
+	proxyAddress string // proxy server address
+	proxyDialer  Dialer
+	authMethods  []AuthMethod
+	authenticate AuthenticateFunc
+
+	mu      sync.Mutex
+	session *muxSession
+}
+
+// NewMultiplexDialer returns a new MultiplexDialer that dials through the
+// provided proxy server's network and address.
+func NewMultiplexDialer(network, address string, optFns ...func(*MultiplexDialerOptions)) *MultiplexDialer {
+	options := MultiplexDialerOptions{
+		Logger:      golog.NewGoLogger(golog.INFO, log.Default()),
+		ProxyDialer: &net.Dialer{},
+		AuthMethods: []AuthMethod{AuthMethodNotRequired},
+	}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	return &MultiplexDialer{
+		logger:       &logger{options.Logger},
+		proxyNetwork: network,
+		proxyAddress: address,
+		proxyDialer:  options.ProxyDialer,
+		authMethods:  options.AuthMethods,
+		authenticate: options.Authenticate,
+	}
+}
+
+func (d *MultiplexDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *MultiplexDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	session, err := d.muxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := session.open()
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = st.SetDeadline(deadline)
+	}
+
+	conn := NewConn(st)
+
+	if _, err := clientRequest(conn, &Socks5Request{
+		CMD:  ConnectCommand,
+		Addr: addr,
+	}, nil); err != nil {
+		_ = st.Close()
+		return nil, err
+	}
+
+	_ = st.SetDeadline(time.Time{})
+
+	return conn.NetConn(), nil
+}
+
+// Close closes the connection to the proxy and all its streams.
+func (d *MultiplexDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.session == nil {
+		return nil
+	}
+
+	return d.session.Close()
+}
+
+// muxSession returns the current session or establishes a new one.
+func (d *MultiplexDialer) muxSession(ctx context.Context) (*muxSession, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.session != nil && !d.session.isClosed() {
+		return d.session, nil
+	}
+
+	conn, err := d.proxyDialer.DialContext(ctx, d.proxyNetwork, d.proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	socksConn := NewConn(conn)
+
+	if _, err := ClientHandshake(ctx, socksConn, &Socks5Request{
+		CMD:  MultiplexCommand,
+		Addr: "0.0.0.0:0",
+	}, func(o *ClientHandshakeOptions) {
+		o.AuthMethods = d.authMethods
+		o.Authenticate = d.authenticate
+	}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	d.logDebugf("Established multiplex session with %s", d.proxyAddress)
+
+	d.session = newMuxSession(conn, socksConn.reader, true)
+
+	return d.session, nil
+}
@@ -0,0 +1,176 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingDialer struct {
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.conns = append(d.conns, conn)
+
+	return conn, nil
+}
+
+func (d *countingDialer) Conns() []net.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]net.Conn(nil), d.conns...)
+}
+
+func TestMultiplex(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	var (
+		mu       sync.Mutex
+		sessions = make(map[string]bool)
+	)
+
+	server := New(func(o *Options) {
+		o.Multiplex = true
+		o.Hooks.OnAccess = func(ctx context.Context, e *AccessEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			sessions[e.Session.ID] = true
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	proxyDialer := &countingDialer{}
+
+	dialer := NewMultiplexDialer("tcp", listen.Addr().String(), func(o *MultiplexDialerOptions) {
+		o.ProxyDialer = proxyDialer
+	})
+
+	defer dialer.Close()
+
+	t.Run("streams", func(t *testing.T) {
+		var wg sync.WaitGroup
+
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				conn, err := dialer.Dial("tcp", echo.Addr().String())
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				defer conn.Close()
+
+				// more than the window of a stream
+				data := make([]byte, 3*muxWindow)
+				_, _ = rand.Read(data)
+
+				go func() {
+					_, _ = conn.Write(data)
+					_ = conn.(closeWriter).CloseWrite()
+				}()
+
+				b, err := io.ReadAll(conn)
+				assert.NoError(t, err)
+				assert.True(t, bytes.Equal(data, b))
+			}()
+		}
+
+		wg.Wait()
+
+		assert.Len(t, proxyDialer.Conns(), 1)
+
+		mu.Lock()
+		assert.Len(t, sessions, 8)
+		mu.Unlock()
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		closedAddr := closed.Addr().String()
+		_ = closed.Close()
+
+		_, err = dialer.Dial("tcp", closedAddr)
+		assertSocks5Rejection(t, err, Socks5StatusConnectionRefused)
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		_ = proxyDialer.Conns()[0].Close()
+
+		assert.Eventually(t, func() bool {
+			conn, err := dialer.Dial("tcp", echo.Addr().String())
+			if err != nil {
+				return false
+			}
+
+			_ = conn.Close()
+
+			return true
+		}, time.Second, 10*time.Millisecond)
+
+		assert.Len(t, proxyDialer.Conns(), 2)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		defer listen.Close()
+
+		go func() {
+			_ = New().Serve(listen)
+		}()
+
+		_, err = NewMultiplexDialer("tcp", listen.Addr().String()).Dial("tcp", echo.Addr().String())
+		assertSocks5Rejection(t, err, Socks5StatusCMDNotSupported)
+	})
+}
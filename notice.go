@@ -0,0 +1,142 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// AuthMethodNotice is the non-standard method of this package, from the
+// private range of RFC 1928, which delivers an operator's notice to the
+// client before the authentication, e.g. "maintenance at 22:00,
+// reconnect required".
+//
+// A client offers the method in addition to its regular methods. If the
+// server has a notice for the client, it selects the method and sends a
+// Notice, which carries the method the server selects from the other
+// methods of the client. The subnegotiation of that method follows,
+// unless the notice disconnects the client.
+const AuthMethodNotice AuthMethod = 0x89
+
+// NoticeVersion1 is the version of the Notice message.
+const NoticeVersion1 = 0x01
+
+// maxNoticeMessageLen is the maximum length of the message of a notice.
+const maxNoticeMessageLen = 0xffff
+
+const noticeFlagDisconnect = 0x01
+
+// Notice is a message of the server to the client, see AuthMethodNotice.
+type Notice struct {
+	// Message is the text of the notice.
+	Message string
+
+	// Disconnect reports whether the server closes the connection after
+	// the notice, e.g. because the client is banned.
+	Disconnect bool
+
+	// Method is the method selected for the authentication. It is set by
+	// the server and AuthMethodNoAcceptableMethods if Disconnect is set.
+	Method AuthMethod
+}
+
+func (n *Notice) String() string {
+	return fmt.Sprintf("notice method=%q disconnect=%t message=%q", n.Method, n.Disconnect, n.Message)
+}
+
+func (n *Notice) MarshalBinary() ([]byte, error) {
+	if len(n.Message) > maxNoticeMessageLen {
+		return nil, errors.New("socks: notice message too long")
+	}
+
+	var flags byte
+	if n.Disconnect {
+		flags |= noticeFlagDisconnect
+	}
+
+	b := []byte{NoticeVersion1, byte(n.Method), flags, 0, 0}
+	binary.BigEndian.PutUint16(b[3:], uint16(len(n.Message)))
+
+	return append(b, n.Message...), nil
+}
+
+func (n *Notice) UnmarshalBinary(p []byte) error {
+	return n.decode(bytes.NewBuffer(p))
+}
+
+func (n *Notice) decode(r messageReader) error {
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+
+	if b[0] != NoticeVersion1 {
+		return versionError("notice", NoticeVersion1, b[0])
+	}
+
+	message := make([]byte, binary.BigEndian.Uint16(b[3:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return err
+	}
+
+	n.Method = AuthMethod(b[1])
+	n.Disconnect = b[2]&noticeFlagDisconnect != 0
+	n.Message = string(message)
+
+	return nil
+}
+
+// NoticeFunc returns the notice for the client of a session, or nil, see
+// Options.Notice. The session only knows the client address yet.
+type NoticeFunc func(ctx context.Context, session *Session) *Notice
+
+// NoticeError is returned by both sides of a connection the server
+// closed after a notice with Disconnect set.
+type NoticeError struct {
+	Notice *Notice
+}
+
+func (e *NoticeError) Error() string {
+	return "socks: disconnected by notice: " + e.Notice.Message
+}
+
+// NoticeAuthenticator returns the client side AuthenticateFunc of
+// AuthMethodNotice, which passes the notice of the server to onNotice
+// and continues with authenticate for the method of the notice. The
+// client must offer AuthMethodNotice in addition to the methods of
+// authenticate; a Socks5Dialer with OnNotice does so.
+func NoticeAuthenticator(onNotice func(n *Notice), authenticate AuthenticateFunc) AuthenticateFunc {
+	return func(ctx context.Context, conn *Conn, method AuthMethod) error {
+		if method == AuthMethodNotice {
+			n := &Notice{}
+			if err := conn.Read(n); err != nil {
+				return err
+			}
+
+			onNotice(n)
+
+			if n.Disconnect {
+				return &NoticeError{Notice: n}
+			}
+
+			if n.Method == AuthMethodNoAcceptableMethods {
+				return newProtocolError("notice", "acceptable method", fmt.Sprintf("%v", n.Method), nil)
+			}
+
+			if err := checkUnsolicited(conn, "notice"); err != nil {
+				return err
+			}
+
+			method = n.Method
+		}
+
+		if authenticate == nil {
+			return nil
+		}
+
+		return authenticate(ctx, conn, method)
+	}
+}
@@ -0,0 +1,96 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoticeMessage(t *testing.T) {
+	for _, n := range []*Notice{
+		{Message: "maintenance at 22:00, reconnect required", Method: AuthMethodUsernamePassword},
+		{Message: "banned", Disconnect: true, Method: AuthMethodNoAcceptableMethods},
+		{},
+	} {
+		b, err := n.MarshalBinary()
+		assert.NoError(t, err)
+
+		got := &Notice{}
+		assert.NoError(t, got.UnmarshalBinary(b))
+		assert.Equal(t, n, got)
+	}
+}
+
+func TestNotice(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	var disconnect int32
+
+	server := New(func(o *Options) {
+		o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		o.Authenticate = userPassServerAuthenticateFuncGen("user", "pass")
+		o.Notice = func(ctx context.Context, session *Session) *Notice {
+			if atomic.LoadInt32(&disconnect) == 1 {
+				return &Notice{Message: "banned", Disconnect: true}
+			}
+
+			return &Notice{Message: "maintenance at 22:00, reconnect required"}
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	dial := func(onNotice func(n *Notice)) error {
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = UsernamePasswordAuthenticator("user", "pass")
+			o.OnNotice = onNotice
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+
+	t.Run("notice", func(t *testing.T) {
+		var notices []*Notice
+
+		assert.NoError(t, dial(func(n *Notice) {
+			notices = append(notices, n)
+		}))
+
+		assert.Equal(t, []*Notice{{
+			Message: "maintenance at 22:00, reconnect required",
+			Method:  AuthMethodUsernamePassword,
+		}}, notices)
+	})
+
+	t.Run("not offered", func(t *testing.T) {
+		assert.NoError(t, dial(nil))
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		atomic.StoreInt32(&disconnect, 1)
+
+		var got *Notice
+
+		err := dial(func(n *Notice) {
+			got = n
+		})
+
+		var noticeErr *NoticeError
+		assert.True(t, errors.As(err, &noticeErr))
+		assert.EqualError(t, err, "socks: disconnected by notice: banned")
+		assert.Equal(t, AuthMethodNoAcceptableMethods, got.Method)
+	})
+}
@@ -0,0 +1,43 @@
+package socks
+
+import (
+	"context"
+	"net"
+)
+
+// PolicyDialer enforces an egress policy on the client. It refuses to
+// dial destinations denied by a rule set, e.g. a RuleList or the rule
+// set of a HostMatcher, before the request reaches the proxy. The rule
+// set decides on a CONNECT request to the destination; conditions on
+// the client address or the user of a session never match.
+type PolicyDialer struct {
+	dialer Dialer
+	rules  RuleSet
+}
+
+// NewPolicyDialer returns a new PolicyDialer which dials the destinations
+// permitted by rules with dialer.
+func NewPolicyDialer(dialer Dialer, rules RuleSet) *PolicyDialer {
+	return &PolicyDialer{
+		dialer: dialer,
+		rules:  rules,
+	}
+}
+
+func (d *PolicyDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *PolicyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	req := &Request{
+		Version: Socks5Version,
+		CMD:     ConnectCommand,
+		Addr:    addr,
+	}
+
+	if !d.rules.Allow(ctx, req) {
+		return nil, &RuleError{Request: req}
+	}
+
+	return d.dialer.DialContext(ctx, network, addr)
+}
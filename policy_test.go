@@ -0,0 +1,50 @@
+package socks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyDialer(t *testing.T) {
+	t.Run("ports", func(t *testing.T) {
+		upstream := &recordingDialer{}
+		dialer := NewPolicyDialer(upstream, DenyPorts(21, 23, 80))
+
+		_, err := dialer.Dial("tcp", "example.com:80")
+
+		var ruleErr *RuleError
+		assert.True(t, errors.As(err, &ruleErr))
+		assert.Equal(t, "example.com:80", ruleErr.Request.Addr)
+
+		conn, err := dialer.Dial("tcp", "example.com:443")
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		assert.Equal(t, []string{"example.com:443"}, upstream.dials)
+	})
+
+	t.Run("rule list", func(t *testing.T) {
+		rules, err := ParseRules(strings.NewReader("allow to *.example.com:443\n"))
+		assert.NoError(t, err)
+
+		upstream := &recordingDialer{}
+		dialer := NewPolicyDialer(upstream, rules)
+
+		conn, err := dialer.Dial("tcp", "api.example.com:443")
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		_, err = dialer.Dial("tcp", "api.example.org:443")
+		assert.Error(t, err)
+
+		_, err = dialer.Dial("tcp", "api.example.com:80")
+		assert.Error(t, err)
+
+		assert.Equal(t, []string{"api.example.com:443"}, upstream.dials)
+	})
+}
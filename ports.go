@@ -0,0 +1,242 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrNoPortAvailable is returned by a PortAllocator without a free port.
+var ErrNoPortAvailable = errors.New("socks: no port available")
+
+// maxPortAttempts is the number of allocated ports tried before a bind
+// gives up, since other processes may use ports of the allocator.
+const maxPortAttempts = 32
+
+// PortAllocator assigns the local ports of the listeners of BIND
+// requests and of the sockets the UDP relay receives the datagrams of
+// the client on, instead of the ephemeral ports of the system, e.g. for
+// firewalls which only open a port window. Ports already in use by
+// other processes are released and replaced.
+type PortAllocator interface {
+	// Allocate reserves a port of network, i.e. "tcp" or "udp", for the
+	// session of ctx, if any.
+	Allocate(ctx context.Context, network string) (int, error)
+
+	// Release returns a port reserved by Allocate.
+	Release(network string, port int)
+}
+
+// PortRangeOptions specifies the assignment of the ports of a PortRange.
+type PortRangeOptions struct {
+	// Random specifies whether the ports are assigned randomly instead
+	// of sequentially, which makes them harder to predict.
+	Random bool
+
+	// Reservations specifies the ports reserved for users. The sessions
+	// of a user with reservations are only assigned the reserved ports,
+	// which are not assigned to the sessions of other users. Reserved
+	// ports may lie outside of the range.
+	Reservations map[string][]int
+}
+
+// PortRange is a PortAllocator which assigns the ports of a range. It
+// is safe for concurrent use.
+type PortRange struct {
+	ports        []int // of the range, without the reserved ones
+	random       bool
+	reservations map[string][]int
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	next int
+	used map[string]map[int]struct{}
+}
+
+// NewPortRange returns a new PortRange which assigns the ports from min
+// to max inclusive.
+func NewPortRange(min, max int, optFns ...func(*PortRangeOptions)) *PortRange {
+	options := PortRangeOptions{}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	reserved := make(map[int]struct{})
+
+	for _, ports := range options.Reservations {
+		for _, port := range ports {
+			reserved[port] = struct{}{}
+		}
+	}
+
+	var ports []int
+
+	for port := min; port <= max; port++ {
+		if _, ok := reserved[port]; !ok {
+			ports = append(ports, port)
+		}
+	}
+
+	return &PortRange{
+		ports:        ports,
+		random:       options.Random,
+		reservations: options.Reservations,
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())), //nolint:gosec // port spreading only
+		used:         make(map[string]map[int]struct{}),
+	}
+}
+
+// Allocate reserves the next free port of the range or of the
+// reservations of the user of the session.
+func (r *PortRange) Allocate(ctx context.Context, network string) (int, error) {
+	ports := r.ports
+
+	if session, ok := SessionFromContext(ctx); ok {
+		if reserved, ok := r.reservations[session.User()]; ok {
+			ports = reserved
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(ports) == 0 {
+		return 0, ErrNoPortAvailable
+	}
+
+	used := r.used[network]
+	if used == nil {
+		used = make(map[int]struct{})
+		r.used[network] = used
+	}
+
+	start := r.next
+	if r.random {
+		start = r.rand.Intn(len(ports))
+	}
+
+	for i := 0; i < len(ports); i++ {
+		j := (start + i) % len(ports)
+
+		if _, ok := used[ports[j]]; ok {
+			continue
+		}
+
+		used[ports[j]] = struct{}{}
+
+		if !r.random {
+			r.next = j + 1
+		}
+
+		return ports[j], nil
+	}
+
+	return 0, ErrNoPortAvailable
+}
+
+// Release returns a port reserved by Allocate.
+func (r *PortRange) Release(network string, port int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.used[network], port)
+}
+
+// bindPort calls bind with the ports of the allocator until a port is
+// not in use. Without an allocator, bind is called with port 0. The
+// returned function releases the port and may be called more than once.
+func bindPort(ctx context.Context, ports PortAllocator, network string, bind func(port int) error) (func(), error) {
+	if ports == nil {
+		return func() {}, bind(0)
+	}
+
+	for i := 0; i < maxPortAttempts; i++ {
+		port, err := ports.Allocate(ctx, network)
+		if err != nil {
+			return nil, err
+		}
+
+		err = bind(port)
+		if err == nil {
+			var once sync.Once
+
+			return func() {
+				once.Do(func() { ports.Release(network, port) })
+			}, nil
+		}
+
+		ports.Release(network, port)
+
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+
+	return nil, ErrNoPortAvailable
+}
+
+// listenPort opens a listener on host with a port of the allocator.
+func listenPort(ctx context.Context, ports PortAllocator, listener Listener, network, host string) (net.Listener, error) {
+	var l net.Listener
+
+	release, err := bindPort(ctx, ports, network, func(port int) (err error) {
+		l, err = listener.Listen(ctx, network, joinPort(host, port))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &allocatedListener{Listener: l, release: release}, nil
+}
+
+// listenPacketPort opens a packet socket on host with a port of the
+// allocator.
+func listenPacketPort(ctx context.Context, ports PortAllocator, network, host string) (net.PacketConn, error) {
+	var (
+		lc net.ListenConfig
+		pc net.PacketConn
+	)
+
+	release, err := bindPort(ctx, ports, network, func(port int) (err error) {
+		pc, err = lc.ListenPacket(ctx, network, joinPort(host, port))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &allocatedPacketConn{PacketConn: pc, release: release}, nil
+}
+
+func joinPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// allocatedListener releases its port on Close.
+type allocatedListener struct {
+	net.Listener
+	release func()
+}
+
+func (l *allocatedListener) Close() error {
+	defer l.release()
+	return l.Listener.Close()
+}
+
+// allocatedPacketConn releases its port on Close.
+type allocatedPacketConn struct {
+	net.PacketConn
+	release func()
+}
+
+func (c *allocatedPacketConn) Close() error {
+	defer c.release()
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,172 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortRange(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("sequential", func(t *testing.T) {
+		r := NewPortRange(1000, 1002)
+
+		var ports []int
+
+		for i := 0; i < 3; i++ {
+			port, err := r.Allocate(ctx, "tcp")
+			assert.NoError(t, err)
+
+			ports = append(ports, port)
+		}
+
+		assert.Equal(t, []int{1000, 1001, 1002}, ports)
+
+		_, err := r.Allocate(ctx, "tcp")
+		assert.ErrorIs(t, err, ErrNoPortAvailable)
+
+		// The networks have their own ports.
+		port, err := r.Allocate(ctx, "udp")
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, port)
+
+		r.Release("tcp", 1001)
+
+		port, err = r.Allocate(ctx, "tcp")
+		assert.NoError(t, err)
+		assert.Equal(t, 1001, port)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		r := NewPortRange(1000, 1009, func(o *PortRangeOptions) {
+			o.Random = true
+		})
+
+		seen := make(map[int]bool)
+
+		for i := 0; i < 10; i++ {
+			port, err := r.Allocate(ctx, "tcp")
+			assert.NoError(t, err)
+			assert.True(t, port >= 1000 && port <= 1009)
+			assert.False(t, seen[port])
+
+			seen[port] = true
+		}
+
+		_, err := r.Allocate(ctx, "tcp")
+		assert.ErrorIs(t, err, ErrNoPortAvailable)
+	})
+
+	t.Run("reservations", func(t *testing.T) {
+		r := NewPortRange(1000, 1001, func(o *PortRangeOptions) {
+			o.Reservations = map[string][]int{"alice": {1001, 2000}}
+		})
+
+		alice := newSession(nil)
+		alice.SetUser("alice")
+
+		aliceCtx := WithSession(ctx, alice)
+
+		for _, want := range []int{1001, 2000} {
+			port, err := r.Allocate(aliceCtx, "tcp")
+			assert.NoError(t, err)
+			assert.Equal(t, want, port)
+		}
+
+		_, err := r.Allocate(aliceCtx, "tcp")
+		assert.ErrorIs(t, err, ErrNoPortAvailable)
+
+		// Other users do not get the reserved ports.
+		port, err := r.Allocate(ctx, "tcp")
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, port)
+
+		_, err = r.Allocate(ctx, "tcp")
+		assert.ErrorIs(t, err, ErrNoPortAvailable)
+	})
+}
+
+func TestListenPort(t *testing.T) {
+	// A port in use by another socket is skipped.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer busy.Close()
+
+	port := busy.Addr().(*net.TCPAddr).Port
+
+	r := NewPortRange(port, port+1)
+
+	l, err := listenPort(context.Background(), r, &net.ListenConfig{}, "tcp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("port %d not available: %v", port+1, err)
+	}
+
+	assert.Equal(t, strconv.Itoa(port+1), portOf(t, l.Addr()))
+
+	_, err = listenPort(context.Background(), r, &net.ListenConfig{}, "tcp", "127.0.0.1")
+	assert.ErrorIs(t, err, ErrNoPortAvailable)
+
+	// Closing the listener releases the port.
+	assert.NoError(t, l.Close())
+
+	l, err = listenPort(context.Background(), r, &net.ListenConfig{}, "tcp", "127.0.0.1")
+	assert.NoError(t, err)
+
+	_ = l.Close()
+}
+
+func TestServerPorts(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	port := free.Addr().(*net.TCPAddr).Port
+	_ = free.Close()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	go func() {
+		_ = New(func(o *Options) {
+			o.HandlerOptions = func(h *DefaultHandlerOptions) {
+				h.Ports = NewPortRange(port, port)
+			}
+		}).Serve(listen)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d := NewSocks5Dialer("tcp", listen.Addr().String())
+
+	addr, _, err := d.Bind(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("port %d not available: %v", port, err)
+	}
+
+	assert.Equal(t, strconv.Itoa(port), portOf(t, addr))
+
+	pc, err := d.ListenPacket(ctx, "udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer pc.Close()
+
+	// The relay of the association got the UDP port of the range.
+	assert.Equal(t, strconv.Itoa(port), portOf(t, pc.(*socks5PacketConn).relay))
+}
+
+func portOf(t *testing.T, addr net.Addr) string {
+	t.Helper()
+
+	_, port, err := net.SplitHostPort(addr.String())
+	assert.NoError(t, err)
+
+	return port
+}
@@ -0,0 +1,134 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+type PrefetchDNSOptions struct {
+	// Resolver specifies the resolver. If nil, net.DefaultResolver is
+	// used.
+	Resolver *net.Resolver
+
+	// Rules specifies the optional rule set deciding which
+	// destinations are prefetched, e.g. the cheap checks of the policy
+	// enforced by the following middlewares, so that names of denied
+	// requests are not resolved. Requests denied by Options.Rules never
+	// reach the middleware.
+	Rules RuleSet
+}
+
+// PrefetchDNS returns a Middleware which starts the resolution of the
+// FQDN destination of CONNECT requests permitted by Options.Rules while
+// the following middlewares process the request. The DefaultHandler
+// connects to the prefetched addresses if the destination has not been
+// rewritten. It is meant for dialers connecting directly, as it
+// replaces the resolution by the dialer, e.g. by an upstream proxy.
+func PrefetchDNS(optFns ...func(*PrefetchDNSOptions)) Middleware {
+	options := PrefetchDNSOptions{
+		Resolver: net.DefaultResolver,
+	}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	return func(next RequestHandler) RequestHandler {
+		return RequestHandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+			if req.CMD != ConnectCommand {
+				return next.ServeSOCKS(ctx, conn, req)
+			}
+
+			host, _, err := net.SplitHostPort(req.Addr)
+			if err != nil || host == "" || net.ParseIP(host) != nil {
+				return next.ServeSOCKS(ctx, conn, req)
+			}
+
+			if _, ok := unixSocketPath(req.Addr); ok {
+				return next.ServeSOCKS(ctx, conn, req)
+			}
+
+			if options.Rules != nil && !options.Rules.Allow(ctx, req) {
+				return next.ServeSOCKS(ctx, conn, req)
+			}
+
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel() // stops an unused resolution
+
+			p := &dnsPrefetch{
+				addr: req.Addr,
+				done: make(chan struct{}),
+			}
+
+			go p.resolve(ctx, options.Resolver, host)
+
+			return next.ServeSOCKS(context.WithValue(ctx, dnsPrefetchKey{}, p), conn, req)
+		})
+	}
+}
+
+// dnsPrefetch is a resolution started ahead of the dial.
+type dnsPrefetch struct {
+	addr string
+	done chan struct{}
+	ips  []net.IPAddr
+	err  error
+}
+
+func (p *dnsPrefetch) resolve(ctx context.Context, resolver *net.Resolver, host string) {
+	defer close(p.done)
+
+	start := time.Now()
+	p.ips, p.err = resolver.LookupIPAddr(ctx, host)
+
+	metricsFromContext(ctx).dnsLookup(p.err == nil, time.Since(start))
+}
+
+// dial connects to the prefetched addresses in order.
+func (p *dnsPrefetch) dial(ctx context.Context, d Dialer) (net.Conn, error) {
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	_, port, err := splitHostPort(p.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+
+	for _, ip := range p.ips {
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no such host", Name: p.addr, IsNotFound: true}
+	}
+
+	return nil, lastErr
+}
+
+type dnsPrefetchKey struct{}
+
+// dnsPrefetchFromContext returns the prefetch of addr, if any.
+func dnsPrefetchFromContext(ctx context.Context, addr string) *dnsPrefetch {
+	p, _ := ctx.Value(dnsPrefetchKey{}).(*dnsPrefetch)
+	if p == nil || p.addr != addr {
+		return nil
+	}
+
+	return p
+}
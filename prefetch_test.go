@@ -0,0 +1,111 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetchDNS(t *testing.T) {
+	_, port, err := net.SplitHostPort(testServer.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	serve := func(t *testing.T, optFns ...func(*PrefetchDNSOptions)) (*Server, string) {
+		listen, err := net.Listen("tcp", "localhost:0")
+		assert.NoError(t, err)
+
+		t.Cleanup(func() { _ = listen.Close() })
+
+		server := New(func(o *Options) {
+			o.Middlewares = []Middleware{PrefetchDNS(optFns...)}
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		return server, listen.Addr().String()
+	}
+
+	get := func(t *testing.T, proxyAddr string) {
+		conn, err := NewSocks5Dialer("tcp", proxyAddr).Dial("tcp", net.JoinHostPort("localhost", port))
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		assert.NoError(t, err)
+
+		resp, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Contains(t, string(resp), "hello")
+	}
+
+	t.Run("prefetched", func(t *testing.T) {
+		server, addr := serve(t)
+
+		get(t, addr)
+
+		m := server.Metrics()
+		assert.Equal(t, uint64(1), m.DNSLookups)
+		assert.Equal(t, uint64(0), m.DNSFailures)
+	})
+
+	t.Run("not prefetched", func(t *testing.T) {
+		server, addr := serve(t, func(o *PrefetchDNSOptions) {
+			o.Rules = RuleSetFunc(func(ctx context.Context, req *Request) bool {
+				return false
+			})
+		})
+
+		get(t, addr)
+
+		assert.Equal(t, uint64(0), server.Metrics().DNSLookups)
+	})
+
+	t.Run("denied by server rules", func(t *testing.T) {
+		var lookups int32
+
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				atomic.AddInt32(&lookups, 1)
+				return nil, errors.New("lookup not expected")
+			},
+		}
+
+		listen, err := net.Listen("tcp", "localhost:0")
+		assert.NoError(t, err)
+
+		defer listen.Close()
+
+		server := New(func(o *Options) {
+			// A slow rule set, during which a prefetch would resolve.
+			o.Rules = RuleSetFunc(func(ctx context.Context, req *Request) bool {
+				time.Sleep(50 * time.Millisecond)
+				return false
+			})
+			o.Middlewares = []Middleware{PrefetchDNS(func(o *PrefetchDNSOptions) {
+				o.Resolver = resolver
+			})}
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		_, err = NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", "blocked.example:80")
+		assert.Error(t, err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		assert.Equal(t, int32(0), atomic.LoadInt32(&lookups))
+		assert.Equal(t, uint64(0), server.Metrics().DNSLookups)
+	})
+}
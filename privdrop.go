@@ -0,0 +1,65 @@
+package socks
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// DropPrivileges switches the process to the unprivileged user, given
+// as "user" or "user:group", after privileged resources like low ports
+// or TLS keys have been opened. Without a group, the primary group of
+// the user is used. It is only supported on Unix systems.
+func DropPrivileges(runAs string) error {
+	uid, gid, err := lookupRunAs(runAs)
+	if err != nil {
+		return err
+	}
+
+	if err := setUserGroup(uid, gid); err != nil {
+		return fmt.Errorf("socks: failed to drop privileges to %q: %w", runAs, err)
+	}
+
+	return nil
+}
+
+// lookupRunAs returns the user and group IDs of "user" or "user:group".
+func lookupRunAs(runAs string) (int, int, error) {
+	name, group := runAs, ""
+	if i := strings.IndexByte(runAs, ':'); i >= 0 {
+		name, group = runAs[:i], runAs[i+1:]
+	}
+
+	if name == "" {
+		return 0, 0, fmt.Errorf("socks: invalid run as user %q", runAs)
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("socks: %w", err)
+	}
+
+	gidStr := u.Gid
+
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, fmt.Errorf("socks: %w", err)
+		}
+
+		gidStr = g.Gid
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("socks: unsupported user ID %q", u.Uid)
+	}
+
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("socks: unsupported group ID %q", gidStr)
+	}
+
+	return uid, gid, nil
+}
@@ -0,0 +1,12 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package socks
+
+import "errors"
+
+const dropPrivilegesSupported = false
+
+func setUserGroup(uid, gid int) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,33 @@
+package socks
+
+import (
+	"os/user"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupRunAs(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	t.Run("user", func(t *testing.T) {
+		uid, gid, err := lookupRunAs(current.Username)
+		assert.NoError(t, err)
+		assert.Equal(t, current.Uid, strconv.Itoa(uid))
+		assert.Equal(t, current.Gid, strconv.Itoa(gid))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, _, err := lookupRunAs(":group")
+		assert.EqualError(t, err, `socks: invalid run as user ":group"`)
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		_, _, err := lookupRunAs("no-such-user-socks")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,139 @@
+package socks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// WritePrometheus writes the metrics of the server in the Prometheus
+// text exposition format, e.g. in the handler of a /metrics endpoint.
+// The labeled session metrics and the top destinations are included if
+// Options.MetricLabels enables them.
+func (s *Server) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	m := s.Metrics()
+
+	counter := func(name, help string, value interface{}) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %v\n", name, help, name, name, value)
+	}
+
+	counter("socks_auth_successes_total", "Successful authentications.", m.AuthSuccesses)
+	counter("socks_auth_failures_total", "Failed authentications.", m.AuthFailures)
+	counter("socks_auth_latency_seconds_total", "Accumulated latency of the authentications.", m.AuthLatency.Seconds())
+	counter("socks_auth_timeouts_total", "Authentications which exceeded the authentication timeout.", m.AuthTimeouts)
+	counter("socks_auth_panics_total", "Authentications which panicked.", m.AuthPanics)
+	counter("socks_no_acceptable_methods_total", "Method selections without an acceptable method.", m.NoAcceptableMethods)
+	counter("socks_auth_grace_accepted_total", "Method selections accepted in grace mode.", m.AuthGraceAccepted)
+	counter("socks_handshakes_rejected_total", "Connections closed because of the handshake limit.", m.HandshakesRejected)
+	counter("socks_bind_successes_total", "BIND requests a valid peer connected to.", m.BindSuccesses)
+	counter("socks_bind_failures_total", "BIND requests without a valid peer.", m.BindFailures)
+	counter("socks_bind_rejected_total", "BIND requests rejected because of the bind limit.", m.BindRejected)
+	counter("socks_bind_wait_seconds_total", "Accumulated wait of the BIND requests for their peer.", m.BindWaitTime.Seconds())
+	fmt.Fprintf(bw, "# HELP socks_binds_pending BIND requests waiting for their peer.\n# TYPE socks_binds_pending gauge\nsocks_binds_pending %d\n", m.BindsPending)
+	counter("socks_udp_spoofed_dropped_total", "Datagrams dropped because of a foreign source.", m.UDPSpoofedDropped)
+	counter("socks_udp_dropped_total", "Datagrams dropped by the UDP relay.", m.UDPDropped)
+	counter("socks_udp_forwarded_total", "Datagrams relayed.", m.UDPForwarded)
+	counter("socks_udp_bytes_total", "Payload bytes of the relayed datagrams.", m.UDPBytes)
+	counter("socks_udp_rejected_total", "UDP associations rejected because UDP is disabled.", m.UDPRejected)
+	counter("socks_dns_lookups_total", "Resolutions of the DNS prefetch.", m.DNSLookups)
+	counter("socks_dns_failures_total", "Failed resolutions of the DNS prefetch.", m.DNSFailures)
+	counter("socks_dns_latency_seconds_total", "Accumulated latency of the resolutions.", m.DNSLatency.Seconds())
+
+	fmt.Fprint(bw, "# HELP socks_sessions_closed_total Closed sessions by reason.\n# TYPE socks_sessions_closed_total counter\n")
+
+	for reason := CloseReasonUnknown + 1; reason < closeReasonCount; reason++ {
+		fmt.Fprintf(bw, "socks_sessions_closed_total{reason=\"%s\"} %d\n", reason, m.CloseReasons[reason])
+	}
+
+	if len(m.HandshakeTimeouts) > 0 {
+		fields := make([]HandshakeField, 0, len(m.HandshakeTimeouts))
+		for field := range m.HandshakeTimeouts {
+			fields = append(fields, field)
+		}
+
+		sort.Slice(fields, func(i, j int) bool {
+			if fields[i].Phase != fields[j].Phase {
+				return fields[i].Phase < fields[j].Phase
+			}
+
+			return fields[i].Field < fields[j].Field
+		})
+
+		fmt.Fprint(bw, "# HELP socks_handshake_timeouts_total Handshakes which exceeded the handshake timeout by field.\n# TYPE socks_handshake_timeouts_total counter\n")
+
+		for _, field := range fields {
+			fmt.Fprintf(bw, "socks_handshake_timeouts_total{phase=\"%s\",field=\"%s\"} %d\n", field.Phase, field.Field, m.HandshakeTimeouts[field])
+		}
+	}
+
+	fmt.Fprint(bw, "# HELP socks_capability Capabilities of the build, 1 if supported.\n# TYPE socks_capability gauge\n")
+
+	capabilities := Capabilities()
+
+	for _, c := range sortedCapabilities() {
+		value := 0
+		if capabilities[c] {
+			value = 1
+		}
+
+		fmt.Fprintf(bw, "socks_capability{name=\"%s\"} %d\n", c, value)
+	}
+
+	if series := s.labels.snapshot(); len(series) > 0 {
+		fmt.Fprint(bw, "# HELP socks_sessions_total Closed sessions.\n# TYPE socks_sessions_total counter\n")
+
+		for _, l := range series {
+			fmt.Fprintf(bw, "socks_sessions_total%s %d\n", s.labels.labelSet(l), l.Sessions)
+		}
+
+		fmt.Fprint(bw, "# HELP socks_session_bytes_total Tunneled bytes of the closed sessions.\n# TYPE socks_session_bytes_total counter\n")
+
+		for _, l := range series {
+			fmt.Fprintf(bw, "socks_session_bytes_total%s %d\n", s.labels.labelSet(l, "direction", "in"), l.BytesIn)
+			fmt.Fprintf(bw, "socks_session_bytes_total%s %d\n", s.labels.labelSet(l, "direction", "out"), l.BytesOut)
+		}
+	}
+
+	if top := s.labels.topDestinations(); len(top) > 0 {
+		fmt.Fprint(bw, "# HELP socks_top_destination_sessions Sessions of the most frequent destinations.\n# TYPE socks_top_destination_sessions gauge\n")
+
+		for _, d := range top {
+			fmt.Fprintf(bw, "socks_top_destination_sessions{destination=\"%s\"} %d\n", escapeLabelValue(d.Destination), d.Sessions)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// labelSet returns the label set of a series with the enabled labels and
+// the extra label pairs.
+func (m *labeledMetrics) labelSet(l LabeledSessionMetrics, extra ...string) string {
+	var pairs []string
+
+	if m.options.Destination != DestinationLabelNone {
+		pairs = append(pairs, fmt.Sprintf("destination=\"%s\"", escapeLabelValue(l.Destination)))
+	}
+
+	if m.options.User != UserLabelNone {
+		pairs = append(pairs, fmt.Sprintf("user=\"%s\"", escapeLabelValue(l.User)))
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], escapeLabelValue(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
@@ -0,0 +1,341 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyProtocolOptions specifies the acceptance of PROXY protocol
+// headers, e.g. of a load balancer in front of the server.
+type ProxyProtocolOptions struct {
+	// Networks specifies the client networks whose connections may
+	// start with a PROXY protocol header of version 1 or 2. If nil, no
+	// headers are accepted.
+	Networks *CIDRSet
+}
+
+// accepts reports whether a header of the client is accepted.
+func (o *ProxyProtocolOptions) accepts(clientAddr net.Addr) bool {
+	if o == nil || o.Networks == nil {
+		return false
+	}
+
+	ip := addrIP(clientAddr)
+
+	return ip != nil && o.Networks.Contains(ip)
+}
+
+// ProxyTLVType is the type of a TLV of a PROXY protocol version 2 header.
+type ProxyTLVType uint8
+
+const (
+	ProxyTLVALPN      ProxyTLVType = 0x01
+	ProxyTLVAuthority ProxyTLVType = 0x02
+	ProxyTLVCRC32C    ProxyTLVType = 0x03
+	ProxyTLVNoop      ProxyTLVType = 0x04
+	ProxyTLVUniqueID  ProxyTLVType = 0x05
+	ProxyTLVSSL       ProxyTLVType = 0x20
+	ProxyTLVNetNS     ProxyTLVType = 0x30
+
+	// ProxyTLVGCP, ProxyTLVAWS and ProxyTLVAzure are the custom TLVs of
+	// the load balancers of the cloud providers.
+	ProxyTLVGCP   ProxyTLVType = 0xe0
+	ProxyTLVAWS   ProxyTLVType = 0xea
+	ProxyTLVAzure ProxyTLVType = 0xee
+)
+
+// proxyTLVAWSVPCEndpointID is the subtype of the AWS TLV carrying the ID
+// of the VPC endpoint.
+const proxyTLVAWSVPCEndpointID = 0x01
+
+// ProxyTLV is a TLV of a PROXY protocol version 2 header.
+type ProxyTLV struct {
+	Type  ProxyTLVType
+	Value []byte
+}
+
+// ProxyHeader is a PROXY protocol header.
+type ProxyHeader struct {
+	// Version is 1 or 2.
+	Version int
+
+	// Local reports whether the connection was not proxied, e.g. a
+	// health check of the load balancer, or the addresses are unknown.
+	Local bool
+
+	// SourceAddr and DestAddr are the addresses of the proxied
+	// connection.
+	SourceAddr net.Addr
+	DestAddr   net.Addr
+
+	// TLVs are the TLVs of a version 2 header.
+	TLVs []ProxyTLV
+}
+
+// TLV returns the value of the first TLV of the type.
+func (h *ProxyHeader) TLV(t ProxyTLVType) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// AWSVPCEndpointID returns the ID of the VPC endpoint of a connection
+// through an AWS Network Load Balancer.
+func (h *ProxyHeader) AWSVPCEndpointID() (string, bool) {
+	v, ok := h.TLV(ProxyTLVAWS)
+	if !ok || len(v) < 1 || v[0] != proxyTLVAWSVPCEndpointID {
+		return "", false
+	}
+
+	return string(v[1:]), true
+}
+
+// MarshalBinary encodes the header as a PROXY protocol version 2 header
+// of a TCP connection, regardless of Version. A header without TCP
+// addresses is encoded with the LOCAL command.
+func (h *ProxyHeader) MarshalBinary() ([]byte, error) {
+	b := append([]byte(nil), proxyV2Signature...)
+
+	src, _ := h.SourceAddr.(*net.TCPAddr)
+	dst, _ := h.DestAddr.(*net.TCPAddr)
+
+	var addrs []byte
+
+	switch {
+	case h.Local || src == nil || dst == nil:
+		b = append(b, 0x20, 0x00) // LOCAL, AF_UNSPEC
+	case src.IP.To4() != nil && dst.IP.To4() != nil:
+		b = append(b, 0x21, 0x11) // PROXY, TCP over IPv4
+		addrs = append(addrs, src.IP.To4()...)
+		addrs = append(addrs, dst.IP.To4()...)
+	default:
+		b = append(b, 0x21, 0x21) // PROXY, TCP over IPv6
+		addrs = append(addrs, src.IP.To16()...)
+		addrs = append(addrs, dst.IP.To16()...)
+	}
+
+	if addrs != nil {
+		addrs = append(addrs, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	}
+
+	for _, tlv := range h.TLVs {
+		if len(tlv.Value) > 0xffff {
+			return nil, fmt.Errorf("socks: PROXY TLV 0x%02x too long", uint8(tlv.Type))
+		}
+
+		addrs = append(addrs, byte(tlv.Type), byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		addrs = append(addrs, tlv.Value...)
+	}
+
+	if len(addrs) > 0xffff {
+		return nil, errors.New("socks: PROXY header too long")
+	}
+
+	b = append(b, byte(len(addrs)>>8), byte(len(addrs)))
+
+	return append(b, addrs...), nil
+}
+
+// NewUpstreamProxyHeader returns a PROXY protocol header for the
+// connection to a target, e.g. to be written in Hooks.OnEstablished. The
+// source is the source of the header accepted from the client, if any,
+// or the client address of the session; the destination is the remote
+// address of target. The TLVs of the types in forward are copied from
+// the accepted header.
+func NewUpstreamProxyHeader(session *Session, target net.Conn, forward ...ProxyTLVType) *ProxyHeader {
+	h := &ProxyHeader{
+		Version:    2,
+		SourceAddr: session.ClientAddr,
+		DestAddr:   target.RemoteAddr(),
+	}
+
+	accepted := session.ProxyHeader()
+	if accepted == nil {
+		return h
+	}
+
+	if !accepted.Local {
+		h.SourceAddr = accepted.SourceAddr
+	}
+
+	for _, tlv := range accepted.TLVs {
+		for _, t := range forward {
+			if tlv.Type == t {
+				h.TLVs = append(h.TLVs, tlv)
+				break
+			}
+		}
+	}
+
+	return h
+}
+
+// maxProxyV1HeaderLen is the maximum length of a version 1 header.
+const maxProxyV1HeaderLen = 107
+
+// readProxyHeader reads a PROXY protocol header of version 1 or 2.
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	sig, err := r.Peek(len(proxyV1Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyV1Signature) {
+		return readProxyV1Header(r)
+	}
+
+	return readProxyV2Header(r)
+}
+
+func readProxyV1Header(r *bufio.Reader) (*ProxyHeader, error) {
+	const phase = "PROXY header"
+
+	var line []byte
+
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1HeaderLen {
+			return nil, newProtocolError(phase, "CRLF", "end of header", line)
+		}
+
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, c)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	h := &ProxyHeader{Version: 1}
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		h.Local = true
+		return h, nil
+	}
+
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, newProtocolError(phase, "TCP4, TCP6 or UNKNOWN", fmt.Sprintf("%q", line), line)
+	}
+
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, newProtocolError(phase, "source address", fmt.Sprintf("%q", line), line)
+	}
+
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, newProtocolError(phase, "destination address", fmt.Sprintf("%q", line), line)
+	}
+
+	h.SourceAddr, h.DestAddr = src, dst
+
+	return h, nil
+}
+
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (*ProxyHeader, error) {
+	const phase = "PROXY header"
+
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(hdr[:12], proxyV2Signature) {
+		return nil, newProtocolError(phase, "signature", "unknown signature", hdr)
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, newProtocolError(phase, "version 2", fmt.Sprintf("version %d", hdr[12]>>4), hdr)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHeader{Version: 2}
+
+	var addrLen int
+
+	switch cmd := hdr[12] & 0x0f; cmd {
+	case 0x00:
+		h.Local = true
+	case 0x01:
+	default:
+		return nil, newProtocolError(phase, "command LOCAL or PROXY", fmt.Sprintf("command %d", cmd), hdr)
+	}
+
+	switch family := hdr[13] >> 4; family {
+	case 0x1: // AF_INET
+		addrLen = 12
+	case 0x2: // AF_INET6
+		addrLen = 36
+	case 0x3: // AF_UNIX
+		addrLen = 216
+		h.Local = true
+	default:
+		h.Local = true
+	}
+
+	if len(payload) < addrLen {
+		return nil, newProtocolError(phase, "addresses", "end of header", hdr)
+	}
+
+	if !h.Local {
+		ipLen := (addrLen - 4) / 2
+		h.SourceAddr = &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), payload[:ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+		}
+		h.DestAddr = &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), payload[ipLen:2*ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+		}
+	}
+
+	for tlvs := payload[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, newProtocolError(phase, "TLV", "end of header", tlvs)
+		}
+
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, newProtocolError(phase, "TLV value", "end of header", tlvs)
+		}
+
+		h.TLVs = append(h.TLVs, ProxyTLV{
+			Type:  ProxyTLVType(tlvs[0]),
+			Value: append([]byte(nil), tlvs[3:3+n]...),
+		})
+
+		tlvs = tlvs[3+n:]
+	}
+
+	return h, nil
+}
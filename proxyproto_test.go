@@ -0,0 +1,179 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// proxyHeaderDialer writes a PROXY protocol header on new connections.
+type proxyHeaderDialer struct {
+	header []byte
+}
+
+func (d *proxyHeaderDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(d.header); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func TestProxyHeader(t *testing.T) {
+	t.Run("v2", func(t *testing.T) {
+		for _, h := range []*ProxyHeader{
+			{
+				Version:    2,
+				SourceAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 40000},
+				DestAddr:   &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1).To4(), Port: 1080},
+				TLVs: []ProxyTLV{
+					{Type: ProxyTLVAWS, Value: append([]byte{0x01}, "vpce-123"...)},
+					{Type: ProxyTLVALPN, Value: []byte("h2")},
+				},
+			},
+			{
+				Version:    2,
+				SourceAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000},
+				DestAddr:   &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1080},
+			},
+			{
+				Version: 2,
+				Local:   true,
+				TLVs:    []ProxyTLV{{Type: ProxyTLVAuthority, Value: []byte("example.com")}},
+			},
+		} {
+			b, err := h.MarshalBinary()
+			assert.NoError(t, err)
+
+			got, err := readProxyHeader(bufio.NewReader(bytes.NewReader(b)))
+			assert.NoError(t, err)
+			assert.Equal(t, h, got)
+		}
+	})
+
+	t.Run("v1", func(t *testing.T) {
+		h, err := readProxyHeader(bufio.NewReader(bytes.NewReader([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 40000 1080\r\n\x05"))))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, h.Version)
+		assert.Equal(t, "192.0.2.1:40000", h.SourceAddr.String())
+		assert.Equal(t, "198.51.100.1:1080", h.DestAddr.String())
+
+		h, err = readProxyHeader(bufio.NewReader(bytes.NewReader([]byte("PROXY UNKNOWN\r\n"))))
+		assert.NoError(t, err)
+		assert.True(t, h.Local)
+
+		_, err = readProxyHeader(bufio.NewReader(bytes.NewReader([]byte("PROXY TCP4 nonsense\r\n"))))
+
+		var protocolErr *ProtocolError
+		assert.ErrorAs(t, err, &protocolErr)
+	})
+
+	t.Run("aws", func(t *testing.T) {
+		h := &ProxyHeader{TLVs: []ProxyTLV{{Type: ProxyTLVAWS, Value: append([]byte{0x01}, "vpce-123"...)}}}
+
+		id, ok := h.AWSVPCEndpointID()
+		assert.True(t, ok)
+		assert.Equal(t, "vpce-123", id)
+
+		_, ok = (&ProxyHeader{}).AWSVPCEndpointID()
+		assert.False(t, ok)
+	})
+}
+
+func TestProxyProtocol(t *testing.T) {
+	lb := &ProxyHeader{
+		Version:    2,
+		SourceAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 40000},
+		DestAddr:   &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1).To4(), Port: 1080},
+		TLVs: []ProxyTLV{
+			{Type: ProxyTLVAWS, Value: append([]byte{0x01}, "vpce-123"...)},
+			{Type: ProxyTLVALPN, Value: []byte("h2")},
+		},
+	}
+
+	header, err := lb.MarshalBinary()
+	assert.NoError(t, err)
+
+	// The target reads the PROXY header sent upstream.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer target.Close()
+
+	upstream := make(chan *ProxyHeader, 1)
+
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+
+			h, _ := readProxyHeader(bufio.NewReader(conn))
+			upstream <- h
+
+			_ = conn.Close()
+		}
+	}()
+
+	serve := func(t *testing.T, cidr string) string {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		t.Cleanup(func() { _ = listen.Close() })
+
+		networks, err := NewCIDRSet(cidr)
+		assert.NoError(t, err)
+
+		server := New(func(o *Options) {
+			o.ProxyProtocol = ProxyProtocolOptions{Networks: networks}
+			o.Hooks.OnEstablished = func(ctx context.Context, e *EstablishedEvent) error {
+				b, err := NewUpstreamProxyHeader(e.Session, e.Target, ProxyTLVAWS).MarshalBinary()
+				if err != nil {
+					return err
+				}
+
+				_, err = e.Target.Write(b)
+
+				return err
+			}
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		return listen.Addr().String()
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		conn, err := NewSocks5Dialer("tcp", serve(t, "127.0.0.0/8"), func(o *Socks5DialerOptions) {
+			o.ProxyDialer = &proxyHeaderDialer{header: header}
+		}).Dial("tcp", target.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		h := <-upstream
+		assert.Equal(t, lb.SourceAddr, h.SourceAddr)
+		assert.Equal(t, target.Addr().String(), h.DestAddr.String())
+		assert.Equal(t, []ProxyTLV{lb.TLVs[0]}, h.TLVs)
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		_, err := NewSocks5Dialer("tcp", serve(t, "10.0.0.0/8"), func(o *Socks5DialerOptions) {
+			o.ProxyDialer = &proxyHeaderDialer{header: header}
+		}).Dial("tcp", target.Addr().String())
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,83 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// ProxyResolver resolves the host name of the address of a proxy, e.g.
+// to avoid a lookup with the system resolver when its queries must
+// themselves go through the proxy.
+type ProxyResolver interface {
+	LookupProxy(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// The ProxyResolverFunc type is an adapter to allow the use of ordinary
+// functions as proxy resolvers.
+type ProxyResolverFunc func(ctx context.Context, host string) ([]net.IP, error)
+
+// LookupProxy calls f(ctx, host).
+func (f ProxyResolverFunc) LookupProxy(ctx context.Context, host string) ([]net.IP, error) {
+	return f(ctx, host)
+}
+
+// NetProxyResolver returns a ProxyResolver which looks up the host with
+// resolver, e.g. a net.Resolver with a custom Dial function.
+func NetProxyResolver(resolver *net.Resolver) ProxyResolver {
+	return ProxyResolverFunc(func(ctx context.Context, host string) ([]net.IP, error) {
+		return resolver.LookupIP(ctx, "ip", host)
+	})
+}
+
+// BootstrapProxyResolver returns a ProxyResolver which resolves every
+// host to the bootstrap IP addresses.
+func BootstrapProxyResolver(ips ...net.IP) ProxyResolver {
+	return ProxyResolverFunc(func(ctx context.Context, host string) ([]net.IP, error) {
+		return ips, nil
+	})
+}
+
+// dialProxy connects to the proxy address with dialer. If resolver is
+// not nil, a host name is resolved with it and the addresses are tried
+// in order.
+func dialProxy(ctx context.Context, dialer Dialer, resolver ProxyResolver, network, address string) (net.Conn, error) {
+	if resolver == nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	ips, err := resolver.LookupProxy(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("socks: no addresses for proxy %s", host)
+	}
+
+	var lastErr error
+
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,66 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyResolver(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New()
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	_, port, _ := net.SplitHostPort(listen.Addr().String())
+	proxyAddr := net.JoinHostPort("proxy.invalid", port)
+
+	t.Run("bootstrap", func(t *testing.T) {
+		// The first address refuses the connection.
+		resolver := BootstrapProxyResolver(net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1"))
+
+		conn, err := NewSocks5Dialer("tcp", proxyAddr, func(o *Socks5DialerOptions) {
+			o.ProxyResolver = resolver
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		conn.Close()
+
+		conn, err = NewSocks4Dialer("tcp", proxyAddr, func(o *Socks4DialerOptions) {
+			o.ProxyResolver = resolver
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		conn.Close()
+	})
+
+	t.Run("lookup error", func(t *testing.T) {
+		_, err := NewSocks5Dialer("tcp", proxyAddr, func(o *Socks5DialerOptions) {
+			o.ProxyResolver = ProxyResolverFunc(func(ctx context.Context, host string) ([]net.IP, error) {
+				assert.Equal(t, "proxy.invalid", host)
+				return nil, errors.New("no bootstrap")
+			})
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		assert.EqualError(t, err, "no bootstrap")
+	})
+
+	t.Run("ip address", func(t *testing.T) {
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.ProxyResolver = ProxyResolverFunc(func(ctx context.Context, host string) ([]net.IP, error) {
+				return nil, errors.New("unexpected lookup")
+			})
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		conn.Close()
+	})
+}
@@ -0,0 +1,148 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+type RacingDialerOptions struct {
+	// Stagger specifies the head start of each dialer over the next one,
+	// like the fallback delay of Happy Eyeballs, which spares the other
+	// proxies while the first answers quickly. A failed dial starts the
+	// next dialer at once. If zero, all dialers start at once.
+	Stagger time.Duration
+}
+
+// RacingDialer is a Dialer which connects to the same destination through
+// several dialers concurrently, e.g. Socks5Dialers of proxies in
+// different regions, and returns the first established connection. The
+// other dials are cancelled and their connections closed.
+type RacingDialer struct {
+	dialers []Dialer
+	stagger time.Duration
+}
+
+// NewRacingDialer returns a new RacingDialer racing dialers in order.
+func NewRacingDialer(dialers []Dialer, optFns ...func(*RacingDialerOptions)) *RacingDialer {
+	options := RacingDialerOptions{}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	return &RacingDialer{
+		dialers: dialers,
+		stagger: options.Stagger,
+	}
+}
+
+func (d *RacingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *RacingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(d.dialers) == 0 {
+		return nil, errors.New("socks: no dialers to race")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	// The channel holds a result of each dialer, so that the losers do
+	// not block after the race.
+	results := make(chan result, len(d.dialers))
+
+	var started, pending int
+
+	start := func() {
+		dialer := d.dialers[started]
+
+		started++
+		pending++
+
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			results <- result{conn: conn, err: err}
+		}()
+	}
+
+	var (
+		timer *time.Timer
+		next  <-chan time.Time
+		errs  []error
+	)
+
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		if started < len(d.dialers) && (pending == 0 || d.stagger <= 0) {
+			start()
+			continue
+		}
+
+		if started < len(d.dialers) && next == nil {
+			timer = time.NewTimer(d.stagger)
+			next = timer.C
+		}
+
+		select {
+		case <-next:
+			next = nil
+
+			start()
+		case r := <-results:
+			pending--
+
+			if r.err == nil {
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.err == nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+
+				return r.conn, nil
+			}
+
+			errs = append(errs, r.err)
+
+			if pending == 0 && started == len(d.dialers) {
+				return nil, &RaceError{Errors: errs}
+			}
+
+			if pending == 0 && timer != nil {
+				// The next dialer starts at once, with a new head start.
+				timer.Stop()
+				next = nil
+			}
+		}
+	}
+}
+
+// RaceError is returned by a RacingDialer if all dialers failed.
+type RaceError struct {
+	// Errors holds the errors of the dialers in the order they failed.
+	Errors []error
+}
+
+func (e *RaceError) Error() string {
+	return fmt.Sprintf("socks: all %d racing dials failed, first: %v", len(e.Errors), e.Errors[0])
+}
+
+// Unwrap returns the error of the first failed dial.
+func (e *RaceError) Unwrap() error {
+	return e.Errors[0]
+}
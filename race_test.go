@@ -0,0 +1,134 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type raceTestDialer func(ctx context.Context) (net.Conn, error)
+
+func (f raceTestDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx)
+}
+
+func TestRacingDialer(t *testing.T) {
+	pipe := func() net.Conn {
+		c1, c2 := net.Pipe()
+		_ = c2.Close()
+
+		return c1
+	}
+
+	t.Run("first wins", func(t *testing.T) {
+		fast := pipe()
+		cancelled := make(chan struct{})
+
+		dialer := NewRacingDialer([]Dialer{
+			raceTestDialer(func(ctx context.Context) (net.Conn, error) {
+				<-ctx.Done()
+				close(cancelled)
+
+				return nil, ctx.Err()
+			}),
+			raceTestDialer(func(ctx context.Context) (net.Conn, error) {
+				return nil, errors.New("refused")
+			}),
+			raceTestDialer(func(ctx context.Context) (net.Conn, error) {
+				return fast, nil
+			}),
+		})
+
+		conn, err := dialer.Dial("tcp", "example.com:80")
+		assert.NoError(t, err)
+		assert.Equal(t, fast, conn)
+
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("slow dial not cancelled")
+		}
+	})
+
+	t.Run("loser closed", func(t *testing.T) {
+		winner, loser := make(chan struct{}), make(chan net.Conn, 1)
+
+		dialer := NewRacingDialer([]Dialer{
+			raceTestDialer(func(ctx context.Context) (net.Conn, error) {
+				defer close(winner)
+				return pipe(), nil
+			}),
+			raceTestDialer(func(ctx context.Context) (net.Conn, error) {
+				<-winner
+
+				c1, c2 := net.Pipe()
+				loser <- c2
+
+				return c1, nil
+			}),
+		})
+
+		_, err := dialer.Dial("tcp", "example.com:80")
+		assert.NoError(t, err)
+
+		_, err = (<-loser).Read(make([]byte, 1))
+		assert.Error(t, err)
+	})
+
+	t.Run("stagger", func(t *testing.T) {
+		started := make(chan int, 3)
+
+		dialer := NewRacingDialer([]Dialer{
+			raceTestDialer(func(ctx context.Context) (net.Conn, error) {
+				started <- 0
+				return nil, errors.New("refused")
+			}),
+			raceTestDialer(func(ctx context.Context) (net.Conn, error) {
+				started <- 1
+				<-ctx.Done()
+
+				return nil, ctx.Err()
+			}),
+			raceTestDialer(func(ctx context.Context) (net.Conn, error) {
+				started <- 2
+				return pipe(), nil
+			}),
+		}, func(o *RacingDialerOptions) {
+			o.Stagger = 50 * time.Millisecond
+		})
+
+		begin := time.Now()
+
+		_, err := dialer.Dial("tcp", "example.com:80")
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(begin), 50*time.Millisecond)
+		assert.Equal(t, 0, <-started)
+		assert.Equal(t, 1, <-started)
+		assert.Equal(t, 2, <-started)
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		refused := errors.New("refused")
+
+		dialer := NewRacingDialer([]Dialer{
+			raceTestDialer(func(ctx context.Context) (net.Conn, error) { return nil, refused }),
+			raceTestDialer(func(ctx context.Context) (net.Conn, error) { return nil, refused }),
+		}, func(o *RacingDialerOptions) {
+			o.Stagger = time.Hour
+		})
+
+		_, err := dialer.Dial("tcp", "example.com:80")
+
+		var raceErr *RaceError
+		assert.True(t, errors.As(err, &raceErr))
+		assert.Len(t, raceErr.Errors, 2)
+		assert.True(t, errors.Is(err, refused))
+
+		_, err = NewRacingDialer(nil).Dial("tcp", "example.com:80")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,172 @@
+package socks
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+type RateLimitOptions struct {
+	// Burst specifies the number of bytes a group may transfer at once
+	// after an idle period. If zero, it is the bytes of one second.
+	Burst int
+
+	// Key specifies the group of a session, e.g. its user, the IP
+	// address of its client or an annotation naming its tenant. The
+	// sessions of a group share a token bucket. If nil, each session is
+	// a group of its own.
+	Key func(session *Session) string
+}
+
+// RateLimiter limits the bytes tunneled by the sessions of a server, see
+// Options.RateLimiter. The sessions are grouped by RateLimitOptions.Key
+// and the bytes of both directions of all sessions of a group are taken
+// from the same token bucket, so that e.g. a user cannot multiply the
+// rate with parallel connections. The bucket of a group is released with
+// its last session.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	key   func(session *Session) string
+
+	mu     sync.Mutex
+	groups map[string]*rateGroup
+}
+
+type rateGroup struct {
+	bucket *tokenBucket
+	refs   int
+}
+
+// NewRateLimiter returns a new RateLimiter allowing each group
+// bytesPerSecond bytes per second. If bytesPerSecond is not positive,
+// the rate is not limited.
+func NewRateLimiter(bytesPerSecond int, optFns ...func(*RateLimitOptions)) *RateLimiter {
+	options := RateLimitOptions{}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	burst := options.Burst
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(burst),
+		key:    options.Key,
+		groups: make(map[string]*rateGroup),
+	}
+}
+
+// Groups returns the number of groups with sessions.
+func (l *RateLimiter) Groups() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.groups)
+}
+
+// acquire returns the token bucket of the group of session and a
+// function releasing it once the session ends.
+func (l *RateLimiter) acquire(session *Session) (*tokenBucket, func()) {
+	key := "session:" + session.ID
+	if l.key != nil {
+		key = l.key(session)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	group, ok := l.groups[key]
+	if !ok {
+		group = &rateGroup{bucket: newTokenBucket(l.rate, l.burst)}
+		l.groups[key] = group
+	}
+
+	group.refs++
+
+	var once sync.Once
+
+	return group.bucket, func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			if group.refs--; group.refs == 0 {
+				delete(l.groups, key)
+			}
+		})
+	}
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per
+// second. Reservations may take more tokens than available; the
+// reserving reader then waits until the debt is refilled.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens and returns how long to wait until they are
+// refilled.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.last = now
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimitedReader reads at the rate of a token bucket. Reads are
+// limited to the burst, so that a large read does not stall the other
+// sessions of the group.
+type rateLimitedReader struct {
+	r      io.Reader
+	bucket *tokenBucket
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if max := int(r.bucket.burst); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		time.Sleep(r.bucket.reserve(n))
+	}
+
+	return n, err
+}
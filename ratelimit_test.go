@@ -0,0 +1,142 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(1000, 100)
+
+	assert.Equal(t, time.Duration(0), b.reserve(100))
+
+	// The debt of 500 tokens takes half a second to refill.
+	wait := b.reserve(500)
+	assert.InDelta(t, 500*time.Millisecond, wait, float64(20*time.Millisecond))
+
+	unlimited := newTokenBucket(0, 0)
+	assert.Equal(t, time.Duration(0), unlimited.reserve(1<<20))
+}
+
+func TestRateLimiterGroups(t *testing.T) {
+	l := NewRateLimiter(1024, func(o *RateLimitOptions) {
+		o.Key = func(session *Session) string {
+			tenant, _ := session.Annotation("tenant")
+			return tenant
+		}
+	})
+
+	a, b, c := newSession(nil), newSession(nil), newSession(nil)
+	a.Annotate("tenant", "red")
+	b.Annotate("tenant", "red")
+	c.Annotate("tenant", "blue")
+
+	bucketA, releaseA := l.acquire(a)
+	bucketB, releaseB := l.acquire(b)
+	bucketC, releaseC := l.acquire(c)
+
+	assert.Same(t, bucketA, bucketB)
+	assert.NotSame(t, bucketA, bucketC)
+	assert.Equal(t, 2, l.Groups())
+
+	releaseA()
+	releaseA()
+	assert.Equal(t, 2, l.Groups())
+
+	releaseB()
+	releaseC()
+	assert.Equal(t, 0, l.Groups())
+
+	// Without a key, each session is a group of its own.
+	l = NewRateLimiter(1024)
+
+	bucketA, releaseA = l.acquire(a)
+	bucketB, releaseB = l.acquire(b)
+
+	assert.NotSame(t, bucketA, bucketB)
+
+	releaseA()
+	releaseB()
+}
+
+func TestRateLimiter(t *testing.T) {
+	const size = 32 * 1024
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer target.Close()
+
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				_, _ = conn.Write(make([]byte, size))
+			}()
+		}
+	}()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	limiter := NewRateLimiter(64*1024, func(o *RateLimitOptions) {
+		o.Burst = 16 * 1024
+		o.Key = func(session *Session) string {
+			return "all"
+		}
+	})
+
+	go func() {
+		_ = New(func(o *Options) {
+			o.RateLimiter = limiter
+		}).Serve(listen)
+	}()
+
+	d := NewSocks5Dialer("tcp", listen.Addr().String())
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			conn, err := d.Dial("tcp", target.Addr().String())
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			defer conn.Close()
+
+			n, err := io.Copy(io.Discard, conn)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(size), n)
+		}()
+	}
+
+	wg.Wait()
+
+	// The sessions share the bucket: 64 KiB minus the burst of 16 KiB
+	// take at least 0.75 seconds at 64 KiB/s.
+	assert.GreaterOrEqual(t, time.Since(start), 700*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		return limiter.Groups() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,367 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transcript holds the bytes of a SOCKS connection in the order the
+// client and the server sent them, e.g. of a session reported by a user
+// as captured by a packet sniffer. ReplayServer and ReplayDialer feed a
+// transcript back through the server and the dialers, which turns the
+// report into a deterministic regression test.
+//
+// The text form of a transcript, see ParseTranscript and String, has a
+// line of hex bytes per chunk, prefixed with "C:" for the bytes of the
+// client and "S:" for the bytes of the server. Lines starting with #
+// are comments:
+//
+//	# curl --socks5 localhost:1080 http://192.0.2.1/
+//	C: 05 01 00
+//	S: 05 00
+//	C: 05 01 00 01 c0 00 02 01 00 50
+//	S: 05 00 00 01 00 00 00 00 00 00
+type Transcript struct {
+	Chunks []TranscriptChunk
+}
+
+// TranscriptChunk holds bytes sent in one direction.
+type TranscriptChunk struct {
+	// FromServer reports whether the server sent the bytes.
+	FromServer bool
+
+	Data []byte
+}
+
+// ParseTranscript parses the text form of a transcript.
+func ParseTranscript(r io.Reader) (*Transcript, error) {
+	t := &Transcript{}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var fromServer bool
+
+		switch {
+		case strings.HasPrefix(text, "C:"):
+		case strings.HasPrefix(text, "S:"):
+			fromServer = true
+		default:
+			return nil, fmt.Errorf("socks: transcript line %d: missing C: or S: prefix", line)
+		}
+
+		b, err := hex.DecodeString(strings.Join(strings.Fields(text[2:]), ""))
+		if err != nil {
+			return nil, fmt.Errorf("socks: transcript line %d: %w", line, err)
+		}
+
+		t.Chunks = append(t.Chunks, TranscriptChunk{FromServer: fromServer, Data: b})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// String returns the text form of the transcript.
+func (t *Transcript) String() string {
+	var b strings.Builder
+
+	for _, chunk := range t.Chunks {
+		prefix := "C:"
+		if chunk.FromServer {
+			prefix = "S:"
+		}
+
+		fmt.Fprintf(&b, "%s % x\n", prefix, chunk.Data)
+	}
+
+	return b.String()
+}
+
+// Client returns the bytes sent by the client.
+func (t *Transcript) Client() []byte {
+	return t.bytes(false)
+}
+
+// Server returns the bytes sent by the server.
+func (t *Transcript) Server() []byte {
+	return t.bytes(true)
+}
+
+func (t *Transcript) bytes(fromServer bool) []byte {
+	var b []byte
+
+	for _, chunk := range t.Chunks {
+		if chunk.FromServer == fromServer {
+			b = append(b, chunk.Data...)
+		}
+	}
+
+	return b
+}
+
+// Dump renders the negotiation of the transcript, see DumpHandshake.
+func (t *Transcript) Dump() (string, error) {
+	return DumpHandshake(t.Client(), t.Server())
+}
+
+// replayChunks returns the chunks of one direction of t, each to be read
+// once the peer has written the bytes it sent before the chunk.
+func (t *Transcript) replayChunks(fromServer bool) []replayChunk {
+	var (
+		chunks []replayChunk
+		peer   int
+	)
+
+	for _, chunk := range t.Chunks {
+		if chunk.FromServer != fromServer {
+			peer += len(chunk.Data)
+			continue
+		}
+
+		chunks = append(chunks, replayChunk{data: chunk.Data, after: peer})
+	}
+
+	return chunks
+}
+
+// The addresses of the connections of a replay.
+var (
+	replayClientAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 49152}
+	replayServerAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1080}
+	replayBindAddr   = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 49152}
+)
+
+// ReplayServer feeds the client bytes of t to a server configured by
+// optFns and returns the bytes the server wrote, along with the error
+// the server closed the connection with. The client bytes are available
+// at once, like those of a client pipelining its messages.
+//
+// The client connects from 192.0.2.1:49152 to 192.0.2.2:1080. Unless
+// optFns sets a Dialer, CONNECT requests succeed with a target which
+// discards the data of the client and closes the tunnel, bound to
+// 192.0.2.2:49152. Targets with a host name resolve to 192.0.2.3.
+func ReplayServer(t *Transcript, optFns ...func(*Options)) ([]byte, error) {
+	server := New(append([]func(*Options){func(o *Options) {
+		o.Dialer = replayTargetDialer{}
+	}}, optFns...)...)
+
+	conn := newReplayConn([]replayChunk{{data: t.Client()}}, replayServerAddr, replayClientAddr)
+
+	err := server.handleConnection(replayListener{}, conn)
+
+	return conn.written(), err
+}
+
+// ReplayDialer is a Dialer for the ProxyDialer of a Socks4Dialer or
+// Socks5Dialer whose connections play the server bytes of a transcript
+// to the client. Each chunk of the server is readable once the client
+// has written the bytes preceding it in the transcript, so a client
+// deviating from the transcript blocks until its read deadline or the
+// close of the connection.
+type ReplayDialer struct {
+	transcript *Transcript
+
+	mu   sync.Mutex
+	conn *replayConn
+}
+
+// NewReplayDialer returns a new ReplayDialer playing the server bytes of
+// t on every connection.
+func NewReplayDialer(t *Transcript) *ReplayDialer {
+	return &ReplayDialer{
+		transcript: t,
+	}
+}
+
+func (d *ReplayDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn := newReplayConn(d.transcript.replayChunks(true), replayClientAddr, replayServerAddr)
+
+	d.mu.Lock()
+	d.conn = conn
+	d.mu.Unlock()
+
+	return conn, nil
+}
+
+// Written returns the bytes the client wrote to the last connection, or
+// nil if the dialer has not been used.
+func (d *ReplayDialer) Written() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn == nil {
+		return nil
+	}
+
+	return d.conn.written()
+}
+
+// replayConn is a connection which reads the chunks of one direction of
+// a transcript and records the bytes written to it. Reads return io.EOF
+// after the last chunk.
+type replayConn struct {
+	local  net.Addr
+	remote net.Addr
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	chunks   []replayChunk
+	w        bytes.Buffer
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// replayChunk is readable once after bytes have been written.
+type replayChunk struct {
+	data  []byte
+	after int
+}
+
+func newReplayConn(chunks []replayChunk, local, remote net.Addr) *replayConn {
+	c := &replayConn{
+		local:  local,
+		remote: remote,
+		chunks: chunks,
+	}
+
+	c.cond = sync.NewCond(&c.mu)
+
+	return c
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case len(c.chunks) == 0:
+			return 0, io.EOF
+		case c.w.Len() >= c.chunks[0].after:
+			n := copy(p, c.chunks[0].data)
+
+			if c.chunks[0].data = c.chunks[0].data[n:]; len(c.chunks[0].data) == 0 {
+				c.chunks = c.chunks[1:]
+			}
+
+			return n, nil
+		case !c.deadline.IsZero() && !time.Now().Before(c.deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		c.cond.Wait()
+	}
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	c.cond.Broadcast()
+
+	return c.w.Write(p)
+}
+
+// written returns a copy of the bytes written to the connection.
+func (c *replayConn) written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]byte(nil), c.w.Bytes()...)
+}
+
+func (c *replayConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	c.cond.Broadcast()
+
+	return nil
+}
+
+func (c *replayConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of the reads waiting for the writes
+// of the peer.
+func (c *replayConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+
+	c.deadline = t
+	c.cond.Broadcast()
+
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			c.cond.Broadcast()
+		})
+	}
+
+	return nil
+}
+
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *replayConn) LocalAddr() net.Addr { return c.local }
+
+func (c *replayConn) RemoteAddr() net.Addr { return c.remote }
+
+// replayTargetDialer connects CONNECT requests of a replay to a target
+// which discards the data of the client and closes the tunnel.
+type replayTargetDialer struct{}
+
+func (replayTargetDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip = net.IPv4(192, 0, 2, 3)
+	}
+
+	return newReplayConn(nil, replayBindAddr, &net.TCPAddr{IP: ip, Port: int(port)}), nil
+}
+
+// replayListener is the listener of the connection of a replay.
+type replayListener struct{}
+
+func (replayListener) Accept() (net.Conn, error) { return nil, net.ErrClosed }
+
+func (replayListener) Close() error { return nil }
+
+func (replayListener) Addr() net.Addr { return replayServerAddr }
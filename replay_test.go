@@ -0,0 +1,129 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readTranscript(t *testing.T, file string) *Transcript {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join("testdata", "replay", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	transcript, err := ParseTranscript(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return transcript
+}
+
+func TestParseTranscript(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		transcript := readTranscript(t, "socks5-connect.txt")
+
+		assert.Len(t, transcript.Chunks, 6)
+		assert.Len(t, transcript.Client(), 31)
+		assert.Len(t, transcript.Server(), 12)
+
+		parsed, err := ParseTranscript(strings.NewReader(transcript.String()))
+		assert.NoError(t, err)
+		assert.Equal(t, transcript, parsed)
+	})
+
+	t.Run("dump", func(t *testing.T) {
+		dump, err := readTranscript(t, "socks5-connect.txt").Dump()
+		assert.NoError(t, err)
+		assert.Contains(t, dump, "C: SOCKS5 request")
+		assert.Contains(t, dump, "C: 18 bytes of data")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseTranscript(strings.NewReader("C: 05 01 00\n05 00\n"))
+		assert.EqualError(t, err, "socks: transcript line 2: missing C: or S: prefix")
+
+		_, err = ParseTranscript(strings.NewReader("S: 05 0\n"))
+		assert.Error(t, err)
+	})
+}
+
+func TestReplayServer(t *testing.T) {
+	t.Run("connect", func(t *testing.T) {
+		transcript := readTranscript(t, "socks5-connect.txt")
+
+		server, err := ReplayServer(transcript)
+		assert.NoError(t, err)
+		assert.Equal(t, transcript.Server(), server)
+	})
+
+	t.Run("auth required", func(t *testing.T) {
+		server, err := ReplayServer(readTranscript(t, "socks5-connect.txt"), func(o *Options) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		})
+		assert.Error(t, err)
+		assert.Equal(t, []byte{0x05, 0xff}, server)
+	})
+
+	t.Run("truncated request", func(t *testing.T) {
+		server, err := ReplayServer(&Transcript{Chunks: []TranscriptChunk{
+			{Data: []byte{0x05, 0x01, 0x00}},
+			{Data: []byte{0x05, 0x01, 0x00, 0x03, 0x0b, 'e'}},
+		}})
+		assert.Error(t, err)
+		assert.Equal(t, []byte{0x05, 0x00}, server)
+	})
+
+	t.Run("protocol error", func(t *testing.T) {
+		_, err := ReplayServer(&Transcript{Chunks: []TranscriptChunk{
+			{Data: []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x07}},
+		}})
+
+		var protocolErr *ProtocolError
+		assert.True(t, errors.As(err, &protocolErr))
+	})
+}
+
+func TestReplayDialer(t *testing.T) {
+	transcript := readTranscript(t, "socks5-connect.txt")
+
+	dialer := NewReplayDialer(transcript)
+	assert.Nil(t, dialer.Written())
+
+	conn, err := NewSocks5Dialer("tcp", "proxy:1080", func(o *Socks5DialerOptions) {
+		o.ProxyDialer = dialer
+	}).Dial("tcp", "192.0.2.1:80")
+	assert.NoError(t, err)
+
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, conn.Close())
+	assert.Equal(t, transcript.Client(), dialer.Written())
+
+	t.Run("deviating client", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		// The transcript knows a client offering two methods, so the
+		// reply waits for a byte the dialer never sends.
+		_, err := NewSocks5Dialer("tcp", "proxy:1080", func(o *Socks5DialerOptions) {
+			o.ProxyDialer = NewReplayDialer(&Transcript{Chunks: []TranscriptChunk{
+				{Data: []byte{0x05, 0x02, 0x00, 0x02}},
+				{FromServer: true, Data: []byte{0x05, 0x00}},
+			}})
+		}).DialContext(ctx, "tcp", "192.0.2.1:80")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,28 @@
+package socks
+
+import "context"
+
+// Request is a parsed SOCKS4 or SOCKS5 request.
+type Request struct {
+	Version Version
+	CMD     Command
+	Addr    string
+
+	// UserID is the user id of a SOCKS4 request.
+	UserID string
+}
+
+// RequestHandler handles a parsed SOCKS request and writes the
+// replies to conn.
+type RequestHandler interface {
+	ServeSOCKS(ctx context.Context, conn *Conn, req *Request) error
+}
+
+// The RequestHandlerFunc type is an adapter to allow the use of
+// ordinary functions as request handlers.
+type RequestHandlerFunc func(ctx context.Context, conn *Conn, req *Request) error
+
+// ServeSOCKS calls f(ctx, conn, req).
+func (f RequestHandlerFunc) ServeSOCKS(ctx context.Context, conn *Conn, req *Request) error {
+	return f(ctx, conn, req)
+}
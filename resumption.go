@@ -0,0 +1,432 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// AuthMethodResumption is the non-standard authentication method of
+// this package, from the private range of RFC 1928, which resumes an
+// earlier authentication with a token instead of calling the
+// authentication backend again.
+//
+// A client offers the method in addition to its regular methods. If the
+// server selects it, the client sends a ResumptionRequest with its
+// token, which is empty if it has none. The server replies with a
+// ResumptionResponse: either the session is resumed, or the server
+// selects one of the regular methods offered by the client, whose
+// subnegotiation follows. After a successful subnegotiation the client
+// sends a ResumptionTicketRequest and the server replies with a
+// ResumptionTicket carrying the token for later connections.
+const AuthMethodResumption AuthMethod = 0x88
+
+// ResumptionVersion1 is the version of the resumption messages.
+const ResumptionVersion1 = 0x01
+
+// maxResumptionTokenLen is the maximum length of a token.
+const maxResumptionTokenLen = 0xffff
+
+// ResumptionStatus is the status of a ResumptionResponse.
+type ResumptionStatus uint8
+
+const (
+	// ResumptionStatusResumed resumes the authentication of the token.
+	ResumptionStatusResumed ResumptionStatus = 0x00
+
+	// ResumptionStatusAuthenticate requires the subnegotiation of the
+	// method of the response.
+	ResumptionStatusAuthenticate ResumptionStatus = 0x01
+)
+
+// ResumptionRequest presents the token of a client.
+type ResumptionRequest struct {
+	Token []byte
+}
+
+func (req *ResumptionRequest) String() string {
+	return fmt.Sprintf("resumption request len=%d", len(req.Token))
+}
+
+func (req *ResumptionRequest) MarshalBinary() ([]byte, error) {
+	if len(req.Token) > maxResumptionTokenLen {
+		return nil, errors.New("socks: resumption token too long")
+	}
+
+	b := []byte{ResumptionVersion1, byte(len(req.Token) >> 8), byte(len(req.Token))}
+
+	return append(b, req.Token...), nil
+}
+
+func (req *ResumptionRequest) UnmarshalBinary(p []byte) error {
+	return req.decode(bytes.NewBuffer(p))
+}
+
+func (req *ResumptionRequest) decode(r messageReader) error {
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if version != ResumptionVersion1 {
+		return versionError("resumption request", ResumptionVersion1, version)
+	}
+
+	token, err := readResumptionToken(r)
+	if err != nil {
+		return err
+	}
+
+	req.Token = token
+
+	return nil
+}
+
+// ResumptionResponse is the reply of the server to a ResumptionRequest.
+type ResumptionResponse struct {
+	Status ResumptionStatus
+
+	// Method is the selected method of ResumptionStatusAuthenticate.
+	Method AuthMethod
+}
+
+func (resp *ResumptionResponse) String() string {
+	return fmt.Sprintf("resumption reply status=%d method=%q", resp.Status, resp.Method)
+}
+
+func (resp *ResumptionResponse) MarshalBinary() ([]byte, error) {
+	return []byte{ResumptionVersion1, byte(resp.Status), byte(resp.Method)}, nil
+}
+
+func (resp *ResumptionResponse) UnmarshalBinary(p []byte) error {
+	return resp.decode(bytes.NewBuffer(p))
+}
+
+func (resp *ResumptionResponse) decode(r messageReader) error {
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+
+	if b[0] != ResumptionVersion1 {
+		return versionError("resumption reply", ResumptionVersion1, b[0])
+	}
+
+	resp.Status = ResumptionStatus(b[1])
+	resp.Method = AuthMethod(b[2])
+
+	return nil
+}
+
+// ResumptionTicketRequest asks the server for a token after a successful
+// subnegotiation.
+type ResumptionTicketRequest struct{}
+
+func (req *ResumptionTicketRequest) MarshalBinary() ([]byte, error) {
+	return []byte{ResumptionVersion1}, nil
+}
+
+func (req *ResumptionTicketRequest) UnmarshalBinary(p []byte) error {
+	return req.decode(bytes.NewBuffer(p))
+}
+
+func (req *ResumptionTicketRequest) decode(r messageReader) error {
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if version != ResumptionVersion1 {
+		return versionError("resumption ticket request", ResumptionVersion1, version)
+	}
+
+	return nil
+}
+
+// ResumptionTicket carries the token of a client and its lifetime. The
+// token is empty if the server does not issue one.
+type ResumptionTicket struct {
+	TTL   time.Duration
+	Token []byte
+}
+
+func (t *ResumptionTicket) String() string {
+	return fmt.Sprintf("resumption ticket ttl=%s len=%d", t.TTL, len(t.Token))
+}
+
+func (t *ResumptionTicket) MarshalBinary() ([]byte, error) {
+	if len(t.Token) > maxResumptionTokenLen {
+		return nil, errors.New("socks: resumption token too long")
+	}
+
+	b := []byte{ResumptionVersion1, 0, 0, 0, 0, byte(len(t.Token) >> 8), byte(len(t.Token))}
+	binary.BigEndian.PutUint32(b[1:5], uint32(t.TTL/time.Second))
+
+	return append(b, t.Token...), nil
+}
+
+func (t *ResumptionTicket) UnmarshalBinary(p []byte) error {
+	return t.decode(bytes.NewBuffer(p))
+}
+
+func (t *ResumptionTicket) decode(r messageReader) error {
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if version != ResumptionVersion1 {
+		return versionError("resumption ticket", ResumptionVersion1, version)
+	}
+
+	ttl := make([]byte, 4)
+	if _, err := io.ReadFull(r, ttl); err != nil {
+		return err
+	}
+
+	token, err := readResumptionToken(r)
+	if err != nil {
+		return err
+	}
+
+	t.TTL = time.Duration(binary.BigEndian.Uint32(ttl)) * time.Second
+	t.Token = token
+
+	return nil
+}
+
+// readResumptionToken reads the length and the token.
+func readResumptionToken(r messageReader) ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+
+	token := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(r, token); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// ResumptionOptions specifies the issuing of tokens for
+// AuthMethodResumption by a server.
+type ResumptionOptions struct {
+	// TTL specifies the lifetime of the tokens. If zero, the server does
+	// not select AuthMethodResumption.
+	TTL time.Duration
+
+	// Key specifies the optional HMAC key of the tokens, e.g. shared by
+	// the servers behind a load balancer. If empty, a random key is
+	// used, which invalidates the tokens on restart.
+	Key []byte
+
+	// BindClientIP specifies whether a token is only valid for the
+	// client IP it was issued to.
+	BindClientIP bool
+}
+
+// resumption issues and verifies the tokens of a server. A token holds
+// the original method, the expiry, the bound client IP and the user,
+// followed by their HMAC-SHA256.
+type resumption struct {
+	ttl          time.Duration
+	key          []byte
+	bindClientIP bool
+	now          func() time.Time
+}
+
+const resumptionTokenVersion = 0x01
+
+// newResumption returns the resumption of the options or nil if it is
+// disabled.
+func newResumption(o *ResumptionOptions) *resumption {
+	if o.TTL <= 0 {
+		return nil
+	}
+
+	key := o.Key
+	if len(key) == 0 {
+		key = make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			panic(fmt.Sprintf("socks: resumption key: %v", err))
+		}
+	}
+
+	return &resumption{
+		ttl:          o.TTL,
+		key:          key,
+		bindClientIP: o.BindClientIP,
+		now:          time.Now,
+	}
+}
+
+// issue returns a token for the user authenticated with method.
+func (r *resumption) issue(method AuthMethod, user string, clientAddr net.Addr) []byte {
+	var ip net.IP
+	if r.bindClientIP {
+		ip = addrIP(clientAddr)
+	}
+
+	b := []byte{resumptionTokenVersion, byte(method), 0, 0, 0, 0, 0, 0, 0, 0, byte(len(ip))}
+	binary.BigEndian.PutUint64(b[2:10], uint64(r.now().Add(r.ttl).Unix()))
+	b = append(b, ip...)
+	b = append(b, user...)
+
+	mac := hmac.New(sha256.New, r.key)
+	_, _ = mac.Write(b)
+
+	return mac.Sum(b)
+}
+
+// verify returns the user of a valid token.
+func (r *resumption) verify(token []byte, clientAddr net.Addr) (string, bool) {
+	if len(token) < 11+sha256.Size || token[0] != resumptionTokenVersion {
+		return "", false
+	}
+
+	payload, sum := token[:len(token)-sha256.Size], token[len(token)-sha256.Size:]
+
+	mac := hmac.New(sha256.New, r.key)
+	_, _ = mac.Write(payload)
+
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return "", false
+	}
+
+	if r.now().Unix() > int64(binary.BigEndian.Uint64(payload[2:10])) {
+		return "", false
+	}
+
+	ipLen := int(payload[10])
+	if len(payload) < 11+ipLen {
+		return "", false
+	}
+
+	if ipLen > 0 {
+		ip := addrIP(clientAddr)
+		if ip == nil || !ip.Equal(net.IP(payload[11:11+ipLen])) {
+			return "", false
+		}
+	}
+
+	return string(payload[11+ipLen:]), true
+}
+
+// ResumptionCache holds the token of a client for AuthMethodResumption,
+// see ResumptionAuthenticator. The zero value is an empty cache. It is
+// safe for concurrent use.
+type ResumptionCache struct {
+	mu     sync.Mutex
+	token  []byte
+	expiry time.Time
+}
+
+// Valid reports whether the cache holds an unexpired token.
+func (c *ResumptionCache) Valid() bool {
+	_, ok := c.get()
+	return ok
+}
+
+// Clear removes the token.
+func (c *ResumptionCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token, c.expiry = nil, time.Time{}
+}
+
+func (c *ResumptionCache) get() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.token) == 0 || !time.Now().Before(c.expiry) {
+		return nil, false
+	}
+
+	return c.token, true
+}
+
+func (c *ResumptionCache) store(t *ResumptionTicket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token, c.expiry = t.Token, time.Now().Add(t.TTL)
+}
+
+// ResumptionAuthenticator returns the client side AuthenticateFunc of
+// AuthMethodResumption, which presents the token of the cache and falls
+// back to authenticate for the method selected by the server. The
+// client must offer AuthMethodResumption in addition to the methods of
+// authenticate; a Socks5Dialer with a ResumptionCache does so.
+func ResumptionAuthenticator(cache *ResumptionCache, authenticate AuthenticateFunc) AuthenticateFunc {
+	return func(ctx context.Context, conn *Conn, method AuthMethod) error {
+		if method != AuthMethodResumption {
+			if authenticate == nil {
+				return nil
+			}
+
+			return authenticate(ctx, conn, method)
+		}
+
+		token, _ := cache.get()
+
+		if err := conn.Write(&ResumptionRequest{Token: token}); err != nil {
+			return err
+		}
+
+		resp := &ResumptionResponse{}
+		if err := conn.Read(resp); err != nil {
+			return err
+		}
+
+		switch resp.Status {
+		case ResumptionStatusResumed:
+			return checkUnsolicited(conn, "resumption")
+		case ResumptionStatusAuthenticate:
+		default:
+			return newProtocolError("resumption", "status 0 or 1", fmt.Sprintf("status %d", resp.Status), nil)
+		}
+
+		cache.Clear()
+
+		if resp.Method == AuthMethodNoAcceptableMethods {
+			return newProtocolError("resumption", "acceptable method", fmt.Sprintf("%v", resp.Method), nil)
+		}
+
+		if err := checkUnsolicited(conn, "resumption"); err != nil {
+			return err
+		}
+
+		if authenticate != nil {
+			if err := authenticate(ctx, conn, resp.Method); err != nil {
+				return err
+			}
+		}
+
+		if err := conn.Write(&ResumptionTicketRequest{}); err != nil {
+			return err
+		}
+
+		ticket := &ResumptionTicket{}
+		if err := conn.Read(ticket); err != nil {
+			return err
+		}
+
+		if len(ticket.Token) > 0 {
+			cache.store(ticket)
+		}
+
+		return checkUnsolicited(conn, "resumption ticket")
+	}
+}
@@ -0,0 +1,192 @@
+package socks
+
+import (
+	"context"
+	"crypto/sha256"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumptionMessages(t *testing.T) {
+	for _, msg := range []wireMessage{
+		&ResumptionRequest{Token: []byte("token")},
+		&ResumptionRequest{},
+		&ResumptionResponse{Status: ResumptionStatusAuthenticate, Method: AuthMethodUsernamePassword},
+		&ResumptionTicket{TTL: 5 * time.Minute, Token: []byte("token")},
+	} {
+		b, err := msg.MarshalBinary()
+		assert.NoError(t, err)
+
+		got := newResumptionMessage(msg)
+		assert.NoError(t, got.UnmarshalBinary(b))
+
+		if req, ok := got.(*ResumptionRequest); ok && len(req.Token) == 0 {
+			req.Token = nil
+		}
+
+		assert.Equal(t, msg, got)
+	}
+}
+
+func newResumptionMessage(msg wireMessage) wireMessage {
+	switch msg.(type) {
+	case *ResumptionRequest:
+		return &ResumptionRequest{}
+	case *ResumptionResponse:
+		return &ResumptionResponse{}
+	default:
+		return &ResumptionTicket{}
+	}
+}
+
+func TestResumptionToken(t *testing.T) {
+	now := time.Now()
+
+	r := newResumption(&ResumptionOptions{TTL: time.Minute, BindClientIP: true})
+	r.now = func() time.Time { return now }
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	token := r.issue(AuthMethodUsernamePassword, "user", client)
+
+	user, ok := r.verify(token, client)
+	assert.True(t, ok)
+	assert.Equal(t, "user", user)
+
+	t.Run("other client", func(t *testing.T) {
+		_, ok := r.verify(token, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234})
+		assert.False(t, ok)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := append([]byte(nil), token...)
+		tampered[len(tampered)-sha256.Size-1] ^= 0xff
+
+		_, ok := r.verify(tampered, client)
+		assert.False(t, ok)
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		_, ok := newResumption(&ResumptionOptions{TTL: time.Minute}).verify(token, client)
+		assert.False(t, ok)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		r.now = func() time.Time { return now.Add(2 * time.Minute) }
+		defer func() { r.now = func() time.Time { return now } }()
+
+		_, ok := r.verify(token, client)
+		assert.False(t, ok)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		assert.Nil(t, newResumption(&ResumptionOptions{}))
+	})
+}
+
+func TestResumption(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	var backendCalls int32
+
+	authenticate := userPassServerAuthenticateFuncGen("user", "pass")
+
+	users := make(chan string, 8)
+
+	server := New(func(o *Options) {
+		o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		o.Authenticate = func(ctx context.Context, conn *Conn, method AuthMethod) error {
+			atomic.AddInt32(&backendCalls, 1)
+			return authenticate(ctx, conn, method)
+		}
+		o.Resumption = ResumptionOptions{TTL: time.Minute}
+		o.Hooks.OnAuth = func(ctx context.Context, e *AuthEvent) {
+			users <- e.User
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	cache := &ResumptionCache{}
+
+	dial := func(cache *ResumptionCache) error {
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = UsernamePasswordAuthenticator("user", "pass")
+			o.Resumption = cache
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+
+	t.Run("first connection", func(t *testing.T) {
+		assert.NoError(t, dial(cache))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&backendCalls))
+		assert.Equal(t, "user", <-users)
+		assert.True(t, cache.Valid())
+	})
+
+	t.Run("resumed", func(t *testing.T) {
+		assert.NoError(t, dial(cache))
+		assert.NoError(t, dial(cache))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&backendCalls))
+		assert.Equal(t, "user", <-users)
+		assert.Equal(t, "user", <-users)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		invalid := &ResumptionCache{}
+		invalid.store(&ResumptionTicket{TTL: time.Minute, Token: []byte("invalid")})
+
+		assert.NoError(t, dial(invalid))
+		assert.Equal(t, int32(2), atomic.LoadInt32(&backendCalls))
+		assert.Equal(t, "user", <-users)
+		assert.True(t, invalid.Valid())
+	})
+
+	t.Run("without resumption", func(t *testing.T) {
+		assert.NoError(t, dial(nil))
+		assert.Equal(t, int32(3), atomic.LoadInt32(&backendCalls))
+		assert.Equal(t, "user", <-users)
+	})
+
+	t.Run("server without resumption", func(t *testing.T) {
+		listen, err := net.Listen("tcp", "localhost:0")
+		assert.NoError(t, err)
+
+		defer listen.Close()
+
+		server := New(func(o *Options) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = authenticate
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		cache := &ResumptionCache{}
+
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = UsernamePasswordAuthenticator("user", "pass")
+			o.Resumption = cache
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		assert.False(t, cache.Valid())
+	})
+}
@@ -0,0 +1,79 @@
+package socks
+
+import (
+	"context"
+	"time"
+)
+
+// RevocationOptions specifies the revalidation of the live sessions of
+// a server against its current policy, see Server.Revalidate.
+type RevocationOptions struct {
+	// GracePeriod specifies how long a session which is no longer
+	// permitted may continue before it is closed. If zero, it is closed
+	// immediately.
+	GracePeriod time.Duration
+
+	// Credentials specifies the optional check whether the user of an
+	// authenticated session is still valid, e.g. after its credentials
+	// were revoked.
+	Credentials func(ctx context.Context, user string) bool
+}
+
+// Revalidate evaluates the requests of the live sessions against the
+// rule set of the server and their users against
+// RevocationOptions.Credentials, e.g. after a reload of a dynamic rule
+// set. The sessions no longer permitted are closed with
+// CloseReasonPolicyRevoked after the grace period. The rule set is
+// called with a context carrying the session. Revalidate returns the
+// number of revoked sessions.
+func (s *Server) Revalidate(ctx context.Context) int {
+	s.mu.Lock()
+
+	var revoked []*Session
+
+	for session := range s.sessions {
+		if !s.permitted(ctx, session) {
+			revoked = append(revoked, session)
+		}
+	}
+
+	s.mu.Unlock()
+
+	for _, session := range revoked {
+		s.logInfof("Revoking session %s of %q to %s", session.ID, session.User(), session.DestAddr())
+
+		session := session
+
+		if s.revocation.GracePeriod <= 0 {
+			s.CloseSession(session.ID, CloseReasonPolicyRevoked)
+			continue
+		}
+
+		time.AfterFunc(s.revocation.GracePeriod, func() {
+			s.CloseSession(session.ID, CloseReasonPolicyRevoked)
+		})
+	}
+
+	return len(revoked)
+}
+
+// permitted reports whether the session is still permitted. Sessions
+// which have not sent their request yet are checked by the handshake.
+func (s *Server) permitted(ctx context.Context, session *Session) bool {
+	req := session.servedRequest()
+	if req == nil {
+		return true
+	}
+
+	if s.revocation.Credentials != nil {
+		if user := session.User(); user != "" && !s.revocation.Credentials(ctx, user) {
+			return false
+		}
+	}
+
+	if s.rules != nil && !s.rules.Allow(WithSession(ctx, session), req) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,141 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevalidate(t *testing.T) {
+	var denied int32
+
+	var revokedUser atomic.Value
+	revokedUser.Store("")
+
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		o.Authenticate = func(ctx context.Context, conn *Conn, method AuthMethod) error {
+			req := &UsernamePasswordAuthRequest{}
+			if err := conn.Read(req); err != nil {
+				return err
+			}
+
+			if session, ok := SessionFromContext(ctx); ok {
+				session.SetUser(req.Username)
+			}
+
+			return conn.Write(&UsernamePasswordAuthResponse{Status: AuthStatusSuccess})
+		}
+		o.Rules = RuleSetFunc(func(ctx context.Context, req *Request) bool {
+			return atomic.LoadInt32(&denied) == 0
+		})
+		o.Revocation.Credentials = func(ctx context.Context, user string) bool {
+			return user != revokedUser.Load().(string)
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	sub := server.Subscribe(64)
+	defer sub.Unsubscribe()
+
+	dial := func(t *testing.T, user string) net.Conn {
+		t.Helper()
+
+		d := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = UsernamePasswordAuthenticator(user, "secret")
+		})
+
+		conn, err := d.Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			server.mu.Lock()
+			defer server.mu.Unlock()
+
+			for session := range server.sessions {
+				if session.User() == user && session.TargetAddr() != "" {
+					return true
+				}
+			}
+
+			return false
+		}, 5*time.Second, 10*time.Millisecond)
+
+		return conn
+	}
+
+	closed := func(t *testing.T, user string) Event {
+		t.Helper()
+
+		for {
+			select {
+			case e := <-sub.C:
+				if e.Type == EventSessionClosed && e.User == user {
+					return e
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no close event")
+				return Event{}
+			}
+		}
+	}
+
+	t.Run("permitted", func(t *testing.T) {
+		conn := dial(t, "alice")
+		defer conn.Close()
+
+		assert.Equal(t, 0, server.Revalidate(context.Background()))
+	})
+
+	t.Run("rules", func(t *testing.T) {
+		conn := dial(t, "bob")
+		defer conn.Close()
+
+		atomic.StoreInt32(&denied, 1)
+		defer atomic.StoreInt32(&denied, 0)
+
+		assert.Equal(t, 1, server.Revalidate(context.Background()))
+		assert.Equal(t, CloseReasonPolicyRevoked, closed(t, "bob").CloseReason)
+	})
+
+	t.Run("credentials", func(t *testing.T) {
+		conn := dial(t, "carol")
+		defer conn.Close()
+
+		other := dial(t, "dave")
+		defer other.Close()
+
+		revokedUser.Store("carol")
+
+		assert.Equal(t, 1, server.Revalidate(context.Background()))
+
+		assert.Equal(t, CloseReasonPolicyRevoked, closed(t, "carol").CloseReason)
+	})
+
+	t.Run("grace period", func(t *testing.T) {
+		server.revocation.GracePeriod = 200 * time.Millisecond
+		defer func() { server.revocation.GracePeriod = 0 }()
+
+		conn := dial(t, "carol")
+		defer conn.Close()
+
+		start := time.Now()
+
+		assert.Equal(t, 1, server.Revalidate(context.Background()))
+		assert.Equal(t, CloseReasonPolicyRevoked, closed(t, "carol").CloseReason)
+		assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	})
+}
@@ -0,0 +1,335 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hupe1980/golog"
+)
+
+// Pool is a named group of upstream dialers.
+type Pool struct {
+	// Dialers specifies the upstream dialers, e.g. a Socks5Dialer for
+	// an upstream proxy or a net.Dialer for direct connections. The
+	// dialers are used in turn and a failed dial is retried with the
+	// next healthy dialer.
+	Dialers []Dialer
+
+	// Upstreams specifies upstream proxies with their own settings. They
+	// are used in turn after Dialers.
+	Upstreams []Upstream
+
+	// HealthCheck specifies the optional health checks of the dialers.
+	// Unhealthy dialers are skipped.
+	HealthCheck HealthCheckOptions
+}
+
+// Route maps destinations to a pool.
+type Route struct {
+	// Destination specifies the destination pattern in the syntax of
+	// the rule format "to" condition, e.g. "*.onion", "10.0.0.0/8" or
+	// "*.internal.example:443".
+	Destination string
+
+	// Pool specifies the name of the pool.
+	Pool string
+}
+
+type RouterOptions struct {
+	// Logger specifies an optional logger.
+	// If nil, logging is done via the log package's standard logger.
+	Logger golog.Logger
+
+	// Pools specifies the upstream pools by name.
+	Pools map[string]Pool
+
+	// Routes specifies the routes in order. The first matching route
+	// selects the pool.
+	Routes []Route
+
+	// DefaultPool specifies the name of the pool for destinations
+	// not matched by any route. If empty, these dials fail.
+	DefaultPool string
+
+	// Hooks specifies optional callbacks. OnUpstreamHealth is called
+	// when the health of an upstream dialer changes.
+	Hooks Hooks
+}
+
+// Router is a Dialer which selects the upstream pool by destination.
+type Router struct {
+	*logger
+	pools       map[string]*pool
+	routes      []route
+	defaultPool string
+	hooks       *Hooks
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+type route struct {
+	pattern hostPattern
+	pool    string
+}
+
+// NewRouter returns a new Router. It returns an error if a route
+// references an unknown pool or has an invalid destination.
+func NewRouter(optFns ...func(*RouterOptions)) (*Router, error) {
+	options := RouterOptions{
+		Logger: golog.NewGoLogger(golog.INFO, log.Default()),
+	}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	r := &Router{
+		logger:      &logger{options.Logger},
+		pools:       make(map[string]*pool, len(options.Pools)),
+		defaultPool: options.DefaultPool,
+		hooks:       &options.Hooks,
+		done:        make(chan struct{}),
+	}
+
+	for name, p := range options.Pools {
+		if len(p.Dialers)+len(p.Upstreams) == 0 {
+			return nil, fmt.Errorf("socks: pool %q has no dialers", name)
+		}
+
+		pool, err := newPool(name, p)
+		if err != nil {
+			return nil, err
+		}
+
+		r.pools[name] = pool
+	}
+
+	for _, rt := range options.Routes {
+		if _, ok := r.pools[rt.Pool]; !ok {
+			return nil, fmt.Errorf("socks: route to %s references unknown pool %q", rt.Destination, rt.Pool)
+		}
+
+		pattern, msg := parseHostPattern(rt.Destination)
+		if msg != "" {
+			return nil, fmt.Errorf("socks: route to %s: %s", rt.Destination, msg)
+		}
+
+		r.routes = append(r.routes, route{pattern: pattern, pool: rt.Pool})
+	}
+
+	if r.defaultPool != "" {
+		if _, ok := r.pools[r.defaultPool]; !ok {
+			return nil, fmt.Errorf("socks: unknown default pool %q", r.defaultPool)
+		}
+	}
+
+	for _, p := range r.pools {
+		if p.healthCheck.Interval > 0 {
+			for i := range p.members {
+				go r.checkHealth(p, i)
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// Dial connects to the address on the named network through the pool
+// selected by the address.
+func (r *Router) Dial(network, address string) (net.Conn, error) {
+	return r.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network through the
+// pool selected by the address using the provided context.
+func (r *Router) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	p, err := r.route(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.dialContext(ctx, network, address)
+}
+
+// Upstreams returns the health of the upstream dialers of all pools.
+func (r *Router) Upstreams() []UpstreamStatus {
+	var upstreams []UpstreamStatus
+
+	for _, p := range r.pools {
+		for i, m := range p.members {
+			upstreams = append(upstreams, m.health.status(p.name, i))
+		}
+	}
+
+	sort.Slice(upstreams, func(i, j int) bool {
+		if upstreams[i].Pool != upstreams[j].Pool {
+			return upstreams[i].Pool < upstreams[j].Pool
+		}
+
+		return upstreams[i].Index < upstreams[j].Index
+	})
+
+	return upstreams
+}
+
+// Close stops the health checks.
+func (r *Router) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+
+	return nil
+}
+
+func (r *Router) route(address string) (*pool, error) {
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rt := range r.routes {
+		if rt.pattern.match(host, int(port)) {
+			return r.pools[rt.pool], nil
+		}
+	}
+
+	if r.defaultPool == "" {
+		return nil, fmt.Errorf("socks: no route to %s", address)
+	}
+
+	return r.pools[r.defaultPool], nil
+}
+
+func (r *Router) checkHealth(p *pool, index int) {
+	m := p.members[index]
+
+	timer := time.NewTimer(nextHealthCheck(&p.healthCheck))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-timer.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), p.healthCheck.Timeout)
+		err := p.healthCheck.Checker.CheckHealth(ctx, m.dialer)
+		cancel()
+
+		if m.health.record(&p.healthCheck, err) {
+			status := m.health.status(p.name, index)
+
+			if status.Healthy {
+				r.logInfof("Upstream %d in pool %s is healthy again", index, p.name)
+			} else {
+				r.logErrorf("Upstream %d in pool %s is unhealthy: %v", index, p.name, err)
+			}
+
+			r.hooks.upstreamHealth(context.Background(), &status)
+		}
+
+		timer.Reset(nextHealthCheck(&p.healthCheck))
+	}
+}
+
+type pool struct {
+	name        string
+	members     []*poolMember
+	healthCheck HealthCheckOptions
+	next        uint32 // accessed atomically
+}
+
+func newPool(name string, p Pool) (*pool, error) {
+	members := make([]*poolMember, 0, len(p.Dialers)+len(p.Upstreams))
+	for _, d := range p.Dialers {
+		members = append(members, &poolMember{dialer: d, health: newHealthState()})
+	}
+
+	for i := range p.Upstreams {
+		u := &p.Upstreams[i]
+
+		d, err := u.newDialer()
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, &poolMember{dialer: d, timeout: u.HandshakeTimeout, health: newHealthState()})
+	}
+
+	hc := p.HealthCheck
+	if hc.Checker == nil {
+		hc.Checker = MethodSelectHealthChecker()
+	}
+
+	if hc.Timeout <= 0 {
+		hc.Timeout = hc.Interval
+	}
+
+	if hc.FailureThreshold < 1 {
+		hc.FailureThreshold = 1
+	}
+
+	if hc.SuccessThreshold < 1 {
+		hc.SuccessThreshold = 1
+	}
+
+	return &pool{
+		name:        name,
+		members:     members,
+		healthCheck: hc,
+	}, nil
+}
+
+func (p *pool) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := int(atomic.AddUint32(&p.next, 1) - 1)
+
+	var lastErr error
+
+	for i := range p.members {
+		m := p.members[(start+i)%len(p.members)]
+		if !m.health.isHealthy() {
+			continue
+		}
+
+		conn, err := m.dialContext(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if lastErr == nil {
+		return nil, fmt.Errorf("socks: no healthy upstream in pool %q", p.name)
+	}
+
+	return nil, lastErr
+}
+
+type poolMember struct {
+	dialer  Dialer
+	timeout time.Duration // limits the connection and handshake
+	health  *healthState
+}
+
+func (m *poolMember) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	return m.dialer.DialContext(ctx, network, address)
+}
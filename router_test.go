@@ -0,0 +1,168 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingDialer struct {
+	err error
+
+	mu    sync.Mutex
+	dials []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials = append(d.dials, address)
+	d.mu.Unlock()
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return (&net.Dialer{}).DialContext(ctx, network, testServer.Listener.Addr().String())
+}
+
+func (d *recordingDialer) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.dials)
+}
+
+func TestRouter(t *testing.T) {
+	t.Run("routes", func(t *testing.T) {
+		direct := &recordingDialer{}
+		tor := &recordingDialer{}
+
+		router, err := NewRouter(func(o *RouterOptions) {
+			o.Pools = map[string]Pool{
+				"direct": {Dialers: []Dialer{direct}},
+				"tor":    {Dialers: []Dialer{tor}},
+			}
+			o.Routes = []Route{
+				{Destination: "*.onion", Pool: "tor"},
+			}
+			o.DefaultPool = "direct"
+		})
+		assert.NoError(t, err)
+
+		defer router.Close()
+
+		conn, err := router.Dial("tcp", "example.onion:80")
+		assert.NoError(t, err)
+		conn.Close()
+
+		conn, err = router.Dial("tcp", "example.com:80")
+		assert.NoError(t, err)
+		conn.Close()
+
+		assert.Equal(t, []string{"example.onion:80"}, tor.dials)
+		assert.Equal(t, []string{"example.com:80"}, direct.dials)
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		broken := &recordingDialer{err: errors.New("broken")}
+		working := &recordingDialer{}
+
+		router, err := NewRouter(func(o *RouterOptions) {
+			o.Pools = map[string]Pool{
+				"egress": {Dialers: []Dialer{broken, working}},
+			}
+			o.DefaultPool = "egress"
+		})
+		assert.NoError(t, err)
+
+		defer router.Close()
+
+		for i := 0; i < 2; i++ {
+			conn, err := router.Dial("tcp", "example.com:80")
+			assert.NoError(t, err)
+			conn.Close()
+		}
+
+		assert.Equal(t, 2, working.count())
+	})
+
+	t.Run("health check", func(t *testing.T) {
+		broken := &recordingDialer{err: errors.New("broken")}
+
+		changes := make(chan UpstreamStatus, 1)
+
+		router, err := NewRouter(func(o *RouterOptions) {
+			o.Pools = map[string]Pool{
+				"egress": {
+					Dialers: []Dialer{broken},
+					HealthCheck: HealthCheckOptions{
+						Checker:          DialHealthChecker("example.com:80"),
+						Interval:         10 * time.Millisecond,
+						Jitter:           5 * time.Millisecond,
+						FailureThreshold: 3,
+					},
+				},
+			}
+			o.DefaultPool = "egress"
+			o.Hooks.OnUpstreamHealth = func(ctx context.Context, s *UpstreamStatus) {
+				changes <- *s
+			}
+		})
+		assert.NoError(t, err)
+
+		defer router.Close()
+
+		status := <-changes
+		assert.Equal(t, "egress", status.Pool)
+		assert.False(t, status.Healthy)
+		assert.Equal(t, 3, status.ConsecutiveFailures)
+		assert.EqualError(t, status.LastErr, "broken")
+
+		_, err = router.Dial("tcp", "example.com:80")
+		assert.EqualError(t, err, `socks: no healthy upstream in pool "egress"`)
+
+		upstreams := router.Upstreams()
+		assert.Len(t, upstreams, 1)
+		assert.False(t, upstreams[0].Healthy)
+	})
+
+	t.Run("no route", func(t *testing.T) {
+		router, err := NewRouter()
+		assert.NoError(t, err)
+
+		_, err = router.Dial("tcp", "example.com:80")
+		assert.EqualError(t, err, "socks: no route to example.com:80")
+	})
+
+	t.Run("unknown pool", func(t *testing.T) {
+		_, err := NewRouter(func(o *RouterOptions) {
+			o.Routes = []Route{{Destination: "*", Pool: "tor"}}
+		})
+		assert.EqualError(t, err, `socks: route to * references unknown pool "tor"`)
+	})
+}
+
+func TestMethodSelectHealthChecker(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server := New()
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	checker := MethodSelectHealthChecker()
+
+	assert.NoError(t, checker.CheckHealth(context.Background(), NewSocks5Dialer("tcp", listen.Addr().String())))
+	assert.NoError(t, checker.CheckHealth(context.Background(), NewSocks4Dialer("tcp", listen.Addr().String())))
+
+	_ = server.Close()
+
+	assert.Error(t, checker.CheckHealth(context.Background(), NewSocks5Dialer("tcp", listen.Addr().String())))
+}
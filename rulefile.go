@@ -0,0 +1,538 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RuleList is a RuleSet parsed from the text rule format.
+//
+// Each non-empty line not starting with '#' holds one rule:
+//
+//	allow|deny [connect|bind|associate ...] [condition ...]
+//
+// The conditions are
+//
+//	user <name|*>           the SOCKS4 user id or the session user
+//	from <ip|cidr>          the client address
+//	to <host>[:<port>]      the destination, host is *, *.domain, a
+//	                        name, an IP address or a CIDR and port is
+//	                        *, a number or a range like 8000-8080
+//	cidr <cidr>             the destination IP address
+//	port <port>             the destination port
+//	days <days>             the days of the week, e.g. mon-fri or sat,sun
+//	time <hh:mm-hh:mm>      the time of day, e.g. 08:00-18:00 or, wrapping
+//	                        midnight, 22:00-06:00
+//	tz <zone>               the IANA time zone of days and time, e.g.
+//	                        Europe/Berlin, instead of the local one
+//
+// The command associate also covers UDPOverTCPCommand.
+//
+// A deny rule may end with "status <name>" to reply with another SOCKS5
+// status than not-allowed, e.g. host-unreachable or connection-refused.
+//
+// All conditions of a rule must match. The first matching rule decides;
+// if no rule matches, the action of an optional "default allow|deny"
+// line applies, which is deny when omitted. Names are not resolved, so
+// IP and CIDR patterns only match IP destinations.
+type RuleList struct {
+	rules        []*rule
+	defaultAllow bool
+	now          func() time.Time
+}
+
+// RuleSyntaxError is returned when a rule cannot be parsed.
+type RuleSyntaxError struct {
+	Line int
+	Text string
+	Msg  string
+}
+
+func (e *RuleSyntaxError) Error() string {
+	return fmt.Sprintf("socks: rule syntax error on line %d: %s: %q", e.Line, e.Msg, e.Text)
+}
+
+// ParseRules parses a RuleList from r.
+func ParseRules(r io.Reader) (*RuleList, error) {
+	l := &RuleList{}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+
+		if fields[0] == "default" {
+			if len(fields) != 2 || (fields[1] != "allow" && fields[1] != "deny") {
+				return nil, &RuleSyntaxError{Line: n, Text: text, Msg: "expected default allow or default deny"}
+			}
+
+			l.defaultAllow = fields[1] == "allow"
+
+			continue
+		}
+
+		rule, msg := parseRule(fields)
+		if msg != "" {
+			return nil, &RuleSyntaxError{Line: n, Text: text, Msg: msg}
+		}
+
+		l.rules = append(l.rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// LoadRules parses a RuleList from the named file.
+func LoadRules(filename string) (*RuleList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ParseRules(f)
+}
+
+// Allow reports whether the request is permitted.
+func (l *RuleList) Allow(ctx context.Context, req *Request) bool {
+	return l.allow(ctx, req, req.CMD, req.Addr)
+}
+
+// AllowDatagram reports whether a datagram of the ASSOCIATE request
+// may be relayed to addr.
+func (l *RuleList) AllowDatagram(ctx context.Context, req *Request, addr string) bool {
+	return l.allow(ctx, req, AssociateCommand, addr)
+}
+
+// Denial returns the status of the deny rule matching the request, if
+// the rule specifies one.
+func (l *RuleList) Denial(ctx context.Context, req *Request) *DenialError {
+	r, _ := l.match(ctx, req, req.CMD, req.Addr)
+	if r == nil || r.status == Socks5StatusGranted {
+		return nil
+	}
+
+	return &DenialError{Socks5Status: r.status}
+}
+
+func (l *RuleList) allow(ctx context.Context, req *Request, cmd Command, addr string) bool {
+	r, ok := l.match(ctx, req, cmd, addr)
+	if !ok {
+		return false
+	}
+
+	if r == nil {
+		return l.defaultAllow
+	}
+
+	return r.allow
+}
+
+// match returns the first rule matching the request, or nil if no rule
+// matches. It returns false if addr is invalid.
+func (l *RuleList) match(ctx context.Context, req *Request, cmd Command, addr string) (*rule, bool) {
+	user := req.UserID
+
+	var clientIP net.IP
+
+	if session, ok := SessionFromContext(ctx); ok {
+		if u := session.User(); u != "" {
+			user = u
+		}
+
+		clientIP = addrIP(session.ClientAddr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, false
+	}
+
+	now := time.Now
+	if l.now != nil {
+		now = l.now
+	}
+
+	for _, r := range l.rules {
+		if r.schedule != nil && !r.schedule.Contains(now()) {
+			continue
+		}
+
+		if r.match(cmd, user, clientIP, host, portNum) {
+			return r, true
+		}
+	}
+
+	return nil, true
+}
+
+type rule struct {
+	allow  bool
+	status Socks5Status // of a deny rule, if not the default
+	cmds   []Command
+	users  []string
+	from   []*net.IPNet
+	to     []hostPattern
+	ports  []portRange
+
+	schedule *Schedule
+}
+
+func parseRule(fields []string) (*rule, string) {
+	r := &rule{}
+
+	switch fields[0] {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return nil, "expected allow or deny"
+	}
+
+	for i := 1; i < len(fields); i++ {
+		switch fields[i] {
+		case "connect":
+			r.cmds = append(r.cmds, ConnectCommand)
+			continue
+		case "bind":
+			r.cmds = append(r.cmds, BindCommand)
+			continue
+		case "associate":
+			r.cmds = append(r.cmds, AssociateCommand, UDPOverTCPCommand)
+			continue
+		}
+
+		keyword := fields[i]
+
+		if i+1 == len(fields) {
+			return nil, "missing value for " + keyword
+		}
+
+		i++
+		value := fields[i]
+
+		switch keyword {
+		case "user":
+			r.users = append(r.users, value)
+		case "from":
+			n, ok := parseCIDR(value)
+			if !ok {
+				return nil, "invalid client address " + value
+			}
+
+			r.from = append(r.from, n)
+		case "to":
+			p, msg := parseHostPattern(value)
+			if msg != "" {
+				return nil, msg
+			}
+
+			r.to = append(r.to, p)
+		case "cidr":
+			n, ok := parseCIDR(value)
+			if !ok {
+				return nil, "invalid CIDR " + value
+			}
+
+			r.to = append(r.to, hostPattern{ipNet: n})
+		case "port":
+			pr, ok := parsePortRange(value)
+			if !ok {
+				return nil, "invalid port " + value
+			}
+
+			r.ports = append(r.ports, pr)
+		case "days":
+			days, err := parseDays(value)
+			if err != nil {
+				return nil, "invalid days " + value
+			}
+
+			r.schedulePart().Days = days
+		case "time":
+			start, end, err := parseTimeWindow(value)
+			if err != nil {
+				return nil, "invalid time " + value
+			}
+
+			r.schedulePart().Start, r.schedule.End = start, end
+		case "tz":
+			loc, err := time.LoadLocation(value)
+			if err != nil {
+				return nil, "invalid time zone " + value
+			}
+
+			r.schedulePart().Location = loc
+		case "status":
+			if r.allow {
+				return nil, "status of an allow rule"
+			}
+
+			if err := r.status.UnmarshalText([]byte(value)); err != nil || r.status == Socks5StatusGranted {
+				return nil, "invalid status " + value
+			}
+		default:
+			return nil, "unknown condition " + keyword
+		}
+	}
+
+	return r, ""
+}
+
+// schedulePart returns the schedule of the rule, creating it for the
+// first of the days, time and tz conditions.
+func (r *rule) schedulePart() *Schedule {
+	if r.schedule == nil {
+		r.schedule = &Schedule{}
+	}
+
+	return r.schedule
+}
+
+func (r *rule) match(cmd Command, user string, clientIP net.IP, host string, port int) bool {
+	if len(r.cmds) > 0 && !matchCommand(r.cmds, cmd) {
+		return false
+	}
+
+	if len(r.users) > 0 && !matchUser(r.users, user) {
+		return false
+	}
+
+	if len(r.from) > 0 && !matchIPNets(r.from, clientIP) {
+		return false
+	}
+
+	if len(r.to) > 0 {
+		matched := false
+
+		for _, p := range r.to {
+			if p.match(host, port) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.ports) > 0 {
+		matched := false
+
+		for _, pr := range r.ports {
+			if pr.contains(port) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchCommand(cmds []Command, cmd Command) bool {
+	for _, c := range cmds {
+		if c == cmd {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchUser(users []string, user string) bool {
+	for _, u := range users {
+		if u == "*" && user != "" || u == user {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchIPNets(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostPattern matches a destination host and an optional port range.
+type hostPattern struct {
+	any    bool
+	suffix string
+	name   string
+	ipNet  *net.IPNet
+	ports  *portRange
+}
+
+func parseHostPattern(s string) (hostPattern, string) {
+	host, port := s, ""
+
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return hostPattern{}, "invalid destination " + s
+		}
+
+		host = s[1:end]
+
+		rest := s[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return hostPattern{}, "invalid destination " + s
+			}
+
+			port = rest[1:]
+		}
+	} else if strings.Count(s, ":") == 1 {
+		i := strings.LastIndex(s, ":")
+		host, port = s[:i], s[i+1:]
+	}
+
+	p := hostPattern{}
+
+	switch {
+	case host == "*":
+		p.any = true
+	case strings.HasPrefix(host, "*."):
+		if len(host) == 2 {
+			return hostPattern{}, "invalid destination " + s
+		}
+
+		p.suffix = strings.ToLower(host[1:])
+	case host == "":
+		return hostPattern{}, "invalid destination " + s
+	default:
+		if n, ok := parseCIDR(host); ok {
+			p.ipNet = n
+		} else if strings.ContainsAny(host, "*/:") {
+			return hostPattern{}, "invalid destination " + s
+		} else {
+			p.name = strings.ToLower(host)
+		}
+	}
+
+	if port != "" {
+		pr, ok := parsePortRange(port)
+		if !ok {
+			return hostPattern{}, "invalid port " + port
+		}
+
+		p.ports = &pr
+	}
+
+	return p, ""
+}
+
+func (p hostPattern) match(host string, port int) bool {
+	if p.ports != nil && !p.ports.contains(port) {
+		return false
+	}
+
+	switch {
+	case p.any:
+		return true
+	case p.ipNet != nil:
+		ip := net.ParseIP(host)
+		return ip != nil && p.ipNet.Contains(ip)
+	case p.suffix != "":
+		return strings.HasSuffix(strings.ToLower(host), p.suffix)
+	default:
+		return strings.EqualFold(host, p.name)
+	}
+}
+
+type portRange struct {
+	min, max int
+}
+
+func parsePortRange(s string) (portRange, bool) {
+	if s == "*" {
+		return portRange{0, 0xffff}, true
+	}
+
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+
+	min, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return portRange{}, false
+	}
+
+	max, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil || max < min {
+		return portRange{}, false
+	}
+
+	return portRange{int(min), int(max)}, true
+}
+
+func (pr portRange) contains(port int) bool {
+	return port >= pr.min && port <= pr.max
+}
+
+// parseCIDR parses a CIDR or a single IP address.
+func parseCIDR(s string) (*net.IPNet, bool) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, true
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, false
+	}
+
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+
+	return nil
+}
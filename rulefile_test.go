@@ -0,0 +1,86 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRules = `
+# internal services
+allow user alice to *.internal.example:443
+deny cidr 10.0.0.0/8
+deny to *.hidden.example status host-unreachable
+allow connect from 127.0.0.1 to *:80
+allow associate port 53
+default deny
+`
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(testRules))
+	assert.NoError(t, err)
+
+	session := newSession(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000})
+	ctx := WithSession(context.Background(), session)
+
+	t.Run("user", func(t *testing.T) {
+		req := &Request{Version: Socks4Version, CMD: ConnectCommand, Addr: "db.internal.example:443", UserID: "alice"}
+		assert.True(t, rules.Allow(ctx, req))
+
+		req.UserID = "bob"
+		assert.False(t, rules.Allow(ctx, req))
+
+		req.Addr = "db.internal.example:8443"
+		req.UserID = "alice"
+		assert.False(t, rules.Allow(ctx, req))
+	})
+
+	t.Run("cidr", func(t *testing.T) {
+		assert.False(t, rules.Allow(ctx, &Request{Version: Socks5Version, CMD: ConnectCommand, Addr: "10.1.2.3:80"}))
+		assert.True(t, rules.Allow(ctx, &Request{Version: Socks5Version, CMD: ConnectCommand, Addr: "192.168.1.1:80"}))
+	})
+
+	t.Run("status", func(t *testing.T) {
+		req := &Request{Version: Socks5Version, CMD: ConnectCommand, Addr: "db.hidden.example:80"}
+		assert.False(t, rules.Allow(ctx, req))
+		assert.Equal(t, &DenialError{Socks5Status: Socks5StatusHostUnreachable}, rules.Denial(ctx, req))
+
+		assert.Nil(t, rules.Denial(ctx, &Request{Version: Socks5Version, CMD: ConnectCommand, Addr: "10.1.2.3:80"}))
+	})
+
+	t.Run("from", func(t *testing.T) {
+		other := WithSession(context.Background(), newSession(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}))
+		assert.False(t, rules.Allow(other, &Request{Version: Socks5Version, CMD: ConnectCommand, Addr: "example.com:80"}))
+	})
+
+	t.Run("datagram", func(t *testing.T) {
+		req := &Request{Version: Socks5Version, CMD: AssociateCommand, Addr: "0.0.0.0:0"}
+		assert.True(t, rules.AllowDatagram(ctx, req, "192.0.2.53:53"))
+		assert.False(t, rules.AllowDatagram(ctx, req, "192.0.2.53:54"))
+	})
+
+	t.Run("syntax error", func(t *testing.T) {
+		for _, text := range []string{
+			"permit all",
+			"allow to",
+			"allow cidr 10.0.0.0/33",
+			"allow to example.com:70000",
+			"allow port 90-80",
+			"allow group admins",
+			"default maybe",
+			"allow to example.com status host-unreachable",
+			"deny to example.com status granted",
+			"deny to example.com status unknown",
+		} {
+			_, err := ParseRules(strings.NewReader("# comment\n" + text))
+
+			var se *RuleSyntaxError
+			assert.True(t, errors.As(err, &se), text)
+			assert.Equal(t, 2, se.Line, text)
+		}
+	})
+}
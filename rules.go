@@ -0,0 +1,151 @@
+package socks
+
+import "context"
+
+// RuleSet decides whether a request is permitted.
+type RuleSet interface {
+	Allow(ctx context.Context, req *Request) bool
+}
+
+// DatagramRuleSet is implemented by rule sets which also restrict the
+// destinations of datagrams relayed by an ASSOCIATE request. req is the
+// ASSOCIATE request and addr the destination of the datagram.
+type DatagramRuleSet interface {
+	RuleSet
+	AllowDatagram(ctx context.Context, req *Request, addr string) bool
+}
+
+// DenialRuleSet is implemented by rule sets which choose the reply to
+// the requests they deny. Denial is called for a request denied by
+// Allow; if it returns nil, the request is denied with the default
+// status.
+type DenialRuleSet interface {
+	RuleSet
+	Denial(ctx context.Context, req *Request) *DenialError
+}
+
+// The RuleSetFunc type is an adapter to allow the use of ordinary
+// functions as rule sets.
+type RuleSetFunc func(ctx context.Context, req *Request) bool
+
+// Allow calls f(ctx, req).
+func (f RuleSetFunc) Allow(ctx context.Context, req *Request) bool {
+	return f(ctx, req)
+}
+
+// PermitAll returns a RuleSet which allows all requests.
+func PermitAll() RuleSet {
+	return RuleSetFunc(func(ctx context.Context, req *Request) bool {
+		return true
+	})
+}
+
+// PermitCommand returns a RuleSet which allows the given commands.
+func PermitCommand(cmds ...Command) RuleSet {
+	return RuleSetFunc(func(ctx context.Context, req *Request) bool {
+		for _, cmd := range cmds {
+			if req.CMD == cmd {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// DenyPorts returns a RuleSet which denies the requests to the given
+// destination ports, e.g. the ports of plaintext protocols.
+func DenyPorts(ports ...int) RuleSet {
+	return RuleSetFunc(func(ctx context.Context, req *Request) bool {
+		_, port, err := splitHostAnyPort(req.Addr)
+		if err != nil {
+			return false
+		}
+
+		for _, p := range ports {
+			if int(port) == p {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// WithDenial returns a RuleSet which denies the requests not permitted
+// by rules with the status of denial, e.g. Socks5StatusHostUnreachable
+// to hide the rule set from probing clients.
+func WithDenial(rules RuleSet, denial *DenialError) RuleSet {
+	return &denialRuleSet{
+		RuleSet: rules,
+		denial:  denial,
+	}
+}
+
+type denialRuleSet struct {
+	RuleSet
+	denial *DenialError
+}
+
+func (rs *denialRuleSet) Denial(ctx context.Context, req *Request) *DenialError {
+	return rs.denial
+}
+
+// AllowDatagram delegates to the wrapped rule set if it restricts
+// datagrams.
+func (rs *denialRuleSet) AllowDatagram(ctx context.Context, req *Request, addr string) bool {
+	if rules, ok := rs.RuleSet.(DatagramRuleSet); ok {
+		return rules.AllowDatagram(ctx, req, addr)
+	}
+
+	return true
+}
+
+type ruleSetKey struct{}
+
+func withRuleSet(ctx context.Context, rules RuleSet) context.Context {
+	return context.WithValue(ctx, ruleSetKey{}, rules)
+}
+
+func ruleSetFromContext(ctx context.Context) RuleSet {
+	rules, _ := ctx.Value(ruleSetKey{}).(RuleSet)
+	return rules
+}
+
+// ruleSetMiddleware rejects the requests not permitted by rules after
+// the delay of tarpit. If socks4EchoAddr is true, SOCKS4 rejections echo
+// the request address.
+func ruleSetMiddleware(rules RuleSet, socks4EchoAddr bool, tarpit *TarpitOptions) Middleware {
+	return func(next RequestHandler) RequestHandler {
+		return RequestHandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+			if rules.Allow(ctx, req) {
+				return next.ServeSOCKS(withRuleSet(ctx, rules), conn, req)
+			}
+
+			denial := &DenialError{}
+
+			if rules, ok := rules.(DenialRuleSet); ok {
+				if d := rules.Denial(ctx, req); d != nil {
+					denial = d
+				}
+			}
+
+			tarpit.wait()
+
+			if err := conn.Write(denial.reply(req, socks4EchoAddr)); err != nil {
+				return err
+			}
+
+			return &RuleError{Request: req}
+		})
+	}
+}
+
+// RuleError is returned when a request is denied by the rule set.
+type RuleError struct {
+	Request *Request
+}
+
+func (e *RuleError) Error() string {
+	return "request to " + e.Request.Addr + " denied by ruleset: " + e.Request.CMD.String()
+}
@@ -0,0 +1,163 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type udpPortRuleSet struct {
+	port string
+}
+
+func (rs *udpPortRuleSet) Allow(ctx context.Context, req *Request) bool {
+	return true
+}
+
+func (rs *udpPortRuleSet) AllowDatagram(ctx context.Context, req *Request, addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port == rs.port
+}
+
+func TestRuleSet(t *testing.T) {
+	t.Run("connect", func(t *testing.T) {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		defer listen.Close()
+
+		server := New(func(o *Options) {
+			o.Rules = PermitCommand(BindCommand)
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		_, err = NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", testServer.Listener.Addr().String())
+		assertSocks5Rejection(t, err, Socks5StatusNotAllowed)
+
+		_, err = NewSocks4Dialer("tcp", listen.Addr().String()).Dial("tcp", testServer.Listener.Addr().String())
+		assert.EqualError(t, err, "socks error: request rejected or failed")
+	})
+
+	t.Run("datagram", func(t *testing.T) {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		defer listen.Close()
+
+		allowed := startUDPEchoServer(t)
+		defer allowed.Close()
+
+		denied := startUDPEchoServer(t)
+		defer denied.Close()
+
+		_, port, _ := net.SplitHostPort(allowed.LocalAddr().String())
+
+		server := New(func(o *Options) {
+			o.Rules = &udpPortRuleSet{port: port}
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		client, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		defer client.Close()
+
+		control, relayAddr := socks5Associate(t, listen.Addr().String(), client.LocalAddr().String())
+		defer control.Close()
+
+		sendUDPDatagram(t, client, relayAddr, denied.LocalAddr().String(), []byte("denied"))
+		sendUDPDatagram(t, client, relayAddr, allowed.LocalAddr().String(), []byte("allowed"))
+
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+		buf := make([]byte, maxUDPPacketSize)
+		n, _, err := client.ReadFrom(buf)
+		assert.NoError(t, err)
+
+		datagram := &UDPDatagram{}
+		assert.NoError(t, datagram.UnmarshalBinary(buf[:n]))
+		assert.Equal(t, []byte("allowed"), datagram.Data)
+		assert.Equal(t, uint64(1), server.Metrics().UDPDropped)
+	})
+}
+
+func TestDenialStatus(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.Rules = WithDenial(DenyPorts(81), &DenialError{Socks5Status: Socks5StatusConnectionRefused})
+		o.Middlewares = []Middleware{func(next RequestHandler) RequestHandler {
+			return RequestHandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+				if _, port, _ := net.SplitHostPort(req.Addr); port == "82" {
+					return &DenialError{Socks5Status: Socks5StatusHostUnreachable, Socks4Status: Socks4StatusNoIdentd}
+				}
+
+				return next.ServeSOCKS(ctx, conn, req)
+			})
+		}}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	socks5 := NewSocks5Dialer("tcp", listen.Addr().String())
+	socks4 := NewSocks4Dialer("tcp", listen.Addr().String())
+
+	t.Run("rule set", func(t *testing.T) {
+		_, err := socks5.Dial("tcp", "127.0.0.1:81")
+		assertSocks5Rejection(t, err, Socks5StatusConnectionRefused)
+
+		_, err = socks4.Dial("tcp", "127.0.0.1:81")
+		assert.EqualError(t, err, "socks error: request rejected or failed")
+	})
+
+	t.Run("middleware", func(t *testing.T) {
+		_, err := socks5.Dial("tcp", "127.0.0.1:82")
+		assertSocks5Rejection(t, err, Socks5StatusHostUnreachable)
+
+		_, err = socks4.Dial("tcp", "127.0.0.1:82")
+		assert.EqualError(t, err, "socks error: "+Socks4StatusNoIdentd.String())
+	})
+}
+
+func TestSocks4RejectionEcho(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.Rules = PermitCommand(BindCommand)
+		o.Socks4EchoRejectedAddr = true
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	assert.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{4, byte(ConnectCommand), 0, 80, 192, 0, 2, 1, 0})
+	assert.NoError(t, err)
+
+	b, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 0x5b, 0, 80, 192, 0, 2, 1}, b)
+}
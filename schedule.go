@@ -0,0 +1,167 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a weekly time window, e.g. 08:00-18:00 on weekdays.
+type Schedule struct {
+	// Days are the days of the window. If empty, the window applies
+	// every day.
+	Days []time.Weekday
+
+	// Start and End are the offsets of the window from midnight. If End
+	// is before Start, the window wraps midnight and Days refer to the
+	// day the window starts. If both are zero, the window spans the
+	// whole day.
+	Start time.Duration
+	End   time.Duration
+
+	// Location is the time zone of the window. If nil, the local time
+	// zone is used.
+	Location *time.Location
+}
+
+// Contains reports whether t is within the window.
+func (s *Schedule) Contains(t time.Time) bool {
+	loc := s.Location
+	if loc == nil {
+		loc = time.Local
+	}
+
+	t = t.In(loc)
+
+	y, m, d := t.Date()
+	offset := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, loc))
+	day := t.Weekday()
+
+	switch {
+	case s.Start == 0 && s.End == 0:
+		return s.hasDay(day)
+	case s.Start <= s.End:
+		return s.hasDay(day) && offset >= s.Start && offset < s.End
+	case offset >= s.Start:
+		return s.hasDay(day)
+	case offset < s.End:
+		// The window started the day before.
+		return s.hasDay((day + 6) % 7)
+	default:
+		return false
+	}
+}
+
+func (s *Schedule) hasDay(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+
+	for _, d := range s.Days {
+		if d == day {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PermitSchedule returns a RuleSet which allows the requests within the
+// window of the schedule, e.g. to limit another rule set to office
+// hours with a Middleware.
+func PermitSchedule(s *Schedule) RuleSet {
+	return RuleSetFunc(func(ctx context.Context, req *Request) bool {
+		return s.Contains(time.Now())
+	})
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseDays parses a comma separated list of days and day ranges like
+// "mon-fri,sun".
+func parseDays(s string) ([]time.Weekday, error) {
+	var days []time.Weekday
+
+	for _, item := range strings.Split(s, ",") {
+		lo, hi := item, item
+		if i := strings.Index(item, "-"); i >= 0 {
+			lo, hi = item[:i], item[i+1:]
+		}
+
+		from, ok := parseWeekday(lo)
+		if !ok {
+			return nil, fmt.Errorf("socks: invalid day %q", lo)
+		}
+
+		to, ok := parseWeekday(hi)
+		if !ok {
+			return nil, fmt.Errorf("socks: invalid day %q", hi)
+		}
+
+		// A range like fri-mon wraps the end of the week.
+		for d := from; ; d = (d + 1) % 7 {
+			days = append(days, d)
+
+			if d == to {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(s)
+
+	for i, name := range weekdays {
+		if s == name {
+			return time.Weekday(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// parseTimeWindow parses a window like "08:00-18:00". The end may be
+// 24:00.
+func parseTimeWindow(s string) (time.Duration, time.Duration, error) {
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("socks: invalid time window %q", s)
+	}
+
+	start, ok := parseClock(s[:i])
+	if !ok || start == 24*time.Hour {
+		return 0, 0, fmt.Errorf("socks: invalid time window %q", s)
+	}
+
+	end, ok := parseClock(s[i+1:])
+	if !ok || end == start {
+		return 0, 0, fmt.Errorf("socks: invalid time window %q", s)
+	}
+
+	return start, end, nil
+}
+
+// parseClock parses a time of day like "08:30".
+func parseClock(s string) (time.Duration, bool) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return 0, false
+	}
+
+	h, err := strconv.Atoi(s[:i])
+	if err != nil || h < 0 || h > 24 {
+		return 0, false
+	}
+
+	m, err := strconv.Atoi(s[i+1:])
+	if err != nil || len(s[i+1:]) != 2 || m < 0 || m > 59 || h == 24 && m != 0 {
+		return 0, false
+	}
+
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, true
+}
@@ -0,0 +1,103 @@
+package socks
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedule(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NoError(t, err)
+
+	// Monday, 2024-01-15.
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, 15+day, hour, min, 0, 0, berlin)
+	}
+
+	t.Run("office hours", func(t *testing.T) {
+		s := &Schedule{
+			Days:     []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+			Start:    8 * time.Hour,
+			End:      18 * time.Hour,
+			Location: berlin,
+		}
+
+		assert.True(t, s.Contains(at(0, 8, 0)))
+		assert.True(t, s.Contains(at(4, 17, 59)))
+		assert.False(t, s.Contains(at(0, 7, 59)))
+		assert.False(t, s.Contains(at(0, 18, 0)))
+		assert.False(t, s.Contains(at(5, 12, 0)))
+
+		// 07:30 UTC is 08:30 in Berlin.
+		assert.True(t, s.Contains(time.Date(2024, 1, 15, 7, 30, 0, 0, time.UTC)))
+	})
+
+	t.Run("wrapping midnight", func(t *testing.T) {
+		s := &Schedule{
+			Days:     []time.Weekday{time.Friday},
+			Start:    22 * time.Hour,
+			End:      6 * time.Hour,
+			Location: berlin,
+		}
+
+		assert.True(t, s.Contains(at(4, 23, 0)))
+		assert.True(t, s.Contains(at(5, 5, 59)))
+		assert.False(t, s.Contains(at(4, 5, 0)))
+		assert.False(t, s.Contains(at(5, 22, 0)))
+	})
+
+	t.Run("whole day", func(t *testing.T) {
+		s := &Schedule{Days: []time.Weekday{time.Sunday}, Location: berlin}
+
+		assert.True(t, s.Contains(at(6, 0, 0)))
+		assert.False(t, s.Contains(at(0, 12, 0)))
+	})
+}
+
+func TestParseSchedule(t *testing.T) {
+	days, err := parseDays("fri-mon,wed")
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday, time.Wednesday}, days)
+
+	_, err = parseDays("mon-xyz")
+	assert.Error(t, err)
+
+	start, end, err := parseTimeWindow("08:30-24:00")
+	assert.NoError(t, err)
+	assert.Equal(t, 8*time.Hour+30*time.Minute, start)
+	assert.Equal(t, 24*time.Hour, end)
+
+	for _, s := range []string{"08:00", "8-18", "08:00-08:00", "24:00-06:00", "08:60-09:00", "08:0-09:00"} {
+		_, _, err := parseTimeWindow(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRuleListSchedule(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+allow user developers to bastion.prod.example:22 days mon-fri time 08:00-18:00 tz Europe/Berlin
+default deny
+`))
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	req := &Request{Version: Socks4Version, CMD: ConnectCommand, Addr: "bastion.prod.example:22", UserID: "developers"}
+
+	rules.now = func() time.Time { return time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC) }
+	assert.True(t, rules.Allow(ctx, req))
+
+	rules.now = func() time.Time { return time.Date(2024, 1, 15, 17, 30, 0, 0, time.UTC) }
+	assert.False(t, rules.Allow(ctx, req))
+
+	rules.now = func() time.Time { return time.Date(2024, 1, 20, 9, 0, 0, 0, time.UTC) }
+	assert.False(t, rules.Allow(ctx, req))
+
+	for _, text := range []string{"allow days someday", "allow time 8-18", "allow tz Mars/Olympus"} {
+		_, err := ParseRules(strings.NewReader(text))
+		assert.Error(t, err, text)
+	}
+}
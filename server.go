@@ -1,9 +1,16 @@
 package socks
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/hupe1980/golog"
 )
@@ -13,10 +20,103 @@ type Options struct {
 	// If nil, logging is done via the log package's standard logger.
 	Logger golog.Logger
 
+	// Dialer specifies the dialer of the default handler for
+	// CONNECT requests.
 	Dialer Dialer
 
+	// Listener specifies the listener of the default handler for
+	// BIND requests.
 	Listener Listener
 
+	// HandlerOptions specifies the optional configuration of the default
+	// handler, e.g. its UDP relay for ASSOCIATE requests. It is called
+	// once, after Logger, Dialer, Listener, Socks4EchoRejectedAddr and
+	// the deprecated fields of the default handler have been set.
+	HandlerOptions func(*DefaultHandlerOptions)
+
+	// UDP specifies the options of the default handler's UDP relay
+	// for ASSOCIATE requests.
+	//
+	// Deprecated: Set DefaultHandlerOptions.UDP in HandlerOptions.
+	UDP UDPOptions
+
+	// PublicIP specifies the optional IP address the default handler
+	// advertises in BIND and ASSOCIATE replies instead of the local
+	// address, e.g. when the server runs behind a NAT.
+	//
+	// Deprecated: Set DefaultHandlerOptions.PublicIP in HandlerOptions.
+	PublicIP net.IP
+
+	// ReplyTargetAddr specifies whether the default handler replies to
+	// SOCKS5 CONNECT requests with the address of the target instead
+	// of the local address, see DefaultHandlerOptions.
+	//
+	// Deprecated: Set DefaultHandlerOptions.ReplyTargetAddr in HandlerOptions.
+	ReplyTargetAddr bool
+
+	// OptimisticReply specifies whether the default handler grants
+	// CONNECT requests before the target is dialed, see
+	// DefaultHandlerOptions.
+	//
+	// Deprecated: Set DefaultHandlerOptions.OptimisticReply in HandlerOptions.
+	OptimisticReply bool
+
+	// UnixSockets specifies the paths of the Unix domain sockets the
+	// default handler connects to for "unix:<path>" destinations, see
+	// DefaultHandlerOptions.
+	//
+	// Deprecated: Set DefaultHandlerOptions.UnixSockets in HandlerOptions.
+	UnixSockets []string
+
+	// BindPeerValidator specifies the optional validation of the peer
+	// connecting to the listener of a BIND request by the default
+	// handler. If nil, MatchBindPeerIP is used.
+	//
+	// Deprecated: Set DefaultHandlerOptions.BindPeerValidator in HandlerOptions.
+	BindPeerValidator BindPeerValidator
+
+	// MaxBinds specifies the number of BIND requests the default handler
+	// lets wait for their peer at the same time, see
+	// DefaultHandlerOptions.
+	//
+	// Deprecated: Set DefaultHandlerOptions.MaxBinds in HandlerOptions.
+	MaxBinds int
+
+	// BindTimeout specifies how long a BIND request of the default
+	// handler waits for its peer, see DefaultHandlerOptions.
+	//
+	// Deprecated: Set DefaultHandlerOptions.BindTimeout in HandlerOptions.
+	BindTimeout time.Duration
+
+	// Ports specifies the optional allocator of the ports of the default
+	// handler's BIND listeners and UDP relays, see DefaultHandlerOptions.
+	//
+	// Deprecated: Set DefaultHandlerOptions.Ports in HandlerOptions.
+	Ports PortAllocator
+
+	// Socks4EchoRejectedAddr specifies whether SOCKS4 rejection replies
+	// carry DSTPORT and DSTIP of the request instead of zeros, for
+	// clients which mis-parse zeroed rejections.
+	Socks4EchoRejectedAddr bool
+
+	// Socks4IPv6 specifies how the default handler replies to SOCKS4
+	// BIND requests whose BND.ADDR is an IPv6 address, see
+	// Socks4IPv6Policy.
+	//
+	// Deprecated: Set DefaultHandlerOptions.Socks4IPv6 in HandlerOptions.
+	Socks4IPv6 Socks4IPv6Policy
+
+	// EgressMark specifies the optional socket mark of the connections
+	// the default handler dials for CONNECT requests, e.g. SessionMark
+	// to correlate firewall logs with the sessions, see EgressMarkFunc.
+	//
+	// Deprecated: Set DefaultHandlerOptions.EgressMark in HandlerOptions.
+	EgressMark EgressMarkFunc
+
+	// Handler specifies the optional handler for parsed requests.
+	// If nil, a DefaultHandler using Dialer and Listener is used.
+	Handler RequestHandler
+
 	// Ident specifies the optional ident function.
 	// It must return an error when the ident is failed.
 	Ident IdentFunc
@@ -26,22 +126,274 @@ type Options struct {
 	// If empty, SOCKS server supports AuthMethodNotRequired.
 	AuthMethods []AuthMethod
 
+	// PreferServerAuthMethods specifies whether the authentication
+	// method is selected by the order of AuthMethods instead of the
+	// order offered by the client.
+	PreferServerAuthMethods bool
+
+	// DisallowAuthDowngrade specifies whether AuthMethodNotRequired
+	// is refused when the client also offers a stronger method of
+	// AuthMethods.
+	DisallowAuthDowngrade bool
+
 	// Authenticate specifies the optional authentication
 	// function. It must be non-nil when AuthMethods is not empty.
 	// It must return an error when the authentication is failed.
+	// The authenticated identity can be recorded with
+	// Session.SetUser on the session stored in the context.
 	Authenticate AuthenticateFunc
+
+	// TrustedNetworks specifies the optional client networks which
+	// skip the authentication, see TrustedNetwork. The first network
+	// containing the client address applies.
+	TrustedNetworks []TrustedNetwork
+
+	// NoAuthGraceNetworks specifies the client networks whose SOCKS5
+	// clients get AuthMethodNotRequired selected if they offer it and
+	// none of their methods is acceptable, e.g. while authentication is
+	// introduced. The AuthenticateFunc is not called for them.
+	NoAuthGraceNetworks *CIDRSet
+
+	// Resumption specifies the optional issuing of tokens which resume
+	// an authentication on later connections of a client without
+	// calling the AuthenticateFunc, see AuthMethodResumption.
+	Resumption ResumptionOptions
+
+	// Notice specifies the optional notice of the operator for SOCKS5
+	// clients offering AuthMethodNotice, e.g. the Socks5Dialer of this
+	// package with OnNotice.
+	Notice NoticeFunc
+
+	// LogAuthMethods specifies whether the authentication methods
+	// offered by SOCKS5 clients are logged, e.g. to find the clients
+	// which cannot authenticate yet.
+	LogAuthMethods bool
+
+	// Hostnames specifies the canonicalization and validation of FQDN
+	// destinations before rules, handlers and logging see them. Invalid
+	// destinations are rejected with host unreachable.
+	Hostnames HostnameOptions
+
+	// ProxyProtocol specifies the acceptance of PROXY protocol headers,
+	// e.g. of a load balancer. The headers are available from
+	// Session.ProxyHeader; the client address of the session remains
+	// the address of the load balancer.
+	ProxyProtocol ProxyProtocolOptions
+
+	// CorrelationID specifies an optional function returning the
+	// correlation ID of the session of a new connection, e.g. from a
+	// header injected by a load balancer, see Session.SetCorrelationID.
+	// It is called before the handshake; ConnInfoFromContext returns
+	// the connection details.
+	CorrelationID func(ctx context.Context, conn net.Conn) string
+
+	// Tarpit specifies the optional delay of the rejections of failed
+	// method selections, authentications and idents and of requests
+	// denied by Rules or with a *DenialError. Replies written by an
+	// AuthenticateFunc itself are not delayed, the connection is held
+	// for the delay instead.
+	Tarpit TarpitOptions
+
+	// MetricLabels specifies the optional labeled session metrics and
+	// their cardinality, see Server.LabeledMetrics and
+	// Server.WritePrometheus.
+	MetricLabels MetricLabelOptions
+
+	// Hooks specifies optional callbacks for server events.
+	Hooks Hooks
+
+	// Rules specifies the optional rule set for requests. If the
+	// rule set implements DatagramRuleSet, it is also applied to the
+	// destinations of relayed UDP datagrams.
+	Rules RuleSet
+
+	// Revocation specifies the revalidation of the live sessions, see
+	// Server.Revalidate.
+	Revocation RevocationOptions
+
+	// Middlewares specifies the optional middlewares applied to
+	// every parsed request permitted by Rules before the command
+	// dispatch.
+	Middlewares []Middleware
+
+	// WebSocketPath specifies the optional path on which the server
+	// accepts WebSocket upgrades and serves SOCKS inside the binary
+	// messages of the WebSocket. Other HTTP requests are rejected.
+	WebSocketPath string
+
+	// SessionLogFields specifies whether the log lines of a connection
+	// are prefixed with the session ID, the client address, the user
+	// and the destination, see SessionLogger. The logger is stored in
+	// the context of the connection, see LoggerFromContext.
+	SessionLogFields bool
+
+	// Capture specifies the optional packet capture of the tunnels of
+	// the sessions started while the capture is enabled.
+	Capture *Capture
+
+	// SessionStore specifies the optional store of the records of
+	// completed sessions.
+	SessionStore SessionStore
+
+	// RunAs specifies the optional unprivileged user, given as "user"
+	// or "user:group", the process switches to once ListenAndServe
+	// has opened its listeners, see DropPrivileges.
+	RunAs string
+
+	// MaxHandshakeBytes specifies the number of bytes a client may send
+	// until its request has been read, including the method selection
+	// and the authentication. If zero, DefaultMaxHandshakeBytes is
+	// used. A negative value disables the limit.
+	MaxHandshakeBytes int
+
+	// CredentialLimits specifies the accepted lengths of the credentials
+	// of username/password requests. Reading a request exceeding them,
+	// e.g. by the AuthenticateFunc, fails with a *CredentialLengthError.
+	CredentialLimits CredentialLimits
+
+	// MaxHandshakes specifies the number of connections which may be in
+	// the handshake at the same time, i.e. until their request has been
+	// read. Further connections are closed without a reply, since
+	// unauthenticated handshakes are cheap for a client to hold open.
+	// Established sessions do not count. If zero, the number is not
+	// limited.
+	MaxHandshakes int
+
+	// HandshakeTimeout specifies the maximum duration of the handshake,
+	// i.e. until the request has been read. Every field of the messages
+	// is read against the same deadline, so a client trickling its
+	// request fails with a *NegotiationTimeoutError naming the field,
+	// which Metrics.HandshakeTimeouts counts. If zero, there is no
+	// timeout.
+	HandshakeTimeout time.Duration
+
+	// AuthTimeout specifies the maximum duration of a call of the
+	// AuthenticateFunc, which also recovers from its panics, see
+	// GuardAuthenticator. The timeouts and panics fail the
+	// authentication and are counted by Metrics.AuthTimeouts and
+	// Metrics.AuthPanics. If zero, HandshakeTimeout is used.
+	AuthTimeout time.Duration
+
+	// IdleTimeout specifies how long a tunnel may be idle, i.e. without
+	// data in either direction, before it is closed with
+	// CloseReasonIdleTimeout. If zero, idle tunnels are not closed.
+	IdleTimeout time.Duration
+
+	// RateLimiter specifies the optional limit of the bytes tunneled by
+	// the sessions, shared by the groups of sessions of
+	// RateLimitOptions.Key.
+	RateLimiter *RateLimiter
+
+	// Multiplex specifies whether the server accepts the non-standard
+	// MULTIPLEX command of this package, which carries the CONNECT
+	// requests of a MultiplexDialer as streams of a single connection.
+	Multiplex bool
+
+	handlerOptions *DefaultHandlerOptions // built by defaultHandlerOptions
 }
 
 type Server struct {
 	*logger
-	dialer       Dialer
-	listener     Listener
-	ident        IdentFunc
-	authMethods  []AuthMethod
-	authenticate AuthenticateFunc
+	handler                 RequestHandler
+	ident                   IdentFunc
+	socks4EchoAddr          bool
+	authMethods             []AuthMethod
+	preferServerAuthMethods bool
+	disallowAuthDowngrade   bool
+	authenticate            AuthenticateFunc
+	trustedNetworks         []TrustedNetwork
+	noAuthGraceNetworks     *CIDRSet
+	logAuthMethods          bool
+	resumption              *resumption
+	notice                  NoticeFunc
+	tarpit                  *TarpitOptions
+	hostnames               *HostnameOptions
+	correlationID           func(ctx context.Context, conn net.Conn) string
+	proxyProtocol           *ProxyProtocolOptions
+	hooks                   *Hooks
+	metrics                 *metrics
+	labels                  *labeledMetrics
+	webSocketPath           string
+	sessionLogFields        bool
+	multiplex               bool
+	capture                 *Capture
+	events                  eventStream
+	sessionStore            SessionStore
+	runAs                   string
+	maxHandshakeBytes       int
+	credentialLimits        *CredentialLimits
+	handshakes              chan struct{} // semaphore of MaxHandshakes, if set
+	handshakeTimeout        time.Duration
+	idleTimeout             time.Duration
+	rateLimiter             *RateLimiter
+	rules                   RuleSet
+	revocation              *RevocationOptions
+
+	inShutdown int32 // accessed atomically
+	mu         sync.Mutex
+	listeners  map[*net.Listener]struct{}
+	sessions   map[*Session]net.Conn
 }
 
+// New returns a new Server. The options are not validated, see
+// NewServer.
 func New(optFns ...func(*Options)) *Server {
+	return newServer(newOptions(optFns))
+}
+
+// NewServer returns a new Server like New, but returns an error if the
+// options are inconsistent, see Options.Validate.
+func NewServer(optFns ...func(*Options)) (*Server, error) {
+	options := newOptions(optFns)
+
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	return newServer(options), nil
+}
+
+// Validate reports the first inconsistency of the options which would
+// otherwise fail at runtime, e.g. in the middle of a handshake.
+// A *CapabilityError is returned if the build lacks a capability the
+// options require, see RequiredCapabilities.
+func (o *Options) Validate() error {
+	for _, method := range o.AuthMethods {
+		if method != AuthMethodNotRequired && o.Authenticate == nil {
+			return fmt.Errorf("socks: invalid options: auth method %v without Authenticate", method)
+		}
+	}
+
+	if o.WebSocketPath != "" && !strings.HasPrefix(o.WebSocketPath, "/") {
+		return fmt.Errorf("socks: invalid options: WebSocketPath %q must start with /", o.WebSocketPath)
+	}
+
+	if err := RequireCapabilities(o.RequiredCapabilities()...); err != nil {
+		return err
+	}
+
+	if o.Handler != nil {
+		return nil
+	}
+
+	if o.Dialer == nil {
+		return errors.New("socks: invalid options: no Dialer for CONNECT")
+	}
+
+	if o.Listener == nil {
+		return errors.New("socks: invalid options: no Listener for BIND")
+	}
+
+	for _, path := range o.defaultHandlerOptions().UnixSockets {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("socks: invalid options: unix socket path %q is not absolute", path)
+		}
+	}
+
+	return nil
+}
+
+func newOptions(optFns []func(*Options)) Options {
 	options := Options{
 		Logger:      golog.NewGoLogger(golog.INFO, log.Default()),
 		Dialer:      &net.Dialer{},
@@ -53,13 +405,125 @@ func New(optFns ...func(*Options)) *Server {
 		fn(&options)
 	}
 
+	return options
+}
+
+// defaultHandlerOptions returns the options of the default handler. They
+// are built once, so that HandlerOptions is called once, no matter
+// whether the options are validated before the server is created.
+func (o *Options) defaultHandlerOptions() *DefaultHandlerOptions {
+	if o.handlerOptions != nil {
+		return o.handlerOptions
+	}
+
+	h := &DefaultHandlerOptions{
+		Logger:                 o.Logger,
+		Dialer:                 o.Dialer,
+		Listener:               o.Listener,
+		UDP:                    o.UDP,
+		PublicIP:               o.PublicIP,
+		ReplyTargetAddr:        o.ReplyTargetAddr,
+		OptimisticReply:        o.OptimisticReply,
+		UnixSockets:            o.UnixSockets,
+		BindPeerValidator:      o.BindPeerValidator,
+		Socks4EchoRejectedAddr: o.Socks4EchoRejectedAddr,
+		Socks4IPv6:             o.Socks4IPv6,
+		EgressMark:             o.EgressMark,
+		MaxBinds:               o.MaxBinds,
+		BindTimeout:            o.BindTimeout,
+		Ports:                  o.Ports,
+	}
+
+	if o.HandlerOptions != nil {
+		o.HandlerOptions(h)
+	}
+
+	o.handlerOptions = h
+
+	return h
+}
+
+// guardAuthenticator returns the guarded AuthenticateFunc of the options
+// or nil.
+func guardAuthenticator(options Options) AuthenticateFunc {
+	if options.Authenticate == nil {
+		return nil
+	}
+
+	timeout := options.AuthTimeout
+	if timeout == 0 {
+		timeout = options.HandshakeTimeout
+	}
+
+	return GuardAuthenticator(options.Authenticate, timeout)
+}
+
+// DefaultMaxHandshakeBytes is the default of Options.MaxHandshakeBytes.
+const DefaultMaxHandshakeBytes = 64 * 1024
+
+func newServer(options Options) *Server {
+	maxHandshakeBytes := options.MaxHandshakeBytes
+	if maxHandshakeBytes == 0 {
+		maxHandshakeBytes = DefaultMaxHandshakeBytes
+	}
+
+	handler := options.Handler
+	if handler == nil {
+		handlerOptions := options.defaultHandlerOptions()
+
+		handler = NewDefaultHandler(func(o *DefaultHandlerOptions) {
+			*o = *handlerOptions
+		})
+	}
+
+	handler = Chain(handler, options.Middlewares...)
+
+	// The middlewares only see the requests permitted by the rule set,
+	// e.g. PrefetchDNS does not resolve the names of denied requests.
+	if options.Rules != nil {
+		handler = ruleSetMiddleware(options.Rules, options.Socks4EchoRejectedAddr, &options.Tarpit)(handler)
+	}
+
+	var handshakes chan struct{}
+	if options.MaxHandshakes > 0 {
+		handshakes = make(chan struct{}, options.MaxHandshakes)
+	}
+
 	return &Server{
-		logger:       &logger{options.Logger},
-		dialer:       options.Dialer,
-		listener:     options.Listener,
-		ident:        options.Ident,
-		authMethods:  options.AuthMethods,
-		authenticate: options.Authenticate,
+		logger:                  &logger{options.Logger},
+		handler:                 handler,
+		ident:                   options.Ident,
+		socks4EchoAddr:          options.Socks4EchoRejectedAddr,
+		authMethods:             options.AuthMethods,
+		preferServerAuthMethods: options.PreferServerAuthMethods,
+		disallowAuthDowngrade:   options.DisallowAuthDowngrade,
+		authenticate:            guardAuthenticator(options),
+		trustedNetworks:         options.TrustedNetworks,
+		noAuthGraceNetworks:     options.NoAuthGraceNetworks,
+		logAuthMethods:          options.LogAuthMethods,
+		resumption:              newResumption(&options.Resumption),
+		notice:                  options.Notice,
+		tarpit:                  &options.Tarpit,
+		hostnames:               &options.Hostnames,
+		correlationID:           options.CorrelationID,
+		proxyProtocol:           &options.ProxyProtocol,
+		hooks:                   &options.Hooks,
+		metrics:                 &metrics{},
+		labels:                  newLabeledMetrics(options.MetricLabels),
+		webSocketPath:           options.WebSocketPath,
+		sessionLogFields:        options.SessionLogFields,
+		multiplex:               options.Multiplex,
+		capture:                 options.Capture,
+		sessionStore:            options.SessionStore,
+		runAs:                   options.RunAs,
+		maxHandshakeBytes:       maxHandshakeBytes,
+		credentialLimits:        &options.CredentialLimits,
+		handshakes:              handshakes,
+		handshakeTimeout:        options.HandshakeTimeout,
+		idleTimeout:             options.IdleTimeout,
+		rateLimiter:             options.RateLimiter,
+		rules:                   options.Rules,
+		revocation:              &options.Revocation,
 	}
 }
 
@@ -68,13 +532,10 @@ func ListenAndServe(addr string) error {
 	return server.ListenAndServe(addr)
 }
 
+// ListenAndServe listens on the TCP address and serves connections, see
+// ListenAndServeNetwork.
 func (s *Server) ListenAndServe(addr string) error {
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
-	}
-
-	return s.Serve(l)
+	return s.ListenAndServeNetwork("tcp", addr)
 }
 
 // Serve serves connections from a listener
@@ -83,53 +544,269 @@ func (s *Server) Serve(l net.Listener) error {
 		_ = l.Close()
 	}()
 
+	if !s.trackListener(&l, true) {
+		return ErrServerClosed
+	}
+
+	defer s.trackListener(&l, false)
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+
 			return err
 		}
 
 		go func() {
-			if err := s.handleConnection(conn); err != nil {
-				s.logErrorf("Connection error: %v", err)
-			}
+			_ = s.handleConnection(l, conn)
 		}()
 	}
 }
 
-func (s *Server) handleConnection(conn net.Conn) error {
+// Metrics returns a snapshot of the server counters.
+func (s *Server) Metrics() Metrics {
+	return s.metrics.snapshot()
+}
+
+// LabeledMetrics returns a snapshot of the labeled session metrics, see
+// Options.MetricLabels.
+func (s *Server) LabeledMetrics() []LabeledSessionMetrics {
+	return s.labels.snapshot()
+}
+
+// TopDestinations returns the most frequent destinations of the closed
+// sessions by descending count, see MetricLabelOptions.TopDestinations.
+func (s *Server) TopDestinations() []DestinationCount {
+	return s.labels.topDestinations()
+}
+
+// Subscribe returns a new subscription to the session events of the
+// server. Up to buffer events are queued for a slow consumer, further
+// events are dropped and counted, see Subscription.Dropped.
+func (s *Server) Subscribe(buffer int) *Subscription {
+	return s.events.subscribe(buffer)
+}
+
+// handleConnection serves conn and returns the error it was closed with.
+func (s *Server) handleConnection(l net.Listener, conn net.Conn) error {
 	defer func() {
 		_ = conn.Close()
 	}()
 
-	socksConn := NewConn(conn)
+	session := newSession(conn.RemoteAddr())
+
+	s.trackSession(session, conn, true)
+	defer s.trackSession(session, conn, false)
+
+	ctx := WithSession(withMetrics(context.Background(), s.metrics), session)
+	ctx = withEvents(ctx, &s.events)
+	ctx = withHooks(ctx, s.hooks)
+	ctx = withConnInfo(ctx, &ConnInfo{
+		ClientAddr:   conn.RemoteAddr(),
+		LocalAddr:    conn.LocalAddr(),
+		ListenerAddr: l.Addr(),
+		conn:         conn,
+	})
 
-	version, err := socksConn.Peek(1)
+	if s.correlationID != nil {
+		session.SetCorrelationID(s.correlationID(ctx, conn))
+	}
+
+	if s.sessionLogFields {
+		ctx = WithLogger(ctx, SessionLogger(s.logger.logger, session))
+	}
+
+	s.events.emit(EventSessionStarted, session, nil)
+
+	err := s.serveConn(ctx, conn)
 	if err != nil {
-		s.logErrorf("Failed to get version byte: %v", err)
-		return err
+		s.fromContext(ctx).logErrorf("Connection error: %v", err)
+	}
+
+	var timeoutErr *NegotiationTimeoutError
+	if errors.As(err, &timeoutErr) {
+		s.metrics.handshakeTimeout(timeoutErr.Phase, timeoutErr.Field)
+	}
+
+	_ = conn.Close()
+
+	session.setCloseReason(classifyClose(session, err))
+	s.metrics.sessionClosed(session.CloseReason())
+
+	s.events.emit(EventSessionClosed, session, err)
+	s.labels.record(session)
+
+	if s.sessionStore != nil {
+		if err := s.sessionStore.StoreSession(ctx, newSessionRecord(session, err)); err != nil {
+			s.fromContext(ctx).logErrorf("Failed to store session: %v", err)
+		}
+	}
+
+	return err
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) error {
+	l := s.fromContext(ctx)
+
+	handshakeDone, ok := s.acquireHandshake()
+	if !ok {
+		s.metrics.handshakeRejected()
+		return ErrTooManyHandshakes
+	}
+
+	if s.handshakeTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
+
+		release := handshakeDone
+		handshakeDone = func() {
+			_ = conn.SetReadDeadline(time.Time{})
+			release()
+		}
 	}
 
-	switch Version(version[0]) {
-	case Socks4Version:
+	defer handshakeDone()
+
+	socksConn := newBudgetConn(conn, s.maxHandshakeBytes)
+	socksConn.handshakeDone = handshakeDone
+
+	protocol, err := socksConn.Sniff()
+	if err != nil {
+		l.logErrorf("Failed to get version byte: %v", err)
+		return fieldError("version identification", "VER", err)
+	}
+
+	session, _ := SessionFromContext(ctx)
+
+	if protocol == ProtocolProxy && s.proxyProtocol.accepts(conn.RemoteAddr()) {
+		header, err := readProxyHeader(socksConn.reader)
+		if err != nil {
+			return err
+		}
+
+		if session != nil {
+			session.setProxyHeader(header)
+		}
+
+		protocol, err = socksConn.Sniff()
+		if err != nil {
+			l.logErrorf("Failed to get version byte: %v", err)
+			return err
+		}
+	}
+
+	if s.webSocketPath != "" && protocol == ProtocolHTTP {
+		wsConn, err := upgradeWebSocket(socksConn, s.webSocketPath)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			_ = wsConn.Close()
+		}()
+
+		// The WebSocket reads the outer connection, whose budget ends
+		// with the handshake inside the WebSocket.
+		outer := socksConn
+
+		socksConn = newBudgetConn(wsConn, s.maxHandshakeBytes)
+		socksConn.handshakeDone = outer.endHandshake
+
+		protocol, err = socksConn.Sniff()
+		if err != nil {
+			l.logErrorf("Failed to get version byte: %v", err)
+			return err
+		}
+	}
+
+	socksConn.session = session
+	socksConn.idleTimeout = s.idleTimeout
+	socksConn.limiter = s.rateLimiter
+	socksConn.credentials = s.credentialLimits
+
+	if s.capture != nil && s.capture.Enabled() {
+		socksConn.capture = s.capture.newSession(session)
+	}
+
+	trusted := trustedNetwork(s.trustedNetworks, conn.RemoteAddr())
+
+	switch protocol {
+	case ProtocolSocks4:
 		socks4Handler := &socks4Handler{
-			logger: s.logger,
-			dialer: s.dialer,
-			conn:   socksConn,
+			logger:    l,
+			conn:      socksConn,
+			ident:     s.ident,
+			trusted:   trusted,
+			tarpit:    s.tarpit,
+			hostnames: s.hostnames,
+			echoAddr:  s.socks4EchoAddr,
+			hooks:     s.hooks,
+			handler:   s.handler,
 		}
 
-		return socks4Handler.handle()
-	case Socks5Version:
+		return socks4Handler.handle(ctx)
+	case ProtocolSocks5:
 		socks5Handler := &socks5Handler{
-			logger:       s.logger,
-			dialer:       s.dialer,
-			conn:         socksConn,
-			authMethods:  s.authMethods,
-			authenticate: s.authenticate,
+			logger:                  l,
+			conn:                    socksConn,
+			authMethods:             s.authMethods,
+			preferServerAuthMethods: s.preferServerAuthMethods,
+			disallowAuthDowngrade:   s.disallowAuthDowngrade,
+			authenticate:            s.authenticate,
+			trusted:                 trusted,
+			grace:                   s.noAuthGraceNetworks != nil && s.noAuthGraceNetworks.Contains(addrIP(conn.RemoteAddr())),
+			logAuthMethods:          s.logAuthMethods,
+			resumption:              s.resumption,
+			notice:                  s.notice,
+			tarpit:                  s.tarpit,
+			hostnames:               s.hostnames,
+			multiplex:               s.multiplex,
+			hooks:                   s.hooks,
+			metrics:                 s.metrics,
+			handler:                 s.handler,
 		}
 
-		return socks5Handler.handle()
+		return socks5Handler.handle(ctx)
 	default:
-		return fmt.Errorf("unsupported socks version: %d", version[0])
+		// There is no reply for unknown protocols, the rejection of
+		// the SOCKS5 method selection is understood by most clients.
+		if protocol == ProtocolHTTP {
+			_, _ = io.WriteString(socksConn.writer, "HTTP/1.0 400 Bad Request\r\nConnection: close\r\n\r\n")
+		} else {
+			_ = socksConn.Write(&MethodSelectResponse{Method: AuthMethodNoAcceptableMethods})
+		}
+
+		version, _ := socksConn.Peek(1)
+
+		got := protocol.String()
+		if protocol == ProtocolUnknown {
+			got = fmt.Sprintf("version %d", version[0])
+		}
+
+		return newProtocolError("version identification", "version 4 or 5", got, version)
+	}
+}
+
+// acquireHandshake acquires a slot of MaxHandshakes without waiting. The
+// returned function releases the slot and may be called more than once.
+func (s *Server) acquireHandshake() (func(), bool) {
+	if s.handshakes == nil {
+		return func() {}, true
 	}
+
+	select {
+	case s.handshakes <- struct{}{}:
+	default:
+		return nil, false
+	}
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			<-s.handshakes
+		})
+	}, true
 }
@@ -0,0 +1,431 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerShutdown(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	var status DrainStatus
+
+	server := New(func(o *Options) {
+		o.Hooks.OnDrain = func(ctx context.Context, s *DrainStatus) {
+			status = *s
+		}
+	})
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		serveErr <- server.Serve(listen)
+	}()
+
+	d := NewSocks5Dialer("tcp", listen.Addr().String())
+
+	conn, err := d.Dial("tcp", testServer.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+	assert.ErrorIs(t, <-serveErr, ErrServerClosed)
+	assert.Equal(t, 1, status.Remaining)
+	assert.Greater(t, status.OldestAge, time.Duration(0))
+
+	_, err = d.Dial("tcp", testServer.Listener.Addr().String())
+	assert.Error(t, err)
+
+	_ = conn.Close()
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assert.Equal(t, 0, status.Remaining)
+}
+
+func TestServerClose(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	server := New()
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	d := NewSocks5Dialer("tcp", listen.Addr().String())
+
+	conn, err := d.Dial("tcp", testServer.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	defer conn.Close()
+
+	server.LameDuck()
+	assert.Equal(t, 1, server.DrainStatus().Remaining)
+
+	assert.NoError(t, server.Close())
+	assert.NoError(t, server.Shutdown(context.Background()))
+}
+
+func TestServerCloseIdleTarget(t *testing.T) {
+	// The target neither reads nor closes its connections.
+	target, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer target.Close()
+
+	go func() {
+		var conns []net.Conn
+
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				break
+			}
+
+			conns = append(conns, c)
+		}
+
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	server := New()
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	conn, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", target.Addr().String())
+	assert.NoError(t, err)
+
+	defer conn.Close()
+
+	assert.NoError(t, server.Close())
+
+	assert.Eventually(t, func() bool {
+		return server.DrainStatus().Remaining == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNewServer(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		server, err := NewServer(func(o *Options) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = userPassServerAuthenticateFuncGen("user", "pass")
+		})
+		assert.NoError(t, err)
+		assert.NotNil(t, server)
+	})
+
+	for name, fn := range map[string]func(*Options){
+		"auth without authenticate": func(o *Options) {
+			o.AuthMethods = []AuthMethod{AuthMethodNotRequired, AuthMethodUsernamePassword}
+		},
+		"bind without listener": func(o *Options) {
+			o.Listener = nil
+		},
+		"connect without dialer": func(o *Options) {
+			o.Dialer = nil
+		},
+		"relative websocket path": func(o *Options) {
+			o.WebSocketPath = "socks"
+		},
+		"relative unix socket": func(o *Options) {
+			o.HandlerOptions = func(h *DefaultHandlerOptions) {
+				h.UnixSockets = []string{"daemon.sock"}
+			}
+		},
+	} {
+		fn := fn
+
+		t.Run(name, func(t *testing.T) {
+			_, err := NewServer(fn)
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("custom handler", func(t *testing.T) {
+		_, err := NewServer(func(o *Options) {
+			o.Listener = nil
+			o.Handler = NewDefaultHandler()
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("handler options", func(t *testing.T) {
+		calls := 0
+
+		server, err := NewServer(func(o *Options) {
+			o.MaxBinds = 2
+			o.HandlerOptions = func(h *DefaultHandlerOptions) {
+				calls++
+
+				assert.Equal(t, 2, h.MaxBinds)
+				h.UDP.OverTCP = true
+			}
+		})
+		assert.NoError(t, err)
+
+		// Validate, RequiredCapabilities and New share the options.
+		assert.Equal(t, 1, calls)
+
+		handler, ok := server.handler.(*DefaultHandler)
+		assert.True(t, ok)
+		assert.Equal(t, 2, cap(handler.binds))
+		assert.True(t, handler.udp.OverTCP)
+	})
+}
+
+func TestHandshakeFailureReplies(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.AuthMethods = []AuthMethod{AuthMethodNotRequired, AuthMethodUsernamePassword}
+		o.Authenticate = func(ctx context.Context, conn *Conn, method AuthMethod) error {
+			if method == AuthMethodUsernamePassword {
+				return errors.New("backend unavailable")
+			}
+
+			return nil
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	exchange := func(t *testing.T, req []byte) []byte {
+		conn, err := net.Dial("tcp", listen.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = conn.Write(req)
+		assert.NoError(t, err)
+
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		resp, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+
+		return resp
+	}
+
+	t.Run("unknown version", func(t *testing.T) {
+		assert.Equal(t, []byte{0x05, 0xff}, exchange(t, []byte{0x07, 0x01, 0x00}))
+	})
+
+	t.Run("http", func(t *testing.T) {
+		resp := exchange(t, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.0 400 Bad Request\r\n"))
+	})
+
+	t.Run("auth error", func(t *testing.T) {
+		assert.Equal(t, []byte{0x05, 0x02, 0x01, 0xff}, exchange(t, []byte{0x05, 0x01, 0x02}))
+	})
+
+	t.Run("address type", func(t *testing.T) {
+		resp := exchange(t, []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x09})
+		assert.Equal(t, []byte{0x05, 0x00, 0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0}, resp)
+	})
+
+	t.Run("request version", func(t *testing.T) {
+		resp := exchange(t, []byte{0x05, 0x01, 0x00, 0x04, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 80})
+		assert.Equal(t, []byte{0x05, 0x00, 0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0}, resp)
+	})
+}
+
+func TestMaxHandshakeBytes(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.MaxHandshakeBytes = 64
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	t.Run("within budget", func(t *testing.T) {
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET / HTTP/1.0\r\nX-Padding: " + strings.Repeat("x", 1024) + "\r\n\r\n"))
+		assert.NoError(t, err)
+
+		resp, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Contains(t, string(resp), "hello")
+	})
+
+	t.Run("exceeded", func(t *testing.T) {
+		conn, err := net.Dial("tcp", listen.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		// SOCKS4 request with an unterminated user ID.
+		_, err = conn.Write(append([]byte{0x04, 0x01, 0x00, 0x50, 127, 0, 0, 1}, []byte(strings.Repeat("a", 1024))...))
+		assert.NoError(t, err)
+
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		resp, _ := io.ReadAll(conn)
+		assert.Empty(t, resp)
+	})
+}
+
+func TestMaxHandshakes(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.MaxHandshakes = 1
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	d := NewSocks5Dialer("tcp", listen.Addr().String())
+
+	// An idle client holds the only handshake slot.
+	idle, err := net.Dial("tcp", listen.Addr().String())
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		conn, err := d.Dial("tcp", testServer.Listener.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Greater(t, server.Metrics().HandshakesRejected, uint64(0))
+
+	_ = idle.Close()
+
+	// Established sessions release their slot.
+	var conns []net.Conn
+
+	assert.Eventually(t, func() bool {
+		conn, err := d.Dial("tcp", testServer.Listener.Addr().String())
+		if err != nil {
+			return false
+		}
+
+		conns = append(conns, conn)
+
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	conn, err := d.Dial("tcp", testServer.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	conns = append(conns, conn)
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.HandshakeTimeout = 200 * time.Millisecond
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	t.Run("tunnel outlives timeout", func(t *testing.T) {
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		time.Sleep(400 * time.Millisecond)
+
+		_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		assert.NoError(t, err)
+
+		resp, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Contains(t, string(resp), "hello")
+	})
+
+	t.Run("trickling client", func(t *testing.T) {
+		conn, err := net.Dial("tcp", listen.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = conn.Write([]byte{0x05, 0x01, 0x00})
+		assert.NoError(t, err)
+
+		reply := make([]byte, 2)
+		_, err = io.ReadFull(conn, reply)
+		assert.NoError(t, err)
+
+		// The request stalls within DST.ADDR of an FQDN.
+		for _, b := range []byte{0x05, 0x01, 0x00, 0x03, 11, 'e'} {
+			_, err = conn.Write([]byte{b})
+			assert.NoError(t, err)
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		resp, _ := io.ReadAll(conn)
+		assert.Empty(t, resp)
+
+		field := HandshakeField{Phase: "SOCKS5 request", Field: "ADDR"}
+
+		assert.Eventually(t, func() bool {
+			return server.Metrics().HandshakeTimeouts[field] == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		server, client := net.Pipe()
+
+		defer client.Close()
+
+		_ = server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+		err := NewConn(server).Read(&MethodSelectRequest{})
+
+		var timeoutErr *NegotiationTimeoutError
+		assert.True(t, errors.As(err, &timeoutErr))
+		assert.EqualError(t, err, "socks: negotiation timeout at field VER of SOCKS5 method selection request")
+	})
+}
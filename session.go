@@ -0,0 +1,306 @@
+package socks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var sessionCounter uint64
+
+// Session holds the state of a single client connection.
+type Session struct {
+	// ID is a random identifier of the session. The streams of a
+	// multiplexed session append their stream ID.
+	ID         string
+	ClientAddr net.Addr
+	StartTime  time.Time
+
+	mu            sync.RWMutex
+	correlationID string
+	proxyHeader   *ProxyHeader
+	user          string
+	destAddr      string
+	targetAddr    string
+	annotations   map[string]string
+	closeReason   CloseReason
+	request       *Request
+
+	bytesIn  uint64 // accessed atomically
+	bytesOut uint64 // accessed atomically
+	udp      udpStats
+}
+
+// UDPStats holds the counters of the UDP association of a session. The
+// payload bytes are counted by Session.BytesIn and Session.BytesOut.
+type UDPStats struct {
+	// DatagramsIn counts the datagrams relayed from the client to the
+	// targets, DatagramsOut from the targets to the client.
+	DatagramsIn  uint64
+	DatagramsOut uint64
+
+	// Dropped counts the datagrams dropped because of the size or flow
+	// limits or the rule set.
+	Dropped uint64
+}
+
+// udpStats holds the counters of UDPStats, accessed atomically.
+type udpStats struct {
+	datagramsIn  uint64
+	datagramsOut uint64
+	dropped      uint64
+}
+
+func newSession(clientAddr net.Addr) *Session {
+	return &Session{
+		ID:         newSessionID(),
+		ClientAddr: clientAddr,
+		StartTime:  time.Now(),
+	}
+}
+
+// newSessionID returns 64 random bits in hex, so that the IDs of the
+// sessions of several servers and restarts do not collide. It falls
+// back to a counter if the random source fails.
+func newSessionID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatUint(atomic.AddUint64(&sessionCounter, 1), 10)
+	}
+
+	return hex.EncodeToString(b[:])
+}
+
+// stream returns the session of a multiplexed stream of the session.
+func (s *Session) stream(id uint32) *Session {
+	return &Session{
+		ID:            s.ID + "/" + strconv.FormatUint(uint64(id), 10),
+		ClientAddr:    s.ClientAddr,
+		StartTime:     time.Now(),
+		correlationID: s.CorrelationID(),
+		proxyHeader:   s.ProxyHeader(),
+		user:          s.User(),
+		annotations:   s.Annotations(),
+	}
+}
+
+// CorrelationID returns the correlation ID of the session, see
+// SetCorrelationID.
+func (s *Session) CorrelationID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.correlationID
+}
+
+// SetCorrelationID sets an external ID of the session, e.g. a request
+// ID injected by a load balancer, which is logged and reported along
+// with the session ID. The streams of a multiplexed session inherit it.
+func (s *Session) SetCorrelationID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.correlationID = id
+}
+
+// ProxyHeader returns the PROXY protocol header the connection of the
+// session started with, or nil, see Options.ProxyProtocol.
+func (s *Session) ProxyHeader() *ProxyHeader {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.proxyHeader
+}
+
+func (s *Session) setProxyHeader(h *ProxyHeader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.proxyHeader = h
+}
+
+// User returns the authenticated identity of the session.
+func (s *Session) User() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.user
+}
+
+// SetUser sets the authenticated identity of the session. It is
+// typically called by an AuthenticateFunc after a successful
+// authentication.
+func (s *Session) SetUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.user = user
+}
+
+// DestAddr returns the destination address of the request of the
+// session.
+func (s *Session) DestAddr() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.destAddr
+}
+
+// SetDestAddr sets the destination address of the request of the
+// session. It is called once the request has been parsed.
+func (s *Session) SetDestAddr(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.destAddr = addr
+}
+
+// TargetAddr returns the remote address of the connection to the
+// target, e.g. the IP address a FQDN destination resolved to.
+func (s *Session) TargetAddr() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.targetAddr
+}
+
+// SetTargetAddr sets the remote address of the connection to the
+// target. It is called by handlers after connecting to the target.
+func (s *Session) SetTargetAddr(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.targetAddr = addr
+}
+
+// CloseReason returns the reason the session was closed for, or
+// CloseReasonUnknown while it is active.
+func (s *Session) CloseReason() CloseReason {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.closeReason
+}
+
+// setRequest records the request served by the session, which
+// Server.Revalidate evaluates again.
+func (s *Session) setRequest(req *Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.request = req
+}
+
+func (s *Session) servedRequest() *Request {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.request
+}
+
+// setCloseReason records the reason unless one has been recorded, so
+// that the cause of a close wins over its consequences.
+func (s *Session) setCloseReason(reason CloseReason) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closeReason == CloseReasonUnknown {
+		s.closeReason = reason
+	}
+}
+
+// Annotate sets the annotation key of the session to value. Earlier
+// stages of the pipeline, e.g. a Middleware or an AuthenticateFunc, can
+// attach annotations like the matched rule, a GeoIP country or a tenant
+// for later stages, the session logger, events and session records.
+// The streams of a multiplexed session inherit its annotations.
+func (s *Session) Annotate(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.annotations == nil {
+		s.annotations = make(map[string]string)
+	}
+
+	s.annotations[key] = value
+}
+
+// Annotation returns the annotation key of the session.
+func (s *Session) Annotation(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.annotations[key]
+
+	return value, ok
+}
+
+// Annotations returns a copy of the annotations of the session, or nil
+// if there are none.
+func (s *Session) Annotations() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.annotations) == 0 {
+		return nil
+	}
+
+	annotations := make(map[string]string, len(s.annotations))
+	for k, v := range s.annotations {
+		annotations[k] = v
+	}
+
+	return annotations
+}
+
+// BytesIn returns the number of bytes tunneled from the client to the
+// target. It is updated when a direction of the tunnel is closed, or
+// per datagram of a UDP association.
+func (s *Session) BytesIn() uint64 {
+	return atomic.LoadUint64(&s.bytesIn)
+}
+
+// BytesOut returns the number of bytes tunneled from the target to the
+// client. It is updated when a direction of the tunnel is closed, or
+// per datagram of a UDP association.
+func (s *Session) BytesOut() uint64 {
+	return atomic.LoadUint64(&s.bytesOut)
+}
+
+// UDPStats returns the counters of the UDP association of the session.
+func (s *Session) UDPStats() UDPStats {
+	return UDPStats{
+		DatagramsIn:  atomic.LoadUint64(&s.udp.datagramsIn),
+		DatagramsOut: atomic.LoadUint64(&s.udp.datagramsOut),
+		Dropped:      atomic.LoadUint64(&s.udp.dropped),
+	}
+}
+
+// countDatagram counts a relayed datagram with n payload bytes.
+func (s *Session) countDatagram(toClient bool, n int) {
+	if toClient {
+		atomic.AddUint64(&s.udp.datagramsOut, 1)
+		atomic.AddUint64(&s.bytesOut, uint64(n))
+	} else {
+		atomic.AddUint64(&s.udp.datagramsIn, 1)
+		atomic.AddUint64(&s.bytesIn, uint64(n))
+	}
+}
+
+type sessionKey struct{}
+
+// WithSession returns a copy of ctx carrying the session.
+func WithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// SessionFromContext returns the session stored in ctx, if any.
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	s, ok := ctx.Value(sessionKey{}).(*Session)
+	return s, ok
+}
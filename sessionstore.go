@@ -0,0 +1,76 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// SessionRecord is the record of a completed session.
+type SessionRecord struct {
+	ID         string
+	ClientAddr net.Addr
+	User       string
+	DestAddr   string
+	TargetAddr string
+	StartTime  time.Time
+	EndTime    time.Time
+
+	// BytesIn is the number of bytes tunneled from the client to the
+	// target, BytesOut from the target to the client.
+	BytesIn  uint64
+	BytesOut uint64
+
+	// CorrelationID is the correlation ID of the session, see
+	// Session.SetCorrelationID.
+	CorrelationID string
+
+	// Annotations are the annotations of the session, see
+	// Session.Annotate.
+	Annotations map[string]string
+
+	// Err is the error the session was closed with, if any.
+	Err error
+
+	// CloseReason is the reason the session was closed for.
+	CloseReason CloseReason
+}
+
+// Duration returns the duration of the session.
+func (r *SessionRecord) Duration() time.Duration {
+	return r.EndTime.Sub(r.StartTime)
+}
+
+// SessionStore persists the records of completed sessions, e.g. in a
+// database or by a webhook, for later forensics.
+type SessionStore interface {
+	// StoreSession stores the record. It is called after the
+	// connection of the session has been closed. A graceful shutdown
+	// waits for pending calls.
+	StoreSession(ctx context.Context, r *SessionRecord) error
+}
+
+// SessionStoreFunc is an adapter to use a function as a SessionStore.
+type SessionStoreFunc func(ctx context.Context, r *SessionRecord) error
+
+func (f SessionStoreFunc) StoreSession(ctx context.Context, r *SessionRecord) error {
+	return f(ctx, r)
+}
+
+func newSessionRecord(session *Session, err error) *SessionRecord {
+	return &SessionRecord{
+		ID:            session.ID,
+		ClientAddr:    session.ClientAddr,
+		User:          session.User(),
+		DestAddr:      session.DestAddr(),
+		TargetAddr:    session.TargetAddr(),
+		StartTime:     session.StartTime,
+		EndTime:       time.Now(),
+		BytesIn:       session.BytesIn(),
+		BytesOut:      session.BytesOut(),
+		Annotations:   session.Annotations(),
+		CorrelationID: session.CorrelationID(),
+		Err:           err,
+		CloseReason:   session.CloseReason(),
+	}
+}
@@ -0,0 +1,155 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionStore(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	records := make(chan *SessionRecord, 1)
+
+	server := New(func(o *Options) {
+		o.SessionStore = SessionStoreFunc(func(ctx context.Context, r *SessionRecord) error {
+			records <- r
+			return nil
+		})
+		o.Middlewares = []Middleware{func(next RequestHandler) RequestHandler {
+			return RequestHandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+				if session, ok := SessionFromContext(ctx); ok {
+					session.Annotate("tenant", "acme")
+				}
+
+				return next.ServeSOCKS(ctx, conn, req)
+			})
+		}}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	conn, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", testServer.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	request := "GET / HTTP/1.0\r\n\r\n"
+
+	_, err = conn.Write([]byte(request))
+	assert.NoError(t, err)
+
+	resp, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+
+	_ = conn.Close()
+
+	select {
+	case r := <-records:
+		assert.Equal(t, testServer.Listener.Addr().String(), r.DestAddr)
+		assert.Equal(t, testServer.Listener.Addr().String(), r.TargetAddr)
+		assert.Equal(t, uint64(len(request)), r.BytesIn)
+		assert.Equal(t, uint64(len(resp)), r.BytesOut)
+		assert.False(t, r.EndTime.Before(r.StartTime))
+		assert.Equal(t, map[string]string{"tenant": "acme"}, r.Annotations)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session record")
+	}
+}
+
+func TestSessionAnnotations(t *testing.T) {
+	session := newSession(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000})
+	assert.Nil(t, session.Annotations())
+
+	session.Annotate("rule", "office-hours")
+	session.Annotate("country", "DE")
+
+	value, ok := session.Annotation("rule")
+	assert.True(t, ok)
+	assert.Equal(t, "office-hours", value)
+
+	_, ok = session.Annotation("tenant")
+	assert.False(t, ok)
+
+	// Annotations returns a copy.
+	session.Annotations()["rule"] = "changed"
+	assert.Equal(t, map[string]string{"rule": "office-hours", "country": "DE"}, session.Annotations())
+
+	stream := session.stream(1)
+	stream.Annotate("country", "FR")
+	assert.Equal(t, map[string]string{"rule": "office-hours", "country": "FR"}, stream.Annotations())
+	assert.Equal(t, "DE", session.Annotations()["country"])
+
+	l := SessionLogger(nil, session).(*sessionLogger)
+	assert.Contains(t, l.fields(), ` country="DE" rule="office-hours"]`)
+}
+
+func TestSessionIDs(t *testing.T) {
+	t.Run("random", func(t *testing.T) {
+		ids := make(map[string]bool)
+
+		for i := 0; i < 1000; i++ {
+			id := newSession(nil).ID
+			assert.Len(t, id, 16)
+			assert.False(t, ids[id])
+
+			ids[id] = true
+		}
+	})
+
+	t.Run("correlation", func(t *testing.T) {
+		listen, err := net.Listen("tcp", "localhost:0")
+		assert.NoError(t, err)
+
+		defer listen.Close()
+
+		records := make(chan *SessionRecord, 1)
+
+		server := New(func(o *Options) {
+			o.CorrelationID = func(ctx context.Context, conn net.Conn) string {
+				info, ok := ConnInfoFromContext(ctx)
+				assert.True(t, ok)
+				assert.Equal(t, conn.RemoteAddr(), info.ClientAddr)
+
+				return "lb-42"
+			}
+			o.SessionStore = SessionStoreFunc(func(ctx context.Context, r *SessionRecord) error {
+				records <- r
+				return nil
+			})
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		sub := server.Subscribe(8)
+		defer sub.Unsubscribe()
+
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		e := <-sub.C
+		assert.Equal(t, "lb-42", e.CorrelationID)
+
+		r := <-records
+		assert.Equal(t, "lb-42", r.CorrelationID)
+		assert.Equal(t, e.SessionID, r.ID)
+
+		session := newSession(nil)
+		session.SetCorrelationID("lb-42")
+		assert.Equal(t, "lb-42", session.stream(1).CorrelationID())
+
+		l := SessionLogger(nil, session).(*sessionLogger)
+		assert.Contains(t, l.fields(), `[session=`+session.ID+` correlation="lb-42"`)
+	})
+}
@@ -0,0 +1,158 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by the Server's Serve and ListenAndServe
+// methods after a call to Shutdown, LameDuck or Close.
+var ErrServerClosed = errors.New("socks: Server closed")
+
+const shutdownPollInterval = 500 * time.Millisecond
+
+// DrainStatus describes the progress of a graceful shutdown.
+type DrainStatus struct {
+	// Remaining is the number of sessions still being served.
+	Remaining int
+
+	// OldestAge is the age of the oldest remaining session.
+	OldestAge time.Duration
+}
+
+// Shutdown gracefully shuts down the server without interrupting any
+// active sessions. It closes all listeners and then waits for the
+// sessions to finish, reporting the progress to Hooks.OnDrain. If ctx
+// expires first, Shutdown returns the context's error and the remaining
+// sessions can be terminated with Close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.LameDuck()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		status := s.DrainStatus()
+
+		s.hooks.drain(ctx, &status)
+
+		if status.Remaining == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// LameDuck stops accepting new connections while continuing to serve
+// the existing sessions indefinitely. It does not wait for the
+// sessions to finish.
+func (s *Server) LameDuck() {
+	atomic.StoreInt32(&s.inShutdown, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for l := range s.listeners {
+		_ = (*l).Close()
+	}
+}
+
+// Close immediately closes all listeners and active sessions.
+func (s *Server) Close() error {
+	s.LameDuck()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for session, conn := range s.sessions {
+		session.setCloseReason(CloseReasonShutdown)
+		_ = conn.Close()
+	}
+
+	return nil
+}
+
+// CloseSession closes the active session with the ID for the reason,
+// e.g. CloseReasonAdminKill, and reports whether it was found.
+func (s *Server) CloseSession(id string, reason CloseReason) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for session, conn := range s.sessions {
+		if session.ID == id {
+			session.setCloseReason(reason)
+			_ = conn.Close()
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// DrainStatus returns the number and the oldest age of the active
+// sessions.
+func (s *Server) DrainStatus() DrainStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := DrainStatus{
+		Remaining: len(s.sessions),
+	}
+
+	for session := range s.sessions {
+		if age := time.Since(session.StartTime); age > status.OldestAge {
+			status.OldestAge = age
+		}
+	}
+
+	return status
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+func (s *Server) trackListener(l *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listeners == nil {
+		s.listeners = make(map[*net.Listener]struct{})
+	}
+
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+
+	return true
+}
+
+func (s *Server) trackSession(session *Session, conn net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(map[*Session]net.Conn)
+	}
+
+	if add {
+		s.sessions[session] = conn
+	} else {
+		delete(s.sessions, session)
+	}
+}
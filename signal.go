@@ -0,0 +1,86 @@
+package socks
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+type SignalOptions struct {
+	// ShutdownTimeout specifies how long a graceful shutdown waits for
+	// the sessions before closing them. If zero, 30 seconds are used.
+	ShutdownTimeout time.Duration
+
+	// Reload specifies the optional function called on SIGHUP, e.g.
+	// Blocklist.Reload.
+	Reload func(ctx context.Context) error
+
+	// Revalidate specifies whether the live sessions are revalidated
+	// after a successful reload, see Server.Revalidate.
+	Revalidate bool
+}
+
+// HandleSignals shuts the server down gracefully on SIGINT or SIGTERM
+// and calls Reload on SIGHUP. It returns after the shutdown or when ctx
+// is done. Sessions remaining after the shutdown timeout are closed.
+func (s *Server) HandleSignals(ctx context.Context, optFns ...func(*SignalOptions)) error {
+	sigCh := make(chan os.Signal, 1)
+
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	return s.ServeSignals(ctx, sigCh, optFns...)
+}
+
+// ServeSignals is like HandleSignals, but reads the signals from sigCh,
+// e.g. the requests of a service manager translated to SIGTERM and
+// SIGHUP.
+func (s *Server) ServeSignals(ctx context.Context, sigCh <-chan os.Signal, optFns ...func(*SignalOptions)) error {
+	options := SignalOptions{
+		ShutdownTimeout: 30 * time.Second,
+	}
+
+	for _, fn := range optFns {
+		fn(&options)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				if options.Reload == nil {
+					continue
+				}
+
+				s.logInfof("Reloading on %v", sig)
+
+				if err := options.Reload(ctx); err != nil {
+					s.logErrorf("Failed to reload: %v", err)
+					continue
+				}
+
+				if options.Revalidate {
+					s.Revalidate(ctx)
+				}
+
+				continue
+			}
+
+			s.logInfof("Shutting down on %v", sig)
+
+			shutdownCtx, cancel := context.WithTimeout(ctx, options.ShutdownTimeout)
+			err := s.Shutdown(shutdownCtx)
+			cancel()
+
+			if err != nil {
+				_ = s.Close()
+			}
+
+			return err
+		}
+	}
+}
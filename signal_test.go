@@ -0,0 +1,42 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleSignals(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	server := New()
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		serveErr <- server.Serve(listen)
+	}()
+
+	sigCh := make(chan os.Signal, 2)
+	sigCh <- syscall.SIGHUP
+	sigCh <- syscall.SIGTERM
+
+	var reloads int
+
+	err = server.ServeSignals(context.Background(), sigCh, func(o *SignalOptions) {
+		o.ShutdownTimeout = time.Second
+		o.Reload = func(ctx context.Context) error {
+			reloads++
+			return nil
+		}
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, reloads)
+	assert.ErrorIs(t, <-serveErr, ErrServerClosed)
+}
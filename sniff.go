@@ -0,0 +1,141 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Protocol is a protocol detected by Conn.Sniff.
+type Protocol int
+
+const (
+	ProtocolUnknown Protocol = iota
+	ProtocolSocks4
+	ProtocolSocks5
+	ProtocolHTTP
+	ProtocolTLS
+
+	// ProtocolProxy is a PROXY protocol header of version 1 or 2.
+	ProtocolProxy
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolSocks4:
+		return "SOCKS4"
+	case ProtocolSocks5:
+		return "SOCKS5"
+	case ProtocolHTTP:
+		return "HTTP"
+	case ProtocolTLS:
+		return "TLS"
+	case ProtocolProxy:
+		return "PROXY"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Sniff detects the protocol from the initial bytes of the connection
+// without consuming them.
+func (c *Conn) Sniff() (Protocol, error) {
+	b, err := c.reader.Peek(1)
+	if err != nil {
+		return ProtocolUnknown, err
+	}
+
+	switch {
+	case Version(b[0]) == Socks4Version:
+		return ProtocolSocks4, nil
+	case Version(b[0]) == Socks5Version:
+		return ProtocolSocks5, nil
+	case b[0] == 0x16: // TLS handshake record
+		if ok, err := c.hasPrefix([]byte{0x16, 0x03}); ok || err != nil {
+			return ProtocolTLS, err
+		}
+	case b[0] == proxyV1Signature[0]:
+		if ok, err := c.hasPrefix(proxyV1Signature); ok || err != nil {
+			return ProtocolProxy, err
+		}
+
+		return ProtocolHTTP, nil
+	case b[0] == proxyV2Signature[0]:
+		if ok, err := c.hasPrefix(proxyV2Signature); ok || err != nil {
+			return ProtocolProxy, err
+		}
+	case b[0] >= 'A' && b[0] <= 'Z': // HTTP method
+		return ProtocolHTTP, nil
+	}
+
+	return ProtocolUnknown, nil
+}
+
+// hasPrefix reports whether the unread data starts with prefix. A
+// connection closed before len(prefix) bytes is no error.
+func (c *Conn) hasPrefix(prefix []byte) (bool, error) {
+	b, err := c.reader.Peek(len(prefix))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	return bytes.Equal(b, prefix), nil
+}
+
+// errShortMessage is returned by a peekBuffer when the peeked bytes do
+// not hold the whole message.
+var errShortMessage = errors.New("short message")
+
+// peekBuffer is a messageReader over peeked bytes.
+type peekBuffer struct {
+	b   []byte
+	off int
+}
+
+func (p *peekBuffer) Read(b []byte) (int, error) {
+	if p.off >= len(p.b) {
+		return 0, errShortMessage
+	}
+
+	n := copy(b, p.b[p.off:])
+	p.off += n
+
+	return n, nil
+}
+
+func (p *peekBuffer) ReadByte() (byte, error) {
+	if p.off >= len(p.b) {
+		return 0, errShortMessage
+	}
+
+	p.off++
+
+	return p.b[p.off-1], nil
+}
+
+func (p *peekBuffer) UnreadByte() error {
+	if p.off == 0 {
+		return errors.New("peekBuffer: UnreadByte at beginning")
+	}
+
+	p.off--
+
+	return nil
+}
+
+func (p *peekBuffer) ReadString(delim byte) (string, error) {
+	i := bytes.IndexByte(p.b[p.off:], delim)
+	if i < 0 {
+		return "", errShortMessage
+	}
+
+	s := string(p.b[p.off : p.off+i+1])
+	p.off += i + 1
+
+	return s, nil
+}
@@ -0,0 +1,70 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnSniff(t *testing.T) {
+	for input, expected := range map[string]Protocol{
+		"\x04\x01\x00\x50":             ProtocolSocks4,
+		"\x05\x01\x00":                 ProtocolSocks5,
+		"GET / HTTP/1.1\r\n":           ProtocolHTTP,
+		"POST / HTTP/1.1\r\n":          ProtocolHTTP,
+		"PROXY TCP4 192.0.2.1 ":        ProtocolProxy,
+		"\r\n\r\n\x00\r\nQUIT\n\x21":   ProtocolProxy,
+		"\x16\x03\x01\x02\x00\x01\x00": ProtocolTLS,
+		"\x00\x00":                     ProtocolUnknown,
+	} {
+		client, server := net.Pipe()
+
+		go func() {
+			_, _ = client.Write([]byte(input))
+			_ = client.Close()
+		}()
+
+		conn := NewConn(server)
+
+		protocol, err := conn.Sniff()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, protocol, input)
+
+		rest, err := io.ReadAll(conn.NetConn())
+		assert.NoError(t, err)
+		assert.Equal(t, input, string(rest))
+	}
+}
+
+func TestConnPeekMessage(t *testing.T) {
+	client, server := net.Pipe()
+
+	req := &Socks5Request{CMD: ConnectCommand, Addr: "example.com:443"}
+
+	b, err := req.MarshalBinary()
+	assert.NoError(t, err)
+
+	go func() {
+		// the message arrives in pieces and is followed by tunnel data
+		_, _ = client.Write(b[:3])
+		_, _ = client.Write(b[3:7])
+		_, _ = client.Write(append(b[7:], "early"...))
+		_ = client.Close()
+	}()
+
+	conn := NewConn(server)
+
+	peeked := &Socks5Request{}
+	assert.NoError(t, conn.PeekMessage(peeked))
+	assert.Equal(t, req, peeked)
+
+	read := &Socks5Request{}
+	assert.NoError(t, conn.Read(read))
+	assert.Equal(t, req, read)
+
+	rest, err := io.ReadAll(conn.NetConn())
+	assert.NoError(t, err)
+	assert.Equal(t, "early", string(rest))
+}
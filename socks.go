@@ -3,7 +3,7 @@ package socks
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
+	"encoding"
 	"errors"
 	"fmt"
 	"io"
@@ -19,12 +19,37 @@ const (
 	Socks5Version Version = 0x05
 )
 
+func (v Version) String() string {
+	switch v {
+	case Socks4Version:
+		return "SOCKS4"
+	case Socks5Version:
+		return "SOCKS5"
+	default:
+		return "unknown version: " + strconv.Itoa(int(v))
+	}
+}
+
 type Command uint8
 
 const (
 	ConnectCommand   Command = 0x01
 	BindCommand      Command = 0x02
 	AssociateCommand Command = 0x03
+
+	// MultiplexCommand is a non-standard command of this package which
+	// turns the connection into a session of multiplexed CONNECT
+	// streams, see Options.Multiplex and MultiplexDialer.
+	MultiplexCommand Command = 0xf0
+
+	// UDPOverTCPCommand is a non-standard command of this package which
+	// associates a UDP relay like ASSOCIATE, but carries the datagrams
+	// over the connection of the request, e.g. for networks which block
+	// UDP between the client and the proxy. Each datagram is framed by
+	// its length as 2 bytes in network byte order followed by the UDP
+	// request header and the data. See UDPOptions.OverTCP and
+	// Socks5DialerOptions.UDPOverTCP.
+	UDPOverTCPCommand Command = 0xf1
 )
 
 func (cmd Command) String() string {
@@ -35,11 +60,26 @@ func (cmd Command) String() string {
 		return "socks bind"
 	case AssociateCommand:
 		return "socks associate"
+	case MultiplexCommand:
+		return "socks multiplex"
+	case UDPOverTCPCommand:
+		return "socks udp over tcp"
 	default:
 		return "socks " + strconv.Itoa(int(cmd))
 	}
 }
 
+// acceptsZeroPort reports whether the address of a request of cmd may
+// have port 0, e.g. an ASSOCIATE whose client does not know its port yet.
+func (cmd Command) acceptsZeroPort() bool {
+	switch cmd {
+	case BindCommand, AssociateCommand, UDPOverTCPCommand, MultiplexCommand:
+		return true
+	default:
+		return false
+	}
+}
+
 type Socks4Status uint8
 
 const (
@@ -103,10 +143,17 @@ func (code Socks5Status) String() string {
 	}
 }
 
+// IdentFunc verifies the user ID of a SOCKS4 request. A returned error
+// rejects the request, with the status of an *IdentError if any. On a
+// server, the context carries the Session and the ConnInfo.
 type IdentFunc func(context.Context, *Conn, *Socks4Request) error
 
 type AddrType uint8
 
+// addrTypeExpected is the expectation of the ProtocolError of an unknown
+// address type.
+const addrTypeExpected = "address type 1, 3 or 4"
+
 const (
 	AddrTypeIPv4 AddrType = 0x01 // IPv4
 	AddrTypeFQDN AddrType = 0x03 // FQDN
@@ -128,6 +175,25 @@ const (
 	AuthMethodNoAcceptableMethods AuthMethod = 0xff // no acceptable authentication methods
 )
 
+func (am AuthMethod) String() string {
+	switch am {
+	case AuthMethodNotRequired:
+		return "no authentication required"
+	case AuthMethodGSSAPI:
+		return "GSSAPI"
+	case AuthMethodUsernamePassword:
+		return "username/password"
+	case AuthMethodResumption:
+		return "resumption"
+	case AuthMethodNotice:
+		return "notice"
+	case AuthMethodNoAcceptableMethods:
+		return "no acceptable methods"
+	default:
+		return "unknown method: " + strconv.Itoa(int(am))
+	}
+}
+
 type AuthStatus uint8
 
 const (
@@ -135,6 +201,20 @@ const (
 	AuthStatusFailure AuthStatus = 0xff
 )
 
+func (status AuthStatus) String() string {
+	if status == AuthStatusSuccess {
+		return "success"
+	}
+
+	// A status other than X'00' indicates a failure.
+	return "failure"
+}
+
+// AuthenticateFunc performs the subnegotiation of the selected method.
+// On a server, the context carries the Session and the ConnInfo, e.g.
+// to pin credentials to client addresses. It should return once the
+// context is done, e.g. by passing it to the authentication backend; a
+// server abandons calls exceeding Options.AuthTimeout.
 type AuthenticateFunc func(context.Context, *Conn, AuthMethod) error
 
 type Socks4Request struct {
@@ -143,20 +223,35 @@ type Socks4Request struct {
 	UserID string
 }
 
+func (req *Socks4Request) String() string {
+	return fmt.Sprintf("SOCKS4 request cmd=%q addr=%s userid=%q", req.CMD, req.Addr, req.UserID)
+}
+
 func (req *Socks4Request) MarshalBinary() ([]byte, error) {
 	b := []byte{byte(Socks4Version), byte(req.CMD)}
 
-	host, port, err := splitHostPort(req.Addr)
+	split := splitHostPort
+	if req.CMD.acceptsZeroPort() {
+		split = splitHostAnyPort
+	}
+
+	host, port, err := split(req.Addr)
 	if err != nil {
 		return nil, err
 	}
 
+	if hasZone(host) {
+		return nil, &ZoneError{Addr: req.Addr}
+	}
+
 	dstIP := make([]byte, 4)
 
 	var domain string
 
 	if ip := net.ParseIP(host); ip != nil {
-		dstIP = ip.To4()
+		if dstIP = ip.To4(); dstIP == nil {
+			return nil, &Socks4AddrError{Addr: req.Addr}
+		}
 	} else {
 		dstIP[0] = 0
 		dstIP[1] = 0
@@ -185,39 +280,41 @@ func (req *Socks4Request) MarshalBinary() ([]byte, error) {
 }
 
 func (req *Socks4Request) UnmarshalBinary(p []byte) error {
-	r := bytes.NewBuffer(p)
+	return req.decode(bytes.NewBuffer(p))
+}
 
+func (req *Socks4Request) decode(r messageReader) error {
 	version := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+	if err := readField(r, "SOCKS4 request", "VN", version); err != nil {
 		return err
 	}
 
 	if Version(version[0]) != Socks4Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", version[0])
+		return versionError("SOCKS4 request", byte(Socks4Version), version[0])
 	}
 
 	cmd := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &cmd); err != nil {
+	if err := readField(r, "SOCKS4 request", "CD", cmd); err != nil {
 		return err
 	}
 
 	req.CMD = Command(cmd[0])
 
 	port := make([]byte, 2)
-	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+	if err := readField(r, "SOCKS4 request", "DSTPORT", port); err != nil {
 		return err
 	}
 
 	portNum := (int(port[0]) << 8) | int(port[1])
 
 	ip := make(net.IP, 4)
-	if err := binary.Read(r, binary.BigEndian, &ip); err != nil {
+	if err := readField(r, "SOCKS4 request", "DSTIP", ip); err != nil {
 		return err
 	}
 
 	userID, err := r.ReadString(0)
 	if err != nil {
-		return err
+		return fieldError("SOCKS4 request", "USERID", err)
 	}
 
 	req.UserID = strings.TrimSuffix(userID, "\x00")
@@ -229,7 +326,7 @@ func (req *Socks4Request) UnmarshalBinary(p []byte) error {
 	if socks4a {
 		domain, err := r.ReadString(0)
 		if err != nil {
-			return err
+			return fieldError("SOCKS4 request", "HOSTNAME", err)
 		}
 
 		req.Addr = net.JoinHostPort(strings.TrimSuffix(domain, "\x00"), strconv.Itoa(portNum))
@@ -243,54 +340,137 @@ type Socks4Response struct {
 	Addr   string
 }
 
+func (resp *Socks4Response) String() string {
+	return fmt.Sprintf("SOCKS4 reply status=%q addr=%s", resp.Status, resp.Addr)
+}
+
+// socks4ResponseLen is the length of a SOCKS4 reply.
+const socks4ResponseLen = 8
+
+// socks4ResponseFields are the fields of a SOCKS4 reply in order.
+var socks4ResponseFields = []struct {
+	name string
+	len  int
+}{
+	{"VN", 1},
+	{"CD", 1},
+	{"DSTPORT", 2},
+	{"DSTIP", 4},
+}
+
 func (resp *Socks4Response) MarshalBinary() ([]byte, error) {
 	b := []byte{0, byte(resp.Status)}
 
+	// The reply is always 8 bytes long, DSTPORT and DSTIP are zero if
+	// no address is given.
 	if resp.Addr == "" {
-		return b, nil
+		return append(b, 0, 0, 0, 0, 0, 0), nil
 	}
 
-	host, port, err := splitHostPort(resp.Addr)
+	host, port, err := splitHostAnyPort(resp.Addr)
 	if err != nil {
 		return nil, err
 	}
 
 	b = append(b, byte(port>>8), byte(port))
 
+	// DSTIP is zero for host names, e.g. the FQDN of a SOCKS4a request,
+	// and the unspecified address, to keep the reply 8 bytes long.
 	ip := net.ParseIP(host)
 
-	b = append(b, ip.To4()...)
+	switch {
+	case ip == nil || ip.IsUnspecified():
+		b = append(b, 0, 0, 0, 0)
+	case ip.To4() != nil:
+		b = append(b, ip.To4()...)
+	default:
+		return nil, &Socks4AddrError{Addr: resp.Addr}
+	}
 
 	return b, nil
 }
 
-func (resp *Socks4Response) UnmarshalBinary(p []byte) error {
-	r := bytes.NewBuffer(p[1:]) // ignore version
+// NewGrantedReply returns a reply granting req in the format of its
+// version, e.g. for custom command handlers and middlewares. addr is
+// BND.ADDR, e.g. the address of a BIND socket; if empty, zeros are
+// replied. A SOCKS4 reply carries zeros for host names and fails to
+// marshal with a *Socks4AddrError for IPv6 addresses.
+func NewGrantedReply(req *Request, addr string) encoding.BinaryMarshaler {
+	if req.Version == Socks4Version {
+		return &Socks4Response{Status: Socks4StatusGranted, Addr: addr}
+	}
 
-	status := make([]byte, 1)
+	return &Socks5Response{Status: Socks5StatusGranted, Addr: addr}
+}
 
-	if err := binary.Read(r, binary.BigEndian, &status); err != nil {
-		return err
+// NewDenyReply returns a reply denying req with status in the format of
+// its version. SOCKS4 knows no reasons, so SOCKS4 requests are denied
+// with Socks4StatusRejected.
+func NewDenyReply(req *Request, status Socks5Status) encoding.BinaryMarshaler {
+	if req.Version == Socks4Version {
+		return &Socks4Response{Status: Socks4StatusRejected}
 	}
 
-	resp.Status = Socks4Status(status[0])
+	return &Socks5Response{Status: status}
+}
 
-	if len(p) > 2 {
-		port := make([]byte, 2)
-		if err := binary.Read(r, binary.BigEndian, &port); err != nil {
-			return err
+// NewSocks4Rejection returns a rejection reply to req. If echoAddr is
+// true, the reply carries DSTPORT and DSTIP of the request, which some
+// clients expect, instead of zeros.
+func NewSocks4Rejection(req *Request, echoAddr bool) *Socks4Response {
+	resp := &Socks4Response{
+		Status: Socks4StatusRejected,
+	}
+
+	if echoAddr {
+		if host, _, err := splitHostPort(req.Addr); err == nil && !isIPv6(host) {
+			resp.Addr = req.Addr
 		}
+	}
+
+	return resp
+}
+
+func (resp *Socks4Response) UnmarshalBinary(p []byte) error {
+	return resp.decode(bytes.NewBuffer(p))
+}
 
-		portNum := (int(port[0]) << 8) | int(port[1])
+func (resp *Socks4Response) decode(r messageReader) error {
+	b := make([]byte, socks4ResponseLen)
+
+	n := 0
+	for _, field := range socks4ResponseFields {
+		if err := readField(r, "SOCKS4 reply", field.name, b[n:n+field.len]); err != nil {
+			// The reply is always 8 bytes long, a shorter one is malformed.
+			if (err == io.EOF && n > 0) || err == io.ErrUnexpectedEOF {
+				return newProtocolError("SOCKS4 reply", field.name, "end of reply", b[:n])
+			}
 
-		ip := make(net.IP, 4)
-		if err := binary.Read(r, binary.BigEndian, &ip); err != nil {
 			return err
 		}
 
-		resp.Addr = net.JoinHostPort(ip.String(), strconv.Itoa(portNum))
+		n += field.len
+	}
+
+	// The reply version is 0, not the SOCKS version, but some servers
+	// reply with 4. Anything else, e.g. a SOCKS5 reply, is rejected.
+	if b[0] != 0 && b[0] != byte(Socks4Version) {
+		return newProtocolError("SOCKS4 reply", "version 0 or 4", fmt.Sprintf("version %d", b[0]), b)
+	}
+
+	resp.Status = Socks4Status(b[1])
+
+	portNum := (int(b[2]) << 8) | int(b[3])
+
+	ip := net.IP(b[4:8])
+
+	if portNum == 0 && ip.IsUnspecified() {
+		resp.Addr = ""
+		return nil
 	}
 
+	resp.Addr = net.JoinHostPort(ip.String(), strconv.Itoa(portNum))
+
 	return nil
 }
 
@@ -298,6 +478,15 @@ type MethodSelectRequest struct {
 	Methods []AuthMethod
 }
 
+func (req *MethodSelectRequest) String() string {
+	methods := make([]string, 0, len(req.Methods))
+	for _, m := range req.Methods {
+		methods = append(methods, m.String())
+	}
+
+	return fmt.Sprintf("SOCKS5 method selection methods=[%s]", strings.Join(methods, ", "))
+}
+
 func (req *MethodSelectRequest) MarshalBinary() ([]byte, error) {
 	b := []byte{byte(Socks5Version), byte(len(req.Methods))}
 
@@ -309,29 +498,32 @@ func (req *MethodSelectRequest) MarshalBinary() ([]byte, error) {
 }
 
 func (req *MethodSelectRequest) UnmarshalBinary(p []byte) error {
-	r := bytes.NewBuffer(p)
+	return req.decode(bytes.NewBuffer(p))
+}
 
+func (req *MethodSelectRequest) decode(r messageReader) error {
 	version := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+	if err := readField(r, "SOCKS5 method selection request", "VER", version); err != nil {
 		return err
 	}
 
 	if Version(version[0]) != Socks5Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", version[0])
+		return versionError("SOCKS5 method selection request", byte(Socks5Version), version[0])
 	}
 
 	number := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &number); err != nil {
+	if err := readField(r, "SOCKS5 method selection request", "NMETHODS", number); err != nil {
 		return err
 	}
 
 	methods := make([]byte, int(number[0]))
-	if err := binary.Read(r, binary.BigEndian, &methods); err != nil {
+	if err := readField(r, "SOCKS5 method selection request", "METHODS", methods); err != nil {
 		return err
 	}
 
-	for _, m := range methods {
-		req.Methods = append(req.Methods, AuthMethod(m))
+	req.Methods = make([]AuthMethod, len(methods))
+	for i, m := range methods {
+		req.Methods[i] = AuthMethod(m)
 	}
 
 	return nil
@@ -341,24 +533,30 @@ type MethodSelectResponse struct {
 	Method AuthMethod
 }
 
+func (resp *MethodSelectResponse) String() string {
+	return fmt.Sprintf("SOCKS5 method selection reply method=%q", resp.Method)
+}
+
 func (resp *MethodSelectResponse) MarshalBinary() ([]byte, error) {
 	return []byte{byte(Socks5Version), byte(resp.Method)}, nil
 }
 
 func (resp *MethodSelectResponse) UnmarshalBinary(p []byte) error {
-	r := bytes.NewBuffer(p)
+	return resp.decode(bytes.NewBuffer(p))
+}
 
+func (resp *MethodSelectResponse) decode(r messageReader) error {
 	version := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+	if err := readField(r, "SOCKS5 method selection reply", "VER", version); err != nil {
 		return err
 	}
 
 	if Version(version[0]) != Socks5Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", version[0])
+		return versionError("SOCKS5 method selection reply", byte(Socks5Version), version[0])
 	}
 
 	method := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &method); err != nil {
+	if err := readField(r, "SOCKS5 method selection reply", "METHOD", method); err != nil {
 		return err
 	}
 
@@ -372,7 +570,27 @@ type UsernamePasswordAuthRequest struct {
 	Password string
 }
 
+// String returns a description of the request with the password
+// redacted.
+func (req *UsernamePasswordAuthRequest) String() string {
+	return fmt.Sprintf("username/password auth request username=%q password=<redacted>", req.Username)
+}
+
+// maxCredentialLen is the maximum length of ULEN and PLEN.
+const maxCredentialLen = 0xff
+
+// MarshalBinary fails with a *CredentialLengthError if the username or
+// the password is longer than 255 bytes. Empty credentials are encoded,
+// although RFC 1929 requires at least one byte.
 func (req *UsernamePasswordAuthRequest) MarshalBinary() ([]byte, error) {
+	if len(req.Username) > maxCredentialLen {
+		return nil, &CredentialLengthError{Field: "UNAME", Length: len(req.Username), Max: maxCredentialLen}
+	}
+
+	if len(req.Password) > maxCredentialLen {
+		return nil, &CredentialLengthError{Field: "PASSWD", Length: len(req.Password), Max: maxCredentialLen}
+	}
+
 	b := []byte{byte(UsernamePasswordAuthVersion1)}
 
 	b = append(b, byte(len(req.Username)))
@@ -385,35 +603,37 @@ func (req *UsernamePasswordAuthRequest) MarshalBinary() ([]byte, error) {
 }
 
 func (req *UsernamePasswordAuthRequest) UnmarshalBinary(p []byte) error {
-	r := bytes.NewBuffer(p)
+	return req.decode(bytes.NewBuffer(p))
+}
 
+func (req *UsernamePasswordAuthRequest) decode(r messageReader) error {
 	version := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+	if err := readField(r, "username/password auth request", "VER", version); err != nil {
 		return err
 	}
 
 	if UsernamePasswordAuthVersion(version[0]) != UsernamePasswordAuthVersion1 {
-		return fmt.Errorf("unsupported username password version: %d", version[0])
+		return versionError("username/password auth request", byte(UsernamePasswordAuthVersion1), version[0])
 	}
 
 	length := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+	if err := readField(r, "username/password auth request", "ULEN", length); err != nil {
 		return err
 	}
 
 	username := make([]byte, length[0])
-	if err := binary.Read(r, binary.BigEndian, &username); err != nil {
+	if err := readField(r, "username/password auth request", "UNAME", username); err != nil {
 		return err
 	}
 
-	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+	if err := readField(r, "username/password auth request", "PLEN", length); err != nil {
 		return err
 	}
 
 	req.Username = string(username)
 
 	password := make([]byte, length[0])
-	if err := binary.Read(r, binary.BigEndian, &password); err != nil {
+	if err := readField(r, "username/password auth request", "PASSWD", password); err != nil {
 		return err
 	}
 
@@ -422,28 +642,77 @@ func (req *UsernamePasswordAuthRequest) UnmarshalBinary(p []byte) error {
 	return nil
 }
 
+// CredentialLimits specifies the accepted lengths of the credentials of
+// the username/password requests read by a server.
+type CredentialLimits struct {
+	// MaxUsername and MaxPassword specify the maximum lengths in bytes.
+	// If zero, the maximum of RFC 1929, 255, is used.
+	MaxUsername int
+	MaxPassword int
+
+	// RejectEmpty specifies whether empty usernames and passwords are
+	// rejected, as required by RFC 1929. Some clients send an empty
+	// password, e.g. with a token as the username.
+	RejectEmpty bool
+}
+
+// check returns a *CredentialLengthError if the credentials of req
+// exceed the limits.
+func (l *CredentialLimits) check(req *UsernamePasswordAuthRequest) error {
+	min := 0
+	if l.RejectEmpty {
+		min = 1
+	}
+
+	for _, field := range []struct {
+		name   string
+		length int
+		max    int
+	}{
+		{"UNAME", len(req.Username), l.MaxUsername},
+		{"PASSWD", len(req.Password), l.MaxPassword},
+	} {
+		max := field.max
+		if max <= 0 || max > maxCredentialLen {
+			max = maxCredentialLen
+		}
+
+		if field.length < min || field.length > max {
+			return &CredentialLengthError{Field: field.name, Length: field.length, Min: min, Max: max}
+		}
+	}
+
+	return nil
+}
+
 type UsernamePasswordAuthResponse struct {
 	Status AuthStatus
 }
 
+func (resp *UsernamePasswordAuthResponse) String() string {
+	return fmt.Sprintf("username/password auth reply status=%s", resp.Status)
+}
+
 func (resp *UsernamePasswordAuthResponse) MarshalBinary() ([]byte, error) {
 	return []byte{byte(UsernamePasswordAuthVersion1), byte(resp.Status)}, nil
 }
 
 func (resp *UsernamePasswordAuthResponse) UnmarshalBinary(p []byte) error {
-	r := bytes.NewBuffer(p)
+	return resp.decode(bytes.NewBuffer(p))
+}
 
+func (resp *UsernamePasswordAuthResponse) decode(r messageReader) error {
 	version := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+	if err := readField(r, "username/password auth reply", "VER", version); err != nil {
 		return err
 	}
 
 	if UsernamePasswordAuthVersion(version[0]) != UsernamePasswordAuthVersion1 {
-		return fmt.Errorf("unsupported username password version: %d", version[0])
+		return versionError("username/password auth reply", byte(UsernamePasswordAuthVersion1), version[0])
 	}
 
 	status := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &status); err != nil {
+	if err := readField(r, "username/password auth reply", "STATUS", status); err != nil {
 		return err
 	}
 
@@ -455,64 +724,60 @@ func (resp *UsernamePasswordAuthResponse) UnmarshalBinary(p []byte) error {
 type Socks5Request struct {
 	CMD  Command
 	Addr string
+
+	// LiteralAsFQDN specifies whether an IP literal in Addr is encoded
+	// as AddrTypeFQDN instead of AddrTypeIPv4 or AddrTypeIPv6, so that
+	// the proxy only sees names. It is not set by UnmarshalBinary.
+	LiteralAsFQDN bool
+}
+
+func (req *Socks5Request) String() string {
+	return fmt.Sprintf("SOCKS5 request cmd=%q addr=%s", req.CMD, req.Addr)
 }
 
 func (req *Socks5Request) MarshalBinary() ([]byte, error) {
 	b := []byte{byte(Socks5Version), byte(req.CMD), 0}
 
-	host, port, err := splitHostPort(req.Addr)
-	if err != nil {
-		return nil, err
-	}
-
-	if ip := net.ParseIP(host); ip != nil {
-		if ip4 := ip.To4(); ip4 != nil {
-			b = append(b, byte(AddrTypeIPv4))
-			b = append(b, ip4...)
-		} else if ip6 := ip.To16(); ip6 != nil {
-			b = append(b, byte(AddrTypeIPv6))
-			b = append(b, ip6...)
-		} else {
-			return nil, errors.New("unknown address type")
-		}
-	} else {
-		if len(host) > 255 {
-			return nil, errors.New("FQDN too long")
+	// A CONNECT to a Unix domain socket has no port, see UnixSocketAddr.
+	if _, unix := unixSocketPath(req.Addr); !unix && !req.CMD.acceptsZeroPort() {
+		if _, _, err := splitHostPort(req.Addr); err != nil {
+			return nil, err
 		}
-		b = append(b, byte(AddrTypeFQDN))
-		b = append(b, byte(len(host)))
-		b = append(b, host...)
 	}
 
-	b = append(b, byte(port>>8), byte(port))
+	if req.LiteralAsFQDN {
+		return appendFQDN(b, "SOCKS5 request", req.Addr)
+	}
 
-	return b, nil
+	return appendAddr(b, "SOCKS5 request", req.Addr)
 }
 
 func (req *Socks5Request) UnmarshalBinary(p []byte) error {
-	r := bytes.NewBuffer(p)
+	return req.decode(bytes.NewBuffer(p))
+}
 
+func (req *Socks5Request) decode(r messageReader) error {
 	version := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+	if err := readField(r, "SOCKS5 request", "VER", version); err != nil {
 		return err
 	}
 
 	if Version(version[0]) != Socks5Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", version[0])
+		return versionError("SOCKS5 request", byte(Socks5Version), version[0])
 	}
 
 	cmd := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &cmd); err != nil {
+	if err := readField(r, "SOCKS5 request", "CMD", cmd); err != nil {
 		return err
 	}
 
 	req.CMD = Command(cmd[0])
 
 	if _, err := r.ReadByte(); err != nil { // null byte
-		return err
+		return fieldError("SOCKS5 request", "RSV", err)
 	}
 
-	addr, err := readAddr(r)
+	addr, err := readAddr(r, "SOCKS5 request")
 	if err != nil {
 		return err
 	}
@@ -527,26 +792,39 @@ type Socks5Response struct {
 	Addr   string
 }
 
+func (resp *Socks5Response) String() string {
+	return fmt.Sprintf("SOCKS5 reply status=%q addr=%s", resp.Status, resp.Addr)
+}
+
 func (resp *Socks5Response) MarshalBinary() ([]byte, error) {
 	b := []byte{byte(Socks5Version), byte(resp.Status), 0}
 
+	// BND.ADDR and BND.PORT are always present, the unspecified address
+	// stands for no address.
 	if resp.Addr == "" {
-		return b, nil
+		return append(b, byte(AddrTypeIPv4), 0, 0, 0, 0, 0, 0), nil
 	}
 
-	host, port, err := splitHostPort(resp.Addr)
+	host, port, err := splitHostAnyPort(resp.Addr)
 	if err != nil {
 		return nil, err
 	}
 
+	// The zone of a bound link-local address is meaningless to the client.
+	host, _ = stripZone(host)
+
 	ip := net.ParseIP(host)
 
+	if ip == nil {
+		return appendFQDN(b, "SOCKS5 reply", resp.Addr)
+	}
+
 	if ip4 := ip.To4(); ip4 != nil {
 		b = append(b, byte(AddrTypeIPv4))
 		b = append(b, ip4...)
-	} else if ip6 := ip.To16(); ip6 != nil {
+	} else {
 		b = append(b, byte(AddrTypeIPv6))
-		b = append(b, ip6...)
+		b = append(b, ip.To16()...)
 	}
 
 	b = append(b, byte(port>>8), byte(port))
@@ -555,20 +833,22 @@ func (resp *Socks5Response) MarshalBinary() ([]byte, error) {
 }
 
 func (resp *Socks5Response) UnmarshalBinary(p []byte) error {
-	r := bytes.NewBuffer(p)
+	return resp.decode(bytes.NewBuffer(p))
+}
 
+func (resp *Socks5Response) decode(r messageReader) error {
 	version := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+	if err := readField(r, "SOCKS5 reply", "VER", version); err != nil {
 		return err
 	}
 
 	if Version(version[0]) != Socks5Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", version[0])
+		return versionError("SOCKS5 reply", byte(Socks5Version), version[0])
 	}
 
 	status := make([]byte, 1)
 
-	if err := binary.Read(r, binary.BigEndian, &status); err != nil {
+	if err := readField(r, "SOCKS5 reply", "REP", status); err != nil {
 		return err
 	}
 
@@ -576,21 +856,166 @@ func (resp *Socks5Response) UnmarshalBinary(p []byte) error {
 
 	_, _ = r.ReadByte() // ignore null byte
 
-	if len(p) > 3 {
-		addr, err := readAddr(r)
-		if err != nil {
-			return err
+	if _, err := r.ReadByte(); err != nil {
+		if err == io.EOF {
+			return nil
 		}
 
-		resp.Addr = addr
+		return err
 	}
 
+	_ = r.UnreadByte()
+
+	addr, err := readAddr(r, "SOCKS5 reply")
+	if err != nil {
+		return err
+	}
+
+	if addr == "0.0.0.0:0" {
+		addr = ""
+	}
+
+	resp.Addr = addr
+
 	return nil
 }
 
-func readAddr(r io.Reader) (string, error) {
+type UDPDatagram struct {
+	Frag uint8
+	Addr string
+	Data []byte
+}
+
+func (d *UDPDatagram) String() string {
+	return fmt.Sprintf("SOCKS5 UDP datagram frag=%d addr=%s len=%d", d.Frag, d.Addr, len(d.Data))
+}
+
+func (d *UDPDatagram) MarshalBinary() ([]byte, error) {
+	b := []byte{0, 0, d.Frag}
+
+	if _, _, err := splitHostPort(d.Addr); err != nil {
+		return nil, err
+	}
+
+	b, err := appendAddr(b, "SOCKS5 UDP datagram", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, d.Data...), nil
+}
+
+func (d *UDPDatagram) UnmarshalBinary(p []byte) error {
+	return d.decode(bytes.NewBuffer(p))
+}
+
+func (d *UDPDatagram) decode(r messageReader) error {
+	header := make([]byte, 3)
+	if err := readField(r, "SOCKS5 UDP datagram", "RSV", header); err != nil {
+		return err
+	}
+
+	d.Frag = header[2]
+
+	addr, err := readAddr(r, "SOCKS5 UDP datagram")
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	d.Addr = addr
+	d.Data = data
+
+	return nil
+}
+
+// messageReader is implemented by bytes.Buffer and bufio.Reader.
+type messageReader interface {
+	io.Reader
+	io.ByteScanner
+	ReadString(delim byte) (string, error)
+}
+
+// appendAddr appends addr to the message of phase.
+func appendAddr(b []byte, phase, addr string) ([]byte, error) {
+	host, port, err := splitHostAnyPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hasZone(host) {
+		return nil, &ZoneError{Addr: addr}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, byte(AddrTypeIPv4))
+			b = append(b, ip4...)
+		} else if ip6 := ip.To16(); ip6 != nil {
+			b = append(b, byte(AddrTypeIPv6))
+			b = append(b, ip6...)
+		} else {
+			return nil, newProtocolError(phase, "IPv4 or IPv6 address", fmt.Sprintf("%q", host), nil)
+		}
+	} else {
+		return appendFQDN(b, phase, addr)
+	}
+
+	b = append(b, byte(port>>8), byte(port))
+
+	return b, nil
+}
+
+// appendFQDN appends addr with AddrTypeFQDN, even if its host is an IP
+// literal. An IPv6 literal is sent without brackets.
+func appendFQDN(b []byte, phase, addr string) ([]byte, error) {
+	host, port, err := splitHostAnyPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hasZone(host) {
+		return nil, &ZoneError{Addr: addr}
+	}
+
+	if len(host) > 255 {
+		return nil, newProtocolError(phase, "FQDN of at most 255 bytes", fmt.Sprintf("%d bytes", len(host)), nil)
+	}
+
+	b = append(b, byte(AddrTypeFQDN))
+	b = append(b, byte(len(host)))
+	b = append(b, host...)
+	b = append(b, byte(port>>8), byte(port))
+
+	return b, nil
+}
+
+// readField reads the field of a message of phase into b. A timeout,
+// e.g. because the handshake deadline passed while a client trickles its
+// message, is reported as a *NegotiationTimeoutError naming the field.
+func readField(r io.Reader, phase, field string, b []byte) error {
+	_, err := io.ReadFull(r, b)
+	return fieldError(phase, field, err)
+}
+
+// fieldError returns err, or a *NegotiationTimeoutError if err is a
+// timeout while reading field.
+func fieldError(phase, field string, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &NegotiationTimeoutError{Phase: phase, Field: field, Err: err}
+	}
+
+	return err
+}
+
+func readAddr(r io.Reader, phase string) (string, error) {
 	atype := make([]byte, 1)
-	if err := binary.Read(r, binary.BigEndian, &atype); err != nil {
+	if err := readField(r, phase, "ATYP", atype); err != nil {
 		return "", err
 	}
 
@@ -599,36 +1024,36 @@ func readAddr(r io.Reader) (string, error) {
 	switch AddrType(atype[0]) {
 	case AddrTypeIPv4:
 		ip := make(net.IP, net.IPv4len)
-		if err := binary.Read(r, binary.BigEndian, &ip); err != nil {
+		if err := readField(r, phase, "ADDR", ip); err != nil {
 			return "", err
 		}
 
 		host = ip.String()
 	case AddrTypeIPv6:
 		ip := make(net.IP, net.IPv6len)
-		if err := binary.Read(r, binary.BigEndian, &ip); err != nil {
+		if err := readField(r, phase, "ADDR", ip); err != nil {
 			return "", err
 		}
 
 		host = ip.String()
 	case AddrTypeFQDN:
 		length := make([]byte, 1)
-		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		if err := readField(r, phase, "ADDR", length); err != nil {
 			return "", err
 		}
 
 		fqdn := make([]byte, length[0])
-		if err := binary.Read(r, binary.BigEndian, &fqdn); err != nil {
+		if err := readField(r, phase, "ADDR", fqdn); err != nil {
 			return "", err
 		}
 
 		host = string(fqdn)
 	default:
-		return "", fmt.Errorf("unknown address type %x", atype[0])
+		return "", newProtocolError(phase, addrTypeExpected, fmt.Sprintf("address type %d", atype[0]), atype)
 	}
 
 	port := make([]byte, 2)
-	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+	if err := readField(r, phase, "PORT", port); err != nil {
 		return "", err
 	}
 
@@ -637,19 +1062,54 @@ func readAddr(r io.Reader) (string, error) {
 	return net.JoinHostPort(host, strconv.Itoa(portNum)), nil
 }
 
+// isIPv6 reports whether host is an IPv6 address other than the
+// unspecified address and IPv4-mapped addresses.
+func isIPv6(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil && !ip.IsUnspecified()
+}
+
+// hasZone reports whether host is an IPv6 address with a zone identifier.
+func hasZone(host string) bool {
+	_, ok := stripZone(host)
+	return ok
+}
+
+// stripZone removes the zone identifier of an IPv6 address host and
+// reports whether it had one.
+func stripZone(host string) (string, bool) {
+	i := strings.LastIndexByte(host, '%')
+	if i < 0 || net.ParseIP(host[:i]) == nil {
+		return host, false
+	}
+
+	return host[:i], true
+}
+
 func splitHostPort(address string) (string, uint16, error) {
-	host, port, err := net.SplitHostPort(address)
+	host, port, err := splitHostAnyPort(address)
 	if err != nil {
 		return "", 0, err
 	}
 
-	portnum, err := strconv.ParseUint(port, 10, 16)
+	if port == 0 {
+		return "", 0, errors.New("port number out of range 0")
+	}
+
+	return host, port, nil
+}
+
+// splitHostAnyPort is like splitHostPort, but accepts port 0, e.g. of
+// the address of an ASSOCIATE or BIND request.
+func splitHostAnyPort(address string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(address)
 	if err != nil {
 		return "", 0, err
 	}
 
-	if 1 > portnum || portnum > 0xffff {
-		return "", 0, errors.New("port number out of range " + port)
+	portnum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, err
 	}
 
 	return host, uint16(portnum), nil
@@ -2,6 +2,8 @@ package socks
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -41,3 +43,52 @@ func TestSocks4Connect(t *testing.T) {
 		assert.Equal(t, "hello", string(body))
 	})
 }
+
+func TestSocks4Ident(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.Ident = func(ctx context.Context, conn *Conn, req *Socks4Request) error {
+			switch req.UserID {
+			case "noidentd":
+				return &IdentError{Status: Socks4StatusNoIdentd}
+			case "invalid":
+				return &IdentError{Status: Socks4StatusInvalidUserID}
+			case "other":
+				return errors.New("other")
+			default:
+				return nil
+			}
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	for userID, tc := range map[string]struct {
+		status Socks4Status
+		err    error
+	}{
+		"noidentd": {Socks4StatusNoIdentd, ErrSocks4NoIdentd},
+		"invalid":  {Socks4StatusInvalidUserID, ErrSocks4InvalidUserID},
+		"other":    {Socks4StatusRejected, ErrSocks4Rejected},
+		"valid":    {Socks4StatusGranted, nil},
+	} {
+		t.Run(userID, func(t *testing.T) {
+			_, err := NewSocks4Dialer("tcp", listen.Addr().String(), func(o *Socks4DialerOptions) {
+				o.UserID = userID
+			}).Dial("tcp", testServer.Listener.Addr().String())
+
+			if tc.status == Socks4StatusGranted {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, fmt.Sprintf("socks error: %v", tc.status))
+				assert.ErrorIs(t, err, tc.err)
+			}
+		})
+	}
+}
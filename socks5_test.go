@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -36,6 +37,14 @@ var userPassServerAuthenticateFuncGen = func(user, pass string) AuthenticateFunc
 			return writeErr
 		}
 
+		if authResp.Status != AuthStatusSuccess {
+			return errors.New("authentication failure")
+		}
+
+		if session, ok := SessionFromContext(ctx); ok {
+			session.SetUser(authReq.Username)
+		}
+
 		return nil
 	}
 }
@@ -248,3 +257,546 @@ func TestSocks5Connect(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestSocks5SelectAuthMethod(t *testing.T) {
+	serverMethods := []AuthMethod{AuthMethodGSSAPI, AuthMethodUsernamePassword, AuthMethodNotRequired}
+	clientMethods := []AuthMethod{AuthMethodNotRequired, AuthMethodUsernamePassword}
+
+	t.Run("client preference", func(t *testing.T) {
+		h := &socks5Handler{authMethods: serverMethods}
+		assert.Equal(t, AuthMethodNotRequired, h.selectAuthMethod(clientMethods))
+	})
+
+	t.Run("server preference", func(t *testing.T) {
+		h := &socks5Handler{authMethods: serverMethods, preferServerAuthMethods: true}
+		assert.Equal(t, AuthMethodUsernamePassword, h.selectAuthMethod(clientMethods))
+	})
+
+	t.Run("disallow downgrade", func(t *testing.T) {
+		h := &socks5Handler{
+			authMethods:           []AuthMethod{AuthMethodNotRequired, AuthMethodUsernamePassword},
+			disallowAuthDowngrade: true,
+		}
+		assert.Equal(t, AuthMethodUsernamePassword, h.selectAuthMethod(clientMethods))
+		assert.Equal(t, AuthMethodNotRequired, h.selectAuthMethod([]AuthMethod{AuthMethodNotRequired}))
+
+		// Methods the server does not support and the private methods
+		// are no stronger methods.
+		assert.Equal(t, AuthMethodNotRequired, h.selectAuthMethod([]AuthMethod{AuthMethodNotRequired, AuthMethodGSSAPI}))
+		assert.Equal(t, AuthMethodNotRequired, h.selectAuthMethod([]AuthMethod{AuthMethodNotice, AuthMethodResumption, AuthMethodNotRequired}))
+	})
+
+	t.Run("disallow downgrade with dialer extensions", func(t *testing.T) {
+		listen, err := net.Listen("tcp", "localhost:0")
+		assert.NoError(t, err)
+
+		defer listen.Close()
+
+		go func() {
+			_ = New(func(o *Options) {
+				o.DisallowAuthDowngrade = true
+			}).Serve(listen)
+		}()
+
+		for name, fn := range map[string]func(*Socks5DialerOptions){
+			"notice":     func(o *Socks5DialerOptions) { o.OnNotice = func(n *Notice) {} },
+			"resumption": func(o *Socks5DialerOptions) { o.Resumption = &ResumptionCache{} },
+		} {
+			conn, err := NewSocks5Dialer("tcp", listen.Addr().String(), fn).Dial("tcp", testServer.Listener.Addr().String())
+			if assert.NoError(t, err, name) {
+				_ = conn.Close()
+			}
+		}
+	})
+}
+
+func TestSocks5Hooks(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	authCh := make(chan *AuthEvent, 1)
+	accessCh := make(chan *AccessEvent, 1)
+
+	server := New(func(o *Options) {
+		o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		o.Authenticate = userPassServerAuthenticateFuncGen("user", "pass")
+		o.Hooks.OnAuth = func(ctx context.Context, e *AuthEvent) { authCh <- e }
+		o.Hooks.OnAccess = func(ctx context.Context, e *AccessEvent) { accessCh <- e }
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	d := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+		o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		o.Authenticate = userPassDialerAuthenticateFuncGen("user", "pass")
+	})
+
+	conn, err := d.Dial("tcp", testServer.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	authEvent := <-authCh
+	assert.True(t, authEvent.Success())
+	assert.Equal(t, AuthMethodUsernamePassword, authEvent.Method)
+	assert.Equal(t, "user", authEvent.User)
+	assert.NotNil(t, authEvent.ClientAddr)
+
+	_ = conn.Close()
+
+	accessEvent := <-accessCh
+	assert.Equal(t, "user", accessEvent.User)
+	assert.Equal(t, ConnectCommand, accessEvent.CMD)
+	assert.Equal(t, testServer.Listener.Addr().String(), accessEvent.Addr)
+
+	assert.Equal(t, uint64(1), server.Metrics().AuthSuccesses)
+}
+
+func TestSocks5Middlewares(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	var calls []string
+
+	trace := func(name string) Middleware {
+		return func(next RequestHandler) RequestHandler {
+			return RequestHandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+				calls = append(calls, name)
+				return next.ServeSOCKS(ctx, conn, req)
+			})
+		}
+	}
+
+	rewrite := func(next RequestHandler) RequestHandler {
+		return RequestHandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+			req.Addr = testServer.Listener.Addr().String()
+			return next.ServeSOCKS(ctx, conn, req)
+		})
+	}
+
+	server := New(func(o *Options) {
+		o.Middlewares = []Middleware{trace("first"), trace("second"), rewrite}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := NewSocks5Dialer("tcp", listen.Addr().String())
+			return d.DialContext(ctx, network, "example.invalid:80")
+		},
+	}
+	resp, err := cli.Get(testServer.URL)
+	assert.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, []string{"first", "second"}, calls)
+}
+
+func TestSocks5CustomHandler(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	defaultHandler := NewDefaultHandler()
+
+	server := New(func(o *Options) {
+		o.Handler = RequestHandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+			if req.Addr == testServer.Listener.Addr().String() {
+				return defaultHandler.ServeSOCKS(ctx, conn, req)
+			}
+
+			return conn.Write(&Socks5Response{Status: Socks5StatusNotAllowed})
+		})
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	d := NewSocks5Dialer("tcp", listen.Addr().String())
+
+	conn, err := d.Dial("tcp", testServer.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	_ = conn.Close()
+
+	_, err = d.Dial("tcp", "example.invalid:80")
+	assertSocks5Rejection(t, err, Socks5StatusNotAllowed)
+}
+
+func TestSocks5DialerZone(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	var addr string
+
+	server := New(func(o *Options) {
+		o.Handler = RequestHandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+			addr = req.Addr
+			return conn.Write(&Socks5Response{Status: Socks5StatusHostUnreachable})
+		})
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	t.Run("reject", func(t *testing.T) {
+		_, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", "[fe80::1%eth0]:80")
+
+		var ze *ZoneError
+		assert.True(t, errors.As(err, &ze))
+		assert.Equal(t, "[fe80::1%eth0]:80", ze.Addr)
+	})
+
+	t.Run("strip", func(t *testing.T) {
+		_, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.ZonePolicy = IPv6ZoneStrip
+		}).Dial("tcp", "[fe80::1%eth0]:80")
+		assert.Error(t, err)
+		assert.Equal(t, "[fe80::1]:80", addr)
+	})
+
+	t.Run("direct", func(t *testing.T) {
+		direct := &recordingDialer{}
+
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.ProxyDialer = direct
+			o.ZonePolicy = IPv6ZoneDirect
+		}).Dial("tcp", "[fe80::1%eth0]:80")
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		assert.Equal(t, []string{"[fe80::1%eth0]:80"}, direct.dials)
+	})
+}
+
+func TestSocks5DialerIPLiteral(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	// The fake proxy returns the raw requests.
+	requests := make(chan []byte, 1)
+
+	go func() {
+		for {
+			c, err := listen.Accept()
+			if err != nil {
+				return
+			}
+
+			conn := NewConn(c)
+
+			_ = conn.Read(&MethodSelectRequest{})
+			_ = conn.Write(&MethodSelectResponse{Method: AuthMethodNotRequired})
+
+			b := make([]byte, 512)
+			n, _ := c.Read(b)
+			requests <- b[:n]
+
+			_ = conn.Write(&Socks5Response{Status: Socks5StatusHostUnreachable})
+			_ = c.Close()
+		}
+	}()
+
+	dial := func(policy IPLiteralPolicy, addr string) []byte {
+		_, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.IPLiteralPolicy = policy
+		}).Dial("tcp", addr)
+		assert.Error(t, err)
+
+		return <-requests
+	}
+
+	testCases := []struct {
+		name   string
+		policy IPLiteralPolicy
+		addr   string
+		want   []byte
+	}{
+		{"IPv4 as IP", IPLiteralAsIP, "192.0.2.1:80", []byte{5, 1, 0, 1, 192, 0, 2, 1, 0, 80}},
+		{"IPv6 as IP", IPLiteralAsIP, "[::1]:80", append(append([]byte{5, 1, 0, 4}, net.IPv6loopback...), 0, 80)},
+		{"FQDN as IP", IPLiteralAsIP, "example.com:80", append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 0, 80)},
+		{"IPv4 as FQDN", IPLiteralAsFQDN, "192.0.2.1:80", append(append([]byte{5, 1, 0, 3, 9}, "192.0.2.1"...), 0, 80)},
+		{"IPv6 as FQDN", IPLiteralAsFQDN, "[::1]:80", append(append([]byte{5, 1, 0, 3, 3}, "::1"...), 0, 80)},
+		{"FQDN as FQDN", IPLiteralAsFQDN, "example.com:80", append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 0, 80)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, dial(tc.policy, tc.addr))
+		})
+	}
+}
+
+func TestSocks5DialerRequestHook(t *testing.T) {
+	transcript := readTranscript(t, "socks5-connect.txt")
+
+	t.Run("rewrite", func(t *testing.T) {
+		replay := NewReplayDialer(transcript)
+
+		conn, err := NewSocks5Dialer("tcp", "proxy:1080", func(o *Socks5DialerOptions) {
+			o.ProxyDialer = replay
+			o.RequestHook = func(ctx context.Context, req *Socks5Request) error {
+				assert.Equal(t, ConnectCommand, req.CMD)
+				assert.Equal(t, "web.internal:8080", req.Addr)
+
+				req.Addr = "192.0.2.1:80"
+
+				return nil
+			}
+		}).Dial("tcp", "web.internal:8080")
+		assert.NoError(t, err)
+
+		_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		assert.NoError(t, err)
+
+		assert.NoError(t, conn.Close())
+		assert.Equal(t, transcript.Client(), replay.Written())
+	})
+
+	t.Run("error", func(t *testing.T) {
+		replay := NewReplayDialer(transcript)
+		hookErr := errors.New("denied")
+
+		_, err := NewSocks5Dialer("tcp", "proxy:1080", func(o *Socks5DialerOptions) {
+			o.ProxyDialer = replay
+			o.RequestHook = func(ctx context.Context, req *Socks5Request) error {
+				return hookErr
+			}
+		}).Dial("tcp", "192.0.2.1:80")
+		assert.ErrorIs(t, err, hookErr)
+
+		// The dialer does not connect to the proxy.
+		assert.Nil(t, replay.Written())
+	})
+}
+
+func TestSocks5TargetAddr(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	accessed := make(chan *AccessEvent, 1)
+
+	server := New(func(o *Options) {
+		o.HandlerOptions = func(h *DefaultHandlerOptions) {
+			h.ReplyTargetAddr = true
+		}
+		o.Hooks.OnAccess = func(ctx context.Context, e *AccessEvent) {
+			accessed <- e
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	_, port, err := net.SplitHostPort(testServer.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	c, err := net.Dial("tcp", listen.Addr().String())
+	assert.NoError(t, err)
+
+	conn := NewConn(c)
+
+	assert.NoError(t, conn.Write(&MethodSelectRequest{Methods: []AuthMethod{AuthMethodNotRequired}}))
+	assert.NoError(t, conn.Read(&MethodSelectResponse{}))
+	assert.NoError(t, conn.Write(&Socks5Request{CMD: ConnectCommand, Addr: net.JoinHostPort("localhost", port)}))
+
+	resp := &Socks5Response{}
+	assert.NoError(t, conn.Read(resp))
+	assert.Equal(t, testServer.Listener.Addr().String(), resp.Addr)
+
+	_ = c.Close()
+
+	e := <-accessed
+	assert.Equal(t, "localhost:"+port, e.Addr)
+	assert.Equal(t, testServer.Listener.Addr().String(), e.TargetAddr)
+}
+
+func TestSocks5OptimisticReply(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.HandlerOptions = func(h *DefaultHandlerOptions) {
+			h.OptimisticReply = true
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	t.Run("early data", func(t *testing.T) {
+		c, err := net.Dial("tcp", listen.Addr().String())
+		assert.NoError(t, err)
+
+		defer c.Close()
+
+		// The handshake, the request and the early data in one write.
+		b := marshalAll(t,
+			&MethodSelectRequest{Methods: []AuthMethod{AuthMethodNotRequired}},
+			&Socks5Request{CMD: ConnectCommand, Addr: testServer.Listener.Addr().String()},
+		)
+		_, err = c.Write(append(b, "GET / HTTP/1.0\r\n\r\n"...))
+		assert.NoError(t, err)
+
+		conn := NewConn(c)
+		assert.NoError(t, conn.Read(&MethodSelectResponse{}))
+
+		resp := &Socks5Response{}
+		assert.NoError(t, conn.Read(resp))
+		assert.Equal(t, Socks5StatusGranted, resp.Status)
+
+		body, err := io.ReadAll(conn.NetConn())
+		assert.NoError(t, err)
+		assert.Contains(t, string(body), "hello")
+	})
+
+	t.Run("failed dial", func(t *testing.T) {
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		_ = closed.Close()
+
+		c, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", closed.Addr().String())
+		assert.NoError(t, err)
+
+		defer c.Close()
+
+		b, _ := io.ReadAll(c)
+		assert.Empty(t, b)
+	})
+}
+
+func TestSocks5UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+
+	daemon, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+
+	defer daemon.Close()
+
+	go func() {
+		conn, err := daemon.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		_, _ = conn.Write([]byte("hello"))
+	}()
+
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.HandlerOptions = func(h *DefaultHandlerOptions) {
+			h.UnixSockets = []string{path}
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	dialer := NewSocks5Dialer("tcp", listen.Addr().String())
+
+	t.Run("allowed", func(t *testing.T) {
+		conn, err := dialer.Dial("tcp", UnixSocketAddr(path))
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		b, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		_, err := dialer.Dial("tcp", UnixSocketAddr(path+".other"))
+		assert.Error(t, err)
+	})
+}
+
+func TestDialerNegotiationTiming(t *testing.T) {
+	listen, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		o.Authenticate = userPassServerAuthenticateFuncGen("user", "pass")
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	t.Run("socks5", func(t *testing.T) {
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = UsernamePasswordAuthenticator("user", "pass")
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		socks5Conn, ok := conn.(*Socks5Conn)
+		assert.True(t, ok)
+
+		timing := socks5Conn.Timing
+		assert.False(t, timing.Start.IsZero())
+		assert.False(t, timing.ProxyConnected.Before(timing.Start))
+		assert.False(t, timing.MethodSelected.Before(timing.ProxyConnected))
+		assert.False(t, timing.Authenticated.Before(timing.MethodSelected))
+		assert.False(t, timing.Replied.Before(timing.Authenticated))
+		assert.Equal(t, timing.Replied.Sub(timing.Start), timing.Overhead())
+		assert.Equal(t, Socks5StatusGranted, socks5Conn.Reply.Status)
+	})
+
+	t.Run("socks4", func(t *testing.T) {
+		conn, err := NewSocks4Dialer("tcp", listen.Addr().String()).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		socks4Conn, ok := conn.(*Socks4Conn)
+		assert.True(t, ok)
+
+		timing := socks4Conn.Timing
+		assert.False(t, timing.ProxyConnected.Before(timing.Start))
+		assert.True(t, timing.MethodSelected.IsZero())
+		assert.True(t, timing.Authenticated.IsZero())
+		assert.False(t, timing.Replied.Before(timing.ProxyConnected))
+		assert.Equal(t, Socks4StatusGranted, socks4Conn.Reply.Status)
+	})
+}
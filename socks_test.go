@@ -1,7 +1,15 @@
 package socks
 
 import (
+	"context"
+	"encoding"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -72,6 +80,38 @@ func TestSocks4Request(t *testing.T) {
 
 		assert.Equal(t, req, req2)
 	})
+
+	t.Run("port 0", func(t *testing.T) {
+		req := &Socks4Request{
+			CMD:  BindCommand,
+			Addr: "127.0.0.1:0",
+		}
+
+		b, err := req.MarshalBinary()
+		assert.NoError(t, err)
+
+		req2 := &Socks4Request{}
+		err = req2.UnmarshalBinary(b)
+		assert.NoError(t, err)
+
+		assert.Equal(t, req, req2)
+
+		_, err = (&Socks4Request{CMD: ConnectCommand, Addr: "127.0.0.1:0"}).MarshalBinary()
+		assert.Error(t, err)
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		_, err := (&Socks4Request{CMD: ConnectCommand, Addr: "[2001:db8::1]:8080"}).MarshalBinary()
+
+		var addrErr *Socks4AddrError
+		assert.True(t, errors.As(err, &addrErr))
+		assert.Equal(t, "[2001:db8::1]:8080", addrErr.Addr)
+
+		// IPv4-mapped addresses are IPv4 addresses.
+		b, err := (&Socks4Request{CMD: ConnectCommand, Addr: "[::ffff:192.0.2.1]:80"}).MarshalBinary()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{4, 1, 0, 80, 192, 0, 2, 1, 0}, b)
+	})
 }
 
 func TestSocks4Response(t *testing.T) {
@@ -106,6 +146,90 @@ func TestSocks4Response(t *testing.T) {
 
 		assert.Equal(t, resp, resp2)
 	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for name, b := range map[string][]byte{
+			"status only": {0, byte(Socks4StatusGranted)},
+			"truncated":   {0, byte(Socks4StatusGranted), 0, 80, 127},
+			"version":     {5, byte(Socks4StatusGranted), 0, 80, 127, 0, 0, 1},
+		} {
+			err := (&Socks4Response{}).UnmarshalBinary(b)
+
+			var pe *ProtocolError
+			assert.True(t, errors.As(err, &pe), name)
+			assert.Equal(t, "SOCKS4 reply", pe.Phase, name)
+		}
+
+		assert.ErrorIs(t, (&Socks4Response{}).UnmarshalBinary(nil), io.EOF)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		server, client := net.Pipe()
+
+		defer client.Close()
+
+		go func() {
+			_, _ = client.Write([]byte{0, byte(Socks4StatusGranted)})
+		}()
+
+		_ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+		err := NewConn(server).Read(&Socks4Response{})
+
+		var timeoutErr *NegotiationTimeoutError
+		assert.True(t, errors.As(err, &timeoutErr))
+		assert.Equal(t, "SOCKS4 reply", timeoutErr.Phase)
+		assert.Equal(t, "DSTPORT", timeoutErr.Field)
+	})
+
+	t.Run("version 4", func(t *testing.T) {
+		resp := &Socks4Response{}
+		err := resp.UnmarshalBinary([]byte{4, byte(Socks4StatusGranted), 0, 80, 127, 0, 0, 1})
+		assert.NoError(t, err)
+
+		assert.Equal(t, Socks4StatusGranted, resp.Status)
+		assert.Equal(t, "127.0.0.1:80", resp.Addr)
+	})
+
+	t.Run("reply addresses", func(t *testing.T) {
+		for name, tc := range map[string]struct {
+			addr   string
+			golden []byte
+		}{
+			"hostname":          {"example.com:443", []byte{0, 0x5a, 1, 187, 0, 0, 0, 0}},
+			"unspecified ipv6":  {"[::]:1080", []byte{0, 0x5a, 4, 56, 0, 0, 0, 0}},
+			"ipv4-mapped ipv6":  {"[::ffff:192.0.2.1]:1080", []byte{0, 0x5a, 4, 56, 192, 0, 2, 1}},
+			"ipv4 without port": {"192.0.2.1:0", []byte{0, 0x5a, 0, 0, 192, 0, 2, 1}},
+		} {
+			b, err := (&Socks4Response{Status: Socks4StatusGranted, Addr: tc.addr}).MarshalBinary()
+			assert.NoError(t, err, name)
+			assert.Equal(t, tc.golden, b, name)
+		}
+
+		_, err := (&Socks4Response{Status: Socks4StatusGranted, Addr: "[2001:db8::1]:1080"}).MarshalBinary()
+
+		var addrErr *Socks4AddrError
+		assert.True(t, errors.As(err, &addrErr))
+		assert.EqualError(t, err, "socks: address [2001:db8::1]:1080 cannot be represented in SOCKS4")
+	})
+
+	t.Run("rejection", func(t *testing.T) {
+		for name, tc := range map[string]struct {
+			addr     string
+			echoAddr bool
+			golden   []byte
+		}{
+			"zero":       {"192.0.2.1:80", false, []byte{0, 0x5b, 0, 0, 0, 0, 0, 0}},
+			"echo":       {"192.0.2.1:80", true, []byte{0, 0x5b, 0, 80, 192, 0, 2, 1}},
+			"echo fqdn":  {"example.com:443", true, []byte{0, 0x5b, 1, 187, 0, 0, 0, 0}},
+			"echo empty": {"", true, []byte{0, 0x5b, 0, 0, 0, 0, 0, 0}},
+			"echo ipv6":  {"[2001:db8::1]:80", true, []byte{0, 0x5b, 0, 0, 0, 0, 0, 0}},
+		} {
+			b, err := NewSocks4Rejection(&Request{Version: Socks4Version, Addr: tc.addr}, tc.echoAddr).MarshalBinary()
+			assert.NoError(t, err, name)
+			assert.Equal(t, tc.golden, b, name)
+		}
+	})
 }
 
 func TestMethodSelectRequest(t *testing.T) {
@@ -169,6 +293,116 @@ func TestUsernamePasswordAuthRequest(t *testing.T) {
 	assert.NoError(t, err)
 
 	assert.Equal(t, req, req2)
+
+	t.Run("lengths", func(t *testing.T) {
+		for _, length := range []int{0, 1, 255} {
+			req := &UsernamePasswordAuthRequest{
+				Username: strings.Repeat("u", length),
+				Password: strings.Repeat("p", length),
+			}
+
+			b, err := req.MarshalBinary()
+			assert.NoError(t, err)
+			assert.Len(t, b, 3+2*length)
+
+			got := &UsernamePasswordAuthRequest{}
+			assert.NoError(t, got.UnmarshalBinary(b))
+			assert.Equal(t, req, got)
+		}
+
+		var lengthErr *CredentialLengthError
+
+		_, err := (&UsernamePasswordAuthRequest{Username: strings.Repeat("u", 256)}).MarshalBinary()
+		assert.True(t, errors.As(err, &lengthErr))
+		assert.Equal(t, &CredentialLengthError{Field: "UNAME", Length: 256, Max: 255}, lengthErr)
+
+		_, err = (&UsernamePasswordAuthRequest{Username: "u", Password: strings.Repeat("p", 256)}).MarshalBinary()
+		assert.EqualError(t, err, "socks: length 256 of field PASSWD not in range 0 to 255")
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		for _, b := range [][]byte{
+			{0x01},
+			{0x01, 0x04, 'u', 's'},
+			{0x01, 0x01, 'u'},
+			{0x01, 0x01, 'u', 0x04, 'p'},
+		} {
+			assert.Error(t, (&UsernamePasswordAuthRequest{}).UnmarshalBinary(b), "% x", b)
+		}
+	})
+
+	// Random input decodes to credentials whose encoding is the consumed
+	// prefix of the input, or fails without panicking.
+	t.Run("random", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+
+		for i := 0; i < 10000; i++ {
+			b := make([]byte, rnd.Intn(600))
+			rnd.Read(b)
+
+			if len(b) > 0 && rnd.Intn(2) == 0 {
+				b[0] = byte(UsernamePasswordAuthVersion1)
+			}
+
+			got := &UsernamePasswordAuthRequest{}
+			if err := got.UnmarshalBinary(b); err != nil {
+				continue
+			}
+
+			enc, err := got.MarshalBinary()
+			assert.NoError(t, err)
+			assert.Equal(t, b[:len(enc)], enc)
+		}
+	})
+}
+
+func TestCredentialLimits(t *testing.T) {
+	limits := &CredentialLimits{MaxUsername: 4, RejectEmpty: true}
+
+	assert.NoError(t, limits.check(&UsernamePasswordAuthRequest{Username: "user", Password: strings.Repeat("p", 255)}))
+	assert.Equal(t, &CredentialLengthError{Field: "UNAME", Length: 5, Min: 1, Max: 4},
+		limits.check(&UsernamePasswordAuthRequest{Username: "user1", Password: "pass"}))
+	assert.Equal(t, &CredentialLengthError{Field: "PASSWD", Length: 0, Min: 1, Max: 255},
+		limits.check(&UsernamePasswordAuthRequest{Username: "user"}))
+
+	assert.NoError(t, (&CredentialLimits{}).check(&UsernamePasswordAuthRequest{}))
+
+	t.Run("server", func(t *testing.T) {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		defer listen.Close()
+
+		go func() {
+			_ = New(func(o *Options) {
+				o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+				o.Authenticate = func(ctx context.Context, conn *Conn, method AuthMethod) error {
+					req := &UsernamePasswordAuthRequest{}
+					if err := conn.Read(req); err != nil {
+						return err
+					}
+
+					return conn.Write(&UsernamePasswordAuthResponse{Status: AuthStatusSuccess})
+				}
+				o.CredentialLimits = CredentialLimits{MaxUsername: 4}
+			}).Serve(listen)
+		}()
+
+		dial := func(username string) error {
+			conn, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+				o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+				o.Authenticate = UsernamePasswordAuthenticator(username, "pass")
+			}).Dial("tcp", testServer.Listener.Addr().String())
+			if err != nil {
+				return err
+			}
+
+			return conn.Close()
+		}
+
+		assert.NoError(t, dial("user"))
+		assert.EqualError(t, dial("user1"), "socks: username/password authentication failed")
+	})
 }
 
 func TestUsernamePasswordAuthResponse(t *testing.T) {
@@ -234,6 +468,57 @@ func TestSocks5Request(t *testing.T) {
 
 		assert.Equal(t, req, req2)
 	})
+
+	t.Run("literal as FQDN", func(t *testing.T) {
+		req := &Socks5Request{
+			CMD:           ConnectCommand,
+			Addr:          "[2001:db8::1]:8080",
+			LiteralAsFQDN: true,
+		}
+
+		b, err := req.MarshalBinary()
+		assert.NoError(t, err)
+		assert.Equal(t, byte(AddrTypeFQDN), b[3])
+
+		req2 := &Socks5Request{}
+		err = req2.UnmarshalBinary(b)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "[2001:db8::1]:8080", req2.Addr)
+
+		_, err = (&Socks5Request{Addr: "[fe80::1%eth0]:80", LiteralAsFQDN: true}).MarshalBinary()
+		assert.Error(t, err)
+	})
+
+	t.Run("port 0", func(t *testing.T) {
+		for _, cmd := range []Command{BindCommand, AssociateCommand, UDPOverTCPCommand} {
+			req := &Socks5Request{
+				CMD:  cmd,
+				Addr: "0.0.0.0:0",
+			}
+
+			b, err := req.MarshalBinary()
+			assert.NoError(t, err, cmd)
+
+			req2 := &Socks5Request{}
+			err = req2.UnmarshalBinary(b)
+			assert.NoError(t, err)
+
+			assert.Equal(t, req, req2)
+		}
+
+		_, err := (&Socks5Request{CMD: ConnectCommand, Addr: "127.0.0.1:0"}).MarshalBinary()
+		assert.Error(t, err)
+
+		_, err = (&Socks5Request{CMD: ConnectCommand, Addr: "localhost:0", LiteralAsFQDN: true}).MarshalBinary()
+		assert.Error(t, err)
+
+		_, err = (&Socks5Request{CMD: ConnectCommand, Addr: "127.0.0.1:65536"}).MarshalBinary()
+		assert.Error(t, err)
+
+		_, err = (&Socks5Request{CMD: ConnectCommand, Addr: UnixSocketAddr("/tmp/socks.sock")}).MarshalBinary()
+		assert.NoError(t, err)
+	})
 }
 
 func TestSocks5Response(t *testing.T) {
@@ -267,4 +552,81 @@ func TestSocks5Response(t *testing.T) {
 
 		assert.Equal(t, resp, resp2)
 	})
+
+	t.Run("FQDN", func(t *testing.T) {
+		resp := &Socks5Response{
+			Status: Socks5StatusGranted,
+			Addr:   "proxy.example:5544",
+		}
+
+		b, err := resp.MarshalBinary()
+		assert.NoError(t, err)
+
+		resp2 := &Socks5Response{}
+		err = resp2.UnmarshalBinary(b)
+		assert.NoError(t, err)
+
+		assert.Equal(t, resp, resp2)
+	})
+
+	t.Run("zone", func(t *testing.T) {
+		resp := &Socks5Response{
+			Status: Socks5StatusGranted,
+			Addr:   "[fe80::1%eth0]:5544",
+		}
+
+		b, err := resp.MarshalBinary()
+		assert.NoError(t, err)
+
+		resp2 := &Socks5Response{}
+		err = resp2.UnmarshalBinary(b)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "[fe80::1]:5544", resp2.Addr)
+	})
+}
+
+func TestUDPDatagram(t *testing.T) {
+	d := &UDPDatagram{
+		Addr: "127.0.0.1:53",
+		Data: []byte("payload"),
+	}
+
+	b, err := d.MarshalBinary()
+	assert.NoError(t, err)
+
+	d2 := &UDPDatagram{}
+	err = d2.UnmarshalBinary(b)
+	assert.NoError(t, err)
+
+	assert.Equal(t, d, d2)
+
+	_, err = (&UDPDatagram{Addr: "127.0.0.1:0"}).MarshalBinary()
+	assert.Error(t, err)
+}
+
+func TestReplyHelpers(t *testing.T) {
+	socks4 := &Request{Version: Socks4Version, CMD: BindCommand, Addr: "192.0.2.1:21"}
+	socks5 := &Request{Version: Socks5Version, CMD: BindCommand, Addr: "192.0.2.1:21"}
+
+	testCases := []struct {
+		name  string
+		reply encoding.BinaryMarshaler
+		want  []byte
+	}{
+		{"SOCKS4 granted", NewGrantedReply(socks4, "192.0.2.2:4000"), []byte{0, 0x5a, 0x0f, 0xa0, 192, 0, 2, 2}},
+		{"SOCKS4 granted without address", NewGrantedReply(socks4, ""), []byte{0, 0x5a, 0, 0, 0, 0, 0, 0}},
+		{"SOCKS4 denied", NewDenyReply(socks4, Socks5StatusHostUnreachable), []byte{0, 0x5b, 0, 0, 0, 0, 0, 0}},
+		{"SOCKS5 granted", NewGrantedReply(socks5, "192.0.2.2:4000"), []byte{5, 0, 0, 1, 192, 0, 2, 2, 0x0f, 0xa0}},
+		{"SOCKS5 granted without address", NewGrantedReply(socks5, ""), []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"SOCKS5 denied", NewDenyReply(socks5, Socks5StatusHostUnreachable), []byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.reply.MarshalBinary()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, b)
+		})
+	}
 }
@@ -0,0 +1,59 @@
+// Package sockstest provides utilities for tests against a SOCKS proxy,
+// like net/http/httptest for HTTP servers.
+package sockstest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/hupe1980/socks"
+)
+
+// StartTestProxy starts a socks.Server configured by optFns on a free
+// loopback port and returns its address and a function which stops it.
+// The server is stopped at the end of the test at the latest; an error
+// of Serve other than socks.ErrServerClosed fails the test.
+func StartTestProxy(t testing.TB, optFns ...func(*socks.Options)) (string, func()) {
+	t.Helper()
+
+	listen, err := newLocalListener()
+	if err != nil {
+		t.Fatalf("sockstest: failed to listen: %v", err)
+	}
+
+	server := socks.New(optFns...)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- server.Serve(listen)
+	}()
+
+	var once sync.Once
+
+	cleanup := func() {
+		once.Do(func() {
+			_ = server.Close()
+
+			if err := <-done; err != nil && !errors.Is(err, socks.ErrServerClosed) {
+				t.Errorf("sockstest: serve: %v", err)
+			}
+		})
+	}
+
+	t.Cleanup(cleanup)
+
+	return listen.Addr().String(), cleanup
+}
+
+// newLocalListener listens on a free port of the IPv4 loopback address,
+// or of the IPv6 one on hosts without IPv4.
+func newLocalListener() (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return net.Listen("tcp6", "[::1]:0")
+	}
+
+	return l, nil
+}
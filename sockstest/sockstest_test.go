@@ -0,0 +1,41 @@
+package sockstest
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hupe1980/socks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartTestProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("hello"))
+	}))
+	defer target.Close()
+
+	addr, cleanup := StartTestProxy(t, func(o *socks.Options) {
+		o.AuthMethods = []socks.AuthMethod{socks.AuthMethodNotRequired}
+	})
+
+	conn, err := socks.NewSocks5Dialer("tcp", addr).Dial("tcp", target.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	assert.NoError(t, err)
+
+	b, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "hello")
+
+	cleanup()
+
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+
+	// A second call, like that of the cleanup of the test, does nothing.
+	cleanup()
+}
@@ -0,0 +1,37 @@
+package socks
+
+import (
+	"math/rand"
+	"time"
+)
+
+// TarpitOptions specifies the delay of the rejections of unauthenticated
+// or denied clients, which slows down scanners and brute forcers without
+// affecting permitted requests.
+type TarpitOptions struct {
+	// Min and Max specify the range of the random delay of a rejection.
+	// If Max is zero, rejections are not delayed.
+	Min time.Duration
+	Max time.Duration
+}
+
+// enabled reports whether rejections are delayed.
+func (o *TarpitOptions) enabled() bool {
+	return o != nil && o.Max > 0
+}
+
+// delay returns a random delay in the range.
+func (o *TarpitOptions) delay() time.Duration {
+	if o.Max <= o.Min {
+		return o.Max
+	}
+
+	return o.Min + time.Duration(rand.Int63n(int64(o.Max-o.Min))) //nolint:gosec // jitter only
+}
+
+// wait delays a rejection.
+func (o *TarpitOptions) wait() {
+	if o.enabled() {
+		time.Sleep(o.delay())
+	}
+}
@@ -0,0 +1,70 @@
+package socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarpit(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.Rules = DenyPorts(81)
+		o.Tarpit = TarpitOptions{Min: 100 * time.Millisecond, Max: 200 * time.Millisecond}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	t.Run("denied", func(t *testing.T) {
+		start := time.Now()
+
+		_, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", "127.0.0.1:81")
+		assertSocks5Rejection(t, err, Socks5StatusNotAllowed)
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+	})
+
+	t.Run("no acceptable methods", func(t *testing.T) {
+		start := time.Now()
+
+		_, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = userPassDialerAuthenticateFuncGen("user", "pass")
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		assert.Error(t, err)
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		start := time.Now()
+
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String()).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+	})
+}
+
+func TestTarpitDelay(t *testing.T) {
+	var o *TarpitOptions
+	assert.False(t, o.enabled())
+
+	o = &TarpitOptions{Min: time.Second, Max: 2 * time.Second}
+	for i := 0; i < 100; i++ {
+		d := o.delay()
+		assert.True(t, d >= o.Min && d < o.Max)
+	}
+
+	o = &TarpitOptions{Max: time.Second}
+	assert.True(t, o.enabled())
+	assert.Less(t, int64(o.delay()), int64(time.Second))
+}
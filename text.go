@@ -0,0 +1,160 @@
+package socks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// enumNames maps the values of an enum type to the names used by their
+// MarshalText and UnmarshalText methods. Values without a name are
+// represented by their decimal number.
+type enumNames map[uint8]string
+
+func (n enumNames) marshal(v uint8) []byte {
+	if name, ok := n[v]; ok {
+		return []byte(name)
+	}
+
+	return []byte(strconv.Itoa(int(v)))
+}
+
+// unmarshal accepts a name, case-insensitively, or a number.
+func (n enumNames) unmarshal(kind string, text []byte) (uint8, error) {
+	s := strings.ToLower(string(text))
+
+	for v, name := range n {
+		if name == s {
+			return v, nil
+		}
+	}
+
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("socks: invalid %s %q", kind, text)
+	}
+
+	return uint8(v), nil
+}
+
+var versionNames = enumNames{
+	uint8(Socks4Version): "socks4",
+	uint8(Socks5Version): "socks5",
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (v Version) MarshalText() ([]byte, error) {
+	return versionNames.marshal(uint8(v)), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (v *Version) UnmarshalText(text []byte) error {
+	n, err := versionNames.unmarshal("version", text)
+	*v = Version(n)
+
+	return err
+}
+
+var commandNames = enumNames{
+	uint8(ConnectCommand):    "connect",
+	uint8(BindCommand):       "bind",
+	uint8(AssociateCommand):  "associate",
+	uint8(MultiplexCommand):  "multiplex",
+	uint8(UDPOverTCPCommand): "udp-over-tcp",
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (cmd Command) MarshalText() ([]byte, error) {
+	return commandNames.marshal(uint8(cmd)), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (cmd *Command) UnmarshalText(text []byte) error {
+	n, err := commandNames.unmarshal("command", text)
+	*cmd = Command(n)
+
+	return err
+}
+
+var authMethodNames = enumNames{
+	uint8(AuthMethodNotRequired):         "none",
+	uint8(AuthMethodGSSAPI):              "gssapi",
+	uint8(AuthMethodUsernamePassword):    "username-password",
+	uint8(AuthMethodNoAcceptableMethods): "no-acceptable-methods",
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (am AuthMethod) MarshalText() ([]byte, error) {
+	return authMethodNames.marshal(uint8(am)), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (am *AuthMethod) UnmarshalText(text []byte) error {
+	n, err := authMethodNames.unmarshal("auth method", text)
+	*am = AuthMethod(n)
+
+	return err
+}
+
+var authStatusNames = enumNames{
+	uint8(AuthStatusSuccess): "success",
+	uint8(AuthStatusFailure): "failure",
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (status AuthStatus) MarshalText() ([]byte, error) {
+	return authStatusNames.marshal(uint8(status)), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (status *AuthStatus) UnmarshalText(text []byte) error {
+	n, err := authStatusNames.unmarshal("auth status", text)
+	*status = AuthStatus(n)
+
+	return err
+}
+
+var socks4StatusNames = enumNames{
+	uint8(Socks4StatusGranted):       "granted",
+	uint8(Socks4StatusRejected):      "rejected",
+	uint8(Socks4StatusNoIdentd):      "no-identd",
+	uint8(Socks4StatusInvalidUserID): "invalid-userid",
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (code Socks4Status) MarshalText() ([]byte, error) {
+	return socks4StatusNames.marshal(uint8(code)), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (code *Socks4Status) UnmarshalText(text []byte) error {
+	n, err := socks4StatusNames.unmarshal("SOCKS4 status", text)
+	*code = Socks4Status(n)
+
+	return err
+}
+
+var socks5StatusNames = enumNames{
+	uint8(Socks5StatusGranted):              "granted",
+	uint8(Socks5StatusFailure):              "failure",
+	uint8(Socks5StatusNotAllowed):           "not-allowed",
+	uint8(Socks5StatusNetworkUnreaachable):  "network-unreachable",
+	uint8(Socks5StatusHostUnreachable):      "host-unreachable",
+	uint8(Socks5StatusConnectionRefused):    "connection-refused",
+	uint8(Socks5StatusTTLExpired):           "ttl-expired",
+	uint8(Socks5StatusCMDNotSupported):      "command-not-supported",
+	uint8(Socks5StatusAddrTypeNotSupported): "address-type-not-supported",
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (code Socks5Status) MarshalText() ([]byte, error) {
+	return socks5StatusNames.marshal(uint8(code)), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (code *Socks5Status) UnmarshalText(text []byte) error {
+	n, err := socks5StatusNames.unmarshal("SOCKS5 status", text)
+	*code = Socks5Status(n)
+
+	return err
+}
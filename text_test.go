@@ -0,0 +1,58 @@
+package socks
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextMarshaler(t *testing.T) {
+	type entry struct {
+		Version      Version      `json:"version"`
+		CMD          Command      `json:"cmd"`
+		Method       AuthMethod   `json:"method"`
+		AuthStatus   AuthStatus   `json:"auth_status"`
+		Socks4Status Socks4Status `json:"socks4_status"`
+		Socks5Status Socks5Status `json:"socks5_status"`
+	}
+
+	e := entry{
+		Version:      Socks5Version,
+		CMD:          AssociateCommand,
+		Method:       AuthMethodUsernamePassword,
+		AuthStatus:   AuthStatusFailure,
+		Socks4Status: Socks4StatusNoIdentd,
+		Socks5Status: Socks5StatusTTLExpired,
+	}
+
+	b, err := json.Marshal(e)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"version":"socks5","cmd":"associate","method":"username-password","auth_status":"failure","socks4_status":"no-identd","socks5_status":"ttl-expired"}`, string(b))
+
+	var e2 entry
+	assert.NoError(t, json.Unmarshal(b, &e2))
+	assert.Equal(t, e, e2)
+
+	t.Run("unknown", func(t *testing.T) {
+		b, err := AuthMethod(0x80).MarshalText()
+		assert.NoError(t, err)
+		assert.Equal(t, "128", string(b))
+
+		var am AuthMethod
+		assert.NoError(t, am.UnmarshalText([]byte("0x80")))
+		assert.Equal(t, AuthMethod(0x80), am)
+	})
+
+	t.Run("case insensitive", func(t *testing.T) {
+		var cmd Command
+		assert.NoError(t, cmd.UnmarshalText([]byte("CONNECT")))
+		assert.Equal(t, ConnectCommand, cmd)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		var v Version
+		assert.EqualError(t, v.UnmarshalText([]byte("socks6")), `socks: invalid version "socks6"`)
+		assert.Error(t, v.UnmarshalText([]byte("256")))
+	})
+}
@@ -0,0 +1,34 @@
+package socks
+
+import "net"
+
+// TrustedNetwork maps client networks to an implicit identity. Clients
+// of a trusted network, e.g. the local host or an internal mesh, skip
+// the authentication: SOCKS5 clients offering AuthMethodNotRequired get
+// it selected without calling the AuthenticateFunc, SOCKS4 requests
+// skip the IdentFunc.
+type TrustedNetwork struct {
+	// Networks are the client networks.
+	Networks *CIDRSet
+
+	// User is the identity recorded in the sessions of the clients. If
+	// empty, SOCKS4 sessions keep the user ID of the request.
+	User string
+}
+
+// trustedNetwork returns the first trusted network containing the
+// client address, or nil.
+func trustedNetwork(networks []TrustedNetwork, clientAddr net.Addr) *TrustedNetwork {
+	ip := addrIP(clientAddr)
+	if ip == nil {
+		return nil
+	}
+
+	for i := range networks {
+		if networks[i].Networks != nil && networks[i].Networks.Contains(ip) {
+			return &networks[i]
+		}
+	}
+
+	return nil
+}
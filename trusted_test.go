@@ -0,0 +1,153 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedNetworks(t *testing.T) {
+	serve := func(t *testing.T, cidr string, users chan<- string) string {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		t.Cleanup(func() { _ = listen.Close() })
+
+		networks, err := NewCIDRSet(cidr)
+		assert.NoError(t, err)
+
+		server := New(func(o *Options) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = userPassServerAuthenticateFuncGen("user", "pass")
+			o.Ident = func(ctx context.Context, conn *Conn, req *Socks4Request) error {
+				return errors.New("no ident")
+			}
+			o.TrustedNetworks = []TrustedNetwork{{Networks: networks, User: "mesh"}}
+			o.Hooks.OnAccess = func(ctx context.Context, e *AccessEvent) {
+				users <- e.Session.User()
+			}
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		return listen.Addr().String()
+	}
+
+	t.Run("trusted", func(t *testing.T) {
+		users := make(chan string, 1)
+		addr := serve(t, "127.0.0.0/8", users)
+
+		conn, err := NewSocks5Dialer("tcp", addr).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		assert.Equal(t, "mesh", <-users)
+
+		conn, err = NewSocks4Dialer("tcp", addr, func(o *Socks4DialerOptions) {
+			o.UserID = "nobody"
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		assert.Equal(t, "mesh", <-users)
+	})
+
+	t.Run("trusted with credentials", func(t *testing.T) {
+		users := make(chan string, 1)
+		addr := serve(t, "127.0.0.0/8", users)
+
+		conn, err := NewSocks5Dialer("tcp", addr, func(o *Socks5DialerOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = userPassDialerAuthenticateFuncGen("user", "pass")
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		assert.Equal(t, "user", <-users)
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		addr := serve(t, "10.0.0.0/8", make(chan string, 1))
+
+		_, err := NewSocks5Dialer("tcp", addr).Dial("tcp", testServer.Listener.Addr().String())
+		assert.Error(t, err)
+
+		_, err = NewSocks4Dialer("tcp", addr).Dial("tcp", testServer.Listener.Addr().String())
+		assert.ErrorIs(t, err, ErrSocks4Rejected)
+	})
+}
+
+func TestNoAcceptableMethods(t *testing.T) {
+	serve := func(t *testing.T, cidr string, l *recordingLogger, events chan<- *MethodSelectEvent) (*Server, string) {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		t.Cleanup(func() { _ = listen.Close() })
+
+		networks, err := NewCIDRSet(cidr)
+		assert.NoError(t, err)
+
+		server := New(func(o *Options) {
+			o.Logger = l
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = userPassServerAuthenticateFuncGen("user", "pass")
+			o.NoAuthGraceNetworks = networks
+			o.LogAuthMethods = true
+			o.Hooks.OnNoAcceptableMethods = func(ctx context.Context, e *MethodSelectEvent) {
+				events <- e
+			}
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		return server, listen.Addr().String()
+	}
+
+	t.Run("grace", func(t *testing.T) {
+		l := &recordingLogger{}
+		events := make(chan *MethodSelectEvent, 1)
+		server, addr := serve(t, "127.0.0.0/8", l, events)
+
+		conn, err := NewSocks5Dialer("tcp", addr).Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		_ = conn.Close()
+
+		e := <-events
+		assert.True(t, e.Grace)
+		assert.Equal(t, []AuthMethod{AuthMethodNotRequired}, e.Offered)
+
+		m := server.Metrics()
+		assert.Equal(t, uint64(1), m.NoAcceptableMethods)
+		assert.Equal(t, uint64(1), m.AuthGraceAccepted)
+		assert.Equal(t, uint64(1), m.AuthSuccesses)
+
+		assert.Contains(t, strings.Join(l.Lines(), "\n"), "offers authentication methods")
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		events := make(chan *MethodSelectEvent, 1)
+		server, addr := serve(t, "10.0.0.0/8", &recordingLogger{}, events)
+
+		_, err := NewSocks5Dialer("tcp", addr).Dial("tcp", testServer.Listener.Addr().String())
+		assert.Error(t, err)
+
+		e := <-events
+		assert.False(t, e.Grace)
+
+		m := server.Metrics()
+		assert.Equal(t, uint64(1), m.NoAcceptableMethods)
+		assert.Equal(t, uint64(0), m.AuthGraceAccepted)
+	})
+}
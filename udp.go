@@ -0,0 +1,702 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDPSourcePolicy specifies from which sources the UDP relay accepts
+// client datagrams.
+type UDPSourcePolicy uint8
+
+const (
+	// UDPSourceStrict accepts datagrams only from the address and port
+	// indicated in the ASSOCIATE request. If the client sends an
+	// unspecified address, the source address of the TCP control
+	// connection is used. If the client sends port 0, the relay is
+	// locked to the port of the first datagram.
+	UDPSourceStrict UDPSourcePolicy = iota
+
+	// UDPSourceClientIP accepts datagrams from any port of the client
+	// IP address, e.g. for clients behind a NAT that rebinds ports.
+	UDPSourceClientIP
+
+	// UDPSourceAny accepts datagrams from any source (open relay).
+	UDPSourceAny
+)
+
+// UDPOversizePolicy specifies how the UDP relay handles datagrams
+// exceeding the maximum datagram size.
+type UDPOversizePolicy uint8
+
+const (
+	// UDPOversizeDrop drops oversized datagrams.
+	UDPOversizeDrop UDPOversizePolicy = iota
+
+	// UDPOversizeTruncate truncates oversized datagrams to the maximum
+	// datagram size.
+	UDPOversizeTruncate
+)
+
+// UDPFamilyPolicy specifies the address family of the socket of the UDP
+// relay facing the client and of BND.ADDR in the ASSOCIATE reply.
+type UDPFamilyPolicy uint8
+
+const (
+	// UDPFamilyControl binds the relay to the address the client reached
+	// the server on, i.e. to the family of the control connection.
+	UDPFamilyControl UDPFamilyPolicy = iota
+
+	// UDPFamilyRequest binds the relay to the family of DST.ADDR of the
+	// request, e.g. for a dual-stack client with an IPv4 control
+	// connection sending its datagrams over IPv6. The relay binds to the
+	// source address the server uses towards DST.ADDR. If DST.ADDR is
+	// a host name or unspecified, the family of the control connection
+	// is used.
+	UDPFamilyRequest
+
+	// UDPFamilyDualStack binds the relay to the unspecified IPv6
+	// address, accepting the datagrams of both families on systems which
+	// map IPv4 to IPv6 sockets. BND.ADDR is chosen like with
+	// UDPFamilyRequest.
+	UDPFamilyDualStack
+)
+
+type UDPOptions struct {
+	// SourcePolicy specifies from which sources the relay accepts
+	// client datagrams. Defaults to UDPSourceStrict.
+	SourcePolicy UDPSourcePolicy
+
+	// IdleTimeout specifies how long an association may be idle
+	// before it is closed. If zero, there is no timeout.
+	IdleTimeout time.Duration
+
+	// MaxDatagramSize specifies the maximum payload size of a relayed
+	// datagram. If zero, the payload size is only limited by UDP.
+	MaxDatagramSize int
+
+	// OversizePolicy specifies how datagrams exceeding
+	// MaxDatagramSize are handled. Defaults to UDPOversizeDrop.
+	OversizePolicy UDPOversizePolicy
+
+	// FamilyPolicy specifies the address family of the relay facing the
+	// client. Defaults to UDPFamilyControl.
+	FamilyPolicy UDPFamilyPolicy
+
+	// MapPort specifies an optional function mapping the local relay
+	// port to the port advertised in the ASSOCIATE reply, e.g. for
+	// UPnP or port-forwarding setups.
+	MapPort func(port int) int
+
+	// MaxFlows specifies the maximum number of distinct targets per
+	// association. Datagrams to further targets are dropped.
+	// If zero, there is no limit.
+	MaxFlows int
+
+	// ControlKeepAlive specifies the TCP keep-alive period of the
+	// control connection, so that the association ends once the
+	// keep-alive probes detect a vanished client. If zero, the
+	// keep-alive settings of the connection are unchanged.
+	ControlKeepAlive time.Duration
+
+	// TargetWriteTimeout specifies the timeout of resolving a target
+	// and sending a datagram to it. If zero, there is no timeout.
+	TargetWriteTimeout time.Duration
+
+	// ClientWriteTimeout specifies the timeout of returning a datagram
+	// to the client. If zero, there is no timeout.
+	ClientWriteTimeout time.Duration
+
+	// DatagramSampling specifies that only every n-th datagram of an
+	// association is reported to Hooks.OnDatagram. If zero, every
+	// datagram is reported.
+	DatagramSampling int
+
+	// OverTCP specifies whether the handler accepts the non-standard
+	// UDPOverTCPCommand, which carries the datagrams of an association
+	// over the connection of the request instead of UDP.
+	OverTCP bool
+
+	// Disabled specifies whether UDP associations, i.e. ASSOCIATE and
+	// UDPOverTCPCommand requests, are rejected. The rejections are
+	// counted by Metrics.UDPRejected and reported to
+	// Hooks.OnUDPRejected.
+	Disabled bool
+
+	// Authorize specifies the optional decision about the UDP
+	// associations while Disabled is set, e.g. to allow UDP only for
+	// certain users of the Session. A nil error grants the request. A
+	// *DenialError is replied with its status; other errors are replied
+	// with Socks5StatusCMDNotSupported. If nil, all requests are rejected
+	// with Socks5StatusCMDNotSupported and ErrUDPDisabled.
+	Authorize func(ctx context.Context, req *Request) error
+}
+
+const (
+	maxUDPPacketSize = 65535
+
+	// maxUDPRuleCacheSize is the maximum number of cached rule
+	// decisions per association.
+	maxUDPRuleCacheSize = 1024
+
+	// maxUDPHeaderLen is the length of a UDP request header with a
+	// FQDN of maximum length.
+	maxUDPHeaderLen = 3 + 1 + 1 + 255 + 2
+)
+
+type udpRelay struct {
+	*logger
+	options    UDPOptions
+	metrics    *metrics
+	hooks      *Hooks
+	session    *Session
+	ctx        context.Context
+	req        *Request
+	rules      DatagramRuleSet
+	clientConn net.PacketConn // socket facing the client
+	targetConn net.PacketConn // socket facing the targets
+	bndAddr    net.Addr       // address advertised to the client, if not of clientConn
+
+	// stream reports whether the datagrams of the client are carried
+	// over the connection of the request, see UDPOverTCPCommand.
+	stream bool
+
+	lastActivity int64  // accessed atomically
+	datagrams    uint64 // accessed atomically, for the sampling
+
+	mu           sync.Mutex
+	expectedIP   net.IP
+	expectedPort int
+	clientAddr   net.Addr
+	flows        map[string]struct{}
+	decisions    map[string]bool
+}
+
+func newUDPRelay(ctx context.Context, conn *Conn, req *Request, options UDPOptions, ports PortAllocator, l *logger) (*udpRelay, error) {
+	var lc net.ListenConfig
+
+	host, bndIP, err := relayHosts(ctx, conn, req.Addr, options.FamilyPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConn, err := listenPacketPort(ctx, ports, "udp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	targetConn, err := lc.ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		_ = clientConn.Close()
+		return nil, err
+	}
+
+	r := newRelay(ctx, req, options, l, clientConn, targetConn)
+
+	if bndIP != nil {
+		r.bndAddr = &net.UDPAddr{IP: bndIP, Port: clientConn.LocalAddr().(*net.UDPAddr).Port}
+	}
+
+	if err := r.setExpectedSource(conn, req.Addr); err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// newStreamUDPRelay returns a relay which exchanges the datagrams of the
+// client over the connection of the request, see UDPOverTCPCommand.
+func newStreamUDPRelay(ctx context.Context, conn *Conn, req *Request, options UDPOptions, l *logger) (*udpRelay, error) {
+	var lc net.ListenConfig
+
+	targetConn, err := lc.ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+
+	r := newRelay(ctx, req, options, l, newStreamPacketConn(conn.NetConn()), targetConn)
+	r.stream = true
+
+	return r, nil
+}
+
+func newRelay(ctx context.Context, req *Request, options UDPOptions, l *logger, clientConn, targetConn net.PacketConn) *udpRelay {
+	r := &udpRelay{
+		logger:     l.fromContext(ctx),
+		options:    options,
+		metrics:    metricsFromContext(ctx),
+		hooks:      hooksFromContext(ctx),
+		clientConn: clientConn,
+		targetConn: targetConn,
+		ctx:        ctx,
+		req:        req,
+		flows:      make(map[string]struct{}),
+		decisions:  make(map[string]bool),
+	}
+
+	if rules, ok := ruleSetFromContext(ctx).(DatagramRuleSet); ok {
+		r.rules = rules
+	}
+
+	r.session, _ = SessionFromContext(ctx)
+
+	return r
+}
+
+func (r *udpRelay) setExpectedSource(conn *Conn, addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	r.expectedPort, err = strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+
+	r.expectedIP = net.ParseIP(host)
+	if r.expectedIP == nil || r.expectedIP.IsUnspecified() {
+		controlHost, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return err
+		}
+
+		r.expectedIP = net.ParseIP(controlHost)
+	}
+
+	return nil
+}
+
+// LocalAddr returns the address of the relay advertised to the client.
+func (r *udpRelay) LocalAddr() net.Addr {
+	if r.bndAddr != nil {
+		return r.bndAddr
+	}
+
+	return r.clientConn.LocalAddr()
+}
+
+// relayHosts returns the host the relay facing the client binds to and,
+// if it differs, the IP advertised in BND.ADDR. By default, the relay
+// binds to the address the client reached the server on, so that
+// BND.ADDR in the reply is reachable by the client.
+func relayHosts(ctx context.Context, conn *Conn, reqAddr string, policy UDPFamilyPolicy) (string, net.IP, error) {
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return "", nil, err
+	}
+
+	local := net.ParseIP(host)
+	if local == nil || policy == UDPFamilyControl {
+		return host, nil, nil
+	}
+
+	if reqHost, _, err := net.SplitHostPort(reqAddr); err == nil {
+		ip := net.ParseIP(reqHost)
+		if ip != nil && !ip.IsUnspecified() && (ip.To4() == nil) != (local.To4() == nil) {
+			if local, err = sourceIP(ctx, ip); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+
+	if policy == UDPFamilyDualStack {
+		return net.IPv6unspecified.String(), local, nil
+	}
+
+	return local.String(), nil, nil
+}
+
+// sourceIP returns the local IP the system routes packets to dst from.
+// Connecting a UDP socket sends no packets.
+func sourceIP(ctx context.Context, dst net.IP) (net.IP, error) {
+	var d net.Dialer
+
+	c, err := d.DialContext(ctx, "udp", net.JoinHostPort(dst.String(), "9"))
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.Close()
+
+	return addrIP(c.LocalAddr()), nil
+}
+
+func (r *udpRelay) Close() error {
+	err := r.clientConn.Close()
+	if targetErr := r.targetConn.Close(); err == nil {
+		err = targetErr
+	}
+
+	return err
+}
+
+// Serve relays datagrams until the relay is closed.
+func (r *udpRelay) Serve() error {
+	errCh := make(chan error, 2)
+	done := make(chan struct{})
+
+	r.touch()
+
+	go func() { errCh <- r.relayToTargets() }()
+	go func() { errCh <- r.relayToClient() }()
+
+	if r.options.IdleTimeout > 0 {
+		go r.expireIdle(done)
+	}
+
+	err := <-errCh
+
+	close(done)
+	_ = r.Close()
+
+	<-errCh
+
+	// The association of a stream also ends when the client closes it.
+	if errors.Is(err, net.ErrClosed) || r.stream && errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
+
+func (r *udpRelay) expireIdle(done <-chan struct{}) {
+	// NewTicker panics for a zero interval, e.g. of an IdleTimeout of
+	// 1ns.
+	interval := r.options.IdleTimeout / 2
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&r.lastActivity))
+			if time.Since(last) >= r.options.IdleTimeout {
+				r.logDebugf("Closing idle UDP association %v", r.LocalAddr())
+
+				_ = r.Close()
+
+				return
+			}
+		}
+	}
+}
+
+func (r *udpRelay) touch() {
+	atomic.StoreInt64(&r.lastActivity, time.Now().UnixNano())
+}
+
+// bufferSize returns the size of the read buffers, one byte larger
+// than needed to detect oversized datagrams.
+func (r *udpRelay) bufferSize(headerLen int) int {
+	if r.options.MaxDatagramSize <= 0 || r.options.MaxDatagramSize+headerLen >= maxUDPPacketSize {
+		return maxUDPPacketSize
+	}
+
+	return r.options.MaxDatagramSize + headerLen + 1
+}
+
+// limit applies the oversize policy to the payload. It reports false
+// if the datagram has to be dropped.
+func (r *udpRelay) limit(data []byte) ([]byte, bool) {
+	if r.options.MaxDatagramSize <= 0 || len(data) <= r.options.MaxDatagramSize {
+		return data, true
+	}
+
+	if r.options.OversizePolicy == UDPOversizeTruncate {
+		return data[:r.options.MaxDatagramSize], true
+	}
+
+	return nil, false
+}
+
+// forwarded counts a relayed datagram and reports it to the hooks.
+func (r *udpRelay) forwarded(toClient bool, addr string, data []byte) {
+	r.metrics.udpForward(len(data))
+
+	if r.session != nil {
+		r.session.countDatagram(toClient, len(data))
+	}
+
+	r.report(toClient, addr, data, false)
+}
+
+// dropped counts a dropped datagram and reports it to the hooks.
+func (r *udpRelay) dropped(toClient bool, addr string, data []byte) {
+	r.metrics.udpDrop()
+
+	if r.session != nil {
+		atomic.AddUint64(&r.session.udp.dropped, 1)
+	}
+
+	r.report(toClient, addr, data, true)
+}
+
+func (r *udpRelay) report(toClient bool, addr string, data []byte, dropped bool) {
+	if r.hooks == nil || r.hooks.OnDatagram == nil {
+		return
+	}
+
+	n := atomic.AddUint64(&r.datagrams, 1)
+	if r.options.DatagramSampling > 1 && (n-1)%uint64(r.options.DatagramSampling) != 0 {
+		return
+	}
+
+	r.hooks.datagram(r.ctx, &DatagramEvent{
+		Session:  r.session,
+		ToClient: toClient,
+		Addr:     addr,
+		Data:     data,
+		Dropped:  dropped,
+	})
+}
+
+func (r *udpRelay) relayToTargets() error {
+	buf := make([]byte, r.bufferSize(maxUDPHeaderLen))
+
+	for {
+		n, src, err := r.clientConn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		if !r.accept(src) {
+			r.metrics.udpSpoofed()
+			r.logDebugf("Dropped UDP datagram from unexpected source %v", src)
+
+			continue
+		}
+
+		datagram := &UDPDatagram{}
+		if err := datagram.UnmarshalBinary(buf[:n]); err != nil {
+			r.logDebugf("Dropped malformed UDP datagram from %v: %v", src, err)
+			continue
+		}
+
+		// Fragmentation is not supported, fragments are dropped.
+		if datagram.Frag != 0 {
+			continue
+		}
+
+		data, ok := r.limit(datagram.Data)
+		if !ok {
+			r.dropped(false, datagram.Addr, datagram.Data)
+			continue
+		}
+
+		if !r.allow(datagram.Addr) {
+			r.dropped(false, datagram.Addr, data)
+			r.logDebugf("Dropped UDP datagram to %v: denied by ruleset", datagram.Addr)
+
+			continue
+		}
+
+		if !r.addFlow(datagram.Addr) {
+			r.dropped(false, datagram.Addr, data)
+			r.logDebugf("Dropped UDP datagram to %v: flow limit reached", datagram.Addr)
+
+			continue
+		}
+
+		r.touch()
+
+		if err := r.sendToTarget(data, datagram.Addr); err != nil {
+			r.logDebugf("Failed to send UDP datagram to %v: %v", datagram.Addr, err)
+			continue
+		}
+
+		r.forwarded(false, datagram.Addr, data)
+	}
+}
+
+// sendToTarget resolves the target and sends the datagram within the
+// TargetWriteTimeout.
+func (r *udpRelay) sendToTarget(data []byte, addr string) error {
+	ctx := r.ctx
+
+	if r.options.TargetWriteTimeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, r.options.TargetWriteTimeout)
+		defer cancel()
+	}
+
+	dst, err := resolveUDPAddr(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = r.targetConn.SetWriteDeadline(deadline)
+	}
+
+	_, err = r.targetConn.WriteTo(data, dst)
+
+	return err
+}
+
+func (r *udpRelay) relayToClient() error {
+	buf := make([]byte, r.bufferSize(0))
+
+	for {
+		n, src, err := r.targetConn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		clientAddr := r.client()
+		if clientAddr == nil {
+			continue
+		}
+
+		data, ok := r.limit(buf[:n])
+		if !ok {
+			r.dropped(true, src.String(), buf[:n])
+			continue
+		}
+
+		r.touch()
+
+		b, err := (&UDPDatagram{Addr: src.String(), Data: data}).MarshalBinary()
+		if err != nil {
+			continue
+		}
+
+		if r.options.ClientWriteTimeout > 0 {
+			_ = r.clientConn.SetWriteDeadline(time.Now().Add(r.options.ClientWriteTimeout))
+		}
+
+		if _, err := r.clientConn.WriteTo(b, clientAddr); err != nil {
+			r.logDebugf("Failed to send UDP datagram to %v: %v", clientAddr, err)
+			continue
+		}
+
+		r.forwarded(true, src.String(), data)
+	}
+}
+
+func (r *udpRelay) accept(src net.Addr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The stream of the request only carries datagrams of the client.
+	if r.stream {
+		r.clientAddr = src
+		return true
+	}
+
+	udpAddr, ok := src.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	switch r.options.SourcePolicy {
+	case UDPSourceAny:
+	case UDPSourceClientIP:
+		if !udpAddr.IP.Equal(r.expectedIP) {
+			return false
+		}
+	default:
+		if !udpAddr.IP.Equal(r.expectedIP) {
+			return false
+		}
+
+		if r.expectedPort == 0 {
+			r.expectedPort = udpAddr.Port
+		} else if r.expectedPort != udpAddr.Port {
+			return false
+		}
+	}
+
+	r.clientAddr = src
+
+	return true
+}
+
+// allow applies the datagram rule set to the destination and caches
+// the decision for the association.
+func (r *udpRelay) allow(addr string) bool {
+	if r.rules == nil {
+		return true
+	}
+
+	r.mu.Lock()
+	allowed, ok := r.decisions[addr]
+	r.mu.Unlock()
+
+	if ok {
+		return allowed
+	}
+
+	allowed = r.rules.AllowDatagram(r.ctx, r.req, addr)
+
+	r.mu.Lock()
+	if len(r.decisions) >= maxUDPRuleCacheSize {
+		r.decisions = make(map[string]bool)
+	}
+	r.decisions[addr] = allowed
+	r.mu.Unlock()
+
+	return allowed
+}
+
+func (r *udpRelay) addFlow(addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.flows[addr]; ok {
+		return true
+	}
+
+	if r.options.MaxFlows > 0 && len(r.flows) >= r.options.MaxFlows {
+		return false
+	}
+
+	r.flows[addr] = struct{}{}
+
+	return true
+}
+
+func (r *udpRelay) client() net.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.clientAddr
+}
+
+// resolveUDPAddr resolves addr like net.ResolveUDPAddr, but honors the
+// cancellation of ctx.
+func resolveUDPAddr(ctx context.Context, addr string) (*net.UDPAddr, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return &net.UDPAddr{IP: ips[0].IP, Port: int(port), Zone: ips[0].Zone}, nil
+}
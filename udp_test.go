@@ -0,0 +1,685 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startUDPEchoServer(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return pc
+}
+
+func socks5Associate(t *testing.T, proxyAddr, clientAddr string) (net.Conn, string) {
+	t.Helper()
+
+	control, err := net.Dial("tcp", proxyAddr)
+	assert.NoError(t, err)
+
+	conn := NewConn(control)
+
+	assert.NoError(t, conn.Write(&MethodSelectRequest{Methods: []AuthMethod{AuthMethodNotRequired}}))
+	assert.NoError(t, conn.Read(&MethodSelectResponse{}))
+	assert.NoError(t, conn.Write(&Socks5Request{CMD: AssociateCommand, Addr: clientAddr}))
+
+	resp := &Socks5Response{}
+	assert.NoError(t, conn.Read(resp))
+	assert.Equal(t, Socks5StatusGranted, resp.Status)
+
+	return control, resp.Addr
+}
+
+func sendUDPDatagram(t *testing.T, pc net.PacketConn, relayAddr, target string, data []byte) {
+	t.Helper()
+
+	b, err := (&UDPDatagram{Addr: target, Data: data}).MarshalBinary()
+	assert.NoError(t, err)
+
+	addr, err := net.ResolveUDPAddr("udp", relayAddr)
+	assert.NoError(t, err)
+
+	_, err = pc.WriteTo(b, addr)
+	assert.NoError(t, err)
+}
+
+func TestSocks5Associate(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New()
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer client.Close()
+
+	control, relayAddr := socks5Associate(t, listen.Addr().String(), client.LocalAddr().String())
+	defer control.Close()
+
+	t.Run("relay", func(t *testing.T) {
+		sendUDPDatagram(t, client, relayAddr, echo.LocalAddr().String(), []byte("hello"))
+
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+		buf := make([]byte, maxUDPPacketSize)
+		n, _, err := client.ReadFrom(buf)
+		assert.NoError(t, err)
+
+		datagram := &UDPDatagram{}
+		assert.NoError(t, datagram.UnmarshalBinary(buf[:n]))
+		assert.Equal(t, echo.LocalAddr().String(), datagram.Addr)
+		assert.Equal(t, []byte("hello"), datagram.Data)
+	})
+
+	t.Run("spoofed source", func(t *testing.T) {
+		spoofed, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		defer spoofed.Close()
+
+		sendUDPDatagram(t, spoofed, relayAddr, echo.LocalAddr().String(), []byte("hello"))
+
+		assert.Eventually(t, func() bool {
+			return server.Metrics().UDPSpoofedDropped == 1
+		}, time.Second, 10*time.Millisecond)
+
+		_ = spoofed.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+		_, _, err = spoofed.ReadFrom(make([]byte, 1))
+		assert.Error(t, err)
+	})
+}
+
+func TestSocks5AssociateSourcePolicy(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.HandlerOptions = func(h *DefaultHandlerOptions) {
+			h.UDP.SourcePolicy = UDPSourceClientIP
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	control, relayAddr := socks5Associate(t, listen.Addr().String(), "0.0.0.0:0")
+	defer control.Close()
+
+	// A client which changes its source port is still accepted.
+	for i := 0; i < 2; i++ {
+		client, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		sendUDPDatagram(t, client, relayAddr, echo.LocalAddr().String(), []byte("hello"))
+
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+		_, _, err = client.ReadFrom(make([]byte, maxUDPPacketSize))
+		assert.NoError(t, err)
+
+		_ = client.Close()
+	}
+
+	assert.Equal(t, uint64(0), server.Metrics().UDPSpoofedDropped)
+}
+
+func TestSocks5AssociateLimits(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.HandlerOptions = func(h *DefaultHandlerOptions) {
+			h.UDP.IdleTimeout = 200 * time.Millisecond
+			h.UDP.MaxDatagramSize = 4
+			h.UDP.OversizePolicy = UDPOversizeTruncate
+			h.UDP.MaxFlows = 1
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	other := startUDPEchoServer(t)
+	defer other.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer client.Close()
+
+	control, relayAddr := socks5Associate(t, listen.Addr().String(), client.LocalAddr().String())
+	defer control.Close()
+
+	sendUDPDatagram(t, client, relayAddr, echo.LocalAddr().String(), []byte("hello"))
+
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+	buf := make([]byte, maxUDPPacketSize)
+	n, _, err := client.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	datagram := &UDPDatagram{}
+	assert.NoError(t, datagram.UnmarshalBinary(buf[:n]))
+	assert.Equal(t, []byte("hell"), datagram.Data)
+
+	sendUDPDatagram(t, client, relayAddr, other.LocalAddr().String(), []byte("hello"))
+
+	assert.Eventually(t, func() bool {
+		return server.Metrics().UDPDropped == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// The idle association is closed together with its control connection.
+	_ = control.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err = control.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestSocks5AssociateTinyIdleTimeout(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.HandlerOptions = func(h *DefaultHandlerOptions) {
+			h.UDP.IdleTimeout = time.Nanosecond
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer client.Close()
+
+	control, _ := socks5Associate(t, listen.Addr().String(), client.LocalAddr().String())
+	defer control.Close()
+
+	// The association expires at once instead of panicking.
+	_ = control.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err = control.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestSocks5AssociateStats(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	var (
+		mu     sync.Mutex
+		events []DatagramEvent
+		stats  = make(chan UDPStats, 1)
+	)
+
+	server := New(func(o *Options) {
+		o.HandlerOptions = func(h *DefaultHandlerOptions) {
+			h.UDP.MaxFlows = 1
+		}
+		o.Hooks.OnDatagram = func(ctx context.Context, e *DatagramEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			e.Data = append([]byte(nil), e.Data...)
+			events = append(events, *e)
+
+			if e.Dropped {
+				stats <- e.Session.UDPStats()
+			}
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	other := startUDPEchoServer(t)
+	defer other.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer client.Close()
+
+	control, relayAddr := socks5Associate(t, listen.Addr().String(), client.LocalAddr().String())
+	defer control.Close()
+
+	sendUDPDatagram(t, client, relayAddr, echo.LocalAddr().String(), []byte("hello"))
+
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, _, err = client.ReadFrom(make([]byte, maxUDPPacketSize))
+	assert.NoError(t, err)
+
+	sendUDPDatagram(t, client, relayAddr, other.LocalAddr().String(), []byte("hi"))
+
+	select {
+	case s := <-stats:
+		assert.Equal(t, UDPStats{DatagramsIn: 1, DatagramsOut: 1, Dropped: 1}, s)
+	case <-time.After(time.Second):
+		t.Fatal("no dropped datagram reported")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Len(t, events, 3)
+	assert.Equal(t, DatagramEvent{Session: events[0].Session, Addr: echo.LocalAddr().String(), Data: []byte("hello")}, events[0])
+	assert.True(t, events[1].ToClient)
+	assert.Equal(t, []byte("hello"), events[1].Data)
+	assert.True(t, events[2].Dropped)
+	assert.Equal(t, other.LocalAddr().String(), events[2].Addr)
+
+	m := server.Metrics()
+	assert.Equal(t, uint64(2), m.UDPForwarded)
+	assert.Equal(t, uint64(10), m.UDPBytes)
+	assert.Equal(t, uint64(1), m.UDPDropped)
+}
+
+func TestSocks5AssociatePublicAddr(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.HandlerOptions = func(h *DefaultHandlerOptions) {
+			h.PublicIP = net.ParseIP("203.0.113.1")
+			h.UDP.MapPort = func(port int) int {
+				return 4000
+			}
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	control, relayAddr := socks5Associate(t, listen.Addr().String(), "0.0.0.0:0")
+	defer control.Close()
+
+	assert.Equal(t, "203.0.113.1:4000", relayAddr)
+}
+
+func TestSocks5AssociateFamily(t *testing.T) {
+	client6, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+
+	defer client6.Close()
+
+	client4, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer client4.Close()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	associate := func(policy UDPFamilyPolicy, client net.PacketConn) (net.Conn, string) {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		t.Cleanup(func() { _ = listen.Close() })
+
+		go func() {
+			_ = New(func(o *Options) {
+				o.HandlerOptions = func(h *DefaultHandlerOptions) {
+					h.UDP.FamilyPolicy = policy
+				}
+			}).Serve(listen)
+		}()
+
+		return socks5Associate(t, listen.Addr().String(), client.LocalAddr().String())
+	}
+
+	echoed := func(client net.PacketConn, relayAddr string) bool {
+		sendUDPDatagram(t, client, relayAddr, echo.LocalAddr().String(), []byte("hello"))
+
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+		_, _, err := client.ReadFrom(make([]byte, maxUDPPacketSize))
+
+		return err == nil
+	}
+
+	t.Run("control", func(t *testing.T) {
+		control, relayAddr := associate(UDPFamilyControl, client6)
+		defer control.Close()
+
+		host, _, _ := net.SplitHostPort(relayAddr)
+		assert.Equal(t, "127.0.0.1", host)
+	})
+
+	t.Run("request", func(t *testing.T) {
+		control, relayAddr := associate(UDPFamilyRequest, client6)
+		defer control.Close()
+
+		host, _, _ := net.SplitHostPort(relayAddr)
+		assert.Equal(t, "::1", host)
+		assert.True(t, echoed(client6, relayAddr))
+	})
+
+	t.Run("dual stack", func(t *testing.T) {
+		control, relayAddr := associate(UDPFamilyDualStack, client4)
+		defer control.Close()
+
+		host, _, _ := net.SplitHostPort(relayAddr)
+		assert.Equal(t, "127.0.0.1", host)
+		assert.True(t, echoed(client4, relayAddr))
+	})
+}
+
+func TestSocks5AssociateTimeouts(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.HandlerOptions = func(h *DefaultHandlerOptions) {
+			h.UDP.ControlKeepAlive = time.Second
+			h.UDP.TargetWriteTimeout = time.Second
+			h.UDP.ClientWriteTimeout = time.Second
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer client.Close()
+
+	control, relayAddr := socks5Associate(t, listen.Addr().String(), client.LocalAddr().String())
+	defer control.Close()
+
+	sendUDPDatagram(t, client, relayAddr, echo.LocalAddr().String(), []byte("hello"))
+
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+	buf := make([]byte, maxUDPPacketSize)
+	n, _, err := client.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	datagram := &UDPDatagram{}
+	assert.NoError(t, datagram.UnmarshalBinary(buf[:n]))
+	assert.Equal(t, []byte("hello"), datagram.Data)
+}
+
+func TestResolveUDPAddr(t *testing.T) {
+	addr, err := resolveUDPAddr(context.Background(), "127.0.0.1:53")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:53", addr.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = resolveUDPAddr(ctx, "example.invalid:53")
+	assert.Error(t, err)
+}
+
+func TestSocks5ListenPacket(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.HandlerOptions = func(h *DefaultHandlerOptions) {
+			h.UDP.OverTCP = true
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	testCases := []struct {
+		name       string
+		udpOverTCP bool
+	}{
+		{"udp", false},
+		{"udp over tcp", true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+				o.UDPOverTCP = tc.udpOverTCP
+			})
+
+			pc, err := d.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+			assert.NoError(t, err)
+
+			defer pc.Close()
+
+			_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			for _, msg := range []string{"hello", "world"} {
+				n, err := pc.WriteTo([]byte(msg), echo.LocalAddr())
+				assert.NoError(t, err)
+				assert.Equal(t, len(msg), n)
+
+				buf := make([]byte, 64)
+
+				n, addr, err := pc.ReadFrom(buf)
+				assert.NoError(t, err)
+				assert.Equal(t, msg, string(buf[:n]))
+				assert.Equal(t, echo.LocalAddr().String(), addr.String())
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		defer listen.Close()
+
+		go func() {
+			_ = New().Serve(listen)
+		}()
+
+		d := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.UDPOverTCP = true
+		})
+
+		_, err = d.ListenPacket(context.Background(), "udp", "")
+		assertSocks5Rejection(t, err, Socks5StatusCMDNotSupported)
+	})
+}
+
+func TestStreamPacketConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	a, b := newStreamPacketConn(c1), newStreamPacketConn(c2)
+	defer a.Close()
+
+	go func() {
+		_, _ = a.WriteTo([]byte("hello"), nil)
+		_, _ = a.WriteTo([]byte{}, nil)
+		_, _ = a.WriteTo([]byte("truncated"), nil)
+	}()
+
+	buf := make([]byte, 5)
+
+	n, addr, err := b.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+	assert.Equal(t, c2.RemoteAddr(), addr)
+
+	n, _, err = b.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, _, err = b.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "trunc", string(buf[:n]))
+
+	_ = a.Close()
+
+	_, _, err = b.ReadFrom(buf)
+	assert.ErrorIs(t, err, io.EOF)
+
+	_, err = b.WriteTo(make([]byte, maxUDPPacketSize+1), nil)
+	assert.Error(t, err)
+}
+
+func TestSocks5AssociateDisabled(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	var rejected int32
+
+	server := New(func(o *Options) {
+		o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+		o.Authenticate = func(ctx context.Context, conn *Conn, method AuthMethod) error {
+			req := &UsernamePasswordAuthRequest{}
+			if err := conn.Read(req); err != nil {
+				return err
+			}
+
+			if session, ok := SessionFromContext(ctx); ok {
+				session.SetUser(req.Username)
+			}
+
+			return conn.Write(&UsernamePasswordAuthResponse{Status: AuthStatusSuccess})
+		}
+		o.HandlerOptions = func(h *DefaultHandlerOptions) {
+			h.UDP.OverTCP = true
+			h.UDP.Disabled = true
+			h.UDP.Authorize = func(ctx context.Context, req *Request) error {
+				session, _ := SessionFromContext(ctx)
+
+				switch session.User() {
+				case "alice":
+					return nil
+				case "mallory":
+					return &DenialError{Socks5Status: Socks5StatusNotAllowed, Err: errors.New("UDP not allowed for mallory")}
+				default:
+					return ErrUDPDisabled
+				}
+			}
+		}
+		o.Hooks.OnUDPRejected = func(ctx context.Context, e *UDPRejectedEvent) {
+			atomic.AddInt32(&rejected, 1)
+		}
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	listenPacket := func(user string, udpOverTCP bool) (net.PacketConn, error) {
+		return NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = UsernamePasswordAuthenticator(user, "secret")
+			o.UDPOverTCP = udpOverTCP
+		}).ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	}
+
+	t.Run("allowed user", func(t *testing.T) {
+		pc, err := listenPacket("alice", false)
+		assert.NoError(t, err)
+
+		defer pc.Close()
+
+		_, err = pc.WriteTo([]byte("hello"), echo.LocalAddr())
+		assert.NoError(t, err)
+
+		_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		buf := make([]byte, 64)
+		n, _, err := pc.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf[:n]))
+	})
+
+	t.Run("custom status", func(t *testing.T) {
+		_, err := listenPacket("mallory", false)
+		assertSocks5Rejection(t, err, Socks5StatusNotAllowed)
+	})
+
+	t.Run("other users", func(t *testing.T) {
+		for _, udpOverTCP := range []bool{false, true} {
+			_, err := listenPacket("bob", udpOverTCP)
+			assertSocks5Rejection(t, err, Socks5StatusCMDNotSupported)
+		}
+	})
+
+	assert.Equal(t, uint64(3), server.Metrics().UDPRejected)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&rejected))
+}
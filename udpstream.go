@@ -0,0 +1,99 @@
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// streamPacketConn carries datagrams as length-prefixed frames of a
+// stream, see UDPOverTCPCommand. The datagrams read are reported from
+// the remote address of the stream.
+type streamPacketConn struct {
+	conn net.Conn
+	wmu  sync.Mutex
+}
+
+func newStreamPacketConn(conn net.Conn) *streamPacketConn {
+	return &streamPacketConn{conn: conn}
+}
+
+// ReadFrom reads the next frame. A frame longer than p is truncated.
+func (c *streamPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(c.conn, length[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := int(binary.BigEndian.Uint16(length[:]))
+
+	n := size
+	if n > len(p) {
+		n = len(p)
+	}
+
+	if _, err := io.ReadFull(c.conn, p[:n]); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+
+	if n < size {
+		if _, err := io.CopyN(io.Discard, c.conn, int64(size-n)); err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+	}
+
+	return n, c.conn.RemoteAddr(), nil
+}
+
+// WriteTo writes p as a frame to the stream, whatever addr is.
+func (c *streamPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) > maxUDPPacketSize {
+		return 0, errors.New("socks: datagram too large")
+	}
+
+	b := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(b, uint16(len(p)))
+	copy(b[2:], p)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if _, err := c.conn.Write(b); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *streamPacketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *streamPacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *streamPacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *streamPacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *streamPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// unexpectedEOF turns the end of the stream within a frame into
+// io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
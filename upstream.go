@@ -0,0 +1,106 @@
+package socks
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Upstream is an upstream proxy of a Pool with its own authentication,
+// TLS and timeout settings.
+type Upstream struct {
+	// Proxy specifies the proxy, e.g. parsed with ParseProxyURL. The
+	// username and password of SOCKS5 are used for the username/password
+	// authentication unless Authenticate is set.
+	Proxy *ProxyConfig
+
+	// ProxyDialer specifies the optional dialer of the connections to
+	// the proxy. If nil, a net.Dialer is used.
+	ProxyDialer Dialer
+
+	// TLSConfig specifies the optional TLS configuration of the
+	// transport TransportTLS, e.g. with a client certificate. If the
+	// ServerName is empty, the host of the proxy is used.
+	TLSConfig *tls.Config
+
+	// AuthMethods and Authenticate specify the optional SOCKS5
+	// authentication, e.g. GSS-API. They take precedence over the
+	// username and password of Proxy.
+	AuthMethods  []AuthMethod
+	Authenticate AuthenticateFunc
+
+	// HandshakeTimeout specifies the optional maximum duration of the
+	// connection and handshake with the proxy.
+	HandshakeTimeout time.Duration
+}
+
+// newDialer returns the Dialer of the upstream.
+func (u *Upstream) newDialer() (Dialer, error) {
+	c := u.Proxy
+	if c == nil {
+		return nil, errors.New("socks: upstream without proxy")
+	}
+
+	forward := u.ProxyDialer
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+
+	switch c.Transport {
+	case TransportTCP:
+	case TransportTLS:
+		host, _, err := net.SplitHostPort(c.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+		if u.TLSConfig != nil {
+			config = u.TLSConfig.Clone()
+		}
+
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+
+		forward = &tlsDialer{
+			forward: forward,
+			config:  config,
+		}
+	case TransportWebSocket:
+		forward = &webSocketDialer{
+			forward: forward,
+			path:    c.Path,
+		}
+	default:
+		return nil, fmt.Errorf("socks: unsupported proxy transport %v", c.Transport)
+	}
+
+	if c.Version == Socks4Version {
+		if u.Authenticate != nil {
+			return nil, fmt.Errorf("socks: upstream %s: SOCKS4 does not support authentication", c.Address)
+		}
+
+		return NewSocks4Dialer("tcp", c.Address, func(o *Socks4DialerOptions) {
+			o.ProxyDialer = forward
+			o.UserID = c.Username
+			o.ResolveLocally = !c.RemoteDNS
+		}), nil
+	}
+
+	return NewSocks5Dialer("tcp", c.Address, func(o *Socks5DialerOptions) {
+		o.ProxyDialer = forward
+		o.ResolveLocally = !c.RemoteDNS
+
+		switch {
+		case u.Authenticate != nil:
+			o.AuthMethods = u.AuthMethods
+			o.Authenticate = u.Authenticate
+		case c.Username != "":
+			o.AuthMethods = []AuthMethod{AuthMethodNotRequired, AuthMethodUsernamePassword}
+			o.Authenticate = UsernamePasswordAuthenticator(c.Username, c.Password)
+		}
+	}), nil
+}
@@ -0,0 +1,117 @@
+package socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouterUpstreams(t *testing.T) {
+	serve := func(t *testing.T, user, pass string) string {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		t.Cleanup(func() { _ = listen.Close() })
+
+		server := New(func(o *Options) {
+			o.AuthMethods = []AuthMethod{AuthMethodUsernamePassword}
+			o.Authenticate = userPassServerAuthenticateFuncGen(user, pass)
+		})
+
+		go func() {
+			_ = server.Serve(listen)
+		}()
+
+		return listen.Addr().String()
+	}
+
+	t.Run("credentials", func(t *testing.T) {
+		alice, err := ParseProxyURL("socks5://alice:secret@" + serve(t, "alice", "secret"))
+		assert.NoError(t, err)
+
+		bob, err := ParseProxyURL("socks5://" + serve(t, "bob", "secret"))
+		assert.NoError(t, err)
+
+		router, err := NewRouter(func(o *RouterOptions) {
+			o.Pools = map[string]Pool{
+				"alice": {Upstreams: []Upstream{{Proxy: alice}}},
+				"bob": {Upstreams: []Upstream{{
+					Proxy:        bob,
+					AuthMethods:  []AuthMethod{AuthMethodUsernamePassword},
+					Authenticate: userPassDialerAuthenticateFuncGen("bob", "secret"),
+				}}},
+			}
+			o.Routes = []Route{{Destination: "127.0.0.1", Pool: "bob"}}
+			o.DefaultPool = "alice"
+		})
+		assert.NoError(t, err)
+
+		defer router.Close()
+
+		_, port, _ := net.SplitHostPort(testServer.Listener.Addr().String())
+
+		conn, err := router.Dial("tcp", "127.0.0.1:"+port)
+		assert.NoError(t, err)
+		conn.Close()
+
+		conn, err = router.Dial("tcp", "localhost:"+port)
+		assert.NoError(t, err)
+		conn.Close()
+	})
+
+	t.Run("handshake timeout", func(t *testing.T) {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		defer listen.Close()
+
+		// The proxy accepts connections but never replies.
+		go func() {
+			for {
+				conn, err := listen.Accept()
+				if err != nil {
+					return
+				}
+
+				defer conn.Close()
+			}
+		}()
+
+		silent, err := ParseProxyURL("socks5://" + listen.Addr().String())
+		assert.NoError(t, err)
+
+		router, err := NewRouter(func(o *RouterOptions) {
+			o.Pools = map[string]Pool{
+				"egress": {Upstreams: []Upstream{{Proxy: silent, HandshakeTimeout: 50 * time.Millisecond}}},
+			}
+			o.DefaultPool = "egress"
+		})
+		assert.NoError(t, err)
+
+		defer router.Close()
+
+		start := time.Now()
+
+		_, err = router.Dial("tcp", "example.com:80")
+		assert.Error(t, err)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	})
+
+	t.Run("socks4 authentication", func(t *testing.T) {
+		proxy, err := ParseProxyURL("socks4://127.0.0.1:1080")
+		assert.NoError(t, err)
+
+		_, err = NewRouter(func(o *RouterOptions) {
+			o.Pools = map[string]Pool{
+				"egress": {Upstreams: []Upstream{{
+					Proxy:        proxy,
+					AuthMethods:  []AuthMethod{AuthMethodUsernamePassword},
+					Authenticate: userPassDialerAuthenticateFuncGen("user", "pass"),
+				}}},
+			}
+		})
+		assert.EqualError(t, err, `socks: upstream 127.0.0.1:1080: SOCKS4 does not support authentication`)
+	})
+}
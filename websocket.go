@@ -0,0 +1,352 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // required by RFC 6455
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webSocketGUID is the GUID of the opening handshake defined in RFC 6455.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// maxWebSocketControlLen is the maximum payload length of a control frame.
+const maxWebSocketControlLen = 125
+
+// upgradeWebSocket reads an HTTP request from conn and accepts it if it
+// is a WebSocket upgrade to path. Other requests are answered with an
+// HTTP error.
+func upgradeWebSocket(conn *Conn, path string) (net.Conn, error) {
+	req, err := http.ReadRequest(conn.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	status := http.StatusOK
+
+	switch {
+	case req.URL.Path != path:
+		status = http.StatusNotFound
+	case req.Method != http.MethodGet,
+		!headerContainsToken(req.Header, "Connection", "upgrade"),
+		!headerContainsToken(req.Header, "Upgrade", "websocket"),
+		req.Header.Get("Sec-WebSocket-Key") == "":
+		status = http.StatusBadRequest
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		status = http.StatusUpgradeRequired
+	}
+
+	if status != http.StatusOK {
+		_, _ = fmt.Fprintf(conn.writer, "HTTP/1.1 %d %s\r\nSec-WebSocket-Version: 13\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+		return nil, fmt.Errorf("rejected HTTP request %s %s: %s", req.Method, req.URL.Path, http.StatusText(status))
+	}
+
+	if _, err := fmt.Fprintf(conn.writer, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", webSocketAccept(req.Header.Get("Sec-WebSocket-Key"))); err != nil {
+		return nil, err
+	}
+
+	return newWebSocketConn(conn.conn, conn.reader, false), nil
+}
+
+// webSocketDialer connects to a proxy serving SOCKS inside a WebSocket,
+// see Options.WebSocketPath.
+type webSocketDialer struct {
+	forward Dialer
+	path    string
+}
+
+func (d *webSocketDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	forward := d.forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+
+	conn, err := forward.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	wsConn, err := clientWebSocket(ctx, conn, address, d.path)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return wsConn, nil
+}
+
+// clientWebSocket performs the opening handshake of a WebSocket client
+// on conn.
+func clientWebSocket(ctx context.Context, conn net.Conn, host, path string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+
+		defer func() {
+			_ = conn.SetDeadline(time.Time{})
+		}()
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, host, key); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("socks: websocket upgrade failed: %s", resp.Status)
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("socks: websocket upgrade failed: invalid Sec-WebSocket-Accept")
+	}
+
+	return newWebSocketConn(conn, reader, true), nil
+}
+
+func webSocketAccept(key string) string {
+	h := sha1.New() //nolint:gosec // required by RFC 6455
+	h.Write([]byte(key + webSocketGUID))
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// webSocketConn transports a byte stream in binary WebSocket messages.
+type webSocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+	client bool // clients mask the frames they send
+
+	remaining uint64 // of the payload of the current data frame
+	mask      []byte
+	maskPos   int
+
+	mu     sync.Mutex // guards writes
+	closed bool
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, client bool) *webSocketConn {
+	return &webSocketConn{
+		Conn:   conn,
+		reader: reader,
+		client: client,
+	}
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.reader.Read(p)
+
+	if c.mask != nil {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+
+	c.remaining -= uint64(n)
+
+	return n, err
+}
+
+// nextFrame reads frame headers and handles control frames until the
+// next data frame starts.
+func (c *webSocketConn) nextFrame() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	if masked == c.client {
+		return newProtocolError("WebSocket frame", fmt.Sprintf("masked=%t", !c.client), fmt.Sprintf("masked=%t", masked), header)
+	}
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return err
+		}
+
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return err
+		}
+
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	var mask []byte
+
+	if masked {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, mask); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		c.remaining = length
+		c.mask = mask
+		c.maskPos = 0
+
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > maxWebSocketControlLen {
+			return newProtocolError("WebSocket frame", "control frame of at most 125 bytes", fmt.Sprintf("%d bytes", length), header)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+
+		if mask != nil {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		switch opcode {
+		case wsOpClose:
+			_ = c.writeFrame(wsOpClose, payload)
+			return io.EOF
+		case wsOpPing:
+			return c.writeFrame(wsOpPong, payload)
+		}
+
+		return nil
+	default:
+		return newProtocolError("WebSocket frame", "known opcode", fmt.Sprintf("opcode %d", opcode), header)
+	}
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	if opcode == wsOpClose {
+		c.closed = true
+	}
+
+	b := []byte{0x80 | opcode, 0}
+
+	switch length := len(payload); {
+	case length <= maxWebSocketControlLen:
+		b[1] = byte(length)
+	case length <= 0xffff:
+		b[1] = 126
+		b = append(b, byte(length>>8), byte(length))
+	default:
+		b[1] = 127
+		b = append(b, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(b[2:], uint64(length))
+	}
+
+	if c.client {
+		mask := make([]byte, 4)
+		if _, err := rand.Read(mask); err != nil {
+			return err
+		}
+
+		b[1] |= 0x80
+		b = append(b, mask...)
+
+		start := len(b)
+		b = append(b, payload...)
+
+		for i := start; i < len(b); i++ {
+			b[i] ^= mask[(i-start)%4]
+		}
+	} else {
+		b = append(b, payload...)
+	}
+
+	_, err := c.Conn.Write(b)
+
+	return err
+}
+
+// CloseWrite sends a close frame.
+func (c *webSocketConn) CloseWrite() error {
+	return c.writeFrame(wsOpClose, nil)
+}
+
+// Close sends a close frame and closes the underlying connection.
+func (c *webSocketConn) Close() error {
+	_ = c.writeFrame(wsOpClose, nil)
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,92 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocket(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer listen.Close()
+
+	server := New(func(o *Options) {
+		o.WebSocketPath = "/socks"
+	})
+
+	go func() {
+		_ = server.Serve(listen)
+	}()
+
+	get := func(t *testing.T, d *Socks5Dialer) {
+		conn, err := d.Dial("tcp", testServer.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		assert.NoError(t, err)
+
+		resp, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Contains(t, string(resp), "hello")
+	}
+
+	t.Run("websocket", func(t *testing.T) {
+		get(t, NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.ProxyDialer = &webSocketDialer{path: "/socks"}
+		}))
+	})
+
+	t.Run("native", func(t *testing.T) {
+		get(t, NewSocks5Dialer("tcp", listen.Addr().String()))
+	})
+
+	t.Run("upload beyond handshake budget", func(t *testing.T) {
+		echo, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		defer echo.Close()
+
+		go func() {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+
+			defer c.Close()
+
+			_, _ = io.Copy(c, c)
+		}()
+
+		conn, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.ProxyDialer = &webSocketDialer{path: "/socks"}
+		}).Dial("tcp", echo.Addr().String())
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		data := bytes.Repeat([]byte("x"), 3*DefaultMaxHandshakeBytes)
+
+		go func() {
+			_, _ = conn.Write(data)
+		}()
+
+		got := make([]byte, len(data))
+		_, err = io.ReadFull(conn, got)
+		assert.NoError(t, err)
+		assert.Equal(t, data, got)
+	})
+
+	t.Run("unknown path", func(t *testing.T) {
+		_, err := NewSocks5Dialer("tcp", listen.Addr().String(), func(o *Socks5DialerOptions) {
+			o.ProxyDialer = &webSocketDialer{path: "/other"}
+		}).Dial("tcp", testServer.Listener.Addr().String())
+		assert.EqualError(t, err, "socks: websocket upgrade failed: 404 Not Found")
+	})
+}